@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// HandshakeInfo describes an upgrade attempt for Config.OnHandshake
+type HandshakeInfo struct {
+	RemoteAddr  string        // of the TCP connection, see http.Request.RemoteAddr
+	ClientAddr  string        // of the client as Config.ClientIP derives it
+	Path        string        // requested URL path
+	Origin      string        // Origin header
+	UserAgent   string        // User-Agent header
+	Subprotocol string        // selected subprotocol, empty when none or refused
+	Status      int           // of the response: 101, 200 for HTTP/2, the refusal's, or 0 when none was sent
+	Reason      string        // why the upgrade failed, empty when it succeeded
+	Duration    time.Duration // from the request to the upgrade or refusal
+	ConnID      uint64        // Conn.ID of the upgraded connection, 0 when it failed
+}
+
+// handshakeInfo describes the attempt to upgrade r that returned c and err
+func (u *Upgrader) handshakeInfo(r *http.Request, c *Conn, err error, d time.Duration) HandshakeInfo {
+	info := HandshakeInfo{
+		RemoteAddr: r.RemoteAddr,
+		ClientAddr: u.clientIP(r),
+		Path:       r.URL.Path,
+		Origin:     r.Header.Get("Origin"),
+		UserAgent:  r.UserAgent(),
+		Duration:   d,
+	}
+	var he *HandshakeError
+	switch {
+	case err == nil:
+		info.Status = http.StatusSwitchingProtocols
+		if isExtendedConnect(r) {
+			info.Status = http.StatusOK
+		}
+		info.Subprotocol = c.Subprotocol()
+		info.ConnID = c.ID()
+	case errors.As(err, &he):
+		info.Status, info.Reason = he.Status, he.Reason
+	default:
+		// the connection was taken over, whether a response made it is unknown
+		info.Reason = err.Error()
+	}
+	return info
+}
+
+// HandshakeLogger returns an OnHandshake writing one line per upgrade
+// attempt to logger, slog.Default() when it's nil
+func HandshakeLogger(logger *slog.Logger) func(HandshakeInfo) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return func(info HandshakeInfo) {
+		attrs := []slog.Attr{
+			slog.String("remote", info.RemoteAddr),
+			slog.String("client", info.ClientAddr),
+			slog.String("path", info.Path),
+			slog.String("origin", info.Origin),
+			slog.String("user_agent", info.UserAgent),
+			slog.Int("status", info.Status),
+			slog.Duration("duration", info.Duration),
+		}
+		if info.Subprotocol != "" {
+			attrs = append(attrs, slog.String("subprotocol", info.Subprotocol))
+		}
+		if info.Reason != "" {
+			attrs = append(attrs, slog.String("reason", info.Reason))
+		}
+		if info.ConnID != 0 {
+			attrs = append(attrs, slog.Uint64("conn", info.ConnID))
+		}
+		logger.LogAttrs(context.Background(), slog.LevelInfo, "handshake", attrs...)
+	}
+}
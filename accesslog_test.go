@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOnHandshake(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.Subprotocols = []string{"chat"}
+	var mu sync.Mutex
+	var infos []HandshakeInfo
+	cfg.OnHandshake = func(info HandshakeInfo) {
+		mu.Lock()
+		infos = append(infos, info)
+		mu.Unlock()
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	for _, tc := range []struct {
+		name   string
+		header http.Header
+		status int
+		reason string
+	}{
+		{"upgraded", http.Header{"Sec-WebSocket-Protocol": {"chat"}, "User-Agent": {"test-agent"}}, http.StatusSwitchingProtocols, ""},
+		{"bad key", http.Header{"Sec-WebSocket-Key": {"short"}}, http.StatusBadRequest, "Sec-WebSocket-Key must be"},
+		{"foreign origin", http.Header{"Origin": {"http://evil.example"}}, http.StatusForbidden, "Forbidden origin"},
+	} {
+		conn, _, resp := handshake(t, addr, "/chat", tc.header)
+		conn.Close()
+		if resp.StatusCode != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.status, resp.StatusCode)
+		}
+
+		mu.Lock()
+		if len(infos) != 1 {
+			mu.Unlock()
+			t.Fatalf("%s: expected one call, got %d", tc.name, len(infos))
+		}
+		info := infos[0]
+		infos = nil
+		mu.Unlock()
+		if info.Status != tc.status || !strings.HasPrefix(info.Reason, tc.reason) || (tc.reason == "") != (info.Reason == "") {
+			t.Errorf("%s: expected %d %q, got %d %q", tc.name, tc.status, tc.reason, info.Status, info.Reason)
+		}
+		if info.Path != "/chat" || info.RemoteAddr == "" || info.ClientAddr == "" || info.Duration <= 0 {
+			t.Errorf("%s: unexpected path, addresses or duration: %+v", tc.name, info)
+		}
+		if origin := tc.header.Get("Origin"); info.Origin != origin {
+			t.Errorf("%s: expected origin %q, got %q", tc.name, origin, info.Origin)
+		}
+		upgraded := tc.status == http.StatusSwitchingProtocols
+		if upgraded && (info.Subprotocol != "chat" || info.UserAgent != "test-agent" || info.ConnID == 0) {
+			t.Errorf("%s: expected the subprotocol, user agent and connection ID, got %+v", tc.name, info)
+		}
+		if !upgraded && (info.Subprotocol != "" || info.ConnID != 0) {
+			t.Errorf("%s: a refusal has no subprotocol nor connection: %+v", tc.name, info)
+		}
+	}
+}
+
+func TestHandshakeLogger(t *testing.T) {
+	logger, capture := captureLogger(slog.LevelInfo)
+	HandshakeLogger(logger)(HandshakeInfo{
+		RemoteAddr: "192.0.2.1:1234",
+		Path:       "/chat",
+		Status:     http.StatusForbidden,
+		Reason:     "Forbidden origin",
+		Duration:   time.Millisecond,
+	})
+	lines := strings.Split(strings.TrimSpace(capture.String()), "\n")
+	if len(lines) != 1 {
+		t.Fatalf("expected one line, got %q", lines)
+	}
+	for _, field := range []string{"msg=handshake", "remote=192.0.2.1:1234", "path=/chat", "status=403", `reason="Forbidden origin"`, "duration=1ms"} {
+		if !strings.Contains(lines[0], field) {
+			t.Errorf("expected %s in %s", field, lines[0])
+		}
+	}
+}
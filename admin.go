@@ -0,0 +1,99 @@
+package main
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// adminCloseCode closes the connections the admin API kicks when
+// Config.AdminCloseCode is zero
+const adminCloseCode = ClosePolicyViolation
+
+// adminConn describes a live connection in the admin API
+type adminConn struct {
+	ID          uint64    `json:"id"`
+	RemoteAddr  string    `json:"remote_addr"`
+	ClientAddr  string    `json:"client_addr"`
+	Path        string    `json:"path"`
+	Subprotocol string    `json:"subprotocol"`
+	ConnectedAt time.Time `json:"connected_at"`
+	BytesIn     uint64    `json:"bytes_in"`
+	BytesOut    uint64    `json:"bytes_out"`
+	MessagesIn  uint64    `json:"messages_in"`
+	MessagesOut uint64    `json:"messages_out"`
+}
+
+// mountAdmin serves the admin API of u at path on mux, see Config.AdminPath
+func (u *Upgrader) mountAdmin(mux *http.ServeMux, path string) {
+	api := http.NewServeMux()
+	api.HandleFunc("GET "+path, u.listConns)
+	api.HandleFunc("DELETE "+path+"/{id}", u.kickConn)
+	handler := u.adminAuth(api)
+	mux.Handle(path, handler)
+	mux.Handle(path+"/", handler)
+}
+
+// adminAuth refuses requests without Config.AdminSecret
+func (u *Upgrader) adminAuth(next http.Handler) http.Handler {
+	secret := []byte(u.cfg.AdminSecret)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(secret) > 0 && subtle.ConstantTimeCompare([]byte(r.Header.Get("X-Admin-Secret")), secret) != 1 {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// listConns answers with the live connections, oldest first
+func (u *Upgrader) listConns(w http.ResponseWriter, r *http.Request) {
+	conns := u.liveConns()
+	slices.SortFunc(conns, func(a, b *Conn) int { return cmp.Compare(a.id, b.id) })
+	list := make([]adminConn, 0, len(conns))
+	for _, c := range conns {
+		stats := c.Stats()
+		list = append(list, adminConn{
+			ID:          c.id,
+			RemoteAddr:  c.RemoteAddr().String(),
+			ClientAddr:  c.ClientAddr(),
+			Path:        c.info.path,
+			Subprotocol: c.Subprotocol(),
+			ConnectedAt: stats.Opened,
+			BytesIn:     stats.BytesIn,
+			BytesOut:    stats.BytesOut,
+			MessagesIn:  stats.MessagesIn,
+			MessagesOut: stats.MessagesOut,
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(list)
+}
+
+// kickConn closes the connection with the ID of the path with
+// Config.AdminCloseCode, the closing handshake goes on after the reply
+func (u *Upgrader) kickConn(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseUint(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Bad connection ID", http.StatusBadRequest)
+		return
+	}
+	for _, c := range u.liveConns() {
+		if c.id != id {
+			continue
+		}
+		code := u.cfg.AdminCloseCode
+		if code == 0 {
+			code = adminCloseCode
+		}
+		c.logger.Info("closed by the admin API", "code", code)
+		go c.Close(code, "closed by administrator")
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	http.Error(w, "No such connection", http.StatusNotFound)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// adminRequest sends an admin API request with secret
+func adminRequest(t *testing.T, method, url, secret string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret != "" {
+		req.Header.Set("X-Admin-Secret", secret)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, url, err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+	return resp
+}
+
+// listConns fetches the connections the admin API lists
+func listConns(t *testing.T, url, secret string) []adminConn {
+	t.Helper()
+	resp := adminRequest(t, http.MethodGet, url, secret)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200, got %d", resp.StatusCode)
+	}
+	var conns []adminConn
+	if err := json.NewDecoder(resp.Body).Decode(&conns); err != nil {
+		t.Fatalf("failed to decode the connections: %v", err)
+	}
+	return conns
+}
+
+func TestAdminAPI(t *testing.T) {
+	const secret = "s3cret"
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.HandshakeRate = 0
+	cfg.AdminPath = "/admin/connections"
+	cfg.AdminSecret = secret
+	cfg.AdminCloseCode = 4001
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+	url := "http://" + addr + cfg.AdminPath
+
+	victim := dial(t, "ws://"+addr+"/", nil)
+	survivor := dial(t, "ws://"+addr+"/", nil)
+	for _, c := range []*Conn{victim, survivor} {
+		if err := c.WriteMessage(TextMessage, []byte("hello")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if _, _, err := c.ReadMessage(); err != nil {
+			t.Fatalf("failed to read the echo: %v", err)
+		}
+	}
+
+	if resp := adminRequest(t, http.MethodGet, url, "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the secret, got %d", resp.StatusCode)
+	}
+	conns := listConns(t, url, secret)
+	if len(conns) != 2 {
+		t.Fatalf("expected 2 connections, got %+v", conns)
+	}
+	var victimID uint64
+	for _, c := range conns {
+		if c.Path != "/" || c.ConnectedAt.IsZero() || c.MessagesIn != 1 || c.MessagesOut != 1 || c.BytesIn == 0 || c.BytesOut == 0 {
+			t.Errorf("unexpected connection %+v", c)
+		}
+		// the server's end of a connection has the client's local address
+		if c.RemoteAddr == victim.LocalAddr().String() {
+			victimID = c.ID
+		}
+	}
+	if victimID == 0 {
+		t.Fatalf("the victim isn't listed: %+v", conns)
+	}
+
+	if resp := adminRequest(t, http.MethodDelete, url+"/12345678", secret); resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown connection, got %d", resp.StatusCode)
+	}
+	if resp := adminRequest(t, http.MethodDelete, fmt.Sprintf("%s/%d", url, victimID), secret); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("expected 202, got %d", resp.StatusCode)
+	}
+	var ce *CloseError
+	if _, _, err := victim.ReadMessage(); !errors.As(err, &ce) || ce.Code != 4001 {
+		t.Fatalf("expected 4001, got %v", err)
+	}
+
+	// the other one stays up
+	if err := survivor.WriteMessage(TextMessage, []byte("still there")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if _, data, err := survivor.ReadMessage(); err != nil || string(data) != "still there" {
+		t.Fatalf("expected the echo, got %q %v", data, err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(conns) != 1 && time.Now().Before(deadline) {
+		conns = listConns(t, url, secret)
+	}
+	if len(conns) != 1 || conns[0].ID == victimID {
+		t.Fatalf("expected only the survivor listed, got %+v", conns)
+	}
+	survivor.Close(CloseNormalClosure, "")
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"sync"
+	"sync/atomic"
+)
+
+// BudgetPolicy decides what happens to a connection that needs memory while
+// the server is over Config.MemoryBudget
+type BudgetPolicy int
+
+const (
+	// BudgetClose closes the connection holding the most with 1013. When
+	// that's another one the memory is granted while it lets go.
+	BudgetClose BudgetPolicy = iota
+	// BudgetPause makes the reader wait until other connections release
+	// memory. The connection holding the most is closed like with
+	// BudgetClose, nobody else could make room for it.
+	BudgetPause
+)
+
+// errBudgetExceeded closes a connection that needed memory the budget doesn't have
+var errBudgetExceeded = &CloseError{Code: CloseTryAgainLater, Text: "memory budget exceeded"}
+
+// heldClosed marks the count of a connection that ended, what it held was
+// given back and later charges are refused
+const heldClosed = math.MinInt64 / 2
+
+// memoryBudget accounts for the memory the connections of an Upgrader hold:
+// reassembly buffers, frame payloads in the decoder and messages queued by
+// Send. Every Conn counts what it holds, the budget the sum of them.
+type memoryBudget struct {
+	limit  int64
+	policy BudgetPolicy
+	conns  func() []*Conn // to pick the connection holding the most from
+	used   atomic.Int64
+
+	waiting  atomic.Int32 // readers paused by BudgetPause
+	mu       sync.Mutex
+	released chan struct{} // closed when memory was given back, then replaced
+}
+
+func newMemoryBudget(cfg Config, conns func() []*Conn) *memoryBudget {
+	return &memoryBudget{limit: cfg.MemoryBudget, policy: cfg.MemoryBudgetPolicy, conns: conns, released: make(chan struct{})}
+}
+
+// MemoryUsed returns the bytes the connections hold, see Config.MemoryBudget
+func (u *Upgrader) MemoryUsed() int64 {
+	if u.budget == nil {
+		return 0
+	}
+	return u.budget.used.Load()
+}
+
+// errBudgetFull refuses memory to Send under BudgetPause, the message is dropped
+var errBudgetFull = errors.New("websocket: memory budget full")
+
+// charge accounts for n more bytes held by the reader of c. Over the budget
+// it closes the connection holding the most, or waits with BudgetPause. It
+// returns errBudgetExceeded when c is the one to close, ErrConnClosed when c
+// ended.
+func (c *Conn) charge(n int64) error {
+	return c.reserve(n, true)
+}
+
+// reserve is charge, but without wait it returns errBudgetFull instead of
+// pausing
+func (c *Conn) reserve(n int64, wait bool) error {
+	b := c.budget
+	if b == nil || n <= 0 {
+		return nil
+	}
+	for {
+		if b.used.Add(n) <= b.limit {
+			return c.grant(n)
+		}
+		b.used.Add(-n)
+
+		victim, freeing := b.largest(c, n)
+		switch {
+		case b.used.Load()+n-freeing <= b.limit:
+			// connections being closed will make room
+			b.used.Add(n)
+			return c.grant(n)
+		case victim == c:
+			c.logger.Warn("memory budget exceeded, closing", "budget", b.limit)
+			return errBudgetExceeded
+		case b.policy == BudgetClose:
+			victim.evict()
+			b.used.Add(n)
+			return c.grant(n)
+		case !wait:
+			return errBudgetFull
+		}
+		if err := b.wait(c, n); err != nil {
+			return err
+		}
+	}
+}
+
+// grant adds the n bytes already added to the budget to the count of c,
+// they go back when c ended. The budget is counted first so teardown
+// subtracts no byte twice.
+func (c *Conn) grant(n int64) error {
+	if !c.hold(n) {
+		c.budget.used.Add(-n)
+		return ErrConnClosed
+	}
+	return nil
+}
+
+// uncharge gives back n bytes c held
+func (c *Conn) uncharge(n int64) {
+	b := c.budget
+	if b == nil || n <= 0 {
+		return
+	}
+	if c.hold(-n) {
+		b.used.Add(-n)
+		b.notify()
+	}
+}
+
+// releaseMemory gives back whatever c still holds, teardown calls it so
+// nothing is left behind by a connection that ended abruptly
+func (c *Conn) releaseMemory() {
+	if c.budget == nil {
+		return
+	}
+	if n := c.held.Swap(heldClosed); n > 0 {
+		c.budget.used.Add(-n)
+		c.budget.notify()
+	}
+}
+
+// hold adds n to the count of c unless c ended
+func (c *Conn) hold(n int64) bool {
+	for {
+		held := c.held.Load()
+		if held < 0 {
+			return false
+		}
+		if c.held.CompareAndSwap(held, held+n) {
+			return true
+		}
+	}
+}
+
+// evict closes c with 1013 to free its memory, only the first time
+func (c *Conn) evict() {
+	if c.evicted.Swap(true) {
+		return
+	}
+	c.logger.Warn("memory budget exceeded, closing the connection holding the most", "held", c.held.Load())
+	go func() {
+		if c.Close(uint16(errBudgetExceeded.Code), errBudgetExceeded.Text) != nil {
+			c.CloseNow()
+		}
+	}()
+}
+
+// largest returns the connection holding the most, counting the n bytes c
+// asks for, and how much the connections being evicted still hold
+func (b *memoryBudget) largest(c *Conn, n int64) (victim *Conn, freeing int64) {
+	victim, most := c, max(c.held.Load(), 0)+n
+	for _, other := range b.conns() {
+		held := other.held.Load()
+		switch {
+		case held <= 0:
+		case other.evicted.Load():
+			freeing += held
+		case other != c && held > most:
+			victim, most = other, held
+		}
+	}
+	return victim, freeing
+}
+
+// wait returns once memory was given back, or with ErrConnClosed when c ended
+func (b *memoryBudget) wait(c *Conn, n int64) error {
+	b.waiting.Add(1)
+	defer b.waiting.Add(-1)
+	b.mu.Lock()
+	released := b.released
+	b.mu.Unlock()
+	if b.used.Load()+n <= b.limit {
+		// given back before we got the channel
+		return nil
+	}
+	select {
+	case <-released:
+		return nil
+	case <-c.done:
+		return ErrConnClosed
+	}
+}
+
+// notify wakes the paused readers
+func (b *memoryBudget) notify() {
+	if b.waiting.Load() == 0 {
+		return
+	}
+	b.mu.Lock()
+	close(b.released)
+	b.released = make(chan struct{})
+	b.mu.Unlock()
+}
+
+// chargeDecoder brings what c accounts for its decoder up to date, the reader
+// calls it after writing to the decoder
+func (c *Conn) chargeDecoder() error {
+	if c.budget == nil {
+		return nil
+	}
+	held := int64(c.decoder.Held())
+	if held < c.decoderHeld {
+		c.uncharge(c.decoderHeld - held)
+	} else if err := c.charge(held - c.decoderHeld); err != nil {
+		return err
+	}
+	c.decoderHeld = held
+	return nil
+}
+
+// budgetFailed starts closing c after the budget refused memory to its
+// reader, the error is what reading the message fails with
+func (c *Conn) budgetFailed(err error) error {
+	var ce *CloseError
+	if errors.As(err, &ce) && c.err == nil && c.state == stateOpen {
+		c.startClose(ce)
+	}
+	return err
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// budgetConns returns n pipe connections sharing a budget of cfg
+func budgetConns(t *testing.T, cfg Config, n int) ([]*Conn, []net.Conn, []*bufio.Reader, *memoryBudget) {
+	t.Helper()
+	conns := make([]*Conn, n)
+	clients := make([]net.Conn, n)
+	readers := make([]*bufio.Reader, n)
+	budget := newMemoryBudget(cfg, func() []*Conn { return conns })
+	for i := range conns {
+		conns[i], clients[i], readers[i] = pipeConn(t, cfg)
+		conns[i].budget = budget
+	}
+	return conns, clients, readers, budget
+}
+
+// readAsync reads a message of c and reports the result on the channel
+func readAsync(c *Conn) <-chan readResult {
+	read := make(chan readResult, 1)
+	go func() {
+		messageType, data, err := c.ReadMessage()
+		read <- readResult{messageType, data, err}
+	}()
+	return read
+}
+
+// waitHeld waits for c to hold at least n bytes
+func waitHeld(t *testing.T, c *Conn, n int64) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for c.held.Load() < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at least %d bytes held, got %d", n, c.held.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func budgetConfig(policy BudgetPolicy) Config {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.ReassemblyBufferSize = 1024
+	cfg.MemoryBudget = 300_000
+	cfg.MemoryBudgetPolicy = policy
+	return cfg
+}
+
+func TestMemoryBudgetClose(t *testing.T) {
+	conns, clients, readers, budget := budgetConns(t, budgetConfig(BudgetClose), 2)
+
+	// the first half of a big message holds the most
+	big := readAsync(conns[0])
+	go clients[0].Write(clientFrame(opBin, make([]byte, 140_000), false))
+	waitHeld(t, conns[0], 140_000)
+
+	// a smaller message goes over the budget, the big one is closed for it
+	small := readAsync(conns[1])
+	go clients[1].Write(clientFrame(opBin, make([]byte, 70_000), true))
+	f := readFrameFrom(t, readers[0])
+	if code, text, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseTryAgainLater {
+		t.Fatalf("expected CLOSE 1013, got opcode %d %d %q", f.Opcode, code, text)
+	}
+	reply, _ := formatClosePayload(CloseTryAgainLater, "")
+	clients[0].Write(clientFrame(opClose, reply, true))
+	var ce *CloseError
+	if r := <-big; !errors.As(r.err, &ce) || ce.Code != CloseTryAgainLater {
+		t.Fatalf("expected 1013, got %v", r.err)
+	}
+	if r := <-small; r.err != nil || len(r.data) != 70_000 {
+		t.Fatalf("expected the small message, got %d bytes %v", len(r.data), r.err)
+	}
+
+	// what the closed connection held was given back, more fits again
+	small = readAsync(conns[1])
+	go clients[1].Write(clientFrame(opBin, make([]byte, 200_000), true))
+	if r := <-small; r.err != nil || len(r.data) != 200_000 {
+		t.Fatalf("expected the message, got %d bytes %v", len(r.data), r.err)
+	}
+	conns[1].close()
+	if used := budget.used.Load(); used != 0 {
+		t.Fatalf("expected nothing held once the connections ended, got %d bytes", used)
+	}
+}
+
+func TestMemoryBudgetPause(t *testing.T) {
+	conns, clients, _, budget := budgetConns(t, budgetConfig(BudgetPause), 2)
+
+	big := readAsync(conns[0])
+	go clients[0].Write(clientFrame(opBin, make([]byte, 140_000), false))
+	waitHeld(t, conns[0], 140_000)
+
+	// the reader of the smaller message waits for memory
+	small := readAsync(conns[1])
+	go clients[1].Write(clientFrame(opBin, make([]byte, 70_000), true))
+	select {
+	case r := <-small:
+		t.Fatalf("the reader didn't wait for memory: %d bytes %v", len(r.data), r.err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// the big message ends and lets go of its buffer, the other one goes on
+	go clients[0].Write(clientFrame(opCont, []byte("end"), true))
+	if r := <-big; r.err != nil || len(r.data) != 140_003 {
+		t.Fatalf("expected the big message, got %d bytes %v", len(r.data), r.err)
+	}
+	if r := <-small; r.err != nil || len(r.data) != 70_000 {
+		t.Fatalf("expected the small message, got %d bytes %v", len(r.data), r.err)
+	}
+	for _, c := range conns {
+		c.close()
+	}
+	if used := budget.used.Load(); used != 0 {
+		t.Fatalf("expected nothing held once the connections ended, got %d bytes", used)
+	}
+}
+
+func TestMemoryBudgetAbruptClose(t *testing.T) {
+	cfg := budgetConfig(BudgetClose)
+	cfg.SendQueueSize = 4
+	conns, clients, _, budget := budgetConns(t, cfg, 1)
+	c := conns[0]
+
+	// a message half read and messages queued by Send the peer never reads
+	read := readAsync(c)
+	go clients[0].Write(clientFrame(opBin, make([]byte, 100_000), false))
+	waitHeld(t, c, 100_000)
+	for range 3 {
+		if err := c.Send(BinaryMessage, make([]byte, 10_000)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+
+	// the peer vanishes
+	clients[0].Close()
+	if r := <-read; r.err == nil {
+		t.Fatalf("expected the read to fail")
+	}
+	deadline := time.Now().Add(time.Second)
+	for budget.used.Load() != 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected nothing held after the connection died, got %d bytes", budget.used.Load())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	if err := c.Send(BinaryMessage, make([]byte, 10_000)); err == nil {
+		t.Fatalf("expected Send to fail on a dead connection")
+	}
+	if used := budget.used.Load(); used != 0 {
+		t.Fatalf("a dead connection was charged %d bytes", used)
+	}
+}
+
+func TestMemoryBudgetSendPause(t *testing.T) {
+	cfg := budgetConfig(BudgetPause)
+	cfg.MemoryBudget = 25_000
+	conns, _, _, budget := budgetConns(t, cfg, 2)
+
+	// nothing reads the pipes, the messages stay in flight
+	for i, size := range []int{10_000, 14_000} {
+		if err := conns[i].Send(BinaryMessage, make([]byte, size)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	// the budget drops what doesn't fit rather than holding up the caller
+	if err := conns[0].Send(BinaryMessage, make([]byte, 1_500)); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if n := conns[0].SendDropped(); n != 1 {
+		t.Fatalf("expected 1 message dropped, got %d", n)
+	}
+	if used := budget.used.Load(); used != 24_000 {
+		t.Fatalf("expected 24000 bytes held, got %d", used)
+	}
+}
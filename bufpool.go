@@ -0,0 +1,87 @@
+package main
+
+import (
+	"math/bits"
+	"sync"
+)
+
+// Read buffers are pooled by size class, each class a power of two, so the
+// thousands of idle connections of a busy server don't hold one each
+var readBufferPools [bits.UintSize]sync.Pool
+
+// getReadBuffer returns a buffer of size bytes from the pool of its size class
+func getReadBuffer(size int) *[]byte {
+	class := bits.Len(uint(size - 1))
+	if b, ok := readBufferPools[class].Get().(*[]byte); ok {
+		*b = (*b)[:size]
+		return b
+	}
+	b := make([]byte, size, 1<<class)
+	return &b
+}
+
+// putReadBuffer gives b back to the pool of its size class
+func putReadBuffer(b *[]byte) {
+	readBufferPools[bits.Len(uint(cap(*b)-1))].Put(b)
+}
+
+// An adaptive read buffer doubles after growAfterReads reads in a row
+// filled it and halves after shrinkAfterReads reads in a row used at most
+// a quarter of it
+const (
+	growAfterReads   = 4
+	shrinkAfterReads = 64
+)
+
+// adaptBuffer resizes the read buffer of a connection with
+// Config.MaxReadBufferSize after a read of n bytes. limited tells that the
+// read only got what bufio had buffered, it says nothing about the traffic
+// unless it filled the buffer.
+func (c *Conn) adaptBuffer(n int, limited bool) {
+	if c.cfg.MaxReadBufferSize == 0 {
+		return
+	}
+	size := len(*c.buffer)
+	switch {
+	case n == size:
+		c.smallReads = 0
+		if c.fullReads++; c.fullReads >= growAfterReads && size < c.cfg.MaxReadBufferSize {
+			c.resizeBuffer(min(2*size, c.cfg.MaxReadBufferSize))
+		}
+	case limited:
+	case n <= size/4:
+		c.fullReads = 0
+		if c.smallReads++; c.smallReads >= shrinkAfterReads && size > c.minBufferSize {
+			c.resizeBuffer(max(size/2, c.minBufferSize))
+		}
+	default:
+		c.fullReads, c.smallReads = 0, 0
+	}
+}
+
+// resizeBuffer makes the next reads use a buffer of size bytes. A pooled
+// buffer goes back to the pool right away, read takes one of the new size.
+func (c *Conn) resizeBuffer(size int) {
+	c.fullReads, c.smallReads = 0, 0
+	c.bufferSize = size
+	if c.cfg.DisableReadBufferPool {
+		buffer := make([]byte, size)
+		c.buffer = &buffer
+		return
+	}
+	if !c.lent {
+		// otherwise payloads handed out still point into it, it's left to the GC
+		putReadBuffer(c.buffer)
+	}
+	c.buffer = nil
+}
+
+// releaseBuffer gives the read buffer back to the pool, unless the
+// connection keeps its own
+func (c *Conn) releaseBuffer() {
+	if c.buffer == nil || c.cfg.DisableReadBufferPool {
+		return
+	}
+	putReadBuffer(c.buffer)
+	c.buffer = nil
+}
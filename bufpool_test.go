@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestReadBufferReleasedWhenIdle(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.PingInterval = 0
+		cfg.ReadBufferSize = 1000
+		cfg.DisableReadBufferPool = disable
+		c, client, _ := pipeConn(t, cfg)
+
+		// half a frame keeps the buffer, the rest of it frees it
+		frame := clientFrame(opText, []byte("hello"), true)
+		go func() {
+			client.Write(frame[:4])
+			client.Write(frame[4:])
+		}()
+		c.readMu.Lock()
+		for c.buffer == nil || c.decoder.Pending() == 0 {
+			c.read()
+		}
+		if len(*c.buffer) != 1000 || cap(*c.buffer) != 1024 && !disable {
+			t.Fatalf("read into a buffer of %d bytes, capacity %d", len(*c.buffer), cap(*c.buffer))
+		}
+		c.readMu.Unlock()
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != "hello" {
+			t.Fatalf("read %q, %v", data, err)
+		}
+		if idle := c.buffer == nil; idle == disable {
+			t.Fatalf("DisableReadBufferPool=%t: the idle connection holds a buffer: %t", disable, !idle)
+		}
+	}
+}
+
+func TestAdaptiveReadBuffer(t *testing.T) {
+	for _, disable := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.PingInterval = 0
+		cfg.ReadBufferSize = 4096
+		cfg.MaxReadBufferSize = 32 << 10
+		cfg.DisableReadBufferPool = disable
+		c, client, _ := pipeConn(t, cfg)
+
+		// a stream of 1MB/s, 32KB every 32ms, then small messages
+		go func() {
+			data := clientFrame(opBin, make([]byte, 256<<10), true)
+			ticker := time.NewTicker(32 * time.Millisecond)
+			defer ticker.Stop()
+			for len(data) > 0 {
+				n := min(32<<10, len(data))
+				client.Write(data[:n])
+				data = data[n:]
+				<-ticker.C
+			}
+			for range 3 * shrinkAfterReads {
+				client.Write(clientFrame(opText, []byte("small"), true))
+			}
+		}()
+
+		if _, data, err := c.ReadMessage(); err != nil || len(data) != 256<<10 {
+			t.Fatalf("read %d bytes, %v", len(data), err)
+		}
+		if c.bufferSize != 32<<10 {
+			t.Fatalf("DisableReadBufferPool=%t: expected the buffer to grow to 32KB under the stream, it has %d bytes", disable, c.bufferSize)
+		}
+		for range 3 * shrinkAfterReads {
+			if _, data, err := c.ReadMessage(); err != nil || string(data) != "small" {
+				t.Fatalf("read %q, %v", data, err)
+			}
+		}
+		if c.bufferSize != 4096 {
+			t.Fatalf("DisableReadBufferPool=%t: expected the buffer to shrink back to 4KB, it has %d bytes", disable, c.bufferSize)
+		}
+	}
+}
+
+// BenchmarkConnLifecycle sets up a connection, reads a message and closes
+// it, with pooled read buffers and with one of its own for every connection
+func BenchmarkConnLifecycle(b *testing.B) {
+	for _, disable := range []bool{false, true} {
+		name := "pooled"
+		if disable {
+			name = "unpooled"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.DisableReadBufferPool = disable
+			cfg.Logger = slog.New(slog.DiscardHandler)
+			transport := &repeatTransport{data: clientFrame(opText, []byte("a small message"), true)}
+			reader := bufio.NewReader(transport)
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c := newConn(context.Background(), transport, reader, cfg, connInfo{path: "/"})
+				if _, _, err := c.ReadMessage(); err != nil {
+					b.Fatal(err)
+				}
+				c.close()
+			}
+		})
+	}
+}
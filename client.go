@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+
+	"gows/wire"
+)
+
+// ErrBadHandshake is wrapped by the error Dial returns when the server
+// answered, but not with a valid 101 Switching Protocols
+var ErrBadHandshake = errors.New("websocket: bad handshake")
+
+// maxRedirects is how many redirects Dial follows before giving up
+const maxRedirects = 10
+
+// Dialer opens client connections to WebSocket servers, over ws:// or wss://.
+// The zero value is ready to use.
+type Dialer struct {
+	// Config holds the settings of the connections, the ones that only
+	// concern a server are ignored. EnableCompression offers permessage-deflate,
+	// Subprotocols are offered in Sec-WebSocket-Protocol.
+	// The zero value disables every limit and timeout, see DefaultConfig.
+	Config Config
+
+	// HandshakeTimeout bounds connecting, the TLS handshake and the opening
+	// handshake. Zero disables it.
+	HandshakeTimeout time.Duration
+
+	// TLSClientConfig is used for wss://, nil uses the defaults
+	TLSClientConfig *tls.Config
+
+	// Proxy returns the proxy to tunnel a connection through, it gets the
+	// upgrade request with an http:// or https:// URL standing for ws:// and
+	// wss://. http:// and https:// proxies are asked for a CONNECT tunnel,
+	// socks5:// and socks5h:// ones speak SOCKS5. Credentials in the proxy
+	// URL are sent along. A nil result connects directly, a nil Proxy uses
+	// http.ProxyFromEnvironment.
+	Proxy func(*http.Request) (*url.URL, error)
+}
+
+// DefaultDialer is a Dialer with the settings of DefaultConfig
+var DefaultDialer = &Dialer{Config: DefaultConfig(), HandshakeTimeout: 10 * time.Second}
+
+// Dial is DialContext without a context
+func (d *Dialer) Dial(urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	return d.DialContext(context.Background(), urlStr, requestHeader)
+}
+
+// DialContext connects to the WebSocket server at urlStr, a ws:// or wss://
+// URL, sending requestHeader with the upgrade request (e.g. Origin, Cookie
+// or Authorization). Redirects are followed, except from wss:// to ws://.
+// ctx bounds connecting and the opening handshake, not the connection.
+//
+// When the server refuses the upgrade the error wraps ErrBadHandshake and
+// the response is returned too, with the start of its body.
+func (d *Dialer) DialContext(ctx context.Context, urlStr string, requestHeader http.Header) (*Conn, *http.Response, error) {
+	if err := d.Config.validate(); err != nil {
+		return nil, nil, err
+	}
+	if d.HandshakeTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.HandshakeTimeout)
+		defer cancel()
+	}
+
+	u, err := parseWebSocketURL(urlStr)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := requestHeader.Clone()
+	for redirects := 0; ; redirects++ {
+		c, resp, err := d.handshake(ctx, u, header)
+		if err != nil || !isRedirect(resp.StatusCode) {
+			return c, resp, err
+		}
+
+		location, err := resp.Location()
+		if err != nil {
+			return nil, resp, fmt.Errorf("%w: redirect without a valid Location: %v", ErrBadHandshake, err)
+		}
+		if redirects == maxRedirects {
+			return nil, resp, fmt.Errorf("%w: stopped after %d redirects", ErrBadHandshake, maxRedirects)
+		}
+		next, err := redirectURL(u, location)
+		if err != nil {
+			return nil, resp, err
+		}
+		// Credentials are only for the host they were given for
+		if next.Host != u.Host {
+			header.Del("Authorization")
+			header.Del("Cookie")
+		}
+		u = next
+	}
+}
+
+// parseWebSocketURL checks that urlStr is a ws:// or wss:// URL
+func parseWebSocketURL(urlStr string) (*url.URL, error) {
+	u, err := url.Parse(urlStr)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("websocket: URL scheme %q is not ws or wss", u.Scheme)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("websocket: URL %q has no host", urlStr)
+	}
+	return u, nil
+}
+
+func isRedirect(status int) bool {
+	switch status {
+	case http.StatusMovedPermanently, http.StatusFound, http.StatusSeeOther, http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	}
+	return false
+}
+
+// redirectURL turns the Location of a redirect into the URL to dial next.
+// Servers may redirect with http:// and https:// URLs, those mean ws:// and
+// wss://. A secure connection is never redirected to a plain one.
+func redirectURL(from, location *url.URL) (*url.URL, error) {
+	next := *location
+	switch next.Scheme {
+	case "http":
+		next.Scheme = "ws"
+	case "https":
+		next.Scheme = "wss"
+	}
+	if next.Scheme != "ws" && next.Scheme != "wss" {
+		return nil, fmt.Errorf("%w: redirect to %q", ErrBadHandshake, location)
+	}
+	if from.Scheme == "wss" && next.Scheme == "ws" {
+		return nil, fmt.Errorf("%w: redirect from wss:// to ws://", ErrBadHandshake)
+	}
+	return &next, nil
+}
+
+// handshake connects to u and sends one upgrade request. A redirect is
+// returned as a response without error, for DialContext to follow.
+func (d *Dialer) handshake(ctx context.Context, u *url.URL, requestHeader http.Header) (*Conn, *http.Response, error) {
+	key, err := newChallengeKey()
+	if err != nil {
+		return nil, nil, err
+	}
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Scheme: strings.Replace(u.Scheme, "ws", "http", 1), Host: u.Host, Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     make(http.Header),
+		Host:       u.Host,
+	}
+	for k, v := range requestHeader {
+		switch http.CanonicalHeaderKey(k) {
+		case "Host":
+			if len(v) > 0 {
+				req.Host = v[0]
+			}
+		case "Upgrade", "Connection", "Sec-Websocket-Key", "Sec-Websocket-Version", "Sec-Websocket-Extensions":
+			return nil, nil, fmt.Errorf("websocket: the %s header is set by the Dialer", k)
+		default:
+			req.Header[k] = v
+		}
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if d.Config.EnableCompression {
+		req.Header.Set("Sec-WebSocket-Extensions", "permessage-deflate")
+	}
+	if len(d.Config.Subprotocols) > 0 {
+		req.Header.Add("Sec-WebSocket-Protocol", strings.Join(d.Config.Subprotocols, ", "))
+	}
+
+	conn, err := d.connect(ctx, u, req)
+	if err != nil {
+		return nil, nil, err
+	}
+	stop := bindDeadline(ctx, conn)
+	fail := func(resp *http.Response, err error) (*Conn, *http.Response, error) {
+		stop()
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return nil, resp, err
+	}
+
+	if err := req.Write(conn); err != nil {
+		return fail(nil, err)
+	}
+	bufferSize := d.Config.ReadBufferSize
+	if bufferSize == 0 {
+		bufferSize = readBufferSize
+	}
+	reader := bufio.NewReaderSize(conn, bufferSize)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return fail(nil, err)
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		// keep the start of the body, the caller may want to show why
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body = io.NopCloser(bytes.NewReader(body))
+		if isRedirect(resp.StatusCode) {
+			stop()
+			_ = conn.Close()
+			return nil, resp, nil
+		}
+		return fail(resp, fmt.Errorf("%w: %s", ErrBadHandshake, resp.Status))
+	}
+	resp.Body = http.NoBody
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket") || !headerContainsToken(resp.Header, "Connection", "upgrade") {
+		return fail(resp, fmt.Errorf("%w: missing Upgrade or Connection header", ErrBadHandshake))
+	}
+	accept := sha1.Sum([]byte(key + wsGUID))
+	if resp.Header.Get("Sec-WebSocket-Accept") != base64.StdEncoding.EncodeToString(accept[:]) {
+		return fail(resp, fmt.Errorf("%w: wrong Sec-WebSocket-Accept", ErrBadHandshake))
+	}
+	info := connInfo{path: u.Path, client: true, subprotocol: resp.Header.Get("Sec-WebSocket-Protocol")}
+	if info.subprotocol != "" && !slices.Contains(headerTokens(req.Header, "Sec-WebSocket-Protocol"), info.subprotocol) {
+		return fail(resp, fmt.Errorf("%w: the server selected subprotocol %q, which wasn't offered", ErrBadHandshake, info.subprotocol))
+	}
+	if len(resp.Header.Values("Sec-WebSocket-Extensions")) > 0 {
+		params, err := acceptDeflateResponse(resp.Header, d.Config.EnableCompression)
+		if err != nil {
+			return fail(resp, err)
+		}
+		info.deflate = &params
+	}
+
+	if !stop() {
+		// ctx ended just as the handshake completed
+		return fail(resp, ctx.Err())
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return newConn(context.Background(), conn, reader, d.Config, info), resp, nil
+}
+
+// connect opens the TCP connection for u, through the proxy if there is
+// one, and the TLS connection on top for wss://
+func (d *Dialer) connect(ctx context.Context, u *url.URL, req *http.Request) (net.Conn, error) {
+	host := u.Hostname()
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "wss" {
+			port = "443"
+		}
+	}
+	target := net.JoinHostPort(host, port)
+
+	proxy := d.Proxy
+	if proxy == nil {
+		proxy = http.ProxyFromEnvironment
+	}
+	proxyURL, err := proxy(req)
+	if err != nil {
+		return nil, err
+	}
+	var conn net.Conn
+	if proxyURL == nil {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", target)
+	} else {
+		conn, err = dialProxy(ctx, proxyURL, target)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := d.Config.Socket.apply(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	if u.Scheme != "wss" {
+		return conn, nil
+	}
+
+	cfg := &tls.Config{}
+	if d.TLSClientConfig != nil {
+		cfg = d.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName = host
+	}
+	// The upgrade needs HTTP/1.1
+	cfg.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// bindDeadline makes ctx bound the I/O on conn: its deadline becomes the
+// connection's and cancelling it interrupts a blocked read or write.
+// Calling stop ends that, it returns false when ctx already ended.
+func bindDeadline(ctx context.Context, conn net.Conn) (stop func() bool) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	return context.AfterFunc(ctx, func() {
+		_ = conn.SetDeadline(time.Now())
+	})
+}
+
+// newChallengeKey returns a random Sec-WebSocket-Key, 16 random bytes base64 encoded
+func newChallengeKey() (string, error) {
+	var nonce [16]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce[:]), nil
+}
+
+// headerContainsToken reports whether a comma separated header holds token
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, line := range h.Values(name) {
+		for _, part := range strings.Split(line, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// buildMaskedFrame assembles a client-to-server frame, masked with a fresh
+// random key as RFC 6455 5.3 requires
+func buildMaskedFrame(opcode byte, payload []byte, fin bool) ([]byte, error) {
+	var header [wire.MaxHeaderSize]byte
+	n, err := writeFrameHeader(&header, opcode, fin, true, uint64(len(payload)))
+	if err != nil {
+		return nil, err
+	}
+	frameData := make([]byte, n+len(payload))
+	copy(frameData, header[:n])
+	copy(frameData[n:], payload)
+	wire.MaskBytes([4]byte(header[n-4:n]), 0, frameData[n:])
+	return frameData, nil
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// echoThrough sends msg on c and checks it comes back unchanged
+func echoThrough(t *testing.T, c *Conn, msg []byte) {
+	t.Helper()
+	if err := c.WriteMessage(opBin, msg); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	messageType, data, err := c.ReadMessage()
+	if err != nil {
+		t.Fatalf("failed to read the echo: %v", err)
+	}
+	if messageType != opBin || !bytes.Equal(data, msg) {
+		t.Fatalf("the echo of %d bytes came back as type %d, %d bytes", len(msg), messageType, len(data))
+	}
+}
+
+func TestDialEcho(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	c := dial(t, "ws://"+addr+"/", nil)
+	echoThrough(t, c, []byte("hello"))
+	echoThrough(t, c, bytes.Repeat([]byte("large "), 20000))
+
+	// The closing handshake works from the client side too
+	if err := c.Close(CloseNormalClosure, "done"); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestDialTLS(t *testing.T) {
+	ca := newTestCA(t)
+	cfg := DefaultConfig()
+	cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)}}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	d := Dialer{Config: DefaultConfig(), TLSClientConfig: &tls.Config{RootCAs: ca.pool}}
+	c, _, err := d.Dial("wss://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.CloseNow()
+	echoThrough(t, c, []byte("secure hello"))
+
+	// Without trusting the CA the certificate is refused
+	if _, _, err := (&Dialer{}).Dial("wss://"+addr+"/", nil); err == nil {
+		t.Fatal("expected an unknown certificate authority to fail the dial")
+	}
+}
+
+func TestDialCompressed(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	d := Dialer{Config: DefaultConfig()}
+	c, resp, err := d.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.CloseNow()
+	if c.deflate == nil || resp.Header.Get("Sec-WebSocket-Extensions") == "" {
+		t.Fatal("expected permessage-deflate to be negotiated")
+	}
+	// Twice, so the second message may refer back to the first
+	for i := 0; i < 2; i++ {
+		echoThrough(t, c, []byte(wordySample(256<<10)))
+	}
+}
+
+func TestSubprotocolNegotiation(t *testing.T) {
+	selected := make(chan string, 1)
+	cfg := DefaultConfig()
+	cfg.Subprotocols = []string{"msgpack", "json"}
+	cfg.OnConnect = func(c *Conn) error {
+		selected <- c.Subprotocol()
+		return nil
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	for _, tc := range []struct {
+		name    string
+		offered []string
+		want    string
+	}{
+		{"matched", []string{"json", "msgpack"}, "msgpack"}, // the server's preference wins
+		{"unmatched", []string{"xml"}, ""},
+		{"absent", nil, ""},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			d := Dialer{Config: DefaultConfig()}
+			d.Config.Subprotocols = tc.offered
+			c, resp, err := d.Dial("ws://"+addr+"/", nil)
+			if err != nil {
+				t.Fatalf("Dial: %v", err)
+			}
+			defer c.CloseNow()
+			if got := <-selected; got != tc.want {
+				t.Fatalf("server selected %q, expected %q", got, tc.want)
+			}
+			if c.Subprotocol() != tc.want || resp.Header.Get("Sec-WebSocket-Protocol") != tc.want {
+				t.Fatalf("client saw %q, expected %q", c.Subprotocol(), tc.want)
+			}
+		})
+	}
+}
+
+func TestDialUnofferedSubprotocol(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		accept := sha1.Sum([]byte(r.Header.Get("Sec-WebSocket-Key") + wsGUID))
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Sec-WebSocket-Accept", base64.StdEncoding.EncodeToString(accept[:]))
+		w.Header().Set("Sec-WebSocket-Protocol", "xml")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	defer ts.Close()
+
+	d := Dialer{Config: Config{Subprotocols: []string{"json"}}}
+	_, _, err := d.Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/", nil)
+	if !errors.Is(err, ErrBadHandshake) || !strings.Contains(err.Error(), `"xml"`) {
+		t.Fatalf("expected a bad handshake about the subprotocol, got %v", err)
+	}
+}
+
+func TestDialWrongAccept(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Upgrade", "websocket")
+		w.Header().Set("Connection", "Upgrade")
+		w.Header().Set("Sec-WebSocket-Accept", "c29tZXRoaW5nIGVsc2U=")
+		w.WriteHeader(http.StatusSwitchingProtocols)
+	}))
+	defer ts.Close()
+
+	_, resp, err := (&Dialer{}).Dial("ws"+strings.TrimPrefix(ts.URL, "http")+"/", nil)
+	if !errors.Is(err, ErrBadHandshake) || !strings.Contains(err.Error(), "Sec-WebSocket-Accept") {
+		t.Fatalf("expected a bad handshake about the accept key, got %v", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the 101 response, got %v", resp)
+	}
+}
+
+func TestDialForbidden(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Authorize = func(r *http.Request) (interface{}, int, error) {
+		return nil, http.StatusForbidden, errors.New("no token")
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	c, resp, err := (&Dialer{}).Dial("ws://"+addr+"/", nil)
+	if c != nil || !errors.Is(err, ErrBadHandshake) {
+		t.Fatalf("expected a bad handshake, got %v", err)
+	}
+	if resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the 403 response, got %v", resp)
+	}
+	if body, _ := io.ReadAll(resp.Body); !strings.Contains(string(body), "no token") {
+		t.Fatalf("expected the response body, got %q", body)
+	}
+}
+
+func TestDialRedirect(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	cookies := make(chan string, 1)
+	redirector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies <- r.Header.Get("Cookie")
+		http.Redirect(w, r, "http://"+addr+"/moved", http.StatusFound)
+	}))
+	defer redirector.Close()
+
+	d := Dialer{Config: DefaultConfig()}
+	c, _, err := d.Dial("ws"+strings.TrimPrefix(redirector.URL, "http")+"/old", http.Header{"Cookie": {"session=abc"}})
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.CloseNow()
+	if cookie := <-cookies; cookie != "session=abc" {
+		t.Fatalf("the first request lost its cookie: %q", cookie)
+	}
+	echoThrough(t, c, []byte("followed"))
+}
+
+func TestRedirectURL(t *testing.T) {
+	tests := []struct {
+		from, location, want string
+	}{
+		{"ws://a.example/x", "http://b.example/y", "ws://b.example/y"},
+		{"wss://a.example/x", "https://b.example/y", "wss://b.example/y"},
+		{"ws://a.example/x", "wss://a.example/x", "wss://a.example/x"},
+		{"wss://a.example/x", "ws://a.example/x", ""},   // no downgrade
+		{"wss://a.example/x", "http://a.example/x", ""}, // not even through http://
+		{"ws://a.example/x", "ftp://a.example/x", ""},
+	}
+	for _, tt := range tests {
+		from, _ := url.Parse(tt.from)
+		location, _ := url.Parse(tt.location)
+		next, err := redirectURL(from, location)
+		if tt.want == "" {
+			if err == nil {
+				t.Errorf("%s -> %s: expected the redirect to be refused, got %s", tt.from, tt.location, next)
+			}
+			continue
+		}
+		if err != nil || next.String() != tt.want {
+			t.Errorf("%s -> %s: expected %s, got %v %v", tt.from, tt.location, tt.want, next, err)
+		}
+	}
+}
+
+func TestDialRefusesBadURLs(t *testing.T) {
+	for _, u := range []string{"http://example.com/", "ws:///path", "://"} {
+		if _, _, err := (&Dialer{}).Dial(u, nil); err == nil {
+			t.Errorf("%q: expected an error", u)
+		}
+	}
+	if _, _, err := (&Dialer{}).Dial("ws://127.0.0.1:1/", http.Header{"Sec-WebSocket-Key": {"x"}}); err == nil {
+		t.Error("expected a handshake header in requestHeader to be refused")
+	}
+}
+
+func TestClientMasksFrames(t *testing.T) {
+	a, b := net.Pipe()
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c := newConn(t.Context(), a, bufio.NewReader(a), cfg, connInfo{path: "/", client: true})
+	defer c.close()
+
+	go func() {
+		c.WriteMessage(opText, []byte("same payload"))
+		c.WriteMessage(opText, []byte("same payload"))
+	}()
+	reader := bufio.NewReader(b)
+	raw := make([][]byte, 2)
+	for i := range raw {
+		raw[i] = make([]byte, 2+4+len("same payload"))
+		if _, err := io.ReadFull(reader, raw[i]); err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if raw[i][1]&0x80 == 0 {
+			t.Fatal("client frame without the MASK bit")
+		}
+		frames, _, err := parseFrames(raw[i], parseOptions{})
+		if err != nil || len(frames) != 1 || string(frames[0].Payload) != "same payload" {
+			t.Fatalf("the server can't read the frame: %v", err)
+		}
+	}
+	if bytes.Equal(raw[0][2:6], raw[1][2:6]) {
+		t.Fatal("two frames were masked with the same key")
+	}
+}
+
+func TestMaskingEnforced(t *testing.T) {
+	// a server fails a connection sending unmasked frames
+	if _, _, err := parseFrames(mustBuildFrame(t, opText, "hi"), parseOptions{}); !errors.Is(err, errProtocol) {
+		t.Fatalf("expected the server to refuse an unmasked frame, got %v", err)
+	}
+	// and a client one sending masked frames
+	if _, _, err := parseFrames(clientFrame(opText, []byte("hi"), true), parseOptions{client: true}); !errors.Is(err, errProtocol) {
+		t.Fatalf("expected the client to refuse a masked frame, got %v", err)
+	}
+
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+	readErr := readInBackground(c)
+	go client.Write(mustBuildFrame(t, opText, "unmasked"))
+	if code, _ := answerClose(t, client, reader); code != CloseProtocolError {
+		t.Fatalf("expected CLOSE 1002, got %d", code)
+	}
+	if err := <-readErr; !IsCloseError(err, CloseProtocolError) {
+		t.Fatalf("expected the reader to end with 1002, got %v", err)
+	}
+}
+
+func mustBuildFrame(t *testing.T, opcode byte, payload string) []byte {
+	t.Helper()
+	data, err := buildFrame(opcode, []byte(payload), true)
+	if err != nil {
+		t.Fatalf("buildFrame: %v", err)
+	}
+	return data
+}
+
+func TestDialHandshakeTimeout(t *testing.T) {
+	// A server that accepts the connection and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	d := Dialer{HandshakeTimeout: 100 * time.Millisecond}
+	start := time.Now()
+	if _, _, err := d.Dial(fmt.Sprintf("ws://%s/", ln.Addr()), nil); err == nil {
+		t.Fatal("expected the handshake to time out")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the handshake took %v", elapsed)
+	}
+}
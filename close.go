@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"slices"
+	"unicode/utf8"
+
+	"gows/wire"
+)
+
+// Close codes defined in RFC 6455, section 7.4.1 and the IANA registry
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005 // never sent, an empty close payload
+	CloseAbnormalClosure         = 1006 // never sent, the TCP connection dropped
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseTLSHandshake            = 1015 // never sent, the TLS handshake failed
+)
+
+// A close frame is a control frame, so its payload is limited to 125 bytes:
+// 2 bytes of code leave 123 bytes for the reason
+const maxCloseReasonLen = 123
+
+// errProtocol is wrapped by every error caused by a peer violating RFC 6455
+var errProtocol = wire.ErrProtocol
+
+// ErrReadLimit is wrapped by the error reading ends with when a frame or
+// message exceeds MaxFrameSize or the read limit (MaxMessageSize, see
+// Conn.SetReadLimit)
+var ErrReadLimit = errors.New("websocket: read limit exceeded")
+
+// errMessageTooBig is wrapped when a frame exceeds the configured size limits
+var errMessageTooBig = &CloseError{Code: CloseMessageTooBig, Text: "message too big", err: ErrReadLimit}
+
+// errInvalidPayload is wrapped when a message payload can't be decoded
+var errInvalidPayload = &CloseError{Code: CloseInvalidFramePayloadData, Text: "invalid payload data"}
+
+// CloseError is the status code and reason carried by a CLOSE frame.
+// Reading ends with one when the peer closed the connection, or when we
+// closed it because of what the peer sent, e.g. 1002 for a protocol error
+// or 1009 for a message over the limit (which also matches ErrReadLimit).
+// A connection dropped without a CLOSE ends with 1006.
+type CloseError struct {
+	Code int
+	Text string
+
+	err error // what made us close, nil when the peer closed
+}
+
+func (e *CloseError) Error() string {
+	if e.Text == "" {
+		return fmt.Sprintf("websocket: close %d", e.Code)
+	}
+	return fmt.Sprintf("websocket: close %d %s", e.Code, e.Text)
+}
+
+func (e *CloseError) Unwrap() error {
+	return e.err
+}
+
+// IsCloseError reports whether err is a *CloseError with one of codes
+func IsCloseError(err error, codes ...int) bool {
+	var ce *CloseError
+	return errors.As(err, &ce) && slices.Contains(codes, ce.Code)
+}
+
+// IsUnexpectedCloseError reports whether err is a *CloseError whose code
+// isn't one of expectedCodes, e.g. anything but 1000 and 1001
+func IsUnexpectedCloseError(err error, expectedCodes ...int) bool {
+	var ce *CloseError
+	return errors.As(err, &ce) && !slices.Contains(expectedCodes, ce.Code)
+}
+
+// closeErrorFor picks the CLOSE frame we answer with when reading from the
+// peer fails, it wraps err
+func closeErrorFor(err error) *CloseError {
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		return &CloseError{Code: ce.Code, Text: ce.Text, err: err}
+	}
+	return &CloseError{Code: CloseProtocolError, Text: "protocol error", err: err}
+}
+
+// failure returns err, why a connection ended, when something failed and
+// nil when either side closed it on purpose
+func failure(err error) error {
+	if ce, ok := err.(*CloseError); ok && ce.err == nil {
+		return nil
+	}
+	return err
+}
+
+// formatClosePayload builds the payload of a CLOSE frame: the 2-byte code
+// followed by the reason. CloseNoStatusReceived stands for "no code at all" and
+// produces an empty payload; any other code reserved for local use is refused.
+func formatClosePayload(code int, reason string) ([]byte, error) {
+	if code == CloseNoStatusReceived {
+		return []byte{}, nil
+	}
+	if !validCloseCode(code) {
+		return nil, fmt.Errorf("close code %d must not be sent", code)
+	}
+	if len(reason) > maxCloseReasonLen {
+		return nil, fmt.Errorf("close reason is %d bytes, the limit is %d", len(reason), maxCloseReasonLen)
+	}
+	payload := make([]byte, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(code))
+	copy(payload[2:], reason)
+	return payload, nil
+}
+
+// parseClosePayload extracts the status code and reason from a CLOSE frame payload.
+// An empty payload is legal and means the peer sent no status code (CloseNoStatusReceived).
+// Otherwise the payload must start with a 2-byte code that is allowed on the wire,
+// optionally followed by a UTF-8 encoded reason.
+func parseClosePayload(payload []byte) (int, string, error) {
+	if len(payload) == 0 {
+		return CloseNoStatusReceived, "", nil
+	}
+	if len(payload) < 2 {
+		return 0, "", fmt.Errorf("%w: close payload of %d byte", errProtocol, len(payload))
+	}
+	code := int(binary.BigEndian.Uint16(payload[:2]))
+	if !validCloseCode(code) {
+		return 0, "", fmt.Errorf("%w: invalid close code %d", errProtocol, code)
+	}
+	reason := payload[2:]
+	if !utf8.Valid(reason) {
+		return 0, "", fmt.Errorf("%w: close reason is not valid UTF-8", errProtocol)
+	}
+	return code, string(reason), nil
+}
+
+// validCloseCode reports whether a close code may appear in a CLOSE frame.
+// 1004 is reserved, and 1005, 1006 and 1015 are only used locally to describe
+// what happened, so an endpoint must never put them on the wire.
+// 3000-3999 are registered with IANA and 4000-4999 are for private use.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003:
+		return true
+	case code >= 1007 && code <= 1014:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
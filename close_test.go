@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseClosePayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		code    int
+		reason  string
+		wantErr bool
+	}{
+		{name: "empty", payload: nil, code: CloseNoStatusReceived},
+		{name: "one byte", payload: []byte{0x03}, wantErr: true},
+		{name: "no status on the wire", payload: []byte{0x03, 0xED}, wantErr: true},
+		{name: "abnormal closure on the wire", payload: []byte{0x03, 0xEE}, wantErr: true},
+		{name: "tls handshake on the wire", payload: []byte{0x03, 0xF7}, wantErr: true},
+		{name: "normal closure", payload: []byte{0x03, 0xE8}, code: CloseNormalClosure},
+		{name: "application code with reason", payload: append([]byte{0x0F, 0xA0}, "café ☕"...), code: 4000, reason: "café ☕"},
+		{name: "invalid utf-8 reason", payload: []byte{0x03, 0xE8, 0xC3, 0x28}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, reason, err := parseClosePayload(tt.payload)
+			if tt.wantErr {
+				if !errors.Is(err, errProtocol) {
+					t.Fatalf("expected protocol error, got %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if code != tt.code || reason != tt.reason {
+				t.Fatalf("got code=%d reason=%q, want code=%d reason=%q", code, reason, tt.code, tt.reason)
+			}
+		})
+	}
+}
+
+func TestFormatParseCloseRoundTrip(t *testing.T) {
+	tests := []struct {
+		code   int
+		reason string
+	}{
+		{CloseNormalClosure, ""},
+		{CloseGoingAway, "server restarting"},
+		{CloseProtocolError, "protocol error"},
+		{CloseMessageTooBig, "message too big"},
+		{CloseInternalServerErr, "oops"},
+		{3000, "registered"},
+		{4999, strings.Repeat("x", maxCloseReasonLen)},
+	}
+	for _, tt := range tests {
+		payload, err := formatClosePayload(tt.code, tt.reason)
+		if err != nil {
+			t.Fatalf("format(%d, %q): %v", tt.code, tt.reason, err)
+		}
+		code, reason, err := parseClosePayload(payload)
+		if err != nil {
+			t.Fatalf("parse(%d, %q): %v", tt.code, tt.reason, err)
+		}
+		if code != tt.code || reason != tt.reason {
+			t.Fatalf("round trip gave code=%d reason=%q, want code=%d reason=%q", code, reason, tt.code, tt.reason)
+		}
+	}
+
+	// no status round trips through an empty payload
+	payload, err := formatClosePayload(CloseNoStatusReceived, "")
+	if err != nil || len(payload) != 0 {
+		t.Fatalf("expected empty payload for no status, got % x (err=%v)", payload, err)
+	}
+	if code, _, _ := parseClosePayload(payload); code != CloseNoStatusReceived {
+		t.Fatalf("expected %d, got %d", CloseNoStatusReceived, code)
+	}
+}
+
+func TestFormatClosePayloadRefusesReservedCodes(t *testing.T) {
+	for _, code := range []int{0, 999, 1004, CloseAbnormalClosure, CloseTLSHandshake, 2999, 5000} {
+		if _, err := formatClosePayload(code, ""); err == nil {
+			t.Fatalf("expected code %d to be refused", code)
+		}
+	}
+	if _, err := formatClosePayload(CloseNormalClosure, strings.Repeat("x", maxCloseReasonLen+1)); err == nil {
+		t.Fatalf("expected an oversized reason to be refused")
+	}
+}
+
+func TestCloseErrorHelpers(t *testing.T) {
+	err := fmt.Errorf("read: %w", &CloseError{Code: CloseGoingAway})
+	if !IsCloseError(err, CloseNormalClosure, CloseGoingAway) {
+		t.Fatal("IsCloseError missed a listed code")
+	}
+	if IsCloseError(err, CloseNormalClosure) || IsCloseError(errors.New("reset"), CloseGoingAway) {
+		t.Fatal("IsCloseError matched an unlisted code or another error")
+	}
+	if IsUnexpectedCloseError(err, CloseNormalClosure, CloseGoingAway) {
+		t.Fatal("IsUnexpectedCloseError flagged an expected code")
+	}
+	if !IsUnexpectedCloseError(err, CloseNormalClosure) {
+		t.Fatal("IsUnexpectedCloseError missed an unexpected code")
+	}
+}
+
+// TestTerminationErrors checks what reading ends with in every way a
+// connection can end
+func TestTerminationErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		peer  func(client net.Conn)
+		code  int
+		cause error // matched with errors.Is, nil for none
+	}{
+		{"peer closes", func(client net.Conn) {
+			payload, _ := formatClosePayload(CloseNormalClosure, "bye")
+			client.Write(clientFrame(opClose, payload, true))
+		}, CloseNormalClosure, nil},
+		{"protocol error", func(client net.Conn) {
+			client.Write(clientFrame(opCont, []byte("orphan"), true))
+		}, CloseProtocolError, errProtocol},
+		{"malformed close", func(client net.Conn) {
+			client.Write(clientFrame(opClose, []byte{0x03}, true))
+		}, CloseProtocolError, errProtocol},
+		{"message too big", func(client net.Conn) {
+			client.Write(clientFrame(opBin, make([]byte, 2048), true))
+		}, CloseMessageTooBig, ErrReadLimit},
+		{"dropped", func(client net.Conn) {
+			client.Close()
+		}, CloseAbnormalClosure, io.EOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.CloseTimeout = 0
+			cfg.MaxMessageSize = 1024
+			c, client, reader := pipeConn(t, cfg)
+			go io.Copy(io.Discard, reader) // our CLOSE, if any
+
+			go tt.peer(client)
+			_, _, err := c.ReadMessage()
+			var ce *CloseError
+			if !errors.As(err, &ce) || ce.Code != tt.code {
+				t.Fatalf("expected CloseError %d, got %v", tt.code, err)
+			}
+			if tt.cause != nil && !errors.Is(err, tt.cause) {
+				t.Fatalf("expected %v to match %v", err, tt.cause)
+			}
+			// Writes fail the same way whoever closed
+			if err := c.WriteMessage(opText, []byte("too late")); !errors.Is(err, ErrConnClosed) {
+				t.Fatalf("expected ErrConnClosed from a write, got %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteAfterCloseNow(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, _ := pipeConn(t, cfg)
+	c.CloseNow()
+	if err := c.WriteMessage(opText, []byte("too late")); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+}
+
+func TestCloseWithoutCloseTimeout(t *testing.T) {
+	for _, reading := range []bool{false, true} {
+		t.Run(fmt.Sprintf("reading=%t", reading), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.CloseTimeout = 0
+			c, client, reader := pipeConn(t, cfg)
+			if reading {
+				go c.ReadMessage()
+			}
+
+			// the peer never answers, Close doesn't wait for it
+			closed := make(chan error, 1)
+			go func() { closed <- c.Close(CloseNormalClosure, "bye") }()
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			f := readFrameFrom(t, reader)
+			if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseNormalClosure {
+				t.Fatalf("expected CLOSE 1000, got opcode %d code %d", f.Opcode, code)
+			}
+			if err := <-closed; err != nil {
+				t.Fatalf("expected nil from Close, got %v", err)
+			}
+			if _, err := reader.ReadByte(); err != io.EOF {
+				t.Fatalf("expected the connection dropped, got %v", err)
+			}
+		})
+	}
+}
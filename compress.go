@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+/*
+   permessage-deflate (RFC 7692)
+   A compressed message is deflated as a whole and split into frames as usual,
+   RSV1 is set on its first frame. The sender flushes the DEFLATE stream with
+   a sync flush and strips the 4 bytes 00 00 FF FF it ends with, the receiver
+   appends them again before inflating.
+   With context takeover (the default) both sides keep their 32KB sliding
+   window from one message to the next, so a message may refer back to bytes
+   of the previous ones.
+*/
+
+// deflateTail is the end of a sync flushed DEFLATE block
+const deflateTail = "\x00\x00\xff\xff"
+
+// deflateFinalBlock is an empty final stored block, appended after the tail so
+// the flate reader sees a complete stream and returns io.EOF
+const deflateFinalBlock = "\x01\x00\x00\xff\xff"
+
+// deflateWindowSize is the LZ77 window of compress/flate, it can't be made smaller
+const deflateWindowSize = 1 << 15
+
+// rsv1Bit marks the first frame of a compressed message
+const rsv1Bit = 0x40
+
+// compressionLevel trades CPU for ratio, BestSpeed already shrinks text a lot
+const compressionLevel = flate.BestSpeed
+
+// extensionOffer is one comma separated entry of Sec-WebSocket-Extensions,
+// an extension name followed by its ";" separated parameters
+type extensionOffer struct {
+	name   string
+	params []extensionParam
+}
+
+type extensionParam struct {
+	key      string
+	value    string
+	hasValue bool
+}
+
+// parseExtensions splits every Sec-WebSocket-Extensions line of h into offers,
+// e.g. `permessage-deflate; client_max_window_bits, x-webkit-deflate-frame`.
+// Parameter values may be quoted.
+func parseExtensions(h http.Header) []extensionOffer {
+	var offers []extensionOffer
+	for _, line := range h.Values("Sec-WebSocket-Extensions") {
+		for _, entry := range strings.Split(line, ",") {
+			parts := strings.Split(entry, ";")
+			offer := extensionOffer{name: strings.ToLower(strings.TrimSpace(parts[0]))}
+			if offer.name == "" {
+				continue
+			}
+			for _, part := range parts[1:] {
+				key, value, hasValue := strings.Cut(part, "=")
+				offer.params = append(offer.params, extensionParam{
+					key:      strings.ToLower(strings.TrimSpace(key)),
+					value:    strings.Trim(strings.TrimSpace(value), `"`),
+					hasValue: hasValue,
+				})
+			}
+			offers = append(offers, offer)
+		}
+	}
+	return offers
+}
+
+// deflateParams are the negotiated permessage-deflate parameters
+type deflateParams struct {
+	serverNoContextTakeover bool // we reset our compressor after every message
+	clientNoContextTakeover bool // the client resets its compressor, we reset our decompressor
+}
+
+// String formats the parameters for the Sec-WebSocket-Extensions response header
+func (p deflateParams) String() string {
+	s := "permessage-deflate"
+	if p.serverNoContextTakeover {
+		s += "; server_no_context_takeover"
+	}
+	if p.clientNoContextTakeover {
+		s += "; client_no_context_takeover"
+	}
+	return s
+}
+
+// negotiateDeflate picks the first permessage-deflate offer we can honor.
+// Offers with parameters we don't support are skipped in favor of the next
+// one, ok is false when none is acceptable and the extension is declined.
+func negotiateDeflate(h http.Header) (params deflateParams, ok bool) {
+	for _, offer := range parseExtensions(h) {
+		if offer.name != "permessage-deflate" {
+			continue
+		}
+		if params, ok := acceptDeflateOffer(offer); ok {
+			return params, true
+		}
+	}
+	return deflateParams{}, false
+}
+
+// acceptDeflateOffer checks the parameters of a single offer (RFC 7692 7.1)
+func acceptDeflateOffer(offer extensionOffer) (deflateParams, bool) {
+	var params deflateParams
+	seen := make(map[string]bool)
+	for _, p := range offer.params {
+		// a parameter may appear only once
+		if seen[p.key] {
+			return deflateParams{}, false
+		}
+		seen[p.key] = true
+
+		switch p.key {
+		case "server_no_context_takeover":
+			if p.hasValue {
+				return deflateParams{}, false
+			}
+			params.serverNoContextTakeover = true
+		case "client_no_context_takeover":
+			if p.hasValue {
+				return deflateParams{}, false
+			}
+			params.clientNoContextTakeover = true
+		case "server_max_window_bits":
+			// compress/flate always uses a 32KB window, so we can only
+			// promise the client the largest window (15 bits)
+			bits, err := strconv.Atoi(p.value)
+			if !p.hasValue || err != nil || bits != 15 {
+				return deflateParams{}, false
+			}
+		case "client_max_window_bits":
+			// the client may limit its own window, our inflater handles any
+			// size. We don't answer with it, so the client keeps 15 bits.
+			if p.hasValue {
+				bits, err := strconv.Atoi(p.value)
+				if err != nil || bits < 8 || bits > 15 {
+					return deflateParams{}, false
+				}
+			}
+		default:
+			return deflateParams{}, false
+		}
+	}
+	return params, true
+}
+
+// acceptDeflateResponse checks the permessage-deflate parameters a server
+// accepted our offer with. The offer has no parameters, so the server may
+// only add no context takeover for either side and limit its own window,
+// which our inflater copes with (RFC 7692 7.1).
+func acceptDeflateResponse(h http.Header, offered bool) (deflateParams, error) {
+	offers := parseExtensions(h)
+	if !offered || len(offers) != 1 || offers[0].name != "permessage-deflate" {
+		return deflateParams{}, fmt.Errorf("%w: extensions %q weren't offered", ErrBadHandshake, h.Values("Sec-WebSocket-Extensions"))
+	}
+	var params deflateParams
+	seen := make(map[string]bool)
+	for _, p := range offers[0].params {
+		if seen[p.key] {
+			return deflateParams{}, fmt.Errorf("%w: permessage-deflate parameter %s repeated", ErrBadHandshake, p.key)
+		}
+		seen[p.key] = true
+
+		switch {
+		case p.key == "server_no_context_takeover" && !p.hasValue:
+			params.serverNoContextTakeover = true
+		case p.key == "client_no_context_takeover" && !p.hasValue:
+			params.clientNoContextTakeover = true
+		case p.key == "server_max_window_bits":
+			if bits, err := strconv.Atoi(p.value); err != nil || bits < 8 || bits > 15 {
+				return deflateParams{}, fmt.Errorf("%w: invalid server_max_window_bits %q", ErrBadHandshake, p.value)
+			}
+		default:
+			return deflateParams{}, fmt.Errorf("%w: unsupported permessage-deflate parameter %s", ErrBadHandshake, p.key)
+		}
+	}
+	return params, nil
+}
+
+// A flate.Writer carries over a megabyte of state, so writers are pooled per
+// compression level and Reset before each use. Readers are pooled as well,
+// the dictionary they start from is kept by the connection.
+var (
+	flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+	flateReaderPool  = sync.Pool{New: func() any { return flate.NewReader(nil) }}
+)
+
+func getFlateWriter(w io.Writer, level int) *flate.Writer {
+	if fw, ok := flateWriterPools[level-flate.HuffmanOnly].Get().(*flate.Writer); ok {
+		fw.Reset(w)
+		return fw
+	}
+	fw, _ := flate.NewWriter(w, level) // only fails for invalid levels
+	return fw
+}
+
+func putFlateWriter(fw *flate.Writer, level int) {
+	fw.Reset(nil) // don't keep the connection's buffer alive from the pool
+	flateWriterPools[level-flate.HuffmanOnly].Put(fw)
+}
+
+// deflateState is the compression state of one connection.
+// With context takeover the compressor and the decompressor's dictionary live
+// as long as the connection, otherwise a pooled writer is borrowed for every
+// message. Call release once the connection is done.
+type deflateState struct {
+	params deflateParams
+	level  int
+
+	buf bytes.Buffer  // compressed output of the message being written
+	fw  *flate.Writer // compressor of the current message, kept between messages under server context takeover
+
+	dict []byte // ends with the last 32KB the client's messages inflated to
+}
+
+func newDeflateState(params deflateParams) *deflateState {
+	return &deflateState{params: params, level: compressionLevel}
+}
+
+// release hands the connection's compressor back to the pool
+func (d *deflateState) release() {
+	if d.fw != nil {
+		putFlateWriter(d.fw, d.level)
+		d.fw = nil
+	}
+}
+
+// setLevel switches the compressor to level from the next message on. The
+// peer's decompressor keeps its window, a new compressor just doesn't refer
+// back to what the old one sent.
+func (d *deflateState) setLevel(level int) {
+	if level != d.level {
+		d.release()
+		d.level = level
+	}
+}
+
+// beginMessage readies the compressor for a new message, its output collects in d.buf
+func (d *deflateState) beginMessage() {
+	d.buf.Reset()
+	if d.fw == nil {
+		d.fw = getFlateWriter(&d.buf, d.level)
+	}
+}
+
+// write compresses part of the message. Whatever is in d.buf afterwards is
+// final and may be sent.
+func (d *deflateState) write(p []byte) error {
+	_, err := d.fw.Write(p)
+	return err
+}
+
+// endMessage returns the rest of the message's compressed data
+func (d *deflateState) endMessage() ([]byte, error) {
+	// Flush ends the data with a sync flush block (00 00 FF FF) which the peer adds back
+	err := d.fw.Flush()
+	if d.params.serverNoContextTakeover {
+		putFlateWriter(d.fw, d.level)
+		d.fw = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(d.buf.Bytes(), []byte(deflateTail)), nil
+}
+
+// compress deflates a whole message payload for a frame with RSV1 set
+func (d *deflateState) compress(payload []byte) ([]byte, error) {
+	d.beginMessage()
+	if err := d.write(payload); err != nil {
+		return nil, err
+	}
+	out, err := d.endMessage()
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(nil), out...), nil
+}
+
+// decompress inflates the payload of a compressed message.
+// The inflated size is bounded by limit (0 = unlimited) so a small
+// compressed message can't expand into gigabytes.
+func (d *deflateState) decompress(payload []byte, limit int) ([]byte, error) {
+	return io.ReadAll(d.inflater(bytes.NewReader(payload), limit))
+}
+
+// inflater inflates a compressed message read from src as it is read.
+// Errors wrap errInvalidPayload, or errMessageTooBig once the output exceeds
+// limit (0 = unlimited).
+func (d *deflateState) inflater(src io.Reader, limit int) io.Reader {
+	var dict []byte
+	if !d.params.clientNoContextTakeover {
+		dict = d.dict[max(0, len(d.dict)-deflateWindowSize):]
+	}
+	fr := flateReaderPool.Get().(io.ReadCloser)
+	if err := fr.(flate.Resetter).Reset(io.MultiReader(src, strings.NewReader(deflateTail+deflateFinalBlock)), dict); err != nil {
+		flateReaderPool.Put(fr)
+		return &inflateReader{err: err}
+	}
+	return &inflateReader{d: d, fr: fr, limit: limit}
+}
+
+// inflateReader is the reader returned by inflater
+type inflateReader struct {
+	d     *deflateState
+	fr    io.ReadCloser // nil once handed back to the pool
+	limit int
+	n     int // inflated so far
+	err   error
+}
+
+func (r *inflateReader) Read(p []byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	n, err := r.fr.Read(p)
+	r.n += n
+	if r.limit > 0 && r.n > r.limit {
+		err = fmt.Errorf("%w: inflated message exceeds the %d byte limit", errMessageTooBig, r.limit)
+		n = 0
+	} else if err != nil && err != io.EOF {
+		err = fmt.Errorf("%w: %v", errInvalidPayload, err)
+	}
+
+	// keep the end of the output as the window the next message may refer to,
+	// trimmed only once it doubled so small reads don't move 32KB every time
+	if !r.d.params.clientNoContextTakeover {
+		r.d.dict = append(r.d.dict, p[:n]...)
+		if len(r.d.dict) > 2*deflateWindowSize {
+			r.d.dict = append(r.d.dict[:0], r.d.dict[len(r.d.dict)-deflateWindowSize:]...)
+		}
+	}
+	if err != nil {
+		r.err = err
+		flateReaderPool.Put(r.fr)
+		r.fr = nil
+	}
+	return n, err
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// clientDeflate returns the compression state of the client side of a
+// connection that negotiated params: the client's compressor follows the
+// client_ parameters and its decompressor the server_ ones.
+func clientDeflate(params deflateParams) *deflateState {
+	return newDeflateState(deflateParams{
+		serverNoContextTakeover: params.clientNoContextTakeover,
+		clientNoContextTakeover: params.serverNoContextTakeover,
+	})
+}
+
+// wordySample is compressible text that doesn't collapse into a few bytes
+func wordySample(size int) string {
+	words := []string{"frame", "mask", "opcode", "payload", "close", "ping", "pong", "text",
+		"binary", "socket", "server", "client", "deflate", "window", "length", "handshake"}
+	rng := rand.New(rand.NewSource(1))
+	var sb strings.Builder
+	for sb.Len() < size {
+		sb.WriteString(words[rng.Intn(len(words))])
+		sb.WriteByte(' ')
+	}
+	return sb.String()
+}
+
+func TestDeflateRoundTrip(t *testing.T) {
+	for _, params := range []deflateParams{{}, {serverNoContextTakeover: true, clientNoContextTakeover: true}} {
+		server := newDeflateState(params)
+		client := clientDeflate(params)
+		for _, msg := range []string{"", "hello", wordySample(50 << 10), wordySample(50 << 10), "hello"} {
+			compressed, err := server.compress([]byte(msg))
+			if err != nil {
+				t.Fatalf("%s: compress: %v", params, err)
+			}
+			out, err := client.decompress(compressed, 0)
+			if err != nil {
+				t.Fatalf("%s: decompress: %v", params, err)
+			}
+			if string(out) != msg {
+				t.Fatalf("%s: round trip changed a %d byte message", params, len(msg))
+			}
+		}
+	}
+}
+
+func TestDecompressLimit(t *testing.T) {
+	// 1MB of zeros compresses to about a kilobyte
+	compressed, err := newDeflateState(deflateParams{}).compress(make([]byte, 1<<20))
+	if err != nil {
+		t.Fatalf("compress: %v", err)
+	}
+	if _, err := newDeflateState(deflateParams{}).decompress(compressed, 64<<10); !errors.Is(err, errMessageTooBig) {
+		t.Fatalf("expected message too big, got %v", err)
+	}
+	if _, err := newDeflateState(deflateParams{}).decompress([]byte{0xFF, 0xFF, 0xFF}, 0); !errors.Is(err, errInvalidPayload) {
+		t.Fatalf("expected invalid payload, got %v", err)
+	}
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	tests := []struct {
+		offer string
+		want  string // accepted response, "" when declined
+	}{
+		{"", ""},
+		{"x-webkit-deflate-frame", ""},
+		{"permessage-deflate", "permessage-deflate"},
+		{"permessage-deflate; client_max_window_bits", "permessage-deflate"},
+		{`permessage-deflate; client_max_window_bits="10"`, "permessage-deflate"},
+		{"permessage-deflate; server_max_window_bits=15", "permessage-deflate"},
+		{"permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			"permessage-deflate; server_no_context_takeover; client_no_context_takeover"},
+		{"Permessage-Deflate; Client_No_Context_Takeover", "permessage-deflate; client_no_context_takeover"},
+		// flate can't shrink its window
+		{"permessage-deflate; server_max_window_bits=8", ""},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate; client_no_context_takeover",
+			"permessage-deflate; client_no_context_takeover"},
+		{"permessage-deflate; server_max_window_bits", ""},
+		{"permessage-deflate; client_max_window_bits=16", ""},
+		{"permessage-deflate; server_no_context_takeover=1", ""},
+		{"permessage-deflate; server_no_context_takeover; server_no_context_takeover", ""},
+		{"permessage-deflate; unknown", ""},
+	}
+	for _, tt := range tests {
+		h := http.Header{}
+		if tt.offer != "" {
+			h.Set("Sec-WebSocket-Extensions", tt.offer)
+		}
+		params, ok := negotiateDeflate(h)
+		got := ""
+		if ok {
+			got = params.String()
+		}
+		if got != tt.want {
+			t.Fatalf("offer %q: got %q, want %q", tt.offer, got, tt.want)
+		}
+	}
+}
+
+func TestCompressedEcho(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		name     string
+		offer    string
+		params   deflateParams
+		takeover bool
+	}{
+		// the offer Chrome sends on every connection
+		{name: "context takeover", offer: "permessage-deflate; client_max_window_bits", takeover: true},
+		{name: "no context takeover", offer: "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			params: deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, reader, resp := handshake(t, addr, "/", http.Header{"Sec-WebSocket-Extensions": {tt.offer}})
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("unexpected status: %s", resp.Status)
+			}
+			if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != tt.params.String() {
+				t.Fatalf("expected %q to be accepted, got %q", tt.params.String(), ext)
+			}
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+			client := clientDeflate(tt.params)
+			msg := wordySample(20 << 10)
+			var wire []int
+			// the same message twice: with context takeover the second one is
+			// mostly a reference back into the first
+			for i := 0; i < 2; i++ {
+				compressed, err := client.compress([]byte(msg))
+				if err != nil {
+					t.Fatalf("compress: %v", err)
+				}
+				data := clientFrame(opText, compressed, true)
+				data[0] |= rsv1Bit
+				if _, err := conn.Write(data); err != nil {
+					t.Fatalf("failed to send frame: %v", err)
+				}
+
+				f := readFrameFrom(t, reader)
+				if !f.Rsv1 || f.Opcode != opText {
+					t.Fatalf("expected a compressed text frame, got opcode=%d rsv1=%t", f.Opcode, f.Rsv1)
+				}
+				if len(f.Payload) >= len(msg) {
+					t.Fatalf("expected fewer bytes on the wire than %d, got %d", len(msg), len(f.Payload))
+				}
+				out, err := client.decompress(f.Payload, 0)
+				if err != nil {
+					t.Fatalf("failed to inflate the echo: %v", err)
+				}
+				if string(out) != msg {
+					t.Fatalf("echo doesn't match the %d byte message", len(msg))
+				}
+				wire = append(wire, len(f.Payload))
+			}
+
+			if tt.takeover && wire[1] > wire[0]/2 {
+				t.Fatalf("expected the second echo to reuse the window, sizes %v", wire)
+			}
+			if !tt.takeover && wire[1] != wire[0] {
+				t.Fatalf("expected every echo to be compressed on its own, sizes %v", wire)
+			}
+		})
+	}
+}
+
+func TestDeclinedDeflateOffer(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	_, _, resp := handshake(t, addr, "/", http.Header{"Sec-WebSocket-Extensions": {"permessage-deflate; server_max_window_bits=8"}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the upgrade to succeed without the extension, got %s", resp.Status)
+	}
+	if ext := resp.Header.Get("Sec-WebSocket-Extensions"); ext != "" {
+		t.Fatalf("expected the extension to be declined, got %q", ext)
+	}
+}
+
+func TestRsv1WithoutCompressionIsProtocolError(t *testing.T) {
+	conn, reader := pipeConnection(t, DefaultConfig())
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	data := clientFrame(opText, []byte("hello"), true)
+	data[0] |= rsv1Bit
+	if _, err := conn.Write(data); err != nil {
+		t.Fatalf("failed to send frame: %v", err)
+	}
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseProtocolError {
+		t.Fatalf("expected close 1002, got opcode=%d code=%d", f.Opcode, code)
+	}
+}
+
+func TestPooledDeflateInterleaved(t *testing.T) {
+	// two connections borrowing from the same pools, one of them keeping its
+	// context: neither may see the other's window
+	paramsA := deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true}
+	paramsB := deflateParams{}
+	serverA, clientA := newDeflateState(paramsA), clientDeflate(paramsA)
+	serverB, clientB := newDeflateState(paramsB), clientDeflate(paramsB)
+	defer serverA.release()
+	defer serverB.release()
+
+	msgA, msgB := wordySample(8<<10), strings.Repeat("websocket ", 1000)
+	for i := 0; i < 5; i++ {
+		for _, c := range []struct {
+			server, client *deflateState
+			msg            string
+		}{{serverA, clientA, msgA}, {serverB, clientB, msgB}} {
+			// server to client
+			compressed, err := c.server.compress([]byte(c.msg))
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			out, err := c.client.decompress(compressed, 0)
+			if err != nil || string(out) != c.msg {
+				t.Fatalf("round %d: server to client round trip failed: %v", i, err)
+			}
+			// client to server
+			compressed, err = c.client.compress([]byte(c.msg))
+			if err != nil {
+				t.Fatalf("compress: %v", err)
+			}
+			out, err = c.server.decompress(compressed, 0)
+			if err != nil || string(out) != c.msg {
+				t.Fatalf("round %d: client to server round trip failed: %v", i, err)
+			}
+		}
+	}
+}
+
+func TestWriteCompressionToggle(t *testing.T) {
+	params := deflateParams{}
+	client, srv := net.Pipe()
+	c := newConn(context.Background(), srv, bufio.NewReader(srv), DefaultConfig(), connInfo{path: "/", deflate: &params})
+	t.Cleanup(func() {
+		client.Close()
+		c.close()
+	})
+	reader, peer := bufio.NewReader(client), clientDeflate(params)
+
+	if err := c.SetCompressionLevel(42); err == nil {
+		t.Fatal("expected an invalid level to be refused")
+	}
+	msg := wordySample(4 << 10)
+	steps := []struct {
+		compress bool
+		level    int
+	}{{true, flate.BestSpeed}, {false, flate.BestSpeed}, {true, flate.BestCompression}, {false, flate.BestCompression}, {true, flate.HuffmanOnly}}
+	for i, step := range steps {
+		c.EnableWriteCompression(step.compress)
+		if err := c.SetCompressionLevel(step.level); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+		go func() {
+			if i%2 == 0 {
+				c.WriteMessage(TextMessage, []byte(msg))
+			} else {
+				w, _ := c.NextWriter(TextMessage)
+				io.WriteString(w, msg)
+				w.Close()
+			}
+		}()
+		f := readFrameFrom(t, reader)
+		if f.Rsv1 != step.compress {
+			t.Fatalf("step %d: expected RSV1=%v", i, step.compress)
+		}
+		payload := f.Payload
+		if f.Rsv1 {
+			// the peer keeps one window across the compressed messages
+			var err error
+			if payload, err = peer.decompress(f.Payload, 0); err != nil {
+				t.Fatalf("step %d: decompress: %v", i, err)
+			}
+		}
+		if string(payload) != msg {
+			t.Fatalf("step %d: the peer decoded %d bytes", i, len(payload))
+		}
+	}
+}
+
+func TestEnableWriteCompressionWithoutDeflate(t *testing.T) {
+	c, _, reader := pipeConn(t, DefaultConfig())
+	c.EnableWriteCompression(true)
+	go c.WriteMessage(TextMessage, []byte("hello"))
+	if f := readFrameFrom(t, reader); f.Rsv1 || string(f.Payload) != "hello" {
+		t.Fatalf("expected an uncompressed frame, got RSV1=%v %q", f.Rsv1, f.Payload)
+	}
+}
+
+// BenchmarkCompressedEcho compares inflating and deflating an echo with
+// freshly allocated flate state against the pooled state of a connection
+func BenchmarkCompressedEcho(b *testing.B) {
+	msg := []byte(wordySample(4 << 10))
+	params := deflateParams{serverNoContextTakeover: true, clientNoContextTakeover: true}
+	compressed, err := clientDeflate(params).compress(msg)
+	if err != nil {
+		b.Fatalf("compress: %v", err)
+	}
+
+	b.Run("fresh", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			fr := flate.NewReader(io.MultiReader(bytes.NewReader(compressed), strings.NewReader(deflateTail+deflateFinalBlock)))
+			out, err := io.ReadAll(fr)
+			if err != nil {
+				b.Fatalf("inflate: %v", err)
+			}
+			var buf bytes.Buffer
+			fw, _ := flate.NewWriter(&buf, compressionLevel)
+			fw.Write(out)
+			fw.Flush()
+		}
+	})
+	b.Run("pooled", func(b *testing.B) {
+		d := newDeflateState(params)
+		defer d.release()
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			out, err := d.decompress(compressed, 0)
+			if err != nil {
+				b.Fatalf("inflate: %v", err)
+			}
+			if _, err := d.compress(out); err != nil {
+				b.Fatalf("deflate: %v", err)
+			}
+		}
+	})
+}
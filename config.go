@@ -0,0 +1,493 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Config holds the server settings.
+// The zero value disables every limit and timeout, DefaultConfig returns the
+// values the server runs with in main. Settings that can't work, e.g. a
+// negative size, make startServer and NewUpgrader fail.
+type Config struct {
+	// CloseTimeout is how long we wait for the peer to answer our CLOSE frame
+	// before dropping the TCP connection. Zero drops it right after sending.
+	CloseTimeout time.Duration
+
+	// DrainTimeout is how long main waits, once SIGINT or SIGTERM arrived,
+	// for the connections to finish their closing handshakes before dropping
+	// them. A second signal drops them right away. Zero waits for as long as
+	// it takes.
+	DrainTimeout time.Duration
+
+	// PingInterval is how often the server pings the peer to keep the
+	// connection alive and measure the round-trip time. Zero disables pings.
+	PingInterval time.Duration
+
+	// MaxFrameSize is the largest payload a single frame may declare, bigger
+	// frames are answered with CLOSE 1009 before any payload is buffered.
+	// Zero means unlimited.
+	MaxFrameSize int
+
+	// MaxMessageSize is the largest message that may be reassembled from
+	// fragments, checked as every fragment arrives. Zero means unlimited.
+	MaxMessageSize int
+
+	// ReadBufferSize is how many bytes a connection reads from the socket at
+	// once. Zero uses 4KB.
+	ReadBufferSize int
+
+	// MaxReadBufferSize makes the read buffer adapt to the traffic: it
+	// doubles up to MaxReadBufferSize while reads keep filling it and halves
+	// back down to ReadBufferSize after a long run of small reads. Zero keeps
+	// it at ReadBufferSize.
+	MaxReadBufferSize int
+
+	// ReassemblyBufferSize is the capacity ReadMessage's reassembly buffer
+	// may keep from one message to the next. A bigger message grows it up to
+	// the read limit, afterwards it is dropped. Zero uses 64KB.
+	ReassemblyBufferSize int
+
+	// DisableReadBufferPool gives every connection a read buffer of its own
+	// for its whole life instead of taking one from a shared pool while data
+	// arrives, for debugging.
+	DisableReadBufferPool bool
+
+	// InPlaceReads makes ReadMessage return messages without copying them:
+	// a message that arrived whole in one read points into the read buffer,
+	// a fragmented one into the reassembly buffer. Either is only
+	// valid until the next read on the connection, for a Handler until it
+	// returns, data kept longer must be copied. It can't be combined with
+	// WorkerPoolSize, whose Handlers run while the reader moves on.
+	InPlaceReads bool
+
+	// FragmentSize is the largest frame payload a message written through
+	// NextWriter, or WriteReader without a size, is split into, Writes are
+	// buffered until a fragment is full. Zero sends every Write as a frame
+	// of its own. It doesn't apply to WriteMessage, see WriteFragmentSize.
+	FragmentSize int
+
+	// WriteFragmentSize splits a WriteMessage payload bigger than it into
+	// frames of at most that many bytes, written one after the other, so a
+	// large message is never encoded in one piece. WriteReader with a size
+	// over it is split the same way. Control frames are never split. Zero
+	// sends every message as a single frame. It doesn't apply to NextWriter,
+	// see FragmentSize.
+	WriteFragmentSize int
+
+	// WriteBufferSize makes the frames of a connection collect in a buffer of
+	// that many bytes instead of going to the socket one by one, so a burst
+	// of small messages takes a single write. The buffer is written when it
+	// fills, by Conn.Flush, WriteBufferDelay after a frame went into it, and
+	// along with every control frame. Without a delay frames wait for one of
+	// the others. Zero writes every frame right away.
+	WriteBufferSize  int
+	WriteBufferDelay time.Duration
+
+	// SendQueueSize is how many messages Conn.Send may queue, zero uses 64.
+	// SendOverflow decides what happens when the queue is full, by default
+	// Send waits for room, at most SendTimeout when that isn't zero.
+	SendQueueSize int
+	SendOverflow  OverflowPolicy
+	SendTimeout   time.Duration
+
+	// SlowClientTimeout is how long a write may be stuck on a peer that
+	// doesn't read, or the send queue stay above SlowClientHighWater
+	// messages (zero is half of SendQueueSize), before SlowClientPolicy
+	// applies: SlowBlock keeps waiting, SlowDrop drops data messages until
+	// the peer reads again, SlowClose closes the connection with 1008. Zero
+	// disables it.
+	SlowClientTimeout   time.Duration
+	SlowClientHighWater int
+	SlowClientPolicy    SlowPolicy
+
+	// MemoryBudget caps the bytes all connections of a server hold together:
+	// messages being reassembled, frames read but not dispatched yet and
+	// messages queued by Conn.Send. A connection that needs more while the
+	// budget is spent meets MemoryBudgetPolicy: BudgetClose closes the
+	// connection holding the most with 1013, BudgetPause makes the reader
+	// wait until memory is given back and drops what Send is asked to
+	// queue. Either way the connection holding the most is closed when it
+	// asks for more itself. Zero disables it.
+	MemoryBudget       int64
+	MemoryBudgetPolicy BudgetPolicy
+
+	// Metrics counts handshakes, connections, messages, bytes and close
+	// codes, serve it on a path of Mux for Prometheus. Nil counts nothing.
+	Metrics *Metrics
+
+	// Expvar publishes the counts of Metrics with the standard library's
+	// expvar under "websocket", adding up every server that sets it, and
+	// serves them at /debug/vars on Mux. Without Metrics the server counts
+	// in one of its own.
+	Expvar bool
+
+	// Logger receives the log lines of the server and its connections, nil
+	// uses slog.Default(). Messages are only logged at debug level, at most
+	// LogPayloadSize bytes of a text message, zero is 64.
+	Logger         *slog.Logger
+	LogPayloadSize int
+
+	// AdminPath serves an admin API on Mux: GET AdminPath lists the live
+	// connections as JSON, DELETE AdminPath/{id} closes one with
+	// AdminCloseCode, zero is 1008. With AdminSecret set every request must
+	// carry it in an X-Admin-Secret header. Empty disables it.
+	AdminPath      string
+	AdminSecret    string
+	AdminCloseCode uint16
+
+	// HealthPath and ReadyPath serve probes on Mux that need no upgrade,
+	// answering with JSON of the uptime and the live connections. HealthPath
+	// answers 200 while the server runs, ReadyPath 503 once Shutdown began or
+	// while MaxConnections are in use. DefaultConfig serves them at /healthz
+	// and /readyz, empty disables them.
+	HealthPath string
+	ReadyPath  string
+
+	// WorkerPoolSize runs Handlers on that many goroutines shared by the
+	// connections of a server instead of on every connection's reader, which
+	// keeps answering pings while its handler is busy. The messages of a
+	// connection are still handled one at a time in the order they arrived.
+	// WorkerQueueSize of them may wait for a worker, zero uses 64.
+	// WorkerOverflow decides what a reader does when the queue is full:
+	// OverflowBlock waits for room, OverflowClose closes its connection with
+	// 1013. Zero runs Handlers on the reader.
+	WorkerPoolSize  int
+	WorkerQueueSize int
+	WorkerOverflow  OverflowPolicy
+
+	// ParkIdleConnections gives the connections served by a Handler to an
+	// epoll or kqueue poller between messages instead of keeping a goroutine
+	// blocked on every one, and pings them from a timer. A reader goroutine
+	// is only started once data arrives and ends when the connection is
+	// idle again, which saves the stacks of many mostly idle connections. A
+	// ConnHandler owns its goroutine, TLS and HTTP/2 connections keep theirs
+	// too. Only on Linux, macOS and the BSDs.
+	ParkIdleConnections bool
+
+	// AcceptBinaryJSON lets ReadJSON decode binary messages too, by default
+	// only text messages may carry JSON
+	AcceptBinaryJSON bool
+
+	// FrameTimeout is how long a partially received frame may wait for its
+	// remaining bytes before the connection is closed with 1008. Idle
+	// connections without a pending frame are not affected. Zero disables it.
+	FrameTimeout time.Duration
+
+	// WriteTimeout bounds every frame write, a peer that stops reading can't
+	// block the connection forever. Zero disables it.
+	WriteTimeout time.Duration
+
+	// CloseOnCancel makes a cancelled ReadMessageContext or
+	// WriteMessageContext drop the connection right away. By default the
+	// cancellation interrupts the call through a deadline, and a read that
+	// hadn't started on a message leaves the connection usable.
+	CloseOnCancel bool
+
+	// MaxConnections caps the number of live WebSocket connections, further
+	// handshakes get 503 with Retry-After. Upgrader.Connections reports how
+	// many are in use. Zero means unlimited.
+	MaxConnections int
+
+	// HandshakeRate limits the upgrade attempts of every client IP per second,
+	// HandshakeBurst of them may come at once. Attempts over the limit get 429
+	// with Retry-After. Zero disables the limit.
+	HandshakeRate  float64
+	HandshakeBurst int
+
+	// MessageRate limits the data messages a connection reads per second,
+	// MessageBurst of them may come at once. MessageRatePolicy decides what
+	// happens to a message over the limit, by default reading waits for it.
+	// Control frames don't count, keepalive keeps working. Zero disables the
+	// limit.
+	MessageRate       float64
+	MessageBurst      int
+	MessageRatePolicy RatePolicy
+
+	// Socket tunes the TCP connection under every WebSocket, by default only
+	// TCP_NODELAY is set
+	Socket SocketOptions
+
+	// ClientIP returns the address a request is rate limited by, by default
+	// the remote address of the connection
+	ClientIP func(r *http.Request) string
+
+	// HandshakeTimeout bounds the opening handshake: reading the request
+	// headers and writing the 101 response. Zero disables it.
+	HandshakeTimeout time.Duration
+
+	// StrictFrameLengths fails the connection with 1002 when a frame encodes
+	// its payload length in a longer form than necessary, e.g. 5 bytes using
+	// the 16-bit extended length. Off by default for compatibility.
+	StrictFrameLengths bool
+
+	// AllowedHosts lists the host names the handshake may be addressed to,
+	// compared case-insensitively with the Host header. An entry without a port
+	// matches any port, IPv6 literals may be written with or without brackets.
+	// A mismatch is refused with 403, an empty list allows any host.
+	AllowedHosts []string
+
+	// CheckOrigin decides whether the upgrade request may proceed, it gets the
+	// full request so it can also look at cookies or other headers. Returning
+	// false refuses the handshake with 403. When nil, requests without an
+	// Origin header (non-browser clients) and same-origin requests are allowed.
+	CheckOrigin func(r *http.Request) bool
+
+	// EnableCompression negotiates permessage-deflate with clients that offer it
+	EnableCompression bool
+
+	// Subprotocols are the application protocols spoken over the connection,
+	// most preferred first. A server selects the first one the client offers
+	// in Sec-WebSocket-Protocol, a client offers all of them. See
+	// Conn.Subprotocol.
+	Subprotocols []string
+
+	// Authorize runs after the handshake headers were validated and before the
+	// connection is taken over, it can look at the query, Authorization header
+	// or cookies. A status outside 2xx refuses the upgrade with that status and
+	// err's text as the body (the status text when err is nil), an error
+	// without a status is a 403. Otherwise the returned identity is kept with
+	// the connection, and so is whatever it stored with SetHandshakeValue.
+	Authorize func(r *http.Request) (identity interface{}, status int, err error)
+
+	// CertFile and KeyFile name a PEM certificate and key to serve wss:// with,
+	// they are added to TLSConfig's certificates when both are set
+	CertFile string
+	KeyFile  string
+
+	// TLSConfig serves wss:// with this configuration. For mutual TLS set
+	// ClientAuth to tls.RequireAndVerifyClientCert and ClientCAs, connections
+	// without a valid client certificate then fail the TLS handshake.
+	TLSConfig *tls.Config
+
+	// VerifyClientCert can refuse a verified client certificate during the
+	// opening handshake, e.g. one that was revoked. An error refuses the
+	// upgrade with 403.
+	VerifyClientCert func(cert *x509.Certificate) error
+
+	// EnableHTTP2 also serves HTTP/2 without TLS (h2c), where WebSockets are
+	// opened with an extended CONNECT (RFC 8441). Go only offers extended
+	// CONNECT when the process runs with GODEBUG=http2xconnect=1.
+	EnableHTTP2 bool
+
+	// ResponseHeader returns extra headers for the 101 response, e.g. a
+	// Set-Cookie for session affinity or an X-Request-Id. Headers the upgrade
+	// itself depends on (Upgrade, Connection, Sec-WebSocket-Accept, ...) are dropped.
+	ResponseHeader func(r *http.Request) http.Header
+
+	// OnHandshake is called once for every upgrade attempt, whether it
+	// succeeded or was refused, e.g. for an access log. HandshakeLogger
+	// writes one through a slog.Logger.
+	OnHandshake func(HandshakeInfo)
+
+	// OnConnect is called with every connection the server's handlers serve,
+	// right after the 101 was sent and before the first message is read.
+	// Returning an error closes the connection the way a Handler error does.
+	OnConnect func(c *Conn) error
+
+	// OnDisconnect is called exactly once for every connection OnConnect saw,
+	// when its read loop ends, also when a handler panicked. err is why: a
+	// *CloseError with the peer's code or the one we closed with (1006 when
+	// the peer went away without a CLOSE), or the read error of a connection
+	// that failed.
+	OnDisconnect func(c *Conn, err error)
+
+	// OnError is called at most once for a connection OnConnect saw, before
+	// OnDisconnect, when it ends because something failed: a protocol
+	// violation or a message over the limit (a *CloseError whose cause
+	// errors.Is can look for, e.g. wire.ErrProtocol), the peer vanishing
+	// without a CLOSE (a *CloseError with 1006), a read or write error of
+	// the socket (usually a net.Error) or a panicking handler. Closing
+	// handshakes either side started on purpose don't count.
+	OnError func(c *Conn, err error)
+
+	// Handlers maps URL paths (http.ServeMux patterns) to the handler serving
+	// WebSocket connections upgraded there, other paths get 404. When empty,
+	// ConnHandler serves every path.
+	Handlers map[string]Handler
+
+	// ConnHandler serves the connections of every path when there are no
+	// Handlers, nil uses EchoHandler. It can't be combined with Broadcast
+	// or Room.
+	ConnHandler ConnHandler
+
+	// Middleware wraps every Handler, the default ones included, the first
+	// entry outermost: it sees each message first and decides whether the
+	// next one does. A ConnHandler that isn't a Handler reads its messages
+	// itself and isn't wrapped. See Middleware.
+	Middleware []Middleware
+
+	// Broadcast makes the default handler relay every message to all other
+	// connections instead of echoing it, see Hub. It can't be combined with
+	// Handlers.
+	Broadcast bool
+
+	// Room makes the default handler relay every message to the other
+	// connections in the same room only. Each connection joins the room Room
+	// returns for its upgrade request, e.g. RoomFromPath or RoomFromQuery.
+	// It can't be combined with Handlers or Broadcast.
+	Room func(r *http.Request) string
+
+	// Mux serves everything that isn't a WebSocket path, e.g. a landing page or
+	// a status endpoint. The Handlers are registered on it, so their paths must
+	// be free. When nil the server only speaks WebSocket.
+	Mux *http.ServeMux
+
+	// afterFunc schedules the frame timeout, tests replace it to fire by hand
+	afterFunc func(d time.Duration, f func()) timer
+
+	// onUpgrade sees every connection right after its 101 was sent, for tests
+	onUpgrade func(info connInfo)
+}
+
+// timer is the part of *time.Timer the frame timeout needs
+type timer interface {
+	Stop() bool
+}
+
+// DefaultConfig returns sensible settings for a public facing server
+func DefaultConfig() Config {
+	return Config{
+		CloseTimeout:     5 * time.Second,
+		DrainTimeout:     30 * time.Second,
+		PingInterval:     30 * time.Second,
+		MaxFrameSize:     1 << 20,  // 1MB
+		MaxMessageSize:   4 << 20,  // 4MB
+		FragmentSize:     32 << 10, // 32KB
+		FrameTimeout:     30 * time.Second,
+		WriteTimeout:     10 * time.Second,
+		HandshakeTimeout: 10 * time.Second,
+		HandshakeRate:    10,
+		HandshakeBurst:   20,
+		HealthPath:       "/healthz",
+		ReadyPath:        "/readyz",
+
+		EnableCompression: true,
+	}
+}
+
+// validate refuses settings that can't work, before anything was started
+func (cfg Config) validate() error {
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"CloseTimeout", cfg.CloseTimeout},
+		{"DrainTimeout", cfg.DrainTimeout},
+		{"PingInterval", cfg.PingInterval},
+		{"FrameTimeout", cfg.FrameTimeout},
+		{"WriteTimeout", cfg.WriteTimeout},
+		{"SendTimeout", cfg.SendTimeout},
+		{"SlowClientTimeout", cfg.SlowClientTimeout},
+		{"WriteBufferDelay", cfg.WriteBufferDelay},
+		{"HandshakeTimeout", cfg.HandshakeTimeout},
+	} {
+		if d.value < 0 {
+			return fmt.Errorf("websocket: %s is negative, use zero to disable it", d.name)
+		}
+	}
+	for _, n := range []struct {
+		name  string
+		value int
+	}{
+		{"MaxFrameSize", cfg.MaxFrameSize},
+		{"MaxMessageSize", cfg.MaxMessageSize},
+		{"ReadBufferSize", cfg.ReadBufferSize},
+		{"MaxReadBufferSize", cfg.MaxReadBufferSize},
+		{"ReassemblyBufferSize", cfg.ReassemblyBufferSize},
+		{"FragmentSize", cfg.FragmentSize},
+		{"WriteFragmentSize", cfg.WriteFragmentSize},
+		{"WriteBufferSize", cfg.WriteBufferSize},
+		{"SendQueueSize", cfg.SendQueueSize},
+		{"SlowClientHighWater", cfg.SlowClientHighWater},
+		{"WorkerPoolSize", cfg.WorkerPoolSize},
+		{"WorkerQueueSize", cfg.WorkerQueueSize},
+		{"MaxConnections", cfg.MaxConnections},
+		{"HandshakeBurst", cfg.HandshakeBurst},
+		{"MessageBurst", cfg.MessageBurst},
+		{"LogPayloadSize", cfg.LogPayloadSize},
+	} {
+		if n.value < 0 {
+			return fmt.Errorf("websocket: %s is negative", n.name)
+		}
+	}
+	readSize := cfg.ReadBufferSize
+	if readSize == 0 {
+		readSize = readBufferSize
+	}
+	if cfg.MaxReadBufferSize > 0 && cfg.MaxReadBufferSize < readSize {
+		return fmt.Errorf("websocket: MaxReadBufferSize is smaller than the read buffer of %d bytes", readSize)
+	}
+	if cfg.HandshakeRate < 0 {
+		return errors.New("websocket: HandshakeRate is negative, use zero to disable it")
+	}
+	if cfg.WorkerOverflow != OverflowBlock && cfg.WorkerOverflow != OverflowClose {
+		return fmt.Errorf("websocket: WorkerOverflow %d isn't OverflowBlock or OverflowClose", cfg.WorkerOverflow)
+	}
+	if cfg.InPlaceReads && cfg.WorkerPoolSize > 0 {
+		return errors.New("websocket: InPlaceReads can't be combined with WorkerPoolSize, queued messages would be overwritten")
+	}
+	if cfg.ParkIdleConnections && !pollSupported {
+		return errors.New("websocket: ParkIdleConnections isn't supported on " + runtime.GOOS)
+	}
+	if cfg.MessageRate < 0 {
+		return errors.New("websocket: MessageRate is negative, use zero to disable it")
+	}
+	if cfg.MessageRatePolicy < RateDelay || cfg.MessageRatePolicy > RateClose {
+		return fmt.Errorf("websocket: unknown MessageRatePolicy %d", cfg.MessageRatePolicy)
+	}
+	if cfg.SendOverflow < OverflowBlock || cfg.SendOverflow > OverflowClose {
+		return fmt.Errorf("websocket: unknown SendOverflow %d", cfg.SendOverflow)
+	}
+	if cfg.SlowClientPolicy < SlowBlock || cfg.SlowClientPolicy > SlowClose {
+		return fmt.Errorf("websocket: unknown SlowClientPolicy %d", cfg.SlowClientPolicy)
+	}
+	if cfg.AdminPath != "" && (!strings.HasPrefix(cfg.AdminPath, "/") || strings.HasSuffix(cfg.AdminPath, "/")) {
+		return fmt.Errorf("websocket: AdminPath %q must start and must not end with a slash", cfg.AdminPath)
+	}
+	for _, p := range []struct{ name, value string }{
+		{"HealthPath", cfg.HealthPath},
+		{"ReadyPath", cfg.ReadyPath},
+	} {
+		if p.value != "" && !strings.HasPrefix(p.value, "/") {
+			return fmt.Errorf("websocket: %s %q must start with a slash", p.name, p.value)
+		}
+	}
+	if cfg.AdminCloseCode != 0 && !validCloseCode(int(cfg.AdminCloseCode)) {
+		return fmt.Errorf("websocket: AdminCloseCode %d must not be sent", cfg.AdminCloseCode)
+	}
+	if cfg.MemoryBudget < 0 {
+		return errors.New("websocket: MemoryBudget is negative, use zero to disable it")
+	}
+	if cfg.MemoryBudgetPolicy < BudgetClose || cfg.MemoryBudgetPolicy > BudgetPause {
+		return fmt.Errorf("websocket: unknown MemoryBudgetPolicy %d", cfg.MemoryBudgetPolicy)
+	}
+	if (cfg.CertFile == "") != (cfg.KeyFile == "") {
+		return errors.New("websocket: CertFile and KeyFile must be set together")
+	}
+	if (cfg.Broadcast || cfg.Room != nil) && len(cfg.Handlers) > 0 {
+		return errors.New("websocket: Broadcast and Room replace the default handler, they can't be combined with Handlers")
+	}
+	if (cfg.Broadcast || cfg.Room != nil) && cfg.ConnHandler != nil {
+		return errors.New("websocket: Broadcast and Room replace the default handler, they can't be combined with ConnHandler")
+	}
+	if cfg.Broadcast && cfg.Room != nil {
+		return errors.New("websocket: Broadcast and Room can't be combined")
+	}
+	return nil
+}
+
+// logger returns Logger, or slog.Default() without one
+func (cfg Config) logger() *slog.Logger {
+	if cfg.Logger != nil {
+		return cfg.Logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfigValidation(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		want   string // part of the error, empty when cfg is fine
+	}{
+		{"defaults", func(cfg *Config) {}, ""},
+		{"zero value", func(cfg *Config) { *cfg = Config{} }, ""},
+		{"negative timeout", func(cfg *Config) { cfg.WriteTimeout = -time.Second }, "WriteTimeout"},
+		{"negative size", func(cfg *Config) { cfg.MaxMessageSize = -1 }, "MaxMessageSize"},
+		{"negative buffer", func(cfg *Config) { cfg.ReadBufferSize = -4096 }, "ReadBufferSize"},
+		{"negative rate", func(cfg *Config) { cfg.HandshakeRate = -1 }, "HandshakeRate"},
+		{"dropping worker overflow", func(cfg *Config) {
+			cfg.WorkerPoolSize = 4
+			cfg.WorkerOverflow = OverflowDropOldest
+		}, "WorkerOverflow"},
+		{"cert without key", func(cfg *Config) { cfg.CertFile = "cert.pem" }, "KeyFile"},
+		{"broadcast with handlers", func(cfg *Config) {
+			cfg.Broadcast = true
+			cfg.Handlers = map[string]Handler{"/": EchoHandler}
+		}, "Handlers"},
+		{"rooms with a conn handler", func(cfg *Config) {
+			cfg.Room = RoomFromPath
+			cfg.ConnHandler = EchoHandler
+		}, "ConnHandler"},
+		{"broadcast and rooms", func(cfg *Config) {
+			cfg.Broadcast = true
+			cfg.Room = RoomFromPath
+		}, "Room"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.change(&cfg)
+
+			_, uerr := NewUpgrader(cfg)
+			server, _, serr := startServer("127.0.0.1:0", cfg)
+			if server != nil {
+				server.Close()
+			}
+			for _, err := range []error{uerr, serr} {
+				if tt.want == "" && err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+					t.Fatalf("expected an error about %s, got %v", tt.want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigTakesEffect(t *testing.T) {
+	large := bytes.Repeat([]byte("x"), 10000)
+	tests := []struct {
+		name   string
+		change func(cfg *Config)
+		run    func(t *testing.T, addr string)
+	}{
+		{"small read buffer", func(cfg *Config) { cfg.ReadBufferSize = 16 }, func(t *testing.T, addr string) {
+			conn, reader := dialWebSocket(t, addr, "/")
+			conn.Write(clientFrame(opBin, large, true))
+			if f := readFrameFrom(t, reader); !bytes.Equal(f.Payload, large) {
+				t.Fatalf("echo of %d bytes came back as %d", len(large), len(f.Payload))
+			}
+		}},
+		{"message limit", func(cfg *Config) { cfg.MaxMessageSize = 1000 }, func(t *testing.T, addr string) {
+			conn, reader := dialWebSocket(t, addr, "/")
+			conn.Write(clientFrame(opBin, large, true))
+			f := readFrameFrom(t, reader)
+			if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseMessageTooBig {
+				t.Fatalf("expected CLOSE 1009, got opcode %d code %d", f.Opcode, code)
+			}
+		}},
+		{"origin check and handler", func(cfg *Config) {
+			cfg.CheckOrigin = func(r *http.Request) bool { return r.Header.Get("Origin") == "https://app.example" }
+			cfg.Handlers = map[string]Handler{"/upper": func(c *Conn, messageType int, data []byte) error {
+				return c.WriteMessage(messageType, bytes.ToUpper(data))
+			}}
+		}, func(t *testing.T, addr string) {
+			if _, _, resp := handshake(t, addr, "/upper", http.Header{"Origin": {"https://evil.example"}}); resp.StatusCode != http.StatusForbidden {
+				t.Fatalf("expected 403 for a foreign origin, got %s", resp.Status)
+			}
+			conn, reader, resp := handshake(t, addr, "/upper", http.Header{"Origin": {"https://app.example"}})
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("expected the upgrade, got %s", resp.Status)
+			}
+			conn.Write(clientFrame(opText, []byte("shout"), true))
+			if f := readFrameFrom(t, reader); string(f.Payload) != "SHOUT" {
+				t.Fatalf("expected SHOUT, got %q", f.Payload)
+			}
+		}},
+		{"connection limit", func(cfg *Config) { cfg.MaxConnections = 1 }, func(t *testing.T, addr string) {
+			dialWebSocket(t, addr, "/")
+			if _, _, resp := handshake(t, addr, "/", nil); resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("expected 503 over the limit, got %s", resp.Status)
+			}
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			tt.change(&cfg)
+			server, addr, err := startServer("127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatalf("failed to start server: %v", err)
+			}
+			defer server.Close()
+			tt.run(t, addr)
+		})
+	}
+}
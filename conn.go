@@ -0,0 +1,1789 @@
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gows/wire"
+)
+
+var (
+	// ErrConnClosed is matched by the errors of writes after the connection
+	// was closed, by either side
+	ErrConnClosed = errors.New("websocket: connection closed")
+
+	// ErrCloseSent is returned by writes after our CLOSE frame went out,
+	// it matches ErrConnClosed
+	ErrCloseSent = fmt.Errorf("%w: close sent", ErrConnClosed)
+
+	// ErrReadInterrupted is returned by the reads after a ReadMessageContext
+	// was cancelled half way through a message, the connection is dropped
+	ErrReadInterrupted = errors.New("websocket: a cancelled read left a message half read")
+
+	errStaleReader   = errors.New("websocket: read from a message after NextReader was called again")
+	errWriterClosed  = errors.New("websocket: write to a closed message writer")
+	errReadCancelled = errors.New("websocket: read cancelled")
+)
+
+// Conn is an upgraded WebSocket connection.
+// ReadMessage returns one complete data message at a time: it reassembles
+// fragments, inflates compressed messages, answers pings and takes part in
+// the closing handshake while it reads. WriteMessage sends a single-frame
+// message. NextReader and NextWriter stream a message instead of holding it
+// in memory. Reads must come from one goroutine, writes may come from any.
+// The connection is closed once reading returns an error.
+type Conn struct {
+	ctx    context.Context
+	id     uint64
+	conn   transport
+	reader *bufio.Reader
+	cfg    Config
+	info   connInfo
+	logger *slog.Logger
+
+	// state tracks the closing handshake. Once we sent our CLOSE frame we only
+	// wait for the peer's CLOSE (or CloseTimeout) before dropping the connection.
+	// clean records whether both sides exchanged CLOSE frames.
+	state int
+	clean bool
+
+	buffer        *[]byte       // what a single Read fills, from the pool and nil while idle, see read
+	bufferSize    int           // the size of the next buffer, see adaptBuffer
+	minBufferSize int           // Config.ReadBufferSize, an adaptive buffer doesn't shrink below it
+	fullReads     int           // reads in a row that filled the buffer
+	smallReads    int           // reads in a row that used at most a quarter of it
+	decoder       *wire.Decoder // holds the frames not dispatched yet and a partial one
+	readErr       error         // error of the last Read, handled once its frames are dispatched
+
+	readOpts wire.ParseOptions // the decoder's options, read parses in place with them
+	parsed   []frame           // frames parsed in place, dispatched before the decoder's, see Config.InPlaceReads
+	lent     bool              // payloads handed out point into the buffer, it can't be reused yet
+
+	reassembly    []byte // ReadMessage assembles messages here, see reassemble
+	reassemblyMax int    // the capacity reassembly may keep, see Config.ReassemblyBufferSize
+
+	messageLimiter *messageLimiter // nil without Config.MessageRate
+	pool           *workerPool     // runs the Handler of c, nil to run it on the reader
+	inbox          *inbox          // the messages of c waiting for pool, see Handler.serve
+
+	poller netpoller   // parks c between messages, nil to keep its reader, see Config.ParkIdleConnections
+	parked atomic.Bool // c is waiting in poller, no goroutine reads it
+	resume func()      // serves c again once the poller saw data, see serveParked
+
+	sinkThreshold int64 // see SetMessageSink
+	sinkFactory   SinkFactory
+	sinkHandler   SinkHandler
+
+	inMessage   bool           // true between the first fragment and the one with FIN=true
+	messageSize int            // bytes received so far for the current message
+	readLimit   atomic.Int64   // largest message accepted, 0 = unlimited, see SetReadLimit
+	message     *messageReader // reader of the current message, nil when it was read to the end
+
+	values *connValues // the application's, see Set
+
+	deflate      *deflateState
+	compressOff  atomic.Bool  // EnableWriteCompression(false) was called
+	level        atomic.Int32 // compression level of the next message, see SetCompressionLevel
+	pings        pingTracker
+	rttLock      chan struct{}                     // held by PingWithRTT, a channel so waiting for it can be cancelled
+	pingHandler  func(appData string) error        // nil answers with a pong
+	pongHandler  func(appData string) error        // nil ignores pongs
+	closeHandler func(code int, text string) error // nil echoes the peer's code
+	done         chan struct{}                     // closed by close, stops the ping loop
+
+	afterFunc    func(d time.Duration, f func()) timer
+	frameTimer   timer
+	frameExpired atomic.Bool
+	readCancel   atomic.Bool           // ReadMessageContext moved the read deadline to now
+	iterErr      atomic.Pointer[error] // why the last iteration of Messages ended, see Err
+	stopOnCancel func() bool
+
+	// writeLock keeps frames whole on the wire, messageMu keeps the fragments
+	// of data messages from interleaving. Control frames only take writeLock
+	// so they can go out between the fragments of a message. writeLock is a
+	// channel so WriteControl can give up waiting for it at a deadline.
+	writeLock     chan struct{}
+	messageMu     sync.Mutex
+	writeDeadline time.Time                                    // the deadline of the last data write, guarded by writeLock
+	writeBuffer   []byte                                       // frames not written yet, see Config.WriteBufferSize, guarded by writeLock
+	flushArmed    bool                                         // a flush of writeBuffer is scheduled, guarded by writeLock
+	scratch       [maxFrameHeaderSize + maxControlPayload]byte // small frames are encoded here, guarded by writeLock
+	vectors       [2][]byte                                    // the header and payload of writeVectored, guarded by writeLock
+	closeWritten  atomic.Bool                                  // our CLOSE is on the wire, set under writeLock
+	writeFailed   atomic.Bool                                  // a frame write failed, the connection can only be dropped
+
+	writingSince atomic.Int64               // unix nanoseconds since a socket write started, 0 between writes, see watchSlow
+	slow         atomic.Bool                // the peer stopped reading, see Config.SlowClientTimeout
+	slowClose    atomic.Pointer[CloseError] // set by SlowClose, the reader ends with it
+
+	budget      *memoryBudget // nil without Config.MemoryBudget
+	held        atomic.Int64  // bytes c accounts for in budget, heldClosed once it ended
+	evicted     atomic.Bool   // the budget closes c to free its memory
+	decoderHeld int64         // the part of held in decoder, owned by the reader
+
+	opened      time.Time     // when c started, see Stats
+	closeCode   atomic.Int32  // of the first CLOSE sent or received, see Config.Metrics
+	bytesIn     atomic.Uint64 // see Stats
+	bytesOut    atomic.Uint64
+	messagesIn  atomic.Uint64
+	messagesOut atomic.Uint64
+
+	sendOnce sync.Once                 // starts the writer of Send
+	sendQ    atomic.Pointer[sendQueue] // nil until the first Send
+
+	// readMu is held while frames are read, Close takes over reading when
+	// nobody else is. localClose is the CLOSE that Close sent while someone
+	// else was reading, that reader then waits for the peer's reply.
+	readMu     sync.Mutex
+	localClose atomic.Pointer[CloseError]
+
+	closeCallOnce sync.Once
+	closeResult   error // what Close returned the first time
+
+	closeSent *CloseError // the CLOSE we sent, nil until then
+	err       error       // why reading ended, returned by every later ReadMessage
+
+	closeOnce sync.Once
+	onClose   func()       // gives back the Upgrader's connection slot, may be nil
+	slotHolds atomic.Int32 // keep the slot taken: the connection until teardown, serveConn and c.inbox until they're done
+	serving   bool         // serveConn holds the slot, see run
+}
+
+// lastConnID numbers the connections, see Conn.ID
+var lastConnID atomic.Uint64
+
+// newConn prepares a Conn for the upgraded connection and starts pinging the peer.
+// Cancelling ctx starts the closing handshake with 1001 "going away".
+func newConn(ctx context.Context, conn transport, reader *bufio.Reader, cfg Config, info connInfo) *Conn {
+	id := lastConnID.Add(1)
+	// Log lines carry the ID, the path and the request's correlation ID so
+	// connections and endpoints can be told apart
+	logger := cfg.logger().With("conn", id, "path", info.path)
+	if info.requestID != "" {
+		logger = logger.With("request_id", info.requestID)
+	}
+	c := &Conn{
+		id:        id,
+		ctx:       ctx,
+		conn:      conn,
+		reader:    reader,
+		cfg:       cfg,
+		info:      info,
+		logger:    logger,
+		state:     stateOpen,
+		done:      make(chan struct{}),
+		writeLock: make(chan struct{}, 1),
+		rttLock:   make(chan struct{}, 1),
+	}
+
+	c.messageLimiter = newMessageLimiter(cfg)
+	c.reassemblyMax = cfg.ReassemblyBufferSize
+	if c.reassemblyMax == 0 {
+		c.reassemblyMax = reassemblyBufferSize
+	}
+	c.bufferSize = cfg.ReadBufferSize
+	if c.bufferSize == 0 {
+		c.bufferSize = readBufferSize
+	}
+	c.minBufferSize = c.bufferSize
+	if cfg.DisableReadBufferPool {
+		buffer := make([]byte, c.bufferSize)
+		c.buffer = &buffer
+	}
+	c.readLimit.Store(int64(cfg.MaxMessageSize))
+	c.level.Store(compressionLevel)
+	c.readOpts = parseOptions{maxFrameSize: c.frameLimit(), strict: cfg.StrictFrameLengths, compression: info.deflate != nil, client: info.client, inPlace: cfg.InPlaceReads}.wire()
+	c.decoder = wire.NewDecoder(c.readOpts)
+
+	if info.deflate != nil {
+		params := *info.deflate
+		if info.client {
+			// the deflate state is described from the server's side
+			params.serverNoContextTakeover, params.clientNoContextTakeover = params.clientNoContextTakeover, params.serverNoContextTakeover
+		}
+		c.deflate = newDeflateState(params)
+	}
+	c.values = info.values
+	if c.values == nil {
+		c.values = new(connValues)
+	}
+
+	c.afterFunc = cfg.afterFunc
+	if c.afterFunc == nil {
+		c.afterFunc = func(d time.Duration, f func()) timer { return time.AfterFunc(d, f) }
+	}
+
+	// Cancelling ctx (server shutdown) interrupts the blocked Read by moving
+	// the read deadline to now, the same way the frame timer does
+	c.stopOnCancel = context.AfterFunc(ctx, func() {
+		_ = conn.SetReadDeadline(time.Now())
+		c.unpark()
+	})
+
+	if cfg.PingInterval > 0 && cfg.ParkIdleConnections {
+		// a parked connection has no goroutine of its own, a timer pings
+		c.afterFunc(cfg.PingInterval, c.keepalive)
+	} else if cfg.PingInterval > 0 {
+		go c.pingLoop()
+	}
+	if cfg.SlowClientTimeout > 0 {
+		go c.watchSlow()
+	}
+	c.slotHolds.Store(1)
+	c.opened = time.Now()
+	cfg.Metrics.opened()
+	return c
+}
+
+// holdSlot keeps the Upgrader's connection slot taken until releaseSlot,
+// false when the connection gave it back already
+func (c *Conn) holdSlot() bool {
+	for {
+		n := c.slotHolds.Load()
+		if n == 0 {
+			return false
+		}
+		if c.slotHolds.CompareAndSwap(n, n+1) {
+			return true
+		}
+	}
+}
+
+// releaseSlot drops a hold on the connection slot, the last one gives it
+// back through onClose
+func (c *Conn) releaseSlot() {
+	if c.slotHolds.Add(-1) == 0 && c.onClose != nil {
+		c.onClose()
+	}
+}
+
+// pingLoop pings the peer periodically, the pongs tell us the round-trip time
+func (c *Conn) pingLoop() {
+	ticker := time.NewTicker(c.cfg.PingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case now := <-ticker.C:
+			if err := c.ping(now); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// keepalive is pingLoop on a timer, every ping schedules the next one
+func (c *Conn) keepalive() {
+	select {
+	case <-c.done:
+		return
+	default:
+	}
+	if err := c.ping(time.Now()); err != nil {
+		return
+	}
+	c.afterFunc(c.cfg.PingInterval, c.keepalive)
+}
+
+// ping sends a keepalive ping
+func (c *Conn) ping(now time.Time) error {
+	// the send time makes every ping payload unique
+	payload := []byte(strconv.FormatInt(now.UnixNano(), 10))
+	c.pings.sent(payload, now)
+	return c.WriteControl(PingMessage, payload, c.controlDeadline())
+}
+
+// close stops the background work of the connection and closes it.
+// Only the first call does anything.
+func (c *Conn) close() {
+	c.closeOnce.Do(c.teardown)
+}
+
+func (c *Conn) teardown() {
+	c.stopOnCancel()
+	c.stopFrameTimer()
+	close(c.done)
+	// A message being written still uses the compressor, then it's left to the GC
+	if c.deflate != nil && c.messageMu.TryLock() {
+		c.deflate.release()
+		c.messageMu.Unlock()
+	}
+	c.logger.Info("connection closed", "clean", c.clean)
+	c.unpark()
+	c.releaseMemory()
+	if m := c.cfg.Metrics; m != nil {
+		code := int(c.closeCode.Load())
+		if code == 0 {
+			code = CloseAbnormalClosure
+		}
+		m.closed(code, time.Since(c.opened))
+	}
+	_ = c.conn.Close()
+	c.releaseSlot()
+}
+
+// Close closes the connection politely: it sends the messages queued by
+// Send, then a CLOSE frame with code and reason, waits up to Config.CloseTimeout for the peer's reply while
+// discarding data messages, and then closes the socket. It returns nil when
+// the peer answered, or once the CLOSE was sent when CloseTimeout is zero.
+// Only the first call does anything, later ones return its result.
+func (c *Conn) Close(code uint16, reason string) error {
+	c.closeCallOnce.Do(func() {
+		c.stopSending()
+		c.closeResult = c.closeHandshake(int(code), reason)
+	})
+	return c.closeResult
+}
+
+func (c *Conn) closeHandshake(code int, reason string) error {
+	payload, err := formatClosePayload(code, reason)
+	if err != nil {
+		return err
+	}
+	ce := &CloseError{Code: code, Text: reason}
+	// ErrCloseSent: the closing handshake is already under way, just wait for it
+	if err := c.WriteControl(CloseMessage, payload, c.controlDeadline()); err != nil && !errors.Is(err, ErrCloseSent) {
+		c.CloseNow()
+		return err
+	}
+
+	reading := c.readMu.TryLock()
+	if reading && c.parked.Load() {
+		// the goroutine the poller starts reads the reply
+		c.readMu.Unlock()
+		reading = false
+	}
+	if reading {
+		// Nobody is reading, read the reply here
+		if c.err == nil && c.state == stateOpen {
+			c.beginClosing(ce)
+		}
+		c.readMu.Unlock()
+		_, err := c.nextFrame()
+		if !c.clean && c.cfg.CloseTimeout > 0 {
+			return fmt.Errorf("websocket: closing handshake not completed: %w", err)
+		}
+		return nil
+	}
+
+	// The reader sees the reply, give it CloseTimeout to do so
+	c.localClose.Store(ce)
+	c.unpark()
+	if c.cfg.CloseTimeout > 0 {
+		t := time.NewTimer(c.cfg.CloseTimeout)
+		defer t.Stop()
+		select {
+		case <-c.done:
+			if c.clean {
+				return nil
+			}
+			return fmt.Errorf("websocket: closing handshake not completed: %w", c.err)
+		case <-t.C:
+		}
+	}
+	c.CloseNow()
+	if c.cfg.CloseTimeout == 0 {
+		// dropping the connection right after the CLOSE is what was asked for
+		return nil
+	}
+	return fmt.Errorf("websocket: closing handshake not completed: %w", os.ErrDeadlineExceeded)
+}
+
+// CloseNow drops the connection without a closing handshake
+func (c *Conn) CloseNow() {
+	_ = c.conn.Close()
+	// A reader gets an error from the closed socket and tears down itself
+	if c.readMu.TryLock() {
+		c.close()
+		c.readMu.Unlock()
+	}
+}
+
+// Request returns the upgrade request: its URL, headers, cookies and
+// RemoteAddr can be used for routing and auth. Its body is empty, its context
+// is the connection's and is cancelled when the connection ends or the server
+// shuts down.
+func (c *Conn) Request() *http.Request {
+	return c.info.request
+}
+
+// ID identifies the connection, no other connection of the process has the
+// same ID. Every log line of the connection carries it as "conn".
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// RequestID returns the X-Request-Id header of the upgrade request, empty
+// without one. Log lines of the connection carry it as "request_id".
+func (c *Conn) RequestID() string {
+	return c.info.requestID
+}
+
+// RemoteAddr is the address of the TCP peer, which is a proxy's when the
+// server runs behind one (see ClientAddr). It is nil when the connection
+// is an HTTP/2 stream.
+func (c *Conn) RemoteAddr() net.Addr {
+	if nc, ok := c.conn.(net.Conn); ok {
+		return nc.RemoteAddr()
+	}
+	return nil
+}
+
+// LocalAddr is the local address of the TCP connection, nil when the
+// connection is an HTTP/2 stream
+func (c *Conn) LocalAddr() net.Addr {
+	if nc, ok := c.conn.(net.Conn); ok {
+		return nc.LocalAddr()
+	}
+	return nil
+}
+
+// ClientAddr is the address of the client as Config.ClientIP derives it,
+// e.g. from X-Forwarded-For, and the host of RemoteAddr by default. It is
+// empty on the client side of a connection.
+func (c *Conn) ClientAddr() string {
+	return c.info.clientAddr
+}
+
+// Subprotocol is the application protocol negotiated in the opening
+// handshake, "" when there is none. See Config.Subprotocols.
+func (c *Conn) Subprotocol() string {
+	return c.info.subprotocol
+}
+
+// UnderlyingConn returns the connection the frames are read from and
+// written to: the *tls.Conn over wss://, nil for an HTTP/2 stream. Reading,
+// writing or closing it bypasses the Conn, you break frame integrity at
+// your own risk.
+func (c *Conn) UnderlyingConn() net.Conn {
+	nc, _ := c.conn.(net.Conn)
+	return nc
+}
+
+// applicationCloseError picks the CLOSE for an error returned by application
+// code: the code of a *CloseError, 1011 for anything else
+func applicationCloseError(err error) *CloseError {
+	var ce *CloseError
+	if errors.As(err, &ce) {
+		return ce
+	}
+	return &CloseError{Code: CloseInternalServerErr, Text: "internal error"}
+}
+
+// Ping sends a PING frame, the peer's PONG goes to the pong handler
+func (c *Conn) Ping(payload []byte) error {
+	return c.WriteControl(PingMessage, payload, c.controlDeadline())
+}
+
+// SetPongHandler sets the function called with the payload of every PONG the
+// peer sends, also while a fragmented message is being read. nil restores the
+// default, which ignores them. An error closes the connection like a Handler
+// error does. It must not be changed while another goroutine is reading.
+func (c *Conn) SetPongHandler(h func(appData string) error) {
+	c.pongHandler = h
+}
+
+// SetPingHandler sets the function called with the payload of every PING the
+// peer sends. nil restores the default, which answers with a PONG carrying
+// the same payload. An error closes the connection like a Handler error does.
+// It must not be changed while another goroutine is reading.
+func (c *Conn) SetPingHandler(h func(appData string) error) {
+	c.pingHandler = h
+}
+
+// writePong is the default ping handler, it answers a PING carrying data
+func (c *Conn) writePong(data []byte) error {
+	err := c.WriteControl(PongMessage, data, c.controlDeadline())
+	if errors.Is(err, ErrCloseSent) {
+		// the closing handshake is under way, no need to answer anymore
+		return nil
+	}
+	return err
+}
+
+// SetCloseHandler sets the function called with the code and reason of the
+// peer's CLOSE. Code is 1005 when the CLOSE carried no status. nil restores
+// the default, which answers with a CLOSE carrying the same code. A custom
+// handler may send its own CLOSE with WriteControl, or none at all; either
+// way the connection is terminated once it returns, even when it fails, and
+// ReadMessage returns a *CloseError with the peer's code and reason.
+// It must not be changed while another goroutine is reading.
+func (c *Conn) SetCloseHandler(h func(code int, text string) error) {
+	c.closeHandler = h
+}
+
+// SetReadLimit bounds the size of the messages read from now on, fragments
+// added up, replacing Config.MaxMessageSize for this connection. A message
+// over the limit is answered with CLOSE 1009 and reading fails with an error
+// matching ErrReadLimit. Zero means unlimited. Config.MaxFrameSize still
+// applies to single frames. It can be called at any time, also while
+// another goroutine is reading.
+func (c *Conn) SetReadLimit(n int64) {
+	c.readLimit.Store(max(n, 0))
+}
+
+// EnableWriteCompression turns compression of the messages written from now
+// on on or off. It only matters on connections that negotiated
+// permessage-deflate, on others enabling it is ignored and messages go out
+// uncompressed. Control frames are never compressed.
+func (c *Conn) EnableWriteCompression(enable bool) {
+	c.compressOff.Store(!enable)
+}
+
+// SetCompressionLevel sets the flate level of the messages compressed from
+// now on, from flate.HuffmanOnly to flate.BestCompression. The default is
+// flate.BestSpeed.
+func (c *Conn) SetCompressionLevel(level int) error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return fmt.Errorf("websocket: invalid compression level %d", level)
+	}
+	c.level.Store(int32(level))
+	return nil
+}
+
+// compressing reports whether the next message is compressed and readies the
+// compressor at the level asked for. The caller holds messageMu.
+func (c *Conn) compressing() bool {
+	if c.deflate == nil || c.compressOff.Load() {
+		return false
+	}
+	c.deflate.setLevel(int(c.level.Load()))
+	return true
+}
+
+// frameLimit is the largest frame the decoder lets through: a single frame
+// can't be bigger than a whole message either
+func (c *Conn) frameLimit() int64 {
+	limit := int64(c.cfg.MaxFrameSize)
+	if n := c.readLimit.Load(); n > 0 && (limit == 0 || n < limit) {
+		limit = n
+	}
+	return limit
+}
+
+// replyClose is the default close handler: it replies with the same code and
+// no reason. An empty close is answered with an explicit 1000 so clients
+// don't report 1005 "no status received".
+func (c *Conn) replyClose(code int, text string) error {
+	if code == CloseNoStatusReceived {
+		code = CloseNormalClosure
+	}
+	payload, err := formatClosePayload(code, "")
+	if err != nil {
+		return err
+	}
+	err = c.WriteControl(CloseMessage, payload, c.controlDeadline())
+	if errors.Is(err, ErrCloseSent) {
+		return nil
+	}
+	return err
+}
+
+// handlerFailed ends the connection after a ping or pong handler failed
+func (c *Conn) handlerFailed(err error) {
+	c.inMessage = false
+	if c.writeFailed.Load() {
+		// nothing can follow a failed write
+		c.err = err
+		return
+	}
+	c.startClose(applicationCloseError(err))
+}
+
+// fail closes the connection because of err: with the code of a *CloseError,
+// otherwise with 1011. It waits for the peer's CLOSE unless writing already
+// failed, then nothing can follow and the connection is simply dropped.
+// It returns why the connection ended, err when it ended without a handshake.
+func (c *Conn) fail(err error) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.writeFailed.Load() {
+		return err
+	}
+	if c.state == stateOpen {
+		c.startClose(applicationCloseError(err))
+	}
+	for {
+		if _, _, rerr := c.ReadMessage(); rerr != nil {
+			return rerr
+		}
+	}
+}
+
+// ReadMessage returns the next data message, TextMessage or BinaryMessage, and its payload.
+// Once the connection is done every call returns the same error: a *CloseError
+// after a closing handshake, or whatever made reading fail.
+// With Config.InPlaceReads data is only valid until the next read on c.
+func (c *Conn) ReadMessage() (messageType int, data []byte, err error) {
+	for {
+		messageType, r, err := c.NextReader()
+		if err != nil {
+			return 0, nil, err
+		}
+		data, err := c.reassemble(r)
+		if err == nil {
+			return messageType, data, nil
+		}
+		// A message failing half way started the closing handshake,
+		// NextReader waits for it to finish
+	}
+}
+
+// reassemble reads the message r delivers in the reassembly buffer and
+// returns a copy of it. With Config.InPlaceReads it returns the buffer
+// itself, or the payload of a message in a single frame as it was read.
+func (c *Conn) reassemble(r io.Reader) ([]byte, error) {
+	if mr := r.(*messageReader); c.cfg.InPlaceReads && mr.fin && len(mr.payload) == len(mr.frame) {
+		if _, raw := mr.src.(frameSource); raw {
+			c.message = nil
+			return mr.payload, nil
+		}
+	}
+	buf, _, err := c.fill(r, 0)
+	defer c.keepReassembly(buf)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.InPlaceReads {
+		return buf, nil
+	}
+	data := make([]byte, len(buf))
+	copy(data, buf)
+	return data, nil
+}
+
+// fill reads what r delivers into the reassembly buffer until r ends or,
+// when stop isn't zero, it holds stop bytes. The buffer grows up to the read
+// limit, one byte more shows that a message of exactly the limit ended.
+func (c *Conn) fill(r io.Reader, stop int) (buf []byte, eof bool, err error) {
+	buf = c.reassembly[:0]
+	for stop == 0 || len(buf) < stop {
+		if len(buf) == cap(buf) {
+			size := max(2*cap(buf), 512)
+			if limit := int(c.readLimit.Load()); limit > 0 && cap(buf) <= limit {
+				size = min(size, limit+1)
+			}
+			if stop > 0 {
+				size = min(size, stop)
+			}
+			if err := c.charge(int64(size - cap(buf))); err != nil {
+				return buf, false, c.budgetFailed(err)
+			}
+			buf = append(make([]byte, 0, size), buf...)
+		}
+		n, err := r.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, true, nil
+		}
+		if err != nil {
+			return buf, false, err
+		}
+	}
+	return buf, false, nil
+}
+
+// keepReassembly keeps buf for the next message, unless it grew too big
+func (c *Conn) keepReassembly(buf []byte) {
+	if cap(buf) <= c.reassemblyMax {
+		c.reassembly = buf[:0]
+	} else {
+		c.reassembly = nil // don't pin the memory of a huge message
+		c.uncharge(int64(cap(buf)))
+	}
+}
+
+// ReadMessageInto reads the next data message into buf, which can be reused
+// for every message: the frames of a message that isn't compressed are
+// recycled, reading one allocates nothing. n is the size of the message.
+// When it doesn't fit the message is read to the end all the same, buf holds
+// its first len(buf) bytes and the error is io.ErrShortBuffer, n tells how
+// big buf has to be. Other errors are the ones of ReadMessage.
+func (c *Conn) ReadMessageInto(buf []byte) (messageType int, n int, err error) {
+	if c.message != nil {
+		_, _ = io.Copy(io.Discard, c.message)
+		c.message = nil
+	}
+	for {
+		f, err := c.nextFrame()
+		if err != nil {
+			return 0, 0, err
+		}
+		messageType = messageTypeOf(f.Opcode)
+		if !f.Rsv1 {
+			return c.readFramesInto(messageType, f, buf)
+		}
+		n, err := c.inflateInto(f, buf)
+		if err == nil || err == io.ErrShortBuffer {
+			return messageType, n, err
+		}
+		// A message failing half way started the closing handshake, the
+		// next frame waits for it to finish
+	}
+}
+
+// readFramesInto copies the message starting with f into buf, giving the
+// payloads back to the decoder
+func (c *Conn) readFramesInto(messageType int, f frame, buf []byte) (int, int, error) {
+	n := 0
+	for {
+		copy(buf[min(n, len(buf)):], f.Payload)
+		n += len(f.Payload)
+		c.reuse(f.Payload)
+		if f.Fin {
+			break
+		}
+		var err error
+		if f, err = c.nextFrame(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if n > len(buf) {
+		return messageType, n, io.ErrShortBuffer
+	}
+	return messageType, n, nil
+}
+
+// inflateInto reads the compressed message starting with f into buf
+func (c *Conn) inflateInto(f frame, buf []byte) (int, error) {
+	mr := c.newMessageReader(f)
+	n, err := io.ReadFull(mr, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	// buf is full, what is left tells the size of the message
+	rest, err := io.Copy(io.Discard, mr)
+	if err != nil {
+		return 0, err
+	}
+	if rest > 0 {
+		return n + int(rest), io.ErrShortBuffer
+	}
+	return n, nil
+}
+
+// defaultLogPayloadSize is how much of a text message is logged when
+// Config.LogPayloadSize is zero
+const defaultLogPayloadSize = 64
+
+// logPayload returns the part of a text message that is logged, see
+// Config.LogPayloadSize
+func (c *Conn) logPayload(data []byte) string {
+	limit := c.cfg.LogPayloadSize
+	if limit == 0 {
+		limit = defaultLogPayloadSize
+	}
+	if len(data) <= limit {
+		return string(data)
+	}
+	return fmt.Sprintf("%s... (%d bytes)", data[:limit], len(data))
+}
+
+// WriteMessage sends payload as a TextMessage or BinaryMessage, compressed
+// when permessage-deflate was negotiated, see EnableWriteCompression. It goes
+// out as a single frame unless it's bigger than Config.WriteFragmentSize.
+func (c *Conn) WriteMessage(messageType int, data []byte) error {
+	if !IsData(messageType) {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	if c.dropSlow() {
+		return ErrSlowConsumer
+	}
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	return c.sentMessage(opcodeOf(messageType), c.writeMessageLocked(opcodeOf(messageType), data))
+}
+
+// sentMessage counts a data message in Config.Metrics unless writing it
+// failed with err, which it returns
+func (c *Conn) sentMessage(opcode byte, err error) error {
+	if err == nil {
+		c.messagesOut.Add(1)
+		c.cfg.Metrics.sentMessage(opcode)
+	}
+	return err
+}
+
+// wroteBytes counts n bytes written to the socket
+func (c *Conn) wroteBytes(n int64) {
+	c.bytesOut.Add(uint64(n))
+	c.cfg.Metrics.wroteBytes(n)
+}
+
+// ConnStats is what a connection did so far, see Conn.Stats
+type ConnStats struct {
+	Opened      time.Time // when the connection was upgraded
+	BytesIn     uint64    // read from the socket, frame headers included
+	BytesOut    uint64    // written to the socket, frame headers included
+	MessagesIn  uint64    // data messages received
+	MessagesOut uint64    // data messages sent
+}
+
+// Stats returns what the connection did so far
+func (c *Conn) Stats() ConnStats {
+	return ConnStats{
+		Opened:      c.opened,
+		BytesIn:     c.bytesIn.Load(),
+		BytesOut:    c.bytesOut.Load(),
+		MessagesIn:  c.messagesIn.Load(),
+		MessagesOut: c.messagesOut.Load(),
+	}
+}
+
+// writeMessageLocked sends a data message while the caller holds messageMu,
+// as a single frame or in fragments of Config.WriteFragmentSize
+func (c *Conn) writeMessageLocked(opcode byte, data []byte) error {
+	if size := c.cfg.WriteFragmentSize; size > 0 && len(data) > size {
+		return c.writeFragmented(opcode, data, size)
+	}
+	// Control frames never go through here, they are never compressed
+	if !c.compressing() {
+		return c.send(opcode, data)
+	}
+	compressed, err := c.deflate.compress(data)
+	if err != nil {
+		return err
+	}
+	return c.writeFrame(frame{Fin: true, Rsv1: true, Opcode: opcode, Payload: compressed})
+}
+
+// writeFragmented sends data in frames of at most size bytes while the
+// caller holds messageMu. It goes through the compressor a fragment at a
+// time, so neither data nor its compressed form is encoded in one piece.
+func (c *Conn) writeFragmented(opcode byte, data []byte, size int) error {
+	w := c.newMessageWriter(opcode, size)
+	for len(data) > size {
+		if _, err := w.Write(data[:size]); err != nil {
+			return err
+		}
+		data = data[size:]
+	}
+	// the rest goes out with FIN, not as an empty frame of its own
+	if !w.compressed {
+		w.buf = data
+	} else if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.finish()
+}
+
+// NextReader returns the type of the next data message and a reader for its
+// payload, which delivers the fragments as they arrive. Control frames in
+// between are handled as usual. Whatever is left unread of the previous
+// message is discarded first. Compressed messages are inflated as they are read.
+func (c *Conn) NextReader() (messageType int, r io.Reader, err error) {
+	if c.message != nil {
+		_, _ = io.Copy(io.Discard, c.message)
+		c.message = nil
+	}
+	f, err := c.nextFrame()
+	if err != nil {
+		return 0, nil, err
+	}
+	return messageTypeOf(f.Opcode), c.newMessageReader(f), nil
+}
+
+// newMessageReader starts reading the message whose first frame is f
+func (c *Conn) newMessageReader(f frame) *messageReader {
+	mr := &messageReader{c: c, frame: f.Payload, payload: f.Payload, fin: f.Fin}
+	mr.src = frameSource{mr}
+	if f.Rsv1 {
+		mr.src = c.deflate.inflater(frameSource{mr}, int(c.readLimit.Load()))
+	}
+	c.message = mr
+	return mr
+}
+
+// messageReader is the reader NextReader returns
+type messageReader struct {
+	c       *Conn
+	src     io.Reader // the message's payload: its frames, or an inflater reading from them
+	frame   []byte    // payload of the current frame, given back to the decoder once read
+	payload []byte    // unread part of the current frame
+	fin     bool      // the current frame is the last of the message
+	err     error     // why reading the frames ended
+	eof     bool      // src was read to the end
+}
+
+func (mr *messageReader) Read(p []byte) (int, error) {
+	if mr.eof {
+		return 0, io.EOF
+	}
+	if mr.c.message != mr {
+		return 0, errStaleReader
+	}
+	n, err := mr.src.Read(p)
+	if err == io.EOF {
+		mr.eof = true
+		mr.c.message = nil
+	} else if err != nil && mr.c.err == nil && mr.c.state == stateOpen {
+		// the inflated payload is invalid or too big
+		mr.c.startClose(closeErrorFor(err))
+	}
+	return n, err
+}
+
+// readFrames reads the raw payload of the message's frames
+func (mr *messageReader) readFrames(p []byte) (int, error) {
+	for len(mr.payload) == 0 {
+		mr.c.reuse(mr.frame)
+		mr.frame = nil
+		if mr.err != nil {
+			return 0, mr.err
+		}
+		if mr.fin {
+			mr.err = io.EOF
+			continue
+		}
+		f, err := mr.c.nextFrame()
+		if err != nil {
+			mr.err = err
+			continue
+		}
+		mr.frame, mr.payload, mr.fin = f.Payload, f.Payload, f.Fin
+	}
+	n := copy(p, mr.payload)
+	mr.payload = mr.payload[n:]
+	return n, nil
+}
+
+// frameSource reads the raw payload of a message's frames
+type frameSource struct {
+	mr *messageReader
+}
+
+func (s frameSource) Read(p []byte) (int, error) {
+	return s.mr.readFrames(p)
+}
+
+// NextWriter returns a writer for a new TextMessage or BinaryMessage. Written data
+// goes out in fragments of Config.FragmentSize, Close sends the last one.
+// Other messages wait until the writer is closed, so it must always be closed.
+func (c *Conn) NextWriter(messageType int) (io.WriteCloser, error) {
+	if !IsData(messageType) {
+		return nil, fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	c.messageMu.Lock()
+	w := c.newMessageWriter(opcodeOf(messageType), c.cfg.FragmentSize)
+	w.counted = true
+	return w, nil
+}
+
+// newMessageWriter starts a message sent in fragments of size while the
+// caller holds messageMu
+func (c *Conn) newMessageWriter(opcode byte, size int) *messageWriter {
+	w := &messageWriter{c: c, opcode: opcode, first: opcode, size: size, compressed: c.compressing()}
+	if w.compressed {
+		c.deflate.beginMessage()
+	}
+	return w
+}
+
+// messageWriter is the writer NextWriter returns
+type messageWriter struct {
+	c          *Conn
+	opcode     byte   // opcode of the next fragment, opCont after the first
+	size       int    // largest fragment payload, 0 = one per Write
+	compressed bool   // the message goes through the connection's compressor
+	buf        []byte // uncompressed data not sent yet
+	frame      []byte // encoding of the last fragment, reused for the next one
+	closed     bool
+	counted    bool // Close counts the message in Config.Metrics, the callers of finish do that themselves
+	first      byte // opcode of the first fragment
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.closed {
+		return 0, errWriterClosed
+	}
+	size := w.size
+	if w.compressed {
+		// the compressor buffers the output, d.buf holds what may be sent
+		d := w.c.deflate
+		if err := d.write(p); err != nil {
+			return 0, err
+		}
+		for d.buf.Len() > 0 && d.buf.Len() >= size {
+			n := d.buf.Len()
+			if size > 0 {
+				n = size
+			}
+			if err := w.fragment(d.buf.Next(n), false); err != nil {
+				return 0, err
+			}
+		}
+		return len(p), nil
+	}
+	if size <= 0 {
+		if err := w.fragment(p, false); err != nil {
+			return 0, err
+		}
+		return len(p), nil
+	}
+	written := len(p)
+	for len(w.buf)+len(p) >= size {
+		var chunk []byte
+		if len(w.buf) == 0 {
+			// nothing buffered, send straight from p
+			chunk, p = p[:size], p[size:]
+		} else {
+			n := size - len(w.buf)
+			w.buf = append(w.buf, p[:n]...)
+			chunk, p = w.buf, p[n:]
+		}
+		if err := w.fragment(chunk, false); err != nil {
+			return 0, err
+		}
+		w.buf = w.buf[:0]
+	}
+	w.buf = append(w.buf, p...)
+	return written, nil
+}
+
+// Close sends what is left of the message as its last fragment
+func (w *messageWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.c.messageMu.Unlock()
+	if !w.counted {
+		return w.finish()
+	}
+	return w.c.sentMessage(w.first, w.finish())
+}
+
+// finish sends the last fragment
+func (w *messageWriter) finish() error {
+	payload := w.buf
+	if w.compressed {
+		var err error
+		if payload, err = w.c.deflate.endMessage(); err != nil {
+			return err
+		}
+	}
+	return w.fragment(payload, true)
+}
+
+// fragment sends one frame of the message, RSV1 marks the first one of a compressed message
+func (w *messageWriter) fragment(payload []byte, fin bool) error {
+	f := frame{Fin: fin, Rsv1: w.compressed && w.opcode != opCont, Opcode: w.opcode, Payload: payload}
+	if w.c.vectored(payload) {
+		w.opcode = opCont
+		return w.c.writeVectored(f)
+	}
+	frameData, err := w.c.appendFrame(w.frame[:0], f)
+	if err != nil {
+		return err
+	}
+	w.frame = frameData
+	w.opcode = opCont
+	return w.c.write(frameData)
+}
+
+// nextFrame returns the next data frame, handling control frames and the
+// closing handshake on the way. It returns c.err once reading ended.
+func (c *Conn) nextFrame() (frame, error) {
+	c.readMu.Lock()
+	defer c.readMu.Unlock()
+	for c.err == nil {
+		if f, err := c.nextParsed(); err == nil {
+			// the frame left the decoder, it can't ask for more
+			_ = c.chargeDecoder()
+			f, ok := c.dispatch(f)
+			if ok {
+				return f, nil
+			}
+			if f.Opcode == opPing || f.Opcode == opPong {
+				// answered, the handlers got a copy
+				c.reuse(f.Payload)
+			}
+			continue
+		}
+		if c.readErr != nil {
+			err := c.readErr
+			c.readErr = nil
+			if err := c.handleReadError(err); err != nil {
+				return frame{}, err
+			}
+			continue
+		}
+		c.read()
+	}
+	c.releaseBuffer()
+	c.close()
+	return frame{}, c.err
+}
+
+// nextParsed returns the next complete frame, the ones read parsed in place
+// come before the decoder's
+func (c *Conn) nextParsed() (frame, error) {
+	if len(c.parsed) > 0 {
+		f := c.parsed[0]
+		c.parsed[0] = frame{}
+		c.parsed = c.parsed[1:]
+		return f, nil
+	}
+	return c.decoder.Next()
+}
+
+// reuse gives a payload that was read back to the decoder, unless it points
+// into the read buffer
+func (c *Conn) reuse(payload []byte) {
+	if !c.lent {
+		c.decoder.Reuse(payload)
+	}
+}
+
+// read fills the buffer once and decodes what arrived. Between frames the
+// connection waits for data without a buffer, it takes one from the pool
+// once something arrived and gives it back when no partial frame is left.
+// The decoder copies what it keeps, no frame refers to a buffer given back.
+// With Config.InPlaceReads the frames that arrived whole are parsed inside
+// the buffer instead, it's kept until the next read, their payloads with it.
+func (c *Conn) read() {
+	if c.lent {
+		// the payloads handed out expire now
+		c.lent = false
+		if c.decoder.Pending() == 0 {
+			c.releaseBuffer()
+		}
+	}
+	fresh := c.buffer == nil
+	if fresh {
+		if _, err := c.reader.Peek(1); err != nil {
+			c.readErr = err
+			return
+		}
+		c.buffer = getReadBuffer(c.bufferSize)
+	}
+	defer func() {
+		if c.decoder.Pending() == 0 && !c.lent {
+			c.releaseBuffer()
+		}
+	}()
+
+	// bufio.Reader.Read delivers arbitrary chunks, not aligned to frame
+	// boundaries. The decoder picks up where the previous chunk ended.
+	buffer := *c.buffer
+	n, err := c.reader.Read(buffer)
+	c.readErr = err
+	c.bytesIn.Add(uint64(n))
+	c.cfg.Metrics.readBytes(n)
+	if n == 0 {
+		return
+	}
+	// after Peek the Read only gets what bufio buffered
+	defer c.adaptBuffer(n, fresh && n == c.reader.Size())
+	c.decoder.SetMaxFrameSize(c.frameLimit())
+	if perr := c.decode(buffer[:n]); perr != nil {
+		// Frame boundaries are lost, drop everything decoded so far.
+		// While waiting for the peer's CLOSE we simply keep looking for it.
+		c.dropFrames()
+		// error → reply with CLOSE (1002, or 1009 for oversized frames) and wait for the peer's answer
+		if c.state == stateOpen {
+			c.startClose(closeErrorFor(frameError(perr)))
+		}
+		return
+	}
+	if err := c.chargeDecoder(); err != nil {
+		// the frames go with the memory, so do their boundaries
+		c.dropFrames()
+		_ = c.chargeDecoder()
+		c.budgetFailed(err)
+		return
+	}
+	// Every completed frame resets the clock, a partial one left behind starts it
+	if c.decoder.Buffered() > 0 || len(c.parsed) > 0 {
+		c.stopFrameTimer()
+	}
+	if c.decoder.Pending() > 0 && c.state == stateOpen {
+		c.armFrameTimer()
+	}
+}
+
+// decode hands what a read got to the decoder. With Config.InPlaceReads and
+// the decoder empty the complete frames are parsed in place first, only a
+// partial frame left at the end is copied.
+func (c *Conn) decode(p []byte) error {
+	if c.readOpts.InPlace && c.decoder.Pending() == 0 && c.decoder.Buffered() == 0 {
+		c.readOpts.MaxFrameSize = c.frameLimit()
+		frames, rest, err := wire.ParseFrames(p, c.readOpts)
+		if err != nil {
+			return err
+		}
+		c.parsed, p = frames, rest
+		c.lent = len(frames) > 0
+	}
+	_, err := c.decoder.Write(p)
+	return err
+}
+
+// dropFrames forgets the frames read but not dispatched yet and a partial one
+func (c *Conn) dropFrames() {
+	c.decoder.Reset()
+	clear(c.parsed)
+	c.parsed = nil
+}
+
+// handleReadError decides what a failed Read means for the connection. It
+// returns an error when only the current read ends, the connection goes on.
+func (c *Conn) handleReadError(err error) error {
+	if ce := c.slowClose.Load(); ce != nil {
+		// SlowClose dropped the connection
+		c.err = ce
+		return nil
+	}
+
+	if c.frameExpired.Swap(false) && c.state == stateOpen && errors.Is(err, os.ErrDeadlineExceeded) {
+		c.frameTimer = nil
+		if c.decoder.Pending() == 0 {
+			// the frame completed just as the timer fired, carry on reading
+			_ = c.conn.SetReadDeadline(time.Time{})
+			return nil
+		}
+		c.dropFrames()
+		c.startClose(&CloseError{Code: ClosePolicyViolation, Text: "frame timeout"})
+		return nil
+	}
+
+	if c.ctx.Err() != nil && c.state == stateOpen && errors.Is(err, os.ErrDeadlineExceeded) {
+		c.dropFrames()
+		c.startClose(&CloseError{Code: CloseGoingAway, Text: "server shutting down"})
+		return nil
+	}
+
+	if c.readCancel.Swap(false) && c.state == stateOpen && errors.Is(err, os.ErrDeadlineExceeded) {
+		_ = c.conn.SetReadDeadline(time.Time{})
+		if !c.inMessage && c.message == nil {
+			// no message was started, nothing is lost
+			return errReadCancelled
+		}
+		// the part of the message already read can't be given back
+		c.sendClose(&CloseError{Code: CloseGoingAway, Text: "read cancelled"})
+		c.err = ErrReadInterrupted
+		return nil
+	}
+
+	// While closing a timeout or EOF just means the peer never answered our CLOSE
+	if c.state == stateOpen {
+		if err == io.EOF {
+			// the peer went away without a CLOSE
+			c.err = &CloseError{Code: CloseAbnormalClosure, Text: "unexpected EOF", err: err}
+			return nil
+		}
+		c.logger.Warn("read error", "err", err)
+	}
+	c.err = err
+	return nil
+}
+
+// dispatch processes one frame and reports whether it's a data frame for the reader
+func (c *Conn) dispatch(f frame) (frame, bool) {
+	if c.state == stateOpen {
+		if ce := c.localClose.Load(); ce != nil {
+			// Close sent our CLOSE from another goroutine
+			c.beginClosing(ce)
+		}
+	}
+	if c.state == stateClosing && f.Opcode != opClose {
+		// after our CLOSE every other frame is discarded
+		return f, false
+	}
+	var ferr error // set when the frame violates the protocol or our limits
+	switch f.Opcode {
+	case opText, opBin:
+		// A new message must not start while another one is still fragmented
+		if c.inMessage {
+			ferr = fmt.Errorf("%w: new message inside a fragmented message", errProtocol)
+			break
+		}
+		c.messageSize = 0
+		ferr = c.checkFragment(f)
+	case opCont:
+		// The WebSocket is fragmented, the pieces continue until FIN=true
+		if !c.inMessage {
+			ferr = fmt.Errorf("%w: continuation frame without a message", errProtocol)
+			break
+		}
+		ferr = c.checkFragment(f)
+	case opPing:
+		var err error
+		if c.pingHandler != nil {
+			err = c.pingHandler(string(f.Payload))
+		} else {
+			err = c.writePong(f.Payload)
+		}
+		if err != nil {
+			c.handlerFailed(err)
+		}
+		return f, false
+	case opPong:
+		// A pong answering one of our pings gives us the round-trip time.
+		// Unsolicited pongs are allowed by the RFC and silently accepted.
+		if rtt, ok := c.pings.pong(f.Payload, time.Now()); ok {
+			c.logger.Debug("[client PONG]", "rtt", rtt)
+		}
+		if c.pongHandler != nil {
+			if err := c.pongHandler(string(f.Payload)); err != nil {
+				c.handlerFailed(err)
+			}
+		}
+		return f, false
+	case opClose:
+		c.handleClose(f.Payload)
+		return f, false
+	default:
+		// Opcodes 3-7 and 0xB-0xF are reserved, no extension defines them
+		ferr = fmt.Errorf("%w: reserved opcode %d", errProtocol, f.Opcode)
+	}
+
+	if ferr == nil && f.Fin && c.messageLimiter != nil {
+		ferr = c.limitMessage()
+	}
+	if ferr != nil {
+		c.inMessage = false
+		c.startClose(closeErrorFor(ferr))
+		return f, false
+	}
+	if f.Opcode != opCont {
+		c.messagesIn.Add(1)
+		c.cfg.Metrics.receivedMessage(f.Opcode)
+	}
+	c.inMessage = !f.Fin
+	return f, true
+}
+
+// checkFragment applies the message size limit to every fragment so a
+// stream of tiny continuation frames can't go on without bound
+func (c *Conn) checkFragment(f frame) error {
+	c.messageSize += len(f.Payload)
+	if limit := c.readLimit.Load(); limit > 0 && int64(c.messageSize) > limit {
+		return fmt.Errorf("%w: message exceeds the %d byte limit", errMessageTooBig, limit)
+	}
+	return nil
+}
+
+// handleClose answers the peer's CLOSE frame or completes the handshake we started
+func (c *Conn) handleClose(payload []byte) {
+	if c.state == stateClosing {
+		// The peer answered our CLOSE, the closing handshake is complete
+		c.state = stateClosed
+		c.clean = true
+		c.err = c.closeSent
+		return
+	}
+	c.recordClose(payload)
+	// A malformed close payload is a protocol error, don't echo it
+	code, reason, err := parseClosePayload(payload)
+	if err != nil {
+		ce := closeErrorFor(err)
+		c.sendClose(ce)
+		c.err = ce
+		return
+	}
+	c.err = &CloseError{Code: code, Text: reason}
+	// The peer started the closing handshake so there is nothing to wait for,
+	// the connection is terminated whatever the handler does
+	c.state = stateClosed
+	handler := c.closeHandler
+	if handler == nil {
+		handler = c.replyClose
+	}
+	if err := handler(code, reason); err != nil {
+		c.logger.Error("close handler", "err", err)
+	}
+	c.clean = c.closeWritten.Load()
+}
+
+// recordClose keeps the code of the first CLOSE sent or received for
+// Config.Metrics
+func (c *Conn) recordClose(payload []byte) {
+	if c.cfg.Metrics == nil {
+		return
+	}
+	code := CloseNoStatusReceived
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload))
+	}
+	c.closeCode.CompareAndSwap(0, int32(code))
+}
+
+// write puts one encoded frame on the wire.
+// A write that misses WriteTimeout is fatal: part of the frame may already be
+// on the wire, so not even a CLOSE can follow it and the caller just drops the connection.
+// Nothing follows our CLOSE, later writes fail with ErrCloseSent.
+func (c *Conn) write(frameData []byte) error {
+	_ = c.lockWrite(time.Time{})
+	defer c.unlockWrite()
+	c.extendWriteDeadline()
+	return c.writeLocked(frameData)
+}
+
+// extendWriteDeadline gives the next write WriteTimeout while the caller
+// holds writeLock
+func (c *Conn) extendWriteDeadline() {
+	if c.cfg.WriteTimeout > 0 {
+		c.writeDeadline = time.Now().Add(c.cfg.WriteTimeout)
+		_ = c.conn.SetWriteDeadline(c.writeDeadline)
+	}
+}
+
+// writeLocked writes a frame while the caller holds writeLock
+func (c *Conn) writeLocked(frameData []byte) error {
+	if err := c.writable(); err != nil {
+		return err
+	}
+	err := c.writeBytesLocked(frameData)
+	if err == nil && frameData[0]&0x08 != 0 {
+		// control frames don't wait in the write buffer
+		err = c.flushLocked()
+	}
+	if frameData[0]&0x0F == opClose {
+		c.closeWritten.Store(true)
+	}
+	return err
+}
+
+// writable reports why no frame may be written anymore, nil while one may
+func (c *Conn) writable() error {
+	if c.closeWritten.Load() {
+		return ErrCloseSent
+	}
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+		return nil
+	}
+}
+
+// writeBytesLocked puts p on the wire while the caller holds writeLock, p
+// is a frame or a piece of one. With Config.WriteBufferSize it goes into the
+// write buffer when it fits.
+func (c *Conn) writeBytesLocked(p []byte) error {
+	if size := c.cfg.WriteBufferSize; size > 0 {
+		if len(c.writeBuffer)+len(p) > size {
+			if err := c.flushLocked(); err != nil {
+				return err
+			}
+		}
+		if len(p) < size {
+			c.writeBuffer = append(c.writeBuffer, p...)
+			c.armFlush()
+			return nil
+		}
+	}
+	c.markWrite()
+	n, err := c.conn.Write(p)
+	c.unmarkWrite()
+	c.wroteBytes(int64(n))
+	return c.writeResult(err)
+}
+
+// Flush writes the frames waiting in the write buffer, see
+// Config.WriteBufferSize
+func (c *Conn) Flush() error {
+	_ = c.lockWrite(time.Time{})
+	defer c.unlockWrite()
+	c.extendWriteDeadline()
+	return c.flushLocked()
+}
+
+// flushLocked writes the write buffer while the caller holds writeLock
+func (c *Conn) flushLocked() error {
+	if len(c.writeBuffer) == 0 {
+		return nil
+	}
+	buffered := c.writeBuffer
+	c.writeBuffer = c.writeBuffer[:0]
+	select {
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+	c.markWrite()
+	n, err := c.conn.Write(buffered)
+	c.unmarkWrite()
+	c.wroteBytes(int64(n))
+	return c.writeResult(err)
+}
+
+// armFlush schedules a flush of the write buffer after
+// Config.WriteBufferDelay, unless one is scheduled already
+func (c *Conn) armFlush() {
+	if c.cfg.WriteBufferDelay <= 0 || c.flushArmed {
+		return
+	}
+	c.flushArmed = true
+	c.afterFunc(c.cfg.WriteBufferDelay, func() {
+		_ = c.lockWrite(time.Time{})
+		defer c.unlockWrite()
+		c.flushArmed = false
+		c.extendWriteDeadline()
+		_ = c.flushLocked()
+	})
+}
+
+// writeResult handles the error of a write to the connection
+func (c *Conn) writeResult(err error) error {
+	if errors.Is(err, net.ErrClosed) {
+		// the connection was torn down while we waited for writeLock
+		return fmt.Errorf("%w: %v", ErrConnClosed, err)
+	}
+	if err != nil {
+		c.writeFailed.Store(true)
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.logger.Warn("write timeout: peer is not reading")
+		} else {
+			c.logger.Warn("write error", "err", err)
+		}
+	}
+	return err
+}
+
+// lockWrite takes writeLock, giving up at deadline unless it's zero
+func (c *Conn) lockWrite(deadline time.Time) error {
+	if deadline.IsZero() {
+		c.writeLock <- struct{}{}
+		return nil
+	}
+	select {
+	case c.writeLock <- struct{}{}:
+		return nil // not taken, no need for a timer
+	default:
+	}
+	t := time.NewTimer(time.Until(deadline))
+	defer t.Stop()
+	select {
+	case c.writeLock <- struct{}{}:
+		return nil
+	case <-t.C:
+		return fmt.Errorf("websocket: waiting for another write: %w", os.ErrDeadlineExceeded)
+	}
+}
+
+func (c *Conn) unlockWrite() {
+	<-c.writeLock
+}
+
+// maxControlPayload is the largest payload of a control frame (RFC 6455 5.5)
+const maxControlPayload = wire.MaxControlPayload
+
+// WriteControl sends a CloseMessage, PingMessage or PongMessage. It may go out between
+// the fragments of a data message, but it won't wait past deadline for a
+// frame that is being written; a zero deadline waits as long as it takes.
+// The deadline also bounds the write itself.
+func (c *Conn) WriteControl(messageType int, data []byte, deadline time.Time) error {
+	if !IsControl(messageType) {
+		return fmt.Errorf("websocket: invalid control message type %d", messageType)
+	}
+	if len(data) > maxControlPayload {
+		return fmt.Errorf("websocket: control frame payload is %d bytes, the limit is %d", len(data), maxControlPayload)
+	}
+	if err := c.lockWrite(deadline); err != nil {
+		return err
+	}
+	defer c.unlockWrite()
+	if messageType == CloseMessage {
+		c.recordClose(data)
+	}
+	_ = c.conn.SetWriteDeadline(deadline)
+	err := c.writeLocked(c.encodeSmall(frame{Fin: true, Opcode: opcodeOf(messageType), Payload: data}))
+	_ = c.conn.SetWriteDeadline(c.writeDeadline)
+	return err
+}
+
+// controlDeadline is the deadline of the control frames the Conn sends itself
+func (c *Conn) controlDeadline() time.Time {
+	if c.cfg.WriteTimeout > 0 {
+		return time.Now().Add(c.cfg.WriteTimeout)
+	}
+	return time.Time{}
+}
+
+// abort gives up on a message none of which was sent yet, nothing goes on the wire
+func (w *messageWriter) abort() {
+	if w.closed {
+		return
+	}
+	if w.opcode == opCont {
+		// fragments are out, the message has to be finished
+		_ = w.Close()
+		return
+	}
+	w.closed = true
+	w.c.messageMu.Unlock()
+}
+
+// buildFrame encodes a frame for the peer, a client masks it with a fresh key
+func (c *Conn) buildFrame(opcode byte, payload []byte, fin bool) ([]byte, error) {
+	if c.info.client {
+		return buildMaskedFrame(opcode, payload, fin)
+	}
+	return buildFrame(opcode, payload, fin)
+}
+
+// appendFrame appends f encoded for the peer to dst, a client masks it with a fresh key
+func (c *Conn) appendFrame(dst []byte, f frame) ([]byte, error) {
+	if !c.info.client {
+		return wire.AppendFrame(dst, f, nil)
+	}
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+	return wire.AppendFrame(dst, f, &key)
+}
+
+// send builds a single-frame message (FIN=true) and writes it to the connection
+func (c *Conn) send(opcode byte, payload []byte) error {
+	return c.writeFrame(frame{Fin: true, Opcode: opcode, Payload: payload})
+}
+
+// writeFrame writes f to the connection. Small frames are encoded in
+// c.scratch and big ones the server sends go out vectored, neither
+// allocates; the frames in between are copied behind their header.
+func (c *Conn) writeFrame(f frame) error {
+	if c.vectored(f.Payload) {
+		return c.writeVectored(f)
+	}
+	if len(f.Payload) > maxControlPayload {
+		frameData, err := c.buildFrame(f.Opcode, f.Payload, f.Fin)
+		if err != nil {
+			return err
+		}
+		if f.Rsv1 {
+			frameData[0] |= rsv1Bit
+		}
+		return c.write(frameData)
+	}
+	_ = c.lockWrite(time.Time{})
+	defer c.unlockWrite()
+	c.extendWriteDeadline()
+	return c.writeLocked(c.encodeSmall(f))
+}
+
+// encodeSmall encodes f, carrying at most maxControlPayload bytes, in
+// c.scratch while the caller holds writeLock. A client masks the copy of
+// the payload, f.Payload is left alone.
+func (c *Conn) encodeSmall(f frame) []byte {
+	// at most maxControlPayload bytes can't fail
+	n, _ := writeFrameHeader((*[maxFrameHeaderSize]byte)(c.scratch[:]), f.Opcode, f.Fin, c.info.client, uint64(len(f.Payload)))
+	if f.Rsv1 {
+		c.scratch[0] |= rsv1Bit
+	}
+	end := n + copy(c.scratch[n:], f.Payload)
+	if c.info.client {
+		wire.MaskBytes([4]byte(c.scratch[n-4:n]), 0, c.scratch[n:end])
+	}
+	return c.scratch[:end]
+}
+
+// vectored reports whether a frame carrying payload is written with
+// writeVectored: a big one the server sends. A client masks the payload,
+// which takes a copy anyway.
+func (c *Conn) vectored(payload []byte) bool {
+	return !c.info.client && len(payload) >= vectoredWriteSize
+}
+
+// writeVectored writes f without copying the payload behind the header: both
+// go out in a single vectored write, a writev on TCP, under writeLock so no
+// other frame can come between them
+func (c *Conn) writeVectored(f frame) error {
+	_ = c.lockWrite(time.Time{})
+	defer c.unlockWrite()
+	c.extendWriteDeadline()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	if err := c.flushLocked(); err != nil {
+		return err
+	}
+	n, err := writeFrameHeader((*[maxFrameHeaderSize]byte)(c.scratch[:]), f.Opcode, f.Fin, false, uint64(len(f.Payload)))
+	if err != nil {
+		return err
+	}
+	if f.Rsv1 {
+		c.scratch[0] |= rsv1Bit
+	}
+	c.vectors = [2][]byte{c.scratch[:n], f.Payload}
+	buffers := net.Buffers(c.vectors[:])
+	c.markWrite()
+	written, err := buffers.WriteTo(c.conn)
+	c.unmarkWrite()
+	c.wroteBytes(written)
+	c.vectors = [2][]byte{} // don't keep the payload alive
+	return c.writeResult(err)
+}
+
+// sendClose sends a CLOSE control frame carrying the code and reason of ce
+func (c *Conn) sendClose(ce *CloseError) {
+	if ce.Code == CloseProtocolError {
+		c.cfg.Metrics.protocolError()
+	}
+	payload, err := formatClosePayload(ce.Code, ce.Text)
+	if err != nil {
+		// never put a reserved code on the wire, fall back to a close without status
+		c.logger.Error("close", "err", err)
+		payload = nil
+	}
+	_ = c.WriteControl(CloseMessage, payload, c.controlDeadline())
+}
+
+// startClose sends our CLOSE frame and starts waiting for the peer's reply.
+// Without a CloseTimeout there is nothing to wait for and reading ends right away.
+func (c *Conn) startClose(ce *CloseError) {
+	c.sendClose(ce)
+	c.beginClosing(ce)
+}
+
+// beginClosing waits for the peer to answer the CLOSE we sent
+func (c *Conn) beginClosing(ce *CloseError) {
+	c.closeSent = ce
+	c.stopFrameTimer()
+	if c.cfg.CloseTimeout <= 0 {
+		c.err = ce
+		return
+	}
+	c.state = stateClosing
+	_ = c.conn.SetReadDeadline(time.Now().Add(c.cfg.CloseTimeout))
+}
+
+// The frame timer runs while the decoder holds a partial frame. When it fires
+// it interrupts the blocked Read by moving the read deadline to now.
+func (c *Conn) armFrameTimer() {
+	if c.cfg.FrameTimeout <= 0 || c.frameTimer != nil {
+		return
+	}
+	c.frameTimer = c.afterFunc(c.cfg.FrameTimeout, func() {
+		c.frameExpired.Store(true)
+		_ = c.conn.SetReadDeadline(time.Now())
+	})
+}
+
+func (c *Conn) stopFrameTimer() {
+	if c.frameTimer != nil {
+		c.frameTimer.Stop()
+		c.frameTimer = nil
+	}
+}
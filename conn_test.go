@@ -0,0 +1,1458 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"gows/wire"
+)
+
+// pipeConn returns a Conn on one end of a pipe and the client end
+func pipeConn(t *testing.T, cfg Config) (*Conn, net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, srv := net.Pipe()
+	c := newConn(context.Background(), srv, bufio.NewReader(srv), cfg, connInfo{path: "/"})
+	t.Cleanup(func() {
+		client.Close()
+		c.close()
+	})
+	return c, client, bufio.NewReader(client)
+}
+
+type readResult struct {
+	messageType int
+	data        []byte
+	err         error
+}
+
+func TestConnReadMessageFragmented(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	results := make(chan readResult)
+	go func() {
+		for {
+			messageType, data, err := c.ReadMessage()
+			results <- readResult{messageType, data, err}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	binary := bytes.Repeat([]byte{0x00, 0xFF, 0x7F}, 100)
+	var wire []byte
+	wire = append(wire, clientFrame(opText, []byte("Hel"), false)...)
+	wire = append(wire, clientFrame(opCont, []byte("lo, "), false)...)
+	wire = append(wire, clientFrame(opCont, []byte("World"), true)...)
+	wire = append(wire, clientFrame(opBin, binary[:100], false)...)
+	wire = append(wire, clientFrame(opCont, binary[100:], true)...)
+	wire = append(wire, clientFrame(opText, []byte("single"), true)...)
+	// Frame boundaries must not matter, feed the bytes in small odd-sized chunks
+	go func() {
+		for len(wire) > 0 {
+			n := min(7, len(wire))
+			if _, err := client.Write(wire[:n]); err != nil {
+				return
+			}
+			wire = wire[n:]
+		}
+	}()
+
+	want := []readResult{
+		{opText, []byte("Hello, World"), nil},
+		{opBin, binary, nil},
+		{opText, []byte("single"), nil},
+	}
+	for _, w := range want {
+		got := <-results
+		if got.err != nil {
+			t.Fatalf("ReadMessage: %v", got.err)
+		}
+		if got.messageType != w.messageType || !bytes.Equal(got.data, w.data) {
+			t.Fatalf("got type %d %q, want type %d %q", got.messageType, got.data, w.messageType, w.data)
+		}
+	}
+
+	payload, _ := formatClosePayload(CloseNormalClosure, "bye")
+	go client.Write(clientFrame(opClose, payload, true))
+	if reply := readFrameFrom(t, reader); reply.Opcode != opClose {
+		t.Fatalf("expected a CLOSE reply, got opcode %d", reply.Opcode)
+	}
+	got := <-results
+	var ce *CloseError
+	if !errors.As(got.err, &ce) || ce.Code != CloseNormalClosure || ce.Text != "bye" {
+		t.Fatalf("expected the peer's close 1000 bye, got %v", got.err)
+	}
+	// Reading after the close keeps returning the same error
+	if _, _, err := c.ReadMessage(); err != got.err {
+		t.Fatalf("expected %v again, got %v", got.err, err)
+	}
+}
+
+func TestReadMessageInto(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	big := bytes.Repeat([]byte{0x00, 0xFF, 0x7F}, 100)
+	var wire []byte
+	wire = append(wire, clientFrame(opText, []byte("Hel"), false)...)
+	wire = append(wire, clientFrame(opPing, []byte("in between"), true)...)
+	wire = append(wire, clientFrame(opCont, []byte("lo, World"), true)...)
+	wire = append(wire, clientFrame(opBin, big[:100], false)...)
+	wire = append(wire, clientFrame(opCont, big[100:], true)...)
+	wire = append(wire, clientFrame(opText, []byte("single"), true)...)
+	go client.Write(wire)
+	replies := make(chan frame, 1)
+	go func() { replies <- readFrameFrom(t, reader) }()
+
+	buf := make([]byte, 64)
+	messageType, n, err := c.ReadMessageInto(buf)
+	if err != nil || messageType != TextMessage || string(buf[:n]) != "Hello, World" {
+		t.Fatalf("read type %d %q, %v", messageType, buf[:n], err)
+	}
+	if f := <-replies; f.Opcode != opPong || string(f.Payload) != "in between" {
+		t.Fatalf("expected the ping in between to be answered, got opcode %d %q", f.Opcode, f.Payload)
+	}
+
+	// too big: n tells the size, buf holds the start of the message
+	messageType, n, err = c.ReadMessageInto(buf)
+	if !errors.Is(err, io.ErrShortBuffer) || messageType != BinaryMessage || n != len(big) || !bytes.Equal(buf, big[:len(buf)]) {
+		t.Fatalf("read type %d, n=%d, %v", messageType, n, err)
+	}
+	// the message was read to the end, the next one follows
+	if _, n, err := c.ReadMessageInto(buf); err != nil || string(buf[:n]) != "single" {
+		t.Fatalf("read %q, %v", buf[:n], err)
+	}
+}
+
+func TestReadMessageIntoCompressed(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	server, client := connPair(t, cfg, &deflateParams{})
+	msg := []byte(wordySample(4 << 10))
+	go func() {
+		client.WriteMessage(TextMessage, msg)
+		client.WriteMessage(TextMessage, msg)
+	}()
+
+	buf := make([]byte, 1<<10)
+	if _, n, err := server.ReadMessageInto(buf); !errors.Is(err, io.ErrShortBuffer) || n != len(msg) || !bytes.Equal(buf, msg[:len(buf)]) {
+		t.Fatalf("read n=%d, %v", n, err)
+	}
+	buf = make([]byte, len(msg))
+	if _, n, err := server.ReadMessageInto(buf); err != nil || !bytes.Equal(buf[:n], msg) {
+		t.Fatalf("read %d bytes, %v", n, err)
+	}
+}
+
+// repeatTransport delivers the same bytes over and over
+type repeatTransport struct {
+	discardTransport
+	data  []byte
+	pos   int
+	chunk int // most bytes a Read returns, 0 = no limit
+}
+
+func (t *repeatTransport) Read(p []byte) (int, error) {
+	if t.chunk > 0 && len(p) > t.chunk {
+		p = p[:t.chunk]
+	}
+	n := copy(p, t.data[t.pos:])
+	t.pos = (t.pos + n) % len(t.data)
+	return n, nil
+}
+
+// repeatConn is a Conn reading the small text message msg forever
+func repeatConn(msg string) *Conn {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	transport := &repeatTransport{data: clientFrame(opText, []byte(msg), true)}
+	return newConn(context.Background(), transport, bufio.NewReader(transport), cfg, connInfo{path: "/"})
+}
+
+func TestReadMessageIntoAllocs(t *testing.T) {
+	c := repeatConn("hello")
+	buf := make([]byte, 64)
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, n, err := c.ReadMessageInto(buf); err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("read %q, %v", buf[:n], err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("reading a message allocated %v times", allocs)
+	}
+}
+
+func BenchmarkReadMessage(b *testing.B) {
+	b.Run("ReadMessage", func(b *testing.B) {
+		c := repeatConn("a small message")
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := c.ReadMessage(); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("ReadMessageInto", func(b *testing.B) {
+		c := repeatConn("a small message")
+		buf := make([]byte, 64)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := c.ReadMessageInto(buf); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestInPlaceReads(t *testing.T) {
+	var data []byte
+	data = append(data, clientFrame(opText, []byte("one"), true)...)
+	data = append(data, clientFrame(opPing, []byte("ping"), true)...)
+	data = append(data, clientFrame(opBin, []byte("tw"), false)...)
+	data = append(data, clientFrame(opCont, []byte("o"), true)...)
+	data = append(data, clientFrame(opText, []byte("three"), true)...)
+	want := []string{"one", "two", "three"}
+	// whole frames in one read, and frames split across reads
+	for _, chunk := range []int{0, 5} {
+		t.Run(fmt.Sprintf("chunk %d", chunk), func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.InPlaceReads = true
+			transport := &repeatTransport{data: data, chunk: chunk}
+			c := newConn(context.Background(), transport, bufio.NewReader(transport), cfg, connInfo{path: "/"})
+			for i := 0; i < 3*len(want); i++ {
+				_, msg, err := c.ReadMessage()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(msg) != want[i%len(want)] {
+					t.Fatalf("message %d is %q, want %q", i, msg, want[i%len(want)])
+				}
+			}
+		})
+	}
+}
+
+func TestInPlaceReadsAlias(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.InPlaceReads = true
+	transport := &repeatTransport{data: clientFrame(opText, []byte("hello"), true)}
+	c := newConn(context.Background(), transport, bufio.NewReader(transport), cfg, connInfo{path: "/"})
+	_, msg, err := c.ReadMessage()
+	if err != nil || string(msg) != "hello" {
+		t.Fatalf("read %q, %v", msg, err)
+	}
+	buffer := *c.buffer
+	if i := bytes.Index(buffer, msg); i < 0 || &buffer[i] != &msg[0] {
+		t.Fatal("the message was copied out of the read buffer")
+	}
+}
+
+func TestInPlaceReadsWithWorkerPool(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.InPlaceReads = true
+	cfg.WorkerPoolSize = 4
+	if err := cfg.validate(); err == nil {
+		t.Fatal("InPlaceReads with WorkerPoolSize was accepted")
+	}
+}
+
+// BenchmarkEcho reads a message and writes it back, the way EchoHandler does
+func BenchmarkEcho(b *testing.B) {
+	for _, size := range []int{1 << 10, 1 << 20} {
+		for _, inPlace := range []bool{false, true} {
+			name := fmt.Sprintf("%dKB copied", size>>10)
+			if inPlace {
+				name = fmt.Sprintf("%dKB in place", size>>10)
+			}
+			b.Run(name, func(b *testing.B) {
+				cfg := DefaultConfig()
+				cfg.PingInterval = 0
+				cfg.ReadBufferSize = 64 << 10
+				cfg.InPlaceReads = inPlace
+				transport := &repeatTransport{data: clientFrame(opBin, make([]byte, size), true)}
+				c := newConn(context.Background(), transport, bufio.NewReaderSize(transport, 64<<10), cfg, connInfo{path: "/"})
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					messageType, data, err := c.ReadMessage()
+					if err != nil {
+						b.Fatal(err)
+					}
+					if err := c.WriteMessage(messageType, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+// fragmentedConn is a Conn reading a message of size bytes, sent in
+// fragments of 1KB, forever
+func fragmentedConn(cfg Config, size int) (*Conn, []byte) {
+	msg := make([]byte, size)
+	for i := range msg {
+		msg[i] = byte(i)
+	}
+	var data []byte
+	opcode := byte(opBin)
+	for pos := 0; pos < size; pos += 1024 {
+		end := min(pos+1024, size)
+		data = append(data, clientFrame(opcode, msg[pos:end], end == size)...)
+		opcode = opCont
+	}
+	transport := &repeatTransport{data: data}
+	return newConn(context.Background(), transport, bufio.NewReader(transport), cfg, connInfo{path: "/"}), msg
+}
+
+func TestReadMessageReassemblyBuffer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, msg := fragmentedConn(cfg, 8192)
+	c.SetReadLimit(8192)
+
+	_, first, err := c.ReadMessage()
+	if err != nil || !bytes.Equal(first, msg) {
+		t.Fatalf("read %d bytes, %v", len(first), err)
+	}
+	buffer := c.reassembly[:1]
+	if cap(buffer) < 8192 || cap(buffer) > 8193 {
+		t.Fatalf("expected the buffer to grow up to the read limit, its capacity is %d", cap(buffer))
+	}
+	clear(first)
+	_, second, err := c.ReadMessage()
+	if err != nil || !bytes.Equal(second, msg) {
+		t.Fatalf("read %d bytes, %v", len(second), err)
+	}
+	if &c.reassembly[:1][0] != &buffer[0] {
+		t.Fatalf("expected the reassembly buffer to be kept between messages")
+	}
+
+	// a message bigger than ReassemblyBufferSize doesn't stay in memory
+	cfg.ReassemblyBufferSize = 4096
+	c, msg = fragmentedConn(cfg, 8192)
+	if _, data, err := c.ReadMessage(); err != nil || !bytes.Equal(data, msg) {
+		t.Fatalf("read %d bytes, %v", len(data), err)
+	}
+	if c.reassembly != nil {
+		t.Fatalf("expected the reassembly buffer to be dropped, its capacity is %d", cap(c.reassembly))
+	}
+}
+
+func BenchmarkReadFragmentedMessages(b *testing.B) {
+	for _, keep := range []int{0, 1} {
+		name := "kept"
+		if keep == 1 {
+			name = "dropped"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.ReassemblyBufferSize = keep
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				c, _ := fragmentedConn(cfg, 8192)
+				for range 10_000 {
+					if _, _, err := c.ReadMessage(); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestConnReadMessageProtocolError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.CloseTimeout = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	errs := make(chan error)
+	go func() {
+		_, _, err := c.ReadMessage()
+		errs <- err
+	}()
+	// a continuation frame without a message to continue
+	go client.Write(clientFrame(opCont, []byte("orphan"), true))
+
+	reply := readFrameFrom(t, reader)
+	code, _, _ := parseClosePayload(reply.Payload)
+	if reply.Opcode != opClose || code != CloseProtocolError {
+		t.Fatalf("expected CLOSE 1002, got opcode %d code %d", reply.Opcode, code)
+	}
+	var ce *CloseError
+	if err := <-errs; !errors.As(err, &ce) || ce.Code != CloseProtocolError {
+		t.Fatalf("expected a 1002 close error, got %v", err)
+	}
+}
+
+func TestConnControlFrameProtocolErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		frame []byte
+	}{
+		{"fragmented ping", clientFrame(opPing, []byte("ping"), false)},
+		{"fragmented close", clientFrame(opClose, []byte{0x03, 0xE8}, false)},
+		{"126 byte pong", clientFrame(opPong, make([]byte, 126), true)},
+		{"reserved data opcode", clientFrame(0x3, []byte("?"), true)},
+		{"reserved control opcode", clientFrame(0xB, []byte("?"), true)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.CloseTimeout = 0
+			c, client, reader := pipeConn(t, cfg)
+
+			errs := make(chan error, 1)
+			go func() {
+				_, _, err := c.ReadMessage()
+				errs <- err
+			}()
+			go client.Write(tt.frame)
+
+			reply := readFrameFrom(t, reader)
+			if code, _, _ := parseClosePayload(reply.Payload); reply.Opcode != opClose || code != CloseProtocolError {
+				t.Fatalf("expected CLOSE 1002, got opcode %d code %d", reply.Opcode, code)
+			}
+			var ce *CloseError
+			if err := <-errs; !errors.As(err, &ce) || ce.Code != CloseProtocolError {
+				t.Fatalf("expected a 1002 close error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestConnSetReadLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.CloseTimeout = 0
+	cfg.MaxMessageSize = 1024
+	c, client, reader := pipeConn(t, cfg)
+
+	// Over the server-wide limit until the handler raises it
+	c.SetReadLimit(4096)
+	big := bytes.Repeat([]byte("x"), 2048)
+	go client.Write(clientFrame(opBin, big, true))
+	if _, data, err := c.ReadMessage(); err != nil || !bytes.Equal(data, big) {
+		t.Fatalf("expected the 2KB message to pass, got %d bytes, %v", len(data), err)
+	}
+
+	// Tightened, the fragments add up to more than the limit
+	c.SetReadLimit(1024)
+	errs := make(chan error)
+	go func() {
+		_, _, err := c.ReadMessage()
+		errs <- err
+	}()
+	go func() {
+		client.Write(clientFrame(opBin, big[:1024], false))
+		client.Write(clientFrame(opCont, big[1024:], true))
+	}()
+	reply := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(reply.Payload); reply.Opcode != opClose || code != CloseMessageTooBig {
+		t.Fatalf("expected CLOSE 1009, got opcode %d code %d", reply.Opcode, code)
+	}
+	if err := <-errs; !errors.Is(err, ErrReadLimit) {
+		t.Fatalf("expected ErrReadLimit, got %v", err)
+	}
+}
+
+func TestConnWriteMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, reader := pipeConn(t, cfg)
+
+	large := bytes.Repeat([]byte("0123456789abcdef"), 70000/16+1) // > 64KB needs the 64-bit length
+	tests := []struct {
+		name        string
+		messageType int
+		payload     []byte
+	}{
+		{"text", opText, []byte("Hello")},
+		{"binary", opBin, []byte{0x00, 0x01, 0xFE, 0xFF}},
+		{"large", opBin, large},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := make(chan error, 1)
+			go func() { errs <- c.WriteMessage(tt.messageType, tt.payload) }()
+			f := readFrameFrom(t, reader)
+			if err := <-errs; err != nil {
+				t.Fatalf("WriteMessage: %v", err)
+			}
+			if !f.Fin || int(f.Opcode) != tt.messageType || f.Rsv1 {
+				t.Fatalf("unexpected frame: fin=%t opcode=%d rsv1=%t", f.Fin, f.Opcode, f.Rsv1)
+			}
+			if !bytes.Equal(f.Payload, tt.payload) {
+				t.Fatalf("payload mismatch: got %d bytes, want %d", len(f.Payload), len(tt.payload))
+			}
+		})
+	}
+
+	if err := c.WriteMessage(opPing, nil); err == nil {
+		t.Fatal("expected WriteMessage to refuse a control opcode")
+	}
+}
+
+// streamEcho sends every message read from c back through NextWriter
+func streamEcho(c *Conn) {
+	for {
+		messageType, r, err := c.NextReader()
+		if err != nil {
+			return
+		}
+		w, err := c.NextWriter(messageType)
+		if err != nil {
+			return
+		}
+		if _, err := io.Copy(w, r); err != nil {
+			return
+		}
+		if err := w.Close(); err != nil {
+			return
+		}
+	}
+}
+
+// streamThrough writes size bytes from src as one message and returns the
+// hashes of what was sent and what came back. It fails the test if nothing
+// came back before the whole message was written.
+func streamThrough(t *testing.T, client *Conn, messageType int, src io.Reader, size int64) (sent, received []byte) {
+	t.Helper()
+	var written atomic.Bool
+	errs := make(chan error, 1)
+	sentHash := sha256.New()
+	go func() {
+		w, err := client.NextWriter(messageType)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if _, err := io.Copy(w, io.TeeReader(io.LimitReader(src, size), sentHash)); err != nil {
+			errs <- err
+			return
+		}
+		written.Store(true)
+		errs <- w.Close()
+	}()
+
+	gotType, r, err := client.NextReader()
+	if err != nil {
+		t.Fatalf("NextReader: %v", err)
+	}
+	if gotType != messageType {
+		t.Fatalf("expected message type %d, got %d", messageType, gotType)
+	}
+	receivedHash := sha256.New()
+	first := make([]byte, 1)
+	if _, err := io.ReadFull(r, first); err != nil {
+		t.Fatalf("failed to read the echo: %v", err)
+	}
+	if written.Load() {
+		t.Fatal("the echo only started after the whole message was written")
+	}
+	receivedHash.Write(first)
+	n, err := io.Copy(receivedHash, r)
+	if err != nil {
+		t.Fatalf("failed to read the echo: %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("failed to write the message: %v", err)
+	}
+	if n+1 != size {
+		t.Fatalf("expected %d bytes back, got %d", size, n+1)
+	}
+	return sentHash.Sum(nil), receivedHash.Sum(nil)
+}
+
+func TestConnStreamLargeMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.MaxMessageSize = 0 // streamed messages are never held in memory
+	cfg.FragmentSize = 4096
+	server, client := connPair(t, cfg, nil)
+	go streamEcho(server)
+
+	const size = 50 << 20
+	sent, received := streamThrough(t, client, opBin, rand.NewChaCha8([32]byte{1}), size)
+	if !bytes.Equal(sent, received) {
+		t.Fatal("the echoed message differs from the one sent")
+	}
+}
+
+func TestConnStreamCompressed(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.MaxMessageSize = 0
+	cfg.FragmentSize = 1024
+	for _, params := range []deflateParams{{}, {serverNoContextTakeover: true, clientNoContextTakeover: true}} {
+		server, client := connPair(t, cfg, &params)
+		go streamEcho(server)
+
+		text := wordySample(4 << 20)
+		// Twice, so the second message may refer back to the first
+		for i := 0; i < 2; i++ {
+			sent, received := streamThrough(t, client, opText, strings.NewReader(text), int64(len(text)))
+			if !bytes.Equal(sent, received) {
+				t.Fatalf("%+v: the echoed message differs from the one sent", params)
+			}
+		}
+	}
+}
+
+func TestConnNextReaderControlFramesMidMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	go func() {
+		client.Write(clientFrame(opText, []byte("first "), false))
+		client.Write(clientFrame(opPing, []byte("are you there"), true))
+		client.Write(clientFrame(opCont, []byte("second"), true))
+	}()
+
+	results := make(chan readResult, 1)
+	go func() {
+		messageType, r, err := c.NextReader()
+		if err != nil {
+			results <- readResult{err: err}
+			return
+		}
+		data, err := io.ReadAll(r)
+		results <- readResult{messageType, data, err}
+	}()
+
+	// The ping is answered while the message is still being read
+	if f := readFrameFrom(t, reader); f.Opcode != opPong || string(f.Payload) != "are you there" {
+		t.Fatalf("expected a pong echoing the ping, got opcode %d %q", f.Opcode, f.Payload)
+	}
+	got := <-results
+	if got.err != nil || got.messageType != opText || string(got.data) != "first second" {
+		t.Fatalf("unexpected message: type %d %q, err %v", got.messageType, got.data, got.err)
+	}
+}
+
+func TestConnNextWriterFragments(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.FragmentSize = 4
+	c, _, reader := pipeConn(t, cfg)
+
+	go func() {
+		w, _ := c.NextWriter(opText)
+		io.WriteString(w, "Hel")
+		io.WriteString(w, "lo, World")
+		w.Close()
+	}()
+
+	want := []struct {
+		opcode  byte
+		payload string
+		fin     bool
+	}{
+		{opText, "Hell", false},
+		{opCont, "o, W", false},
+		{opCont, "orld", false},
+		{opCont, "", true},
+	}
+	for _, w := range want {
+		f := readFrameFrom(t, reader)
+		if f.Opcode != w.opcode || string(f.Payload) != w.payload || f.Fin != w.fin {
+			t.Fatalf("got opcode %d %q fin=%t, want opcode %d %q fin=%t", f.Opcode, f.Payload, f.Fin, w.opcode, w.payload, w.fin)
+		}
+	}
+}
+
+func TestWriteMessageFragments(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WriteFragmentSize = 1000
+	c, _, reader := pipeConn(t, cfg)
+
+	data := make([]byte, 3000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	go c.WriteMessage(BinaryMessage, data)
+	var got []byte
+	for i, opcode := range []byte{opBin, opCont, opCont} {
+		f := readFrameFrom(t, reader)
+		if f.Opcode != opcode || len(f.Payload) != 1000 || f.Fin != (i == 2) {
+			t.Fatalf("fragment %d: opcode %d, %d bytes, fin=%t", i, f.Opcode, len(f.Payload), f.Fin)
+		}
+		got = append(got, f.Payload...)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the fragments don't add up to the message")
+	}
+
+	// control frames stay whole
+	go c.WriteControl(PingMessage, make([]byte, 125), time.Time{})
+	if f := readFrameFrom(t, reader); f.Opcode != opPing || !f.Fin || len(f.Payload) != 125 {
+		t.Fatalf("expected a whole ping, got opcode %d fin=%t", f.Opcode, f.Fin)
+	}
+}
+
+func TestWriteMessageFragmentsCompressed(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WriteFragmentSize = 512
+	server, client := connPair(t, cfg, &deflateParams{})
+
+	msg := []byte(wordySample(64 << 10))
+	for i := 0; i < 2; i++ {
+		go server.WriteMessage(TextMessage, msg)
+		if messageType, data, err := client.ReadMessage(); err != nil || messageType != TextMessage || !bytes.Equal(data, msg) {
+			t.Fatalf("message %d: the client reassembled %d bytes, %v", i, len(data), err)
+		}
+	}
+}
+
+// maxWriteTransport remembers the biggest write
+type maxWriteTransport struct {
+	discardTransport
+	max int
+}
+
+func (t *maxWriteTransport) Write(p []byte) (int, error) {
+	t.max = max(t.max, len(p))
+	return len(p), nil
+}
+
+func TestWriteMessageFragmentsMemory(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WriteFragmentSize = 64 << 10
+	transport := &maxWriteTransport{}
+	c := newConn(context.Background(), transport, nil, cfg, connInfo{path: "/"})
+	data := make([]byte, 32<<20)
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := c.WriteMessage(BinaryMessage, data); err != nil {
+		t.Fatalf("WriteMessage: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if transport.max > cfg.WriteFragmentSize+wire.MaxHeaderSize {
+		t.Fatalf("wrote %d bytes at once", transport.max)
+	}
+	// one fragment is encoded at a time, in the same buffer
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Fatalf("writing a 32MB message allocated %d bytes", allocated)
+	}
+}
+
+// BenchmarkReadLargeFrame reads a 1MB frame arriving in pieces of
+// different sizes. The decoder looks at every byte once, so the cost doesn't
+// grow with the number of pieces.
+func BenchmarkReadLargeFrame(b *testing.B) {
+	payload := make([]byte, 1<<20)
+	for _, chunk := range []int{1 << 10, 64 << 10} {
+		b.Run(fmt.Sprintf("%dKB chunks", chunk>>10), func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.ReadBufferSize = 64 << 10
+			transport := &repeatTransport{data: clientFrame(opBin, payload, true), chunk: chunk}
+			c := newConn(context.Background(), transport, bufio.NewReaderSize(transport, 64<<10), cfg, connInfo{path: "/"})
+			buf := make([]byte, len(payload))
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := c.ReadMessageInto(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestConnConcurrentVectoredWrites(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, reader := pipeConn(t, cfg)
+
+	// every writer sends messages of its own byte, written as a header and
+	// the payload in place, while pings go out in between
+	const writers, perWriter, pings = 4, 20, 50
+	size := vectoredWriteSize * 4
+	errs := make(chan error, writers+1)
+	for i := range writers {
+		go func() {
+			payload := bytes.Repeat([]byte{byte(i)}, size)
+			for range perWriter {
+				if err := c.WriteMessage(BinaryMessage, payload); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+	go func() {
+		for range pings {
+			if err := c.Ping([]byte("between")); err != nil {
+				errs <- err
+				return
+			}
+		}
+		errs <- nil
+	}()
+
+	for data, control := 0, 0; data < writers*perWriter || control < pings; {
+		f := readFrameFrom(t, reader)
+		switch f.Opcode {
+		case opPing:
+			if string(f.Payload) != "between" {
+				t.Fatalf("a ping carried %.20q", f.Payload)
+			}
+			control++
+		case opBin:
+			if !f.Fin || len(f.Payload) != size || bytes.Count(f.Payload, f.Payload[:1]) != size {
+				t.Fatalf("a message arrived mixed up with another frame")
+			}
+			data++
+		default:
+			t.Fatalf("unexpected opcode %d", f.Opcode)
+		}
+	}
+	for range writers + 1 {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkWriteLargeMessage writes 8MB messages with the payload copied
+// behind the header, as buildFrame does, and as WriteMessage writes them
+func BenchmarkWriteLargeMessage(b *testing.B) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	payload := make([]byte, 8<<20)
+	b.Run("concatenated", func(b *testing.B) {
+		c := newConn(context.Background(), discardTransport{}, nil, cfg, connInfo{path: "/"})
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			frameData, err := c.buildFrame(opBin, payload, true)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if err := c.write(frameData); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("vectored", func(b *testing.B) {
+		c := newConn(context.Background(), discardTransport{}, nil, cfg, connInfo{path: "/"})
+		b.SetBytes(int64(len(payload)))
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if err := c.WriteMessage(BinaryMessage, payload); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// countingTransport keeps what is written to it and counts the writes
+type countingTransport struct {
+	discardTransport
+	writes  int
+	written []byte
+}
+
+func (t *countingTransport) Write(p []byte) (int, error) {
+	t.writes++
+	t.written = append(t.written, p...)
+	return len(p), nil
+}
+
+func TestWriteBuffer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WriteBufferSize = 100
+	transport := &countingTransport{}
+	c := newConn(context.Background(), transport, nil, cfg, connInfo{path: "/"})
+
+	expectWritten := func(writes int, want ...string) {
+		t.Helper()
+		frames, rest, err := wire.ParseFrames(transport.written, wire.ParseOptions{})
+		if err != nil || len(rest) != 0 {
+			t.Fatalf("wrote broken frames: %v", err)
+		}
+		var got []string
+		for _, f := range frames {
+			got = append(got, string(f.Payload))
+		}
+		if transport.writes != writes || !slices.Equal(got, want) {
+			t.Fatalf("expected %d writes of %q, got %d of %q", writes, want, transport.writes, got)
+		}
+	}
+
+	for _, msg := range []string{"one", "two", "three"} {
+		if err := c.WriteMessage(TextMessage, []byte(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expectWritten(0)
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expectWritten(1, "one", "two", "three")
+
+	// a control frame takes the frames before it along
+	c.WriteMessage(TextMessage, []byte("four"))
+	c.Ping([]byte("ping"))
+	expectWritten(2, "one", "two", "three", "four", "ping")
+
+	// a full buffer is written before the frame that doesn't fit, one as big
+	// as the buffer goes out on its own
+	c.WriteMessage(TextMessage, bytes.Repeat([]byte("5"), 60))
+	c.WriteMessage(TextMessage, bytes.Repeat([]byte("6"), 60))
+	c.WriteMessage(TextMessage, bytes.Repeat([]byte("7"), 100))
+	expectWritten(5, "one", "two", "three", "four", "ping", strings.Repeat("5", 60), strings.Repeat("6", 60), strings.Repeat("7", 100))
+}
+
+func TestWriteBufferDelay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WriteBufferSize = 4096
+	cfg.WriteBufferDelay = 10 * time.Millisecond
+	c, client, reader := pipeConn(t, cfg)
+
+	if err := c.WriteMessage(TextMessage, []byte("soon")); err != nil {
+		t.Fatal(err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if f := readFrameFrom(t, reader); f.Opcode != opText || string(f.Payload) != "soon" {
+		t.Fatalf("expected the buffered message, got opcode %d %q", f.Opcode, f.Payload)
+	}
+}
+
+func TestWriteBufferFlushedOnClose(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WriteBufferSize = 4096
+	server, client := connPair(t, cfg, nil)
+
+	if err := server.WriteMessage(TextMessage, []byte("last words")); err != nil {
+		t.Fatal(err)
+	}
+	closed := make(chan error, 1)
+	go func() { closed <- server.Close(CloseNormalClosure, "bye") }()
+	if _, data, err := client.ReadMessage(); err != nil || string(data) != "last words" {
+		t.Fatalf("read %q, %v", data, err)
+	}
+	var ce *CloseError
+	if _, _, err := client.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseNormalClosure {
+		t.Fatalf("expected the CLOSE after the message, got %v", err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+// BenchmarkSmallMessages writes 100k messages of 20 bytes per iteration,
+// one write to the socket for each of them and through a write buffer
+func BenchmarkSmallMessages(b *testing.B) {
+	msg := make([]byte, 20)
+	for _, size := range []int{0, 16 << 10} {
+		name := "unbuffered"
+		if size > 0 {
+			name = "buffered"
+		}
+		b.Run(name, func(b *testing.B) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.WriteBufferSize = size
+			transport := &countingTransport{}
+			c := newConn(context.Background(), transport, nil, cfg, connInfo{path: "/"})
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for range 100_000 {
+					if err := c.WriteMessage(BinaryMessage, msg); err != nil {
+						b.Fatal(err)
+					}
+					transport.written = transport.written[:0]
+				}
+				c.Flush()
+			}
+			b.ReportMetric(float64(transport.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+func TestConnConcurrentWrites(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.FragmentSize = 8
+	c, _, reader := pipeConn(t, cfg)
+
+	const writers, perWriter = 16, 1000
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		go func() {
+			for j := 0; j < perWriter; j++ {
+				msg := fmt.Sprintf("writer %d message %d", i, j)
+				var err error
+				if j%10 == 0 {
+					// streamed in fragments, which must not interleave with other messages
+					var w io.WriteCloser
+					if w, err = c.NextWriter(opText); err == nil {
+						io.WriteString(w, msg)
+						err = w.Close()
+					}
+				} else {
+					err = c.WriteMessage(opText, []byte(msg))
+				}
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- nil
+		}()
+	}
+
+	next := make([]int, writers) // the message number expected from every writer
+	var message []byte
+	for received := 0; received < writers*perWriter; {
+		f := readFrameFrom(t, reader)
+		if f.Opcode != opText && f.Opcode != opCont {
+			t.Fatalf("unexpected opcode %d", f.Opcode)
+		}
+		if (f.Opcode == opText) != (message == nil) {
+			t.Fatalf("fragments of different messages interleaved")
+		}
+		message = append(message, f.Payload...)
+		if !f.Fin {
+			continue
+		}
+		var i, j int
+		if _, err := fmt.Sscanf(string(message), "writer %d message %d", &i, &j); err != nil {
+			t.Fatalf("malformed message %q", message)
+		}
+		if j != next[i] {
+			t.Fatalf("writer %d: expected message %d, got %d", i, next[i], j)
+		}
+		next[i]++
+		message = nil
+		received++
+	}
+	for i := 0; i < writers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("write failed: %v", err)
+		}
+	}
+}
+
+func TestConnNoWritesAfterClose(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, reader := pipeConn(t, cfg)
+
+	go c.sendClose(&CloseError{Code: CloseNormalClosure})
+	if f := readFrameFrom(t, reader); f.Opcode != opClose {
+		t.Fatalf("expected CLOSE, got opcode %d", f.Opcode)
+	}
+	if err := c.WriteMessage(opText, []byte("too late")); !errors.Is(err, ErrCloseSent) {
+		t.Fatalf("expected ErrCloseSent, got %v", err)
+	}
+}
+
+func TestWriteControlDuringMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.FragmentSize = 100
+	c, _, reader := pipeConn(t, cfg)
+
+	resume := make(chan struct{})
+	done := make(chan error, 1)
+	go func() {
+		w, _ := c.NextWriter(opBin)
+		w.Write(make([]byte, 100))
+		<-resume
+		w.Write(make([]byte, 100))
+		done <- w.Close()
+	}()
+
+	if f := readFrameFrom(t, reader); f.Opcode != opBin || f.Fin {
+		t.Fatalf("expected the first fragment, got opcode %d fin=%t", f.Opcode, f.Fin)
+	}
+	// The message is still being written, a ping goes out in between
+	errs := make(chan error, 1)
+	go func() { errs <- c.WriteControl(opPing, []byte("between"), time.Now().Add(time.Second)) }()
+	if f := readFrameFrom(t, reader); f.Opcode != opPing || string(f.Payload) != "between" {
+		t.Fatalf("expected the ping, got opcode %d %q", f.Opcode, f.Payload)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("WriteControl: %v", err)
+	}
+	close(resume)
+	for _, wantFin := range []bool{false, true} {
+		if f := readFrameFrom(t, reader); f.Opcode != opCont || f.Fin != wantFin {
+			t.Fatalf("expected a continuation fin=%t, got opcode %d fin=%t", wantFin, f.Opcode, f.Fin)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("message write failed: %v", err)
+	}
+}
+
+func TestWriteControlDeadline(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WriteTimeout = 0
+	c, _, _ := pipeConn(t, cfg)
+
+	// Nobody reads, the large frame holds the write lock
+	go c.WriteMessage(opBin, make([]byte, 1<<20))
+	for len(c.writeLock) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	err := c.WriteControl(opPing, nil, time.Now().Add(50*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("WriteControl gave up after %v", elapsed)
+	}
+}
+
+func TestWriteControlValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, _ := pipeConn(t, cfg)
+
+	if err := c.WriteControl(opPing, make([]byte, maxControlPayload+1), time.Time{}); err == nil {
+		t.Fatal("expected an oversized control payload to be refused")
+	}
+	if err := c.WriteControl(opText, nil, time.Time{}); err == nil {
+		t.Fatal("expected a data opcode to be refused")
+	}
+}
+
+// answerClose reads the server's CLOSE and replies with the same code
+func answerClose(t *testing.T, client net.Conn, reader *bufio.Reader) (code int, reason string) {
+	t.Helper()
+	f := readFrameFrom(t, reader)
+	if f.Opcode != opClose {
+		t.Fatalf("expected CLOSE, got opcode %d", f.Opcode)
+	}
+	code, reason, _ = parseClosePayload(f.Payload)
+	reply, _ := formatClosePayload(code, "")
+	if _, err := client.Write(clientFrame(opClose, reply, true)); err != nil {
+		t.Fatalf("failed to answer the CLOSE: %v", err)
+	}
+	return code, reason
+}
+
+func TestConnCloseCooperativePeer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	result := make(chan error, 1)
+	go func() { result <- c.Close(4000, "bye for now") }()
+	// Data the peer sent before seeing the CLOSE is discarded
+	go client.Write(clientFrame(opText, []byte("late"), true))
+	code, reason := answerClose(t, client, reader)
+	if code != 4000 || reason != "bye for now" {
+		t.Fatalf("expected CLOSE 4000 bye for now, got %d %q", code, reason)
+	}
+	if err := <-result; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	// The socket is gone
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	// A second call is a no-op
+	if err := c.Close(CloseNormalClosure, ""); err != nil {
+		t.Fatalf("second Close: %v", err)
+	}
+}
+
+func TestConnCloseWhileReading(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				readErr <- err
+				return
+			}
+		}
+	}()
+	// let the reader block in Read first
+	for c.readMu.TryLock() {
+		c.readMu.Unlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	result := make(chan error, 1)
+	go func() { result <- c.Close(CloseNormalClosure, "done") }()
+	answerClose(t, client, reader)
+	if err := <-result; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	var ce *CloseError
+	if err := <-readErr; !errors.As(err, &ce) || ce.Code != CloseNormalClosure {
+		t.Fatalf("expected the reader to end with our close, got %v", err)
+	}
+}
+
+func TestConnCloseTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.CloseTimeout = 100 * time.Millisecond
+	c, _, reader := pipeConn(t, cfg)
+
+	start := time.Now()
+	result := make(chan error, 1)
+	go func() { result <- c.Close(CloseGoingAway, "") }()
+	if f := readFrameFrom(t, reader); f.Opcode != opClose {
+		t.Fatalf("expected CLOSE, got opcode %d", f.Opcode)
+	}
+	// never answered
+	err := <-result
+	if err == nil {
+		t.Fatal("expected an error when the peer never answers")
+	}
+	if elapsed := time.Since(start); elapsed < cfg.CloseTimeout || elapsed > time.Second {
+		t.Fatalf("Close returned after %v, expected about %v", elapsed, cfg.CloseTimeout)
+	}
+	if _, rerr := reader.ReadByte(); rerr == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+	if again := c.Close(CloseNormalClosure, ""); again != err {
+		t.Fatalf("expected the second Close to return %v, got %v", err, again)
+	}
+}
+
+func TestConnCloseValidation(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, _ := pipeConn(t, cfg)
+
+	if err := c.Close(CloseAbnormalClosure, ""); err == nil {
+		t.Fatal("expected a reserved code to be refused")
+	}
+	c2, _, _ := pipeConn(t, cfg)
+	if err := c2.Close(CloseNormalClosure, strings.Repeat("x", maxCloseReasonLen+1)); err == nil {
+		t.Fatal("expected an overlong reason to be refused")
+	}
+}
+
+func TestConnCloseNow(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, reader := pipeConn(t, cfg)
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		readErr <- err
+	}()
+	c.CloseNow()
+	if err := <-readErr; err == nil {
+		t.Fatal("expected the reader to fail")
+	}
+	// no CLOSE frame, the connection is just gone
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("expected the connection to be closed")
+	}
+}
+
+// readInBackground runs ReadMessage until it fails and returns the error
+func readInBackground(c *Conn) <-chan error {
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	return errs
+}
+
+func TestConnPingPongHandler(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	pongs := make(chan string, 1)
+	c.SetPongHandler(func(appData string) error {
+		pongs <- appData
+		return nil
+	})
+	readInBackground(c)
+
+	go c.Ping([]byte("probe"))
+	f := readFrameFrom(t, reader)
+	if f.Opcode != opPing || string(f.Payload) != "probe" {
+		t.Fatalf("expected PING probe, got opcode %d %q", f.Opcode, f.Payload)
+	}
+	// The pong arrives in the middle of a fragmented message
+	client.Write(clientFrame(opText, []byte("half"), false))
+	client.Write(clientFrame(opPong, f.Payload, true))
+	select {
+	case got := <-pongs:
+		if got != "probe" {
+			t.Fatalf("pong handler saw %q", got)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("pong handler wasn't called")
+	}
+}
+
+func TestConnPongHandlerError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	c.SetPongHandler(func(appData string) error {
+		return &CloseError{Code: ClosePolicyViolation, Text: "unexpected pong"}
+	})
+	readErr := readInBackground(c)
+
+	go client.Write(clientFrame(opPong, []byte("unsolicited"), true))
+	code, reason := answerClose(t, client, reader)
+	if code != ClosePolicyViolation || reason != "unexpected pong" {
+		t.Fatalf("expected CLOSE 1008 unexpected pong, got %d %q", code, reason)
+	}
+	var ce *CloseError
+	if err := <-readErr; !errors.As(err, &ce) || ce.Code != ClosePolicyViolation {
+		t.Fatalf("expected the reader to end with 1008, got %v", err)
+	}
+}
+
+func TestConnPingHandler(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	// Count the pings and never answer them
+	var pings atomic.Int32
+	c.SetPingHandler(func(appData string) error {
+		pings.Add(1)
+		return nil
+	})
+	readInBackground(c)
+
+	client.Write(clientFrame(opPing, []byte("one"), true))
+	client.Write(clientFrame(opPing, []byte("two"), true))
+	for deadline := time.Now().Add(2 * time.Second); pings.Load() != 2; {
+		if time.Now().After(deadline) {
+			t.Fatalf("ping handler saw %d pings, want 2", pings.Load())
+		}
+		time.Sleep(time.Millisecond)
+	}
+	// and no pong was sent
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := reader.ReadByte(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected nothing from the server, got %v", err)
+	}
+}
+
+func TestConnPingHandlerError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	c.SetPingHandler(func(appData string) error {
+		return errors.New("too many pings")
+	})
+	readErr := readInBackground(c)
+
+	go client.Write(clientFrame(opPing, nil, true))
+	if code, _ := answerClose(t, client, reader); code != CloseInternalServerErr {
+		t.Fatalf("expected CLOSE 1011, got %d", code)
+	}
+	if err := <-readErr; err == nil {
+		t.Fatal("expected the reader to fail")
+	}
+}
+
+func TestConnCloseHandler(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	var gotCode int
+	var gotText string
+	c.SetCloseHandler(func(code int, text string) error {
+		gotCode, gotText = code, text
+		payload, _ := formatClosePayload(4000, "see you")
+		return c.WriteControl(opClose, payload, time.Now().Add(time.Second))
+	})
+	readErr := readInBackground(c)
+
+	payload, _ := formatClosePayload(4321, "custom reason")
+	go client.Write(clientFrame(opClose, payload, true))
+	f := readFrameFrom(t, reader)
+	code, reason, _ := parseClosePayload(f.Payload)
+	if f.Opcode != opClose || code != 4000 || reason != "see you" {
+		t.Fatalf("expected the handler's CLOSE 4000, got opcode %d code %d %q", f.Opcode, code, reason)
+	}
+	err := <-readErr
+	if gotCode != 4321 || gotText != "custom reason" {
+		t.Fatalf("close handler saw %d %q", gotCode, gotText)
+	}
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != 4321 || ce.Text != "custom reason" {
+		t.Fatalf("expected CloseError 4321, got %v", err)
+	}
+}
+
+func TestConnCloseHandlerError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	c.SetCloseHandler(func(code int, text string) error {
+		return errors.New("no reply")
+	})
+	readErr := readInBackground(c)
+
+	payload, _ := formatClosePayload(4321, "custom reason")
+	go client.Write(clientFrame(opClose, payload, true))
+	var ce *CloseError
+	if err := <-readErr; !errors.As(err, &ce) || ce.Code != 4321 {
+		t.Fatalf("expected CloseError 4321, got %v", err)
+	}
+	// No CLOSE was sent, the connection is just dropped
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be closed, got %v", err)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// ReadMessageContext is ReadMessage returning ctx.Err() as soon as ctx is
+// cancelled. The blocked read is interrupted by moving its deadline to now,
+// or by dropping the connection with Config.CloseOnCancel. When the
+// cancellation comes before the next message started the connection stays
+// usable. When part of a message was already read it can't be delivered
+// anymore: the connection is closed with 1001 and later reads return
+// ErrReadInterrupted.
+func (c *Conn) ReadMessageContext(ctx context.Context) (messageType int, data []byte, err error) {
+	if ctx.Done() == nil {
+		return c.ReadMessage()
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, nil, err
+	}
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(fired)
+		if c.cfg.CloseOnCancel {
+			c.CloseNow()
+			return
+		}
+		c.readCancel.Store(true)
+		_ = c.conn.SetReadDeadline(time.Now())
+	})
+	messageType, data, err = c.ReadMessage()
+	if stop() {
+		return messageType, data, err
+	}
+	<-fired
+	if err != nil {
+		return 0, nil, ctx.Err()
+	}
+	// The message was complete before the deadline took effect
+	if c.readCancel.Swap(false) {
+		_ = c.conn.SetReadDeadline(time.Time{})
+	}
+	return messageType, data, nil
+}
+
+// WriteMessageContext is WriteMessage returning ctx.Err() as soon as ctx is
+// cancelled. A frame may be half way out when the write is interrupted, so
+// nothing can follow it: a cancelled write always drops the connection.
+// Waiting for another message to be written isn't interrupted.
+func (c *Conn) WriteMessageContext(ctx context.Context, messageType int, data []byte) error {
+	if ctx.Done() == nil {
+		return c.WriteMessage(messageType, data)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	fired := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		defer close(fired)
+		if c.cfg.CloseOnCancel {
+			c.CloseNow()
+			return
+		}
+		_ = c.conn.SetWriteDeadline(time.Now())
+	})
+	err := c.WriteMessage(messageType, data)
+	if stop() {
+		return err
+	}
+	<-fired
+	if err != nil {
+		c.CloseNow()
+		return ctx.Err()
+	}
+	// The message went out before the deadline took effect
+	_ = c.lockWrite(time.Time{})
+	_ = c.conn.SetWriteDeadline(c.writeDeadline)
+	c.unlockWrite()
+	return nil
+}
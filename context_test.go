@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestReadMessageContextCancel(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, _ := pipeConn(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	start := time.Now()
+	if _, _, err := c.ReadMessageContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("the cancelled read took %v", elapsed)
+	}
+
+	// No message was started, the connection carries on
+	go client.Write(clientFrame(opText, []byte("still here"), true))
+	ctx, cancel = context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, data, err := c.ReadMessageContext(ctx); err != nil || string(data) != "still here" {
+		t.Fatalf("expected the next message, got %q %v", data, err)
+	}
+}
+
+func TestReadMessageContextMidMessage(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessageContext(ctx)
+		errs <- err
+	}()
+	// the first fragment arrives, the rest never does
+	client.Write(clientFrame(opText, []byte("half a "), false))
+	cancel()
+
+	reply := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(reply.Payload); reply.Opcode != opClose || code != CloseGoingAway {
+		t.Fatalf("expected CLOSE 1001, got opcode %d code %d", reply.Opcode, code)
+	}
+	if err := <-errs; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	// The half message is never delivered
+	if _, data, err := c.ReadMessage(); !errors.Is(err, ErrReadInterrupted) {
+		t.Fatalf("expected ErrReadInterrupted, got %q %v", data, err)
+	}
+}
+
+func TestWriteMessageContextStalled(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, _ := pipeConn(t, cfg) // the peer never reads
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := c.WriteMessageContext(ctx, opBin, make([]byte, 1<<20)); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	// Part of the frame may be out, the connection is gone
+	if err := c.WriteMessage(opText, []byte("more")); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("expected ErrConnClosed, got %v", err)
+	}
+}
+
+func TestCloseOnCancel(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.CloseOnCancel = true
+	c, client, reader := pipeConn(t, cfg)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(20*time.Millisecond, cancel)
+	if _, _, err := c.ReadMessageContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the connection to be dropped, got %v", err)
+	}
+}
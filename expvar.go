@@ -0,0 +1,73 @@
+package main
+
+import (
+	"expvar"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// expvarMetrics are the Metrics of the servers with Config.Expvar, the
+// "websocket" expvar map adds them up. expvar names are process-wide, a
+// server ending doesn't take its counts back.
+var expvarMetrics struct {
+	once sync.Once
+	mu   sync.Mutex
+	all  []*Metrics
+}
+
+// publishExpvar adds m to the "websocket" expvar map, publishing the map
+// the first time
+func publishExpvar(m *Metrics) {
+	expvarMetrics.once.Do(func() {
+		vars := new(expvar.Map).Init()
+		vars.Set("connections_open", expvarSum(func(m *Metrics) int64 { return m.active.Load() }))
+		vars.Set("connections_accepted", expvarSum(func(m *Metrics) int64 { return int64(m.handshakes[0].Load()) }))
+		vars.Set("messages_received", expvarSum(func(m *Metrics) int64 { return int64(m.received[0].Load() + m.received[1].Load()) }))
+		vars.Set("messages_sent", expvarSum(func(m *Metrics) int64 { return int64(m.sent[0].Load() + m.sent[1].Load()) }))
+		vars.Set("bytes_received", expvarSum(func(m *Metrics) int64 { return int64(m.bytesReceived.Load()) }))
+		vars.Set("bytes_sent", expvarSum(func(m *Metrics) int64 { return int64(m.bytesSent.Load()) }))
+		vars.Set("protocol_errors", expvarSum(func(m *Metrics) int64 { return int64(m.protocolErrors.Load()) }))
+		vars.Set("closes", expvar.Func(expvarCloses))
+		expvar.Publish("websocket", vars)
+	})
+	expvarMetrics.mu.Lock()
+	expvarMetrics.all = append(expvarMetrics.all, m)
+	expvarMetrics.mu.Unlock()
+}
+
+// expvarSum is a counter adding up count over the published Metrics
+func expvarSum(count func(m *Metrics) int64) expvar.Func {
+	return func() interface{} {
+		expvarMetrics.mu.Lock()
+		defer expvarMetrics.mu.Unlock()
+		var sum int64
+		for _, m := range expvarMetrics.all {
+			sum += count(m)
+		}
+		return sum
+	}
+}
+
+// expvarCloses returns the connections that ended by close code
+func expvarCloses() interface{} {
+	expvarMetrics.mu.Lock()
+	defer expvarMetrics.mu.Unlock()
+	closes := make(map[string]uint64)
+	for _, m := range expvarMetrics.all {
+		m.mu.Lock()
+		for code, n := range m.closes {
+			closes[strconv.Itoa(code)] += n
+		}
+		m.mu.Unlock()
+	}
+	return closes
+}
+
+// mountExpvar serves expvar's handler at /debug/vars on mux. expvar
+// registers it on http.DefaultServeMux itself.
+func mountExpvar(mux *http.ServeMux) {
+	if mux != http.DefaultServeMux {
+		mux.Handle("/debug/vars", expvar.Handler())
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// websocketVars fetches the "websocket" expvar map from url
+func websocketVars(t *testing.T, url string) map[string]json.RawMessage {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to fetch the vars: %v", err)
+	}
+	defer resp.Body.Close()
+	var vars struct {
+		Websocket map[string]json.RawMessage `json:"websocket"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		t.Fatalf("failed to decode the vars: %v", err)
+	}
+	return vars.Websocket
+}
+
+// expvarCounter decodes a counter of vars
+func expvarCounter(t *testing.T, vars map[string]json.RawMessage, name string) int64 {
+	t.Helper()
+	var n int64
+	if err := json.Unmarshal(vars[name], &n); err != nil {
+		t.Fatalf("%s: %v", name, err)
+	}
+	return n
+}
+
+func TestExpvar(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.EnableCompression = false
+	cfg.Expvar = true
+	cfg.Mux = http.NewServeMux()
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+	url := "http://" + addr + "/debug/vars"
+	// the counts are process-wide, other tests may have added to them
+	before := websocketVars(t, url)
+
+	c := dial(t, "ws://"+addr+"/", nil)
+	if err := c.WriteMessage(TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("expected the echo, got %q %v", data, err)
+	}
+	open := dial(t, "ws://"+addr+"/", nil)
+
+	// a frame with RSV2 set breaks the protocol
+	frame := clientFrame(opText, []byte("bad"), true)
+	frame[0] |= 0x20
+	if _, err := c.UnderlyingConn().Write(frame); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	var ce *CloseError
+	if _, _, err := c.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseProtocolError {
+		t.Fatalf("expected 1002, got %v", err)
+	}
+
+	var after map[string]json.RawMessage
+	deadline := time.Now().Add(time.Second)
+	for {
+		after = websocketVars(t, url)
+		if expvarCounter(t, after, "connections_open") == expvarCounter(t, before, "connections_open")+1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for name, want := range map[string]int64{
+		"connections_open":     1,
+		"connections_accepted": 2,
+		"messages_received":    1,
+		"messages_sent":        1,
+		"bytes_received":       11 + 9 + 8,                               // masked frames: hello, the bad one, the CLOSE reply
+		"bytes_sent":           7 + 2 + 2 + int64(len("protocol error")), // the echo, CLOSE 1002
+		"protocol_errors":      1,
+	} {
+		if got := expvarCounter(t, after, name) - expvarCounter(t, before, name); got != want {
+			t.Errorf("%s: expected %d more, got %d", name, want, got)
+		}
+	}
+	var closes map[string]int64
+	if err := json.Unmarshal(after["closes"], &closes); err != nil || closes["1002"] < 1 {
+		t.Errorf("expected a close with 1002, got %s", after["closes"])
+	}
+	open.CloseNow()
+}
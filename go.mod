@@ -1,3 +1,3 @@
 module gows
 
-go 1.21
+go 1.24
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+/*
+   WebSockets over HTTP/2 (RFC 8441)
+   HTTP/2 has no Upgrade and no connection to take over. The client opens a
+   stream with an extended CONNECT (:method CONNECT, :protocol websocket),
+   the server answers 200 and both sides exchange ordinary WebSocket frames as
+   the stream's DATA. There is no Sec-WebSocket-Key/Accept exchange.
+   Go only advertises SETTINGS_ENABLE_CONNECT_PROTOCOL when the process runs
+   with GODEBUG=http2xconnect=1.
+*/
+
+// h2Stream lets the frame loop run over an HTTP/2 stream: the request body is
+// read, frames go to the response writer and are flushed one by one.
+// A read deadline that passes ends the stream for good, unlike on a net.Conn.
+type h2Stream struct {
+	r  *http.Request
+	w  http.ResponseWriter
+	rc *http.ResponseController
+
+	mu     sync.Mutex // the response writer can't be used once the handler returned
+	closed bool
+}
+
+func (s *h2Stream) Read(p []byte) (int, error) {
+	return s.r.Body.Read(p)
+}
+
+func (s *h2Stream) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return 0, net.ErrClosed
+	}
+	n, err := s.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, s.rc.Flush()
+}
+
+func (s *h2Stream) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	return s.r.Body.Close()
+}
+
+func (s *h2Stream) SetReadDeadline(t time.Time) error {
+	return s.rc.SetReadDeadline(t)
+}
+
+func (s *h2Stream) SetWriteDeadline(t time.Time) error {
+	return s.rc.SetWriteDeadline(t)
+}
+
+// isExtendedConnect reports whether r is an HTTP/2 extended CONNECT
+func isExtendedConnect(r *http.Request) bool {
+	return r.Method == http.MethodConnect && r.ProtoMajor == 2 && r.Header.Get(":protocol") != ""
+}
+
+// acceptExtendedConnect answers a validated extended CONNECT with 200 and
+// returns the connection on its stream. The stream ends when the handler
+// serving r returns.
+func acceptExtendedConnect(ctx context.Context, w http.ResponseWriter, r *http.Request, cfg Config, info connInfo, header http.Header) (*Conn, error) {
+	for name, values := range header {
+		if name = http.CanonicalHeaderKey(name); !reservedResponseHeaders[name] {
+			w.Header()[name] = values
+		}
+	}
+	if info.deflate != nil {
+		w.Header().Set("Sec-WebSocket-Extensions", info.deflate.String())
+	}
+	if info.subprotocol != "" {
+		w.Header().Set("Sec-WebSocket-Protocol", info.subprotocol)
+	}
+
+	stream := &h2Stream{r: r, w: w, rc: http.NewResponseController(w)}
+	if cfg.HandshakeTimeout > 0 {
+		_ = stream.SetWriteDeadline(time.Now().Add(cfg.HandshakeTimeout))
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := stream.rc.Flush(); err != nil {
+		return nil, err
+	}
+	_ = stream.SetWriteDeadline(time.Time{})
+
+	return newConn(ctx, stream, bufio.NewReader(stream), cfg, info), nil
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Extended CONNECT is only enabled by GODEBUG=http2xconnect=1 when net/http
+// initializes, so the test runs itself again in a process that has it.
+func requireExtendedConnect(t *testing.T) {
+	t.Helper()
+	if strings.Contains(os.Getenv("GODEBUG"), "http2xconnect=1") {
+		return
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^"+t.Name()+"$", "-test.v")
+	cmd.Env = append(os.Environ(), "GODEBUG=http2xconnect=1")
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("%s with extended CONNECT failed: %v\n%s", t.Name(), err, out)
+	}
+	t.Skip("ran in a child process with GODEBUG=http2xconnect=1")
+}
+
+// HTTP/2 frame types and flags the test client uses
+const (
+	h2Data         = 0x0
+	h2Headers      = 0x1
+	h2RstStream    = 0x3
+	h2Settings     = 0x4
+	h2FlagEndData  = 0x1 // END_STREAM
+	h2FlagAck      = 0x1
+	h2FlagEndBlock = 0x4 // END_HEADERS
+
+	h2SettingEnableConnect = 0x8
+)
+
+// h2Client is just enough of an HTTP/2 client for one extended CONNECT:
+// net/http's Transport refuses to send the :protocol pseudo-header.
+type h2Client struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+	data   []byte // unread DATA of stream 1
+	ended  bool   // stream 1 was ended by the server
+}
+
+func dialH2(t *testing.T, addr string) *h2Client {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &h2Client{t: t, conn: conn, reader: bufio.NewReader(conn)}
+
+	if _, err := io.WriteString(conn, "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"); err != nil {
+		t.Fatalf("failed to send the preface: %v", err)
+	}
+	c.writeFrame(h2Settings, 0, 0, nil)
+
+	typ, flags, _, payload := c.readFrame()
+	if typ != h2Settings || flags&h2FlagAck != 0 {
+		t.Fatalf("expected the server's SETTINGS first, got frame type %d", typ)
+	}
+	connectEnabled := false
+	for i := 0; i+6 <= len(payload); i += 6 {
+		if binary.BigEndian.Uint16(payload[i:]) == h2SettingEnableConnect && binary.BigEndian.Uint32(payload[i+2:]) == 1 {
+			connectEnabled = true
+		}
+	}
+	if !connectEnabled {
+		t.Fatalf("server doesn't advertise SETTINGS_ENABLE_CONNECT_PROTOCOL")
+	}
+	c.writeFrame(h2Settings, h2FlagAck, 0, nil)
+	return c
+}
+
+func (c *h2Client) writeFrame(typ, flags byte, stream uint32, payload []byte) {
+	c.t.Helper()
+	hdr := make([]byte, 9)
+	hdr[0], hdr[1], hdr[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	hdr[3], hdr[4] = typ, flags
+	binary.BigEndian.PutUint32(hdr[5:], stream)
+	if _, err := c.conn.Write(append(hdr, payload...)); err != nil {
+		c.t.Fatalf("failed to write frame: %v", err)
+	}
+}
+
+func (c *h2Client) readFrame() (typ, flags byte, stream uint32, payload []byte) {
+	c.t.Helper()
+	hdr := make([]byte, 9)
+	if _, err := io.ReadFull(c.reader, hdr); err != nil {
+		c.t.Fatalf("failed to read frame: %v", err)
+	}
+	payload = make([]byte, int(hdr[0])<<16|int(hdr[1])<<8|int(hdr[2]))
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		c.t.Fatalf("failed to read frame: %v", err)
+	}
+	return hdr[3], hdr[4], binary.BigEndian.Uint32(hdr[5:]) & 0x7FFFFFFF, payload
+}
+
+// connect opens stream 1 with an extended CONNECT and returns the response
+// status. Headers are sent as HPACK literals without indexing or Huffman.
+func (c *h2Client) connect(protocol, authority, path string) int {
+	c.t.Helper()
+	var block []byte
+	for _, f := range [][2]string{
+		{":method", "CONNECT"}, {":protocol", protocol}, {":scheme", "http"},
+		{":path", path}, {":authority", authority}, {"sec-websocket-version", "13"},
+	} {
+		block = append(block, 0x00, byte(len(f[0])))
+		block = append(block, f[0]...)
+		block = append(block, byte(len(f[1])))
+		block = append(block, f[1]...)
+	}
+	c.writeFrame(h2Headers, h2FlagEndBlock, 1, block)
+
+	for {
+		typ, flags, stream, payload := c.readFrame()
+		if stream != 1 {
+			continue
+		}
+		switch typ {
+		case h2Headers:
+			c.ended = flags&h2FlagEndData != 0
+			// :status is the first field, the common ones are indexed in the static table
+			switch payload[0] {
+			case 0x88:
+				return 200
+			case 0x8c:
+				return 400
+			}
+			c.t.Fatalf("unexpected response header block % x", payload)
+		case h2RstStream:
+			c.t.Fatalf("server reset the stream")
+		}
+	}
+}
+
+// Write sends WebSocket bytes as DATA on stream 1
+func (c *h2Client) Write(p []byte) (int, error) {
+	c.writeFrame(h2Data, 0, 1, p)
+	return len(p), nil
+}
+
+// Read returns the DATA the server sent on stream 1, io.EOF once it ended
+func (c *h2Client) Read(p []byte) (int, error) {
+	for len(c.data) == 0 {
+		if c.ended {
+			return 0, io.EOF
+		}
+		typ, flags, stream, payload := c.readFrame()
+		if stream != 1 {
+			continue
+		}
+		switch typ {
+		case h2Data:
+			c.data = payload
+			c.ended = flags&h2FlagEndData != 0
+		case h2RstStream:
+			return 0, fmt.Errorf("stream reset")
+		}
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func TestHTTP2ExtendedConnect(t *testing.T) {
+	requireExtendedConnect(t)
+
+	cfg := DefaultConfig()
+	cfg.EnableHTTP2 = true
+	cfg.Handlers = map[string]Handler{"/ws": EchoHandler}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	client := dialH2(t, addr)
+	if status := client.connect("websocket", addr, "/ws"); status != 200 {
+		t.Fatalf("expected 200, got %d", status)
+	}
+
+	reader := bufio.NewReader(client)
+	for _, msg := range []string{"hello", strings.Repeat("x", 10000)} {
+		client.Write(clientFrame(opText, []byte(msg), true))
+		f := readFrameFrom(t, reader)
+		if f.Opcode != opText || string(f.Payload) != msg {
+			t.Fatalf("unexpected echo: opcode=%d, %d bytes", f.Opcode, len(f.Payload))
+		}
+	}
+
+	// the closing handshake works the same as over HTTP/1.1 and ends the stream
+	client.Write(clientFrame(opClose, []byte{0x03, 0xE8}, true))
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseNormalClosure {
+		t.Fatalf("expected close 1000, got opcode=%d code=%d", f.Opcode, code)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the stream to end after the close, got %v", err)
+	}
+}
+
+func TestHTTP2ConnectOtherProtocol(t *testing.T) {
+	requireExtendedConnect(t)
+
+	cfg := DefaultConfig()
+	cfg.EnableHTTP2 = true
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	client := dialH2(t, addr)
+	if status := client.connect("not-websocket", addr, "/"); status != 400 {
+		t.Fatalf("expected 400 for another protocol, got %d", status)
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// health is the body of the health and readiness endpoints
+type health struct {
+	Status        string  `json:"status"`
+	UptimeSeconds float64 `json:"uptime_seconds"`
+	Connections   int64   `json:"connections"`
+}
+
+// mountHealth serves the health and readiness endpoints of u on mux, see
+// Config.HealthPath and Config.ReadyPath
+func (u *Upgrader) mountHealth(mux *http.ServeMux, healthPath, readyPath string) {
+	if healthPath != "" {
+		mux.HandleFunc("GET "+healthPath, func(w http.ResponseWriter, r *http.Request) {
+			u.writeHealth(w, true)
+		})
+	}
+	if readyPath != "" {
+		mux.HandleFunc("GET "+readyPath, func(w http.ResponseWriter, r *http.Request) {
+			u.writeHealth(w, u.ready())
+		})
+	}
+}
+
+// ready is whether u takes upgrades: it isn't shutting down and has a
+// connection slot left
+func (u *Upgrader) ready() bool {
+	if u.ctx.Err() != nil {
+		return false
+	}
+	return u.cfg.MaxConnections == 0 || u.Connections() < int64(u.cfg.MaxConnections)
+}
+
+// writeHealth answers a probe with 200, or 503 when not ok
+func (u *Upgrader) writeHealth(w http.ResponseWriter, ok bool) {
+	h := health{Status: "ok", UptimeSeconds: time.Since(u.started).Seconds(), Connections: u.Connections()}
+	status := http.StatusOK
+	if !ok {
+		h.Status = "unavailable"
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(h)
+}
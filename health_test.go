@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// probe asks handler for path and decodes the answer
+func probe(t *testing.T, handler http.Handler, path string) (int, health) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	var h health
+	if err := json.NewDecoder(rec.Body).Decode(&h); err != nil {
+		t.Fatalf("%s: failed to decode %q: %v", path, rec.Body.String(), err)
+	}
+	return rec.Code, h
+}
+
+// waitStatus waits until path answers status
+func waitStatus(t *testing.T, handler http.Handler, path string, status int) health {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		code, h := probe(t, handler, path)
+		if code == status {
+			return h
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: expected %d, got %d %+v", path, status, code, h)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.HandshakeRate = 0
+	cfg.MaxConnections = 1
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	// plain GETs get an answer instead of the 404 of the WebSocket paths
+	for _, path := range []string{"/healthz", "/readyz"} {
+		resp, err := http.Get("http://" + addr + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var h health
+		err = json.NewDecoder(resp.Body).Decode(&h)
+		resp.Body.Close()
+		if err != nil || resp.StatusCode != http.StatusOK || h.Status != "ok" || h.Connections != 0 || h.UptimeSeconds <= 0 {
+			t.Fatalf("%s: expected 200 ok, got %d %+v %v", path, resp.StatusCode, h, err)
+		}
+	}
+
+	// at capacity the server is alive but not ready
+	c := dial(t, "ws://"+addr+"/", nil)
+	h := waitStatus(t, server.Handler, "/readyz", http.StatusServiceUnavailable)
+	if h.Status != "unavailable" || h.Connections != 1 {
+		t.Errorf("expected 1 connection, got %+v", h)
+	}
+	if code, _ := probe(t, server.Handler, "/healthz"); code != http.StatusOK {
+		t.Errorf("expected /healthz 200 at capacity, got %d", code)
+	}
+	c.Close(CloseNormalClosure, "")
+	waitStatus(t, server.Handler, "/readyz", http.StatusOK)
+}
+
+func TestHealthEndpointsShutdown(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.HandshakeRate = 0
+	cfg.HealthPath = "/live"
+	cfg.ReadyPath = "/ready"
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	if code, _ := probe(t, server.Handler, "/ready"); code != http.StatusOK {
+		t.Fatalf("expected /ready 200 after start, got %d", code)
+	}
+
+	// a client that never answers the CLOSE keeps Shutdown draining
+	held, _, _ := handshake(t, addr, "/", nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan struct{})
+	go func() {
+		server.Shutdown(ctx)
+		close(done)
+	}()
+	waitStatus(t, server.Handler, "/ready", http.StatusServiceUnavailable)
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned before the connection drained")
+	default:
+	}
+	if code, _ := probe(t, server.Handler, "/live"); code != http.StatusOK {
+		t.Errorf("expected /live 200 while draining, got %d", code)
+	}
+	held.Close()
+	<-done
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// hubQueueSize is how many broadcasts may wait for a connection before it
+// counts as too slow and is dropped
+const hubQueueSize = 64
+
+// Hub relays messages to every connection registered with it, e.g. the
+// members of a chat. Each connection gets its own queue and writer, so a
+// slow or dead connection never holds up a broadcast: once its queue is full
+// it is dropped. Connections may also join named rooms, e.g. "lobby" or
+// "game-42", and receive the broadcasts to those rooms.
+// All methods may be called from any goroutine.
+type Hub struct {
+	// Logger receives the hub's log lines, nil uses slog.Default(). The hub
+	// of a server with Config.Broadcast or Config.Room logs to Config.Logger.
+	Logger *slog.Logger
+
+	mu      sync.RWMutex
+	clients map[*Conn]*hubClient
+	rooms   map[string]map[*Conn]*hubClient // empty rooms are removed
+	closed  bool
+}
+
+// hubClient is the queue of one registered connection, closed when it unregisters
+type hubClient struct {
+	send  chan *PreparedMessage
+	rooms map[string]bool // the rooms the connection joined
+}
+
+// logger returns the Logger of h or the default one
+func (h *Hub) logger() *slog.Logger {
+	if h.Logger != nil {
+		return h.Logger
+	}
+	return slog.Default()
+}
+
+// NewHub returns a Hub without connections
+func NewHub() *Hub {
+	return &Hub{clients: make(map[*Conn]*hubClient), rooms: make(map[string]map[*Conn]*hubClient)}
+}
+
+// Register adds c to the hub, it receives every later broadcast until it is
+// unregistered. Connections registered after Close are ignored.
+func (h *Hub) Register(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.register(c)
+}
+
+// register adds c to the hub while the caller holds h.mu, it returns nil after Close
+func (h *Hub) register(c *Conn) *hubClient {
+	if h.closed {
+		return nil
+	}
+	if client := h.clients[c]; client != nil {
+		return client
+	}
+	client := &hubClient{send: make(chan *PreparedMessage, hubQueueSize), rooms: make(map[string]bool)}
+	h.clients[c] = client
+	go h.writeLoop(c, client)
+	return client
+}
+
+// Unregister removes c from the hub and from every room it joined,
+// broadcasts still queued for it are dropped
+func (h *Hub) Unregister(c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client := h.clients[c]
+	if client == nil {
+		return
+	}
+	for room := range client.rooms {
+		h.leave(room, c, client)
+	}
+	delete(h.clients, c)
+	close(client.send)
+}
+
+// Join adds c to room, registering it first when it isn't yet.
+// A connection may be in any number of rooms.
+func (h *Hub) Join(room string, c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	client := h.register(c)
+	if client == nil {
+		return
+	}
+	members := h.rooms[room]
+	if members == nil {
+		members = make(map[*Conn]*hubClient)
+		h.rooms[room] = members
+	}
+	members[c] = client
+	client.rooms[room] = true
+}
+
+// Leave removes c from room, c stays registered
+func (h *Hub) Leave(room string, c *Conn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if client := h.clients[c]; client != nil && client.rooms[room] {
+		h.leave(room, c, client)
+	}
+}
+
+// leave removes a member from room while the caller holds h.mu
+func (h *Hub) leave(room string, c *Conn, client *hubClient) {
+	delete(client.rooms, room)
+	members := h.rooms[room]
+	delete(members, c)
+	if len(members) == 0 {
+		delete(h.rooms, room)
+	}
+}
+
+// RoomSize returns the number of connections in room
+func (h *Hub) RoomSize(room string) int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.rooms[room])
+}
+
+// RoomMembers returns the IDs of the connections in room, in ascending order
+func (h *Hub) RoomMembers(room string) []uint64 {
+	h.mu.RLock()
+	ids := make([]uint64, 0, len(h.rooms[room]))
+	for c := range h.rooms[room] {
+		ids = append(ids, c.ID())
+	}
+	h.mu.RUnlock()
+	slices.Sort(ids)
+	return ids
+}
+
+// writeLoop writes the queued broadcasts to c until it unregisters or a write fails
+func (h *Hub) writeLoop(c *Conn, client *hubClient) {
+	for pm := range client.send {
+		if err := c.WritePreparedMessage(pm); err != nil {
+			h.Unregister(c)
+			return
+		}
+	}
+}
+
+// Broadcast sends a message to every registered connection. The frame is
+// encoded once, see PreparedMessage.
+func (h *Hub) Broadcast(messageType int, data []byte) {
+	h.broadcast(nil, messageType, data, func() map[*Conn]*hubClient { return h.clients })
+}
+
+// BroadcastRoom sends a message to every connection in room
+func (h *Hub) BroadcastRoom(room string, messageType int, data []byte) {
+	h.broadcast(nil, messageType, data, func() map[*Conn]*hubClient { return h.rooms[room] })
+}
+
+// BroadcastJSON sends v encoded as JSON in a text message to every
+// registered connection but the ones in except, typically the sender. v is
+// marshaled once, an error doing so is returned and nothing is sent.
+func (h *Hub) BroadcastJSON(v interface{}, except ...*Conn) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.broadcast(except, TextMessage, data, func() map[*Conn]*hubClient { return h.clients })
+	return nil
+}
+
+// BroadcastRoomJSON is BroadcastJSON for the connections in room
+func (h *Hub) BroadcastRoomJSON(room string, v interface{}, except ...*Conn) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	h.broadcast(except, TextMessage, data, func() map[*Conn]*hubClient { return h.rooms[room] })
+	return nil
+}
+
+// broadcast sends a message to the connections members returns, but not to
+// the ones in except. members is called with h.mu read locked.
+func (h *Hub) broadcast(except []*Conn, messageType int, data []byte, members func() map[*Conn]*hubClient) {
+	pm, err := NewPreparedMessage(messageType, data)
+	if err != nil {
+		h.logger().Error("hub: can't broadcast", "err", err)
+		return
+	}
+	var slow []*Conn
+	h.mu.RLock()
+	for c, client := range members() {
+		if slices.Contains(except, c) {
+			continue
+		}
+		select {
+		case client.send <- pm:
+		default:
+			slow = append(slow, c)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, c := range slow {
+		c.logger.Warn("hub: dropping a connection that doesn't keep up")
+		h.Unregister(c)
+		c.CloseNow()
+	}
+}
+
+// relay is the Handler of a server in broadcast mode, it sends every message
+// to all connections but the one it came from
+func (h *Hub) relay(c *Conn, messageType int, data []byte) error {
+	h.broadcast([]*Conn{c}, messageType, data, func() map[*Conn]*hubClient { return h.clients })
+	return nil
+}
+
+// relayRooms is the Handler of a server with Config.Room, it sends every
+// message to the other connections in the rooms of the one it came from
+func (h *Hub) relayRooms(c *Conn, messageType int, data []byte) error {
+	h.broadcast([]*Conn{c}, messageType, data, func() map[*Conn]*hubClient {
+		client := h.clients[c]
+		if client == nil {
+			return nil
+		}
+		if len(client.rooms) == 1 {
+			for room := range client.rooms {
+				return h.rooms[room]
+			}
+		}
+		// each member gets the message once, even when it shares several rooms with c
+		members := make(map[*Conn]*hubClient)
+		for room := range client.rooms {
+			maps.Copy(members, h.rooms[room])
+		}
+		return members
+	})
+	return nil
+}
+
+// track registers every connection served with cfg, after the application's
+// OnConnect accepted it, and unregisters it before OnDisconnect. With
+// cfg.Room the connection joins the room it names instead.
+func (h *Hub) track(cfg Config) Config {
+	onConnect, onDisconnect := cfg.OnConnect, cfg.OnDisconnect
+	cfg.OnConnect = func(c *Conn) error {
+		if onConnect != nil {
+			if err := onConnect(c); err != nil {
+				return err
+			}
+		}
+		if cfg.Room != nil {
+			h.Join(cfg.Room(c.Request()), c)
+		} else {
+			h.Register(c)
+		}
+		return nil
+	}
+	cfg.OnDisconnect = func(c *Conn, err error) {
+		h.Unregister(c)
+		if onDisconnect != nil {
+			onDisconnect(c, err)
+		}
+	}
+	return cfg
+}
+
+// Close unregisters every connection and closes it with 1001 "going away",
+// returning once all closing handshakes ended
+func (h *Hub) Close() {
+	h.mu.Lock()
+	h.closed = true
+	conns := make([]*Conn, 0, len(h.clients))
+	for c, client := range h.clients {
+		delete(h.clients, c)
+		close(client.send)
+		conns = append(conns, c)
+	}
+	clear(h.rooms)
+	h.mu.Unlock()
+
+	var wg sync.WaitGroup
+	for _, c := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = c.Close(CloseGoingAway, "")
+		}()
+	}
+	wg.Wait()
+}
+
+// RoomFromPath is a Config.Room joining every connection to the room named
+// by its URL path, without the leading slash: /game-42 joins "game-42"
+func RoomFromPath(r *http.Request) string {
+	return strings.TrimPrefix(r.URL.Path, "/")
+}
+
+// RoomFromQuery returns a Config.Room joining every connection to the room
+// named by the query parameter param, e.g. RoomFromQuery("room") for /?room=lobby
+func RoomFromQuery(param string) func(r *http.Request) string {
+	return func(r *http.Request) string {
+		return r.URL.Query().Get(param)
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBroadcastMode(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Broadcast = true
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conns := make([]net.Conn, 3)
+	readers := make([]*bufio.Reader, 3)
+	for i := range conns {
+		conns[i], readers[i] = dialWebSocket(t, addr, "/")
+		defer conns[i].Close()
+		// A pong means the read loop runs, so the connection is registered
+		conns[i].Write(clientFrame(opPing, []byte("ready"), true))
+		if f := readFrameFrom(t, readers[i]); f.Opcode != opPong {
+			t.Fatalf("expected PONG, got opcode %d", f.Opcode)
+		}
+	}
+
+	conns[0].Write(clientFrame(opText, []byte("hello all"), true))
+	for i := 1; i < 3; i++ {
+		f := readFrameFrom(t, readers[i])
+		if f.Opcode != opText || string(f.Payload) != "hello all" {
+			t.Fatalf("client %d: expected the broadcast, got opcode %d %q", i, f.Opcode, f.Payload)
+		}
+	}
+	// The sender only gets the answer to its ping, not its own message
+	conns[0].Write(clientFrame(opPing, []byte("after"), true))
+	if f := readFrameFrom(t, readers[0]); f.Opcode != opPong || string(f.Payload) != "after" {
+		t.Fatalf("expected only the PONG, got opcode %d %q", f.Opcode, f.Payload)
+	}
+}
+
+func TestHubDropsSlowConnection(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	hub := NewHub()
+
+	slow, slowClient, slowReader := pipeConn(t, cfg)
+	fast, fastClient, fastReader := pipeConn(t, cfg)
+	hub.Register(slow)
+	hub.Register(fast)
+
+	// The fast client reads every message, the slow one doesn't read at all
+	fastClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for i := 0; i < hubQueueSize+2; i++ {
+		hub.Broadcast(opText, []byte("update"))
+		if f := readFrameFrom(t, fastReader); string(f.Payload) != "update" {
+			t.Fatalf("fast client got %q", f.Payload)
+		}
+	}
+
+	hub.mu.RLock()
+	_, registered := hub.clients[slow]
+	hub.mu.RUnlock()
+	if registered {
+		t.Fatal("the slow connection is still registered")
+	}
+	// and it was dropped: whatever was written before ends in EOF
+	slowClient.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for {
+		if _, err := slowReader.ReadByte(); err != nil {
+			if err != io.EOF {
+				t.Fatalf("expected the slow connection to be closed, got %v", err)
+			}
+			break
+		}
+	}
+}
+
+func TestHubUnregister(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	hub := NewHub()
+	defer hub.Close()
+
+	c, client, reader := pipeConn(t, cfg)
+	hub.Register(c)
+	hub.Unregister(c)
+	hub.Unregister(c) // twice is fine
+	hub.Broadcast(opText, []byte("nobody listens"))
+
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("an unregistered connection got the broadcast")
+	}
+}
+
+func TestHubLogger(t *testing.T) {
+	logger, logs := captureLogger(slog.LevelInfo)
+	hub := NewHub()
+	hub.Logger = logger
+	defer hub.Close()
+
+	// a ping isn't a message to broadcast
+	hub.Broadcast(PingMessage, nil)
+	if !strings.Contains(logs.String(), "hub: can't broadcast") {
+		t.Fatalf("expected the failed broadcast logged, got %q", logs.String())
+	}
+}
+
+func TestHubClose(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	hub := NewHub()
+
+	c, client, reader := pipeConn(t, cfg)
+	hub.Register(c)
+	readInBackground(c)
+	closed := make(chan struct{})
+	go func() {
+		hub.Close()
+		close(closed)
+	}()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if code, _ := answerClose(t, client, reader); code != CloseGoingAway {
+		t.Fatalf("expected CLOSE 1001, got %d", code)
+	}
+	<-closed
+
+	// Registering after Close does nothing
+	hub.Register(c)
+	if len(hub.clients) != 0 {
+		t.Fatal("a connection registered after Close")
+	}
+}
+
+// expectMessage reads the next frame and checks it is the text message want
+func expectMessage(t *testing.T, client net.Conn, reader *bufio.Reader, want string) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if f := readFrameFrom(t, reader); f.Opcode != opText || string(f.Payload) != want {
+		t.Fatalf("expected %q, got opcode %d %q", want, f.Opcode, f.Payload)
+	}
+}
+
+// expectNothing checks that nothing arrives for a short while
+func expectNothing(t *testing.T, client net.Conn, reader *bufio.Reader) {
+	t.Helper()
+	client.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := reader.ReadByte(); err == nil {
+		t.Fatal("expected nothing, got a frame")
+	}
+}
+
+func TestHubRooms(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	hub := NewHub()
+
+	lobbyOnly, lobbyClient, lobbyReader := pipeConn(t, cfg)
+	gameOnly, gameClient, gameReader := pipeConn(t, cfg)
+	both, bothClient, bothReader := pipeConn(t, cfg)
+	hub.Join("lobby", lobbyOnly)
+	hub.Join("game-42", gameOnly)
+	hub.Join("lobby", both)
+	hub.Join("game-42", both)
+
+	if n := hub.RoomSize("lobby"); n != 2 {
+		t.Fatalf("lobby has %d members, want 2", n)
+	}
+	want := []uint64{lobbyOnly.ID(), both.ID()}
+	if got := hub.RoomMembers("lobby"); !slices.Equal(got, want) {
+		t.Fatalf("lobby members are %v, want %v", got, want)
+	}
+
+	hub.BroadcastRoom("lobby", opText, []byte("to the lobby"))
+	expectMessage(t, lobbyClient, lobbyReader, "to the lobby")
+	expectMessage(t, bothClient, bothReader, "to the lobby")
+	expectNothing(t, gameClient, gameReader)
+
+	hub.BroadcastRoom("game-42", opText, []byte("to the game"))
+	expectMessage(t, gameClient, gameReader, "to the game")
+	expectMessage(t, bothClient, bothReader, "to the game")
+	expectNothing(t, lobbyClient, lobbyReader)
+
+	// Leaving one room keeps the other
+	hub.Leave("lobby", both)
+	hub.BroadcastRoom("lobby", opText, []byte("lobby again"))
+	expectMessage(t, lobbyClient, lobbyReader, "lobby again")
+	expectNothing(t, bothClient, bothReader)
+	if n := hub.RoomSize("game-42"); n != 2 {
+		t.Fatalf("game-42 has %d members, want 2", n)
+	}
+
+	// Unregistering leaves every room, empty rooms disappear
+	hub.Unregister(lobbyOnly)
+	hub.Unregister(both)
+	if _, ok := hub.rooms["lobby"]; ok {
+		t.Fatal("the empty lobby wasn't removed")
+	}
+	if got := hub.RoomMembers("game-42"); !slices.Equal(got, []uint64{gameOnly.ID()}) {
+		t.Fatalf("game-42 members are %v", got)
+	}
+}
+
+// countingJSON counts how often it is marshaled
+type countingJSON struct {
+	calls atomic.Int32
+}
+
+func (v *countingJSON) MarshalJSON() ([]byte, error) {
+	v.calls.Add(1)
+	return []byte(`{"event":"joined"}`), nil
+}
+
+func TestHubBroadcastJSON(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	hub := NewHub()
+
+	sender, senderClient, senderReader := pipeConn(t, cfg)
+	first, firstClient, firstReader := pipeConn(t, cfg)
+	second, secondClient, secondReader := pipeConn(t, cfg)
+	hub.Register(sender)
+	hub.Register(first)
+	hub.Register(second)
+
+	v := &countingJSON{}
+	if err := hub.BroadcastJSON(v, sender); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, firstClient, firstReader, `{"event":"joined"}`)
+	expectMessage(t, secondClient, secondReader, `{"event":"joined"}`)
+	expectNothing(t, senderClient, senderReader)
+	if n := v.calls.Load(); n != 1 {
+		t.Fatalf("the value was marshaled %d times, want once", n)
+	}
+
+	if err := hub.BroadcastJSON(make(chan int)); err == nil {
+		t.Fatal("a value that can't be marshaled was broadcast")
+	}
+	expectNothing(t, firstClient, firstReader)
+}
+
+func TestHubBroadcastRoomJSON(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	hub := NewHub()
+
+	sender, senderClient, senderReader := pipeConn(t, cfg)
+	member, memberClient, memberReader := pipeConn(t, cfg)
+	outsider, outsiderClient, outsiderReader := pipeConn(t, cfg)
+	hub.Join("lobby", sender)
+	hub.Join("lobby", member)
+	hub.Join("game-42", outsider)
+
+	if err := hub.BroadcastRoomJSON("lobby", map[string]int{"players": 2}, sender); err != nil {
+		t.Fatal(err)
+	}
+	expectMessage(t, memberClient, memberReader, `{"players":2}`)
+	expectNothing(t, senderClient, senderReader)
+	expectNothing(t, outsiderClient, outsiderReader)
+}
+
+func TestRoomMode(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Room = RoomFromQuery("room")
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	paths := []string{"/?room=lobby", "/?room=lobby", "/?room=game"}
+	conns := make([]net.Conn, len(paths))
+	readers := make([]*bufio.Reader, len(paths))
+	for i, path := range paths {
+		conns[i], readers[i] = dialWebSocket(t, addr, path)
+		defer conns[i].Close()
+		// A pong means the read loop runs, so the connection joined its room
+		conns[i].Write(clientFrame(opPing, nil, true))
+		readFrameFrom(t, readers[i])
+	}
+
+	conns[0].Write(clientFrame(opText, []byte("lobby only"), true))
+	expectMessage(t, conns[1], readers[1], "lobby only")
+	expectNothing(t, conns[2], readers[2])
+	expectNothing(t, conns[0], readers[0])
+}
+
+func TestRoomFromPath(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/game-42", nil)
+	if room := RoomFromPath(r); room != "game-42" {
+		t.Fatalf("expected game-42, got %q", room)
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// errBinaryJSON is wrapped when ReadJSON gets a binary message without Config.AcceptBinaryJSON
+var errBinaryJSON = errors.New("binary message where JSON text was expected")
+
+// JSONError is returned by ReadJSON when a message arrived but couldn't be
+// decoded. The connection is still usable, the caller decides whether to close it.
+type JSONError struct {
+	Err error
+}
+
+func (e *JSONError) Error() string {
+	return fmt.Sprintf("websocket: decoding JSON message: %v", e.Err)
+}
+
+func (e *JSONError) Unwrap() error {
+	return e.Err
+}
+
+// WriteJSON sends v encoded as JSON in a text message, streamed through NextWriter
+func (c *Conn) WriteJSON(v interface{}) error {
+	w, err := c.NextWriter(TextMessage)
+	if err != nil {
+		return err
+	}
+	// The encoder marshals v before writing, a value that can't be encoded
+	// fails before any fragment was sent
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		w.(*messageWriter).abort()
+		return err
+	}
+	return w.Close()
+}
+
+// ReadJSON decodes the next message into v. A message that isn't valid JSON
+// for v, or a binary one unless Config.AcceptBinaryJSON is set, gives a
+// *JSONError; any other error comes from the connection.
+func (c *Conn) ReadJSON(v interface{}) error {
+	messageType, r, err := c.NextReader()
+	if err != nil {
+		return err
+	}
+	if messageType == BinaryMessage && !c.cfg.AcceptBinaryJSON {
+		return &JSONError{Err: errBinaryJSON}
+	}
+	if err := json.NewDecoder(r).Decode(v); err != nil {
+		// Reading stopped because the connection failed, not because of the content
+		if c.err != nil || c.state != stateOpen {
+			return err
+		}
+		return &JSONError{Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+)
+
+type chatMessage struct {
+	From string   `json:"from"`
+	Text string   `json:"text"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+func TestJSONRoundTrip(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	for _, compressed := range []bool{false, true} {
+		var params *deflateParams
+		if compressed {
+			params = &deflateParams{}
+		}
+		server, client := connPair(t, cfg, params)
+		go streamEcho(server)
+
+		sent := chatMessage{From: "alice", Text: "hello \"bob\" <3", Tags: []string{"greeting"}}
+		errs := make(chan error, 1)
+		go func() { errs <- client.WriteJSON(sent) }()
+
+		var got chatMessage
+		if err := client.ReadJSON(&got); err != nil {
+			t.Fatalf("compressed=%t: ReadJSON: %v", compressed, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("compressed=%t: WriteJSON: %v", compressed, err)
+		}
+		if got.From != sent.From || got.Text != sent.Text || len(got.Tags) != 1 || got.Tags[0] != "greeting" {
+			t.Fatalf("compressed=%t: got %+v, want %+v", compressed, got, sent)
+		}
+	}
+}
+
+func TestReadJSONDecodeError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, _ := pipeConn(t, cfg)
+
+	go func() {
+		client.Write(clientFrame(opText, []byte(`{"from": "alice", "text": `), true))
+		client.Write(clientFrame(opText, []byte(`{"from": "bob"}`), true))
+	}()
+
+	var msg chatMessage
+	err := c.ReadJSON(&msg)
+	var je *JSONError
+	if !errors.As(err, &je) {
+		t.Fatalf("expected a *JSONError for malformed JSON, got %v", err)
+	}
+	// The connection survives a bad message
+	if err := c.ReadJSON(&msg); err != nil || msg.From != "bob" {
+		t.Fatalf("expected the next message to decode, got %+v, %v", msg, err)
+	}
+}
+
+func TestReadJSONBinaryMessage(t *testing.T) {
+	for _, accept := range []bool{false, true} {
+		cfg := DefaultConfig()
+		cfg.PingInterval = 0
+		cfg.AcceptBinaryJSON = accept
+		c, client, _ := pipeConn(t, cfg)
+		go client.Write(clientFrame(opBin, []byte(`{"from": "carol"}`), true))
+
+		var msg chatMessage
+		err := c.ReadJSON(&msg)
+		if accept {
+			if err != nil || msg.From != "carol" {
+				t.Fatalf("expected the binary message to decode, got %+v, %v", msg, err)
+			}
+			continue
+		}
+		var je *JSONError
+		if !errors.As(err, &je) || !errors.Is(err, errBinaryJSON) {
+			t.Fatalf("expected a binary message to be refused, got %v", err)
+		}
+	}
+}
+
+func TestReadJSONConnectionError(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, _ := pipeConn(t, cfg)
+	client.Close()
+
+	var msg chatMessage
+	err := c.ReadJSON(&msg)
+	var je *JSONError
+	if errors.As(err, &je) || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected the connection's EOF, got %v", err)
+	}
+}
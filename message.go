@@ -0,0 +1,61 @@
+package main
+
+import "fmt"
+
+// The message types of ReadMessage, WriteMessage, Handler and the other
+// APIs of Conn. Their values are the RFC 6455 opcodes and won't change, but
+// they are not opcodes: a message may arrive in several frames, the first
+// one carrying the opcode and the others opCont.
+const (
+	TextMessage   = 1 // UTF-8 text
+	BinaryMessage = 2
+	CloseMessage  = 8 // see WriteControl
+	PingMessage   = 9
+	PongMessage   = 10
+)
+
+// IsData reports whether messageType is TextMessage or BinaryMessage
+func IsData(messageType int) bool {
+	return messageType == TextMessage || messageType == BinaryMessage
+}
+
+// IsControl reports whether messageType is CloseMessage, PingMessage or PongMessage
+func IsControl(messageType int) bool {
+	return messageType == CloseMessage || messageType == PingMessage || messageType == PongMessage
+}
+
+// opcodeOf returns the opcode of the frames carrying a message of
+// messageType, which callers checked with IsData or IsControl
+func opcodeOf(messageType int) byte {
+	switch messageType {
+	case TextMessage:
+		return opText
+	case BinaryMessage:
+		return opBin
+	case CloseMessage:
+		return opClose
+	case PingMessage:
+		return opPing
+	case PongMessage:
+		return opPong
+	}
+	panic(fmt.Sprintf("websocket: %d is not a message type", messageType))
+}
+
+// messageTypeOf returns the type of the message a frame with opcode starts,
+// 0 for opCont and opcodes RFC 6455 doesn't define
+func messageTypeOf(opcode byte) int {
+	switch opcode {
+	case opText:
+		return TextMessage
+	case opBin:
+		return BinaryMessage
+	case opClose:
+		return CloseMessage
+	case opPing:
+		return PingMessage
+	case opPong:
+		return PongMessage
+	}
+	return 0
+}
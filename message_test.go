@@ -0,0 +1,70 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageTypeMapping(t *testing.T) {
+	tests := []struct {
+		messageType int
+		opcode      byte
+		data        bool
+	}{
+		{TextMessage, 0x1, true},
+		{BinaryMessage, 0x2, true},
+		{CloseMessage, 0x8, false},
+		{PingMessage, 0x9, false},
+		{PongMessage, 0xA, false},
+	}
+	for _, tt := range tests {
+		if got := opcodeOf(tt.messageType); got != tt.opcode {
+			t.Errorf("type %d: opcode %#x, want %#x", tt.messageType, got, tt.opcode)
+		}
+		if got := messageTypeOf(tt.opcode); got != tt.messageType {
+			t.Errorf("opcode %#x: type %d, want %d", tt.opcode, got, tt.messageType)
+		}
+		if IsData(tt.messageType) != tt.data || IsControl(tt.messageType) == tt.data {
+			t.Errorf("type %d: IsData=%t IsControl=%t", tt.messageType, IsData(tt.messageType), IsControl(tt.messageType))
+		}
+	}
+	// continuation frames and undefined opcodes don't start a message
+	for _, opcode := range []byte{opCont, 0x3, 0x7, 0xB, 0xF} {
+		if got := messageTypeOf(opcode); got != 0 {
+			t.Errorf("opcode %#x: type %d, want none", opcode, got)
+		}
+	}
+	for _, messageType := range []int{0, 3, 7, 11, -1} {
+		if IsData(messageType) || IsControl(messageType) {
+			t.Errorf("%d counts as a message type", messageType)
+		}
+	}
+}
+
+func TestMessageTypesAtTheAPI(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	server, client := connPair(t, cfg, nil)
+
+	if err := client.WriteMessage(PingMessage, nil); err == nil {
+		t.Error("WriteMessage accepted a control message type")
+	}
+	if _, err := client.NextWriter(CloseMessage); err == nil {
+		t.Error("NextWriter accepted a control message type")
+	}
+	if err := client.WriteControl(TextMessage, nil, time.Time{}); err == nil {
+		t.Error("WriteControl accepted a data message type")
+	}
+	if _, err := NewPreparedMessage(PongMessage, nil); err == nil {
+		t.Error("NewPreparedMessage accepted a control message type")
+	}
+
+	go client.WriteMessage(TextMessage, []byte("hello"))
+	if messageType, data, err := server.ReadMessage(); err != nil || messageType != TextMessage || string(data) != "hello" {
+		t.Fatalf("expected a TextMessage, got %d %q %v", messageType, data, err)
+	}
+	go client.WriteMessage(BinaryMessage, []byte{1, 2})
+	if messageType, _, err := server.ReadMessage(); err != nil || messageType != BinaryMessage {
+		t.Fatalf("expected a BinaryMessage, got %d %v", messageType, err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"context"
+	"iter"
+)
+
+// Message is a data message read by Messages
+type Message struct {
+	Type int // TextMessage or BinaryMessage
+	Data []byte
+}
+
+// Messages returns an iterator over the data messages read from c, for use
+// with range. Each message is read when the loop asks for it, nothing is
+// read ahead of a slow loop body. The iteration ends when reading fails,
+// because the connection closed or ctx was cancelled, and Err then returns
+// why. Leaving the loop early ends it without an error, c stays usable.
+// Only one goroutine may read at a time.
+func (c *Conn) Messages(ctx context.Context) iter.Seq[Message] {
+	return func(yield func(Message) bool) {
+		c.iterErr.Store(nil)
+		for {
+			messageType, data, err := c.ReadMessageContext(ctx)
+			if err != nil {
+				c.iterErr.Store(&err)
+				return
+			}
+			if !yield(Message{Type: messageType, Data: data}) {
+				return
+			}
+		}
+	}
+}
+
+// Err returns the error the last iteration of Messages ended with: a
+// *CloseError carrying the code once the connection closed, ctx.Err() when
+// the context was cancelled. It's nil during an iteration and after one
+// that was left early.
+func (c *Conn) Err() error {
+	if err := c.iterErr.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
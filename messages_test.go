@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestMessagesRange(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+	go io.Copy(io.Discard, reader) // the CLOSE reply
+	bye, _ := formatClosePayload(4000, "bye")
+	go func() {
+		client.Write(clientFrame(opText, []byte("one"), true))
+		client.Write(clientFrame(opBin, []byte("two"), true))
+		client.Write(clientFrame(opClose, bye, true))
+	}()
+
+	var got []Message
+	for m := range c.Messages(context.Background()) {
+		got = append(got, m)
+	}
+	if len(got) != 2 || got[0].Type != TextMessage || string(got[0].Data) != "one" || got[1].Type != BinaryMessage || string(got[1].Data) != "two" {
+		t.Fatalf("unexpected messages %+v", got)
+	}
+	var ce *CloseError
+	if err := c.Err(); !errors.As(err, &ce) || ce.Code != 4000 {
+		t.Fatalf("expected the peer's 4000, got %v", err)
+	}
+}
+
+func TestMessagesCancel(t *testing.T) {
+	before := runtime.NumGoroutine()
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, _ := pipeConn(t, cfg)
+	go func() {
+		client.Write(clientFrame(opText, []byte("first"), true))
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	n := 0
+	for range c.Messages(ctx) {
+		n++
+		// the next read blocks until the cancellation interrupts it
+		time.AfterFunc(10*time.Millisecond, cancel)
+	}
+	if n != 1 {
+		t.Fatalf("expected 1 message before the cancellation, got %d", n)
+	}
+	if err := c.Err(); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	// nothing was started, the connection goes on
+	go client.Write(clientFrame(opText, []byte("second"), true))
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "second" {
+		t.Fatalf("expected the next message, got %q, %v", data, err)
+	}
+
+	// the iteration left nothing running behind
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left over:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
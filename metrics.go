@@ -0,0 +1,248 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics counts what the connections of a server do, see Config.Metrics. It
+// is an http.Handler serving them in the Prometheus text format, mount it on
+// Config.Mux or a mux of its own for Prometheus to scrape. The methods that
+// count do nothing on a nil *Metrics, instrumented code doesn't check.
+type Metrics struct {
+	active         atomic.Int64
+	handshakes     [3]atomic.Uint64 // by handshakeResults
+	received       [2]atomic.Uint64 // data messages by type, text first
+	sent           [2]atomic.Uint64
+	bytesReceived  atomic.Uint64
+	bytesSent      atomic.Uint64
+	protocolErrors atomic.Uint64
+	durations      histogram
+
+	mu     sync.Mutex
+	closes map[int]uint64 // by close code
+}
+
+// handshakeResults label handshakes_total: upgraded, refused with an HTTP
+// error, or failed after the connection was taken over
+var handshakeResults = [3]string{"accepted", "rejected", "failed"}
+
+// durationBuckets are the upper bounds of connection_duration_seconds
+var durationBuckets = []float64{1, 10, 60, 300, 1800, 3600, 4 * 3600, 24 * 3600}
+
+// NewMetrics returns Metrics counting from zero
+func NewMetrics() *Metrics {
+	return &Metrics{durations: newHistogram(durationBuckets), closes: make(map[int]uint64)}
+}
+
+// handshake counts an opening handshake by what Upgrade returned
+func (m *Metrics) handshake(err error) {
+	if m == nil {
+		return
+	}
+	var he *HandshakeError
+	switch {
+	case err == nil:
+		m.handshakes[0].Add(1)
+	case errors.As(err, &he):
+		m.handshakes[1].Add(1)
+	default:
+		m.handshakes[2].Add(1)
+	}
+}
+
+// opened counts a connection that started
+func (m *Metrics) opened() {
+	if m == nil {
+		return
+	}
+	m.active.Add(1)
+}
+
+// closed counts a connection that ended after d with code, 1006 when no
+// CLOSE was sent nor received
+func (m *Metrics) closed(code int, d time.Duration) {
+	if m == nil {
+		return
+	}
+	m.active.Add(-1)
+	m.durations.observe(d.Seconds())
+	m.mu.Lock()
+	m.closes[code]++
+	m.mu.Unlock()
+}
+
+// receivedMessage counts a data message that started arriving
+func (m *Metrics) receivedMessage(opcode byte) {
+	if m == nil {
+		return
+	}
+	m.received[dataIndex(opcode)].Add(1)
+}
+
+// sentMessage counts a data message written to the end
+func (m *Metrics) sentMessage(opcode byte) {
+	if m == nil {
+		return
+	}
+	m.sent[dataIndex(opcode)].Add(1)
+}
+
+// readBytes counts n bytes read from a socket
+func (m *Metrics) readBytes(n int) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.bytesReceived.Add(uint64(n))
+}
+
+// wroteBytes counts n bytes written to a socket
+func (m *Metrics) wroteBytes(n int64) {
+	if m == nil || n <= 0 {
+		return
+	}
+	m.bytesSent.Add(uint64(n))
+}
+
+// protocolError counts a connection closed with 1002
+func (m *Metrics) protocolError() {
+	if m == nil {
+		return
+	}
+	m.protocolErrors.Add(1)
+}
+
+// dataIndex is 0 for text and 1 for binary messages
+func dataIndex(opcode byte) int {
+	if opcode == opText {
+		return 0
+	}
+	return 1
+}
+
+// ServeHTTP writes the metrics in the Prometheus text exposition format
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	_, _ = m.WriteTo(w)
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	e := &exposition{w: w}
+	e.metric("websocket_active_connections", "gauge", "Connections open right now.")
+	e.sample("websocket_active_connections", "", float64(m.active.Load()))
+
+	e.metric("websocket_handshakes_total", "counter", "Opening handshakes by result.")
+	for i, result := range handshakeResults {
+		e.sample("websocket_handshakes_total", label("result", result), float64(m.handshakes[i].Load()))
+	}
+
+	for _, dir := range []struct {
+		name, help string
+		counts     *[2]atomic.Uint64
+	}{
+		{"websocket_messages_received_total", "Data messages received by type.", &m.received},
+		{"websocket_messages_sent_total", "Data messages sent by type.", &m.sent},
+	} {
+		e.metric(dir.name, "counter", dir.help)
+		e.sample(dir.name, label("type", "text"), float64(dir.counts[0].Load()))
+		e.sample(dir.name, label("type", "binary"), float64(dir.counts[1].Load()))
+	}
+
+	e.metric("websocket_bytes_received_total", "counter", "Bytes read from the connections, frame headers included.")
+	e.sample("websocket_bytes_received_total", "", float64(m.bytesReceived.Load()))
+	e.metric("websocket_bytes_sent_total", "counter", "Bytes written to the connections, frame headers included.")
+	e.sample("websocket_bytes_sent_total", "", float64(m.bytesSent.Load()))
+
+	e.metric("websocket_protocol_errors_total", "counter", "Connections closed with 1002 for breaking the protocol.")
+	e.sample("websocket_protocol_errors_total", "", float64(m.protocolErrors.Load()))
+
+	e.metric("websocket_connection_duration_seconds", "histogram", "How long the connections that ended were open.")
+	m.durations.write(e, "websocket_connection_duration_seconds")
+
+	e.metric("websocket_closes_total", "counter", "Connections that ended by close code, 1006 without a CLOSE frame.")
+	m.mu.Lock()
+	codes := make([]int, 0, len(m.closes))
+	for code := range m.closes {
+		codes = append(codes, code)
+	}
+	slices.Sort(codes)
+	for _, code := range codes {
+		e.sample("websocket_closes_total", label("code", strconv.Itoa(code)), float64(m.closes[code]))
+	}
+	m.mu.Unlock()
+	return e.n, e.err
+}
+
+// histogram counts observations into cumulative buckets
+type histogram struct {
+	bounds []float64
+	counts []atomic.Uint64 // per bucket, the last one is +Inf
+	sum    atomic.Uint64   // math.Float64bits of the sum
+}
+
+func newHistogram(bounds []float64) histogram {
+	return histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(h.bounds, v)
+	h.counts[i].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+func (h *histogram) write(e *exposition, name string) {
+	var count uint64
+	for i := range h.counts {
+		count += h.counts[i].Load()
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatFloat(h.bounds[i], 'g', -1, 64)
+		}
+		e.sample(name+"_bucket", label("le", le), float64(count))
+	}
+	e.sample(name+"_sum", "", math.Float64frombits(h.sum.Load()))
+	e.sample(name+"_count", "", float64(count))
+}
+
+// exposition writes lines of the text format, keeping the first error
+type exposition struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (e *exposition) metric(name, kind, help string) {
+	e.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (e *exposition) sample(name, labels string, v float64) {
+	e.printf("%s%s %s\n", name, labels, strconv.FormatFloat(v, 'g', -1, 64))
+}
+
+func (e *exposition) printf(format string, args ...interface{}) {
+	if e.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(e.w, format, args...)
+	e.n += int64(n)
+	e.err = err
+}
+
+// label formats a single label, the values used here need no escaping
+func label(name, value string) string {
+	return "{" + name + `="` + value + `"}`
+}
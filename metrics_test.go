@@ -0,0 +1,137 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// scrape fetches the metrics at url by name and labels
+func scrape(t *testing.T, url string) map[string]float64 {
+	t.Helper()
+	resp, err := http.Get(url)
+	if err != nil {
+		t.Fatalf("failed to scrape: %v", err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	samples := make(map[string]float64)
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		name, value, ok := strings.Cut(line, " ")
+		v, err := strconv.ParseFloat(value, 64)
+		if !ok || err != nil {
+			t.Fatalf("malformed sample %q", line)
+		}
+		samples[name] = v
+	}
+	return samples
+}
+
+func TestMetrics(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.EnableCompression = false
+	cfg.Metrics = NewMetrics()
+	cfg.Mux = http.NewServeMux()
+	cfg.Mux.Handle("/metrics", cfg.Metrics)
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	// a request that isn't an upgrade is refused
+	resp, err := http.Get("http://" + addr + "/")
+	if err != nil {
+		t.Fatalf("failed to send the request: %v", err)
+	}
+	resp.Body.Close()
+
+	c := dial(t, "ws://"+addr+"/", nil)
+	for _, m := range []struct {
+		messageType int
+		data        string
+	}{{TextMessage, "hello"}, {BinaryMessage, "abc"}} {
+		if err := c.WriteMessage(m.messageType, []byte(m.data)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != m.data {
+			t.Fatalf("expected the echo, got %q %v", data, err)
+		}
+	}
+	if err := c.Close(CloseNormalClosure, ""); err != nil {
+		t.Fatalf("failed to close: %v", err)
+	}
+
+	var samples map[string]float64
+	deadline := time.Now().Add(time.Second)
+	for {
+		samples = scrape(t, "http://"+addr+"/metrics")
+		if samples["websocket_connection_duration_seconds_count"] == 1 || time.Now().After(deadline) {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for name, want := range map[string]float64{
+		"websocket_active_connections":                            0,
+		`websocket_handshakes_total{result="accepted"}`:           1,
+		`websocket_handshakes_total{result="rejected"}`:           1,
+		`websocket_handshakes_total{result="failed"}`:             0,
+		`websocket_messages_received_total{type="text"}`:          1,
+		`websocket_messages_received_total{type="binary"}`:        1,
+		`websocket_messages_sent_total{type="text"}`:              1,
+		`websocket_messages_sent_total{type="binary"}`:            1,
+		"websocket_bytes_received_total":                          11 + 9 + 8, // masked frames: hello, abc, CLOSE 1000
+		"websocket_bytes_sent_total":                              7 + 5 + 4,
+		`websocket_connection_duration_seconds_bucket{le="1"}`:    1,
+		`websocket_connection_duration_seconds_bucket{le="+Inf"}`: 1,
+		"websocket_connection_duration_seconds_count":             1,
+		"websocket_protocol_errors_total":                         0,
+		`websocket_closes_total{code="1000"}`:                     1,
+	} {
+		if got, ok := samples[name]; !ok || got != want {
+			t.Errorf("%s: expected %v, got %v (present %t)", name, want, got, ok)
+		}
+	}
+}
+
+func TestMetricsActiveConnections(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.Metrics = NewMetrics()
+	c, client, _ := pipeConn(t, cfg)
+	if n := cfg.Metrics.active.Load(); n != 1 {
+		t.Fatalf("expected 1 active connection, got %d", n)
+	}
+
+	// a peer that vanishes ends the connection without a CLOSE
+	client.Close()
+	if _, _, err := c.ReadMessage(); err == nil {
+		t.Fatalf("expected the read to fail")
+	}
+	if n := cfg.Metrics.active.Load(); n != 0 {
+		t.Fatalf("expected no active connection, got %d", n)
+	}
+	if n := cfg.Metrics.closes[CloseAbnormalClosure]; n != 1 {
+		t.Fatalf("expected 1 close with 1006, got %d", n)
+	}
+}
+
+// BenchmarkMetricsDisabled measures an instrumentation point without Metrics
+func BenchmarkMetricsDisabled(b *testing.B) {
+	var m *Metrics
+	for i := 0; i < b.N; i++ {
+		m.readBytes(i)
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+// NetConn returns a net.Conn whose bytes travel in the binary messages of
+// c, for running a stream protocol over WebSocket. Write sends each call as
+// one message, Read delivers the payloads of incoming binary messages as one
+// stream. Text messages are discarded, control frames are handled by c as
+// usual. Read returns io.EOF once the peer closed with 1000 or 1001, Close
+// runs the closing handshake.
+//
+// The deadlines are those of the underlying connection. A read that misses
+// its deadline ends the connection, the stream can't be resumed half way
+// through a frame. Config.WriteTimeout, when set, replaces the write deadline
+// for every message. Like Conn, reads must come from one goroutine.
+func NetConn(c *Conn) net.Conn {
+	return &netConn{c: c}
+}
+
+type netConn struct {
+	c *Conn
+	r io.Reader // the binary message being read, nil between messages
+}
+
+func (nc *netConn) Read(p []byte) (int, error) {
+	for {
+		if nc.r == nil {
+			messageType, r, err := nc.c.NextReader()
+			if err != nil {
+				if IsCloseError(err, CloseNormalClosure, CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if messageType != BinaryMessage {
+				continue // NextReader discards it
+			}
+			nc.r = r
+		}
+		n, err := nc.r.Read(p)
+		if err == io.EOF {
+			// the message ended, not the stream
+			nc.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (nc *netConn) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := nc.c.WriteMessage(BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (nc *netConn) Close() error {
+	err := nc.c.Close(CloseNormalClosure, "")
+	if errors.Is(err, ErrConnClosed) {
+		return net.ErrClosed
+	}
+	return err
+}
+
+func (nc *netConn) LocalAddr() net.Addr {
+	if a := nc.c.LocalAddr(); a != nil {
+		return a
+	}
+	return websocketAddr{}
+}
+
+func (nc *netConn) RemoteAddr() net.Addr {
+	if a := nc.c.RemoteAddr(); a != nil {
+		return a
+	}
+	return websocketAddr{}
+}
+
+func (nc *netConn) SetDeadline(t time.Time) error {
+	if err := nc.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return nc.SetWriteDeadline(t)
+}
+
+func (nc *netConn) SetReadDeadline(t time.Time) error {
+	return nc.c.conn.SetReadDeadline(t)
+}
+
+func (nc *netConn) SetWriteDeadline(t time.Time) error {
+	// A write blocked right now sees the deadline at once, control frames
+	// restore it once they went out
+	err := nc.c.conn.SetWriteDeadline(t)
+	_ = nc.c.lockWrite(time.Time{})
+	nc.c.writeDeadline = t
+	nc.c.unlockWrite()
+	return err
+}
+
+// websocketAddr stands for an address of a transport that doesn't have one,
+// an HTTP/2 stream
+type websocketAddr struct{}
+
+func (websocketAddr) Network() string { return "websocket" }
+func (websocketAddr) String() string  { return "websocket" }
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNetConnEcho(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	server, client := connPair(t, cfg, nil)
+	go func() {
+		echo := NetConn(server)
+		io.Copy(echo, echo)
+	}()
+
+	stream := NetConn(client)
+	data := make([]byte, 5<<20)
+	rand.New(rand.NewSource(1)).Read(data)
+	writeErr := make(chan error, 1)
+	go func() {
+		// writes of odd sizes, with a text message in between that is not
+		// part of the stream
+		for rest, size := data, 1; len(rest) > 0; size = size*7%65521 + 1 {
+			n := min(size, len(rest))
+			if _, err := stream.Write(rest[:n]); err != nil {
+				writeErr <- err
+				return
+			}
+			rest = rest[n:]
+			if size == 1 {
+				client.WriteMessage(opText, []byte("not part of the stream"))
+			}
+		}
+		writeErr <- nil
+	}()
+
+	got := make([]byte, 0, len(data))
+	buf := make([]byte, 8191)
+	for size := 3; len(got) < len(data); size = size*5%len(buf) + 1 {
+		n, err := stream.Read(buf[:size])
+		if err != nil {
+			t.Fatalf("Read after %d bytes: %v", len(got), err)
+		}
+		got = append(got, buf[:n]...)
+	}
+	if err := <-writeErr; err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("the stream came back corrupted")
+	}
+
+	// Closing ends the echo, the peer saw EOF and answered
+	if err := stream.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestNetConnEOF(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	server, client := connPair(t, cfg, nil)
+	closed := make(chan error, 1)
+	go func() { closed <- server.Close(CloseNormalClosure, "") }()
+
+	if n, err := NetConn(client).Read(make([]byte, 10)); n != 0 || err != io.EOF {
+		t.Fatalf("expected EOF after a normal closure, got %d %v", n, err)
+	}
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+}
+
+func TestNetConnReadDeadline(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	_, client := connPair(t, cfg, nil)
+
+	stream := NetConn(client)
+	stream.SetReadDeadline(time.Now().Add(20 * time.Millisecond))
+	if _, err := stream.Read(make([]byte, 10)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the deadline to be exceeded, got %v", err)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Only a handful of pings are ever in flight, older ones are forgotten
+// so a peer that never answers can't make the tracker grow
+const maxPendingPings = 8
+
+type pendingPing struct {
+	payload  string
+	sentAt   time.Time
+	answered chan time.Duration // PingWithRTT waits on it, nil for keepalive pings
+}
+
+// pingTracker remembers the pings the server sent so incoming pongs can be
+// matched against them to measure the round-trip time.
+// The keepalive goroutine records pings while the read loop matches pongs.
+type pingTracker struct {
+	mu      sync.Mutex
+	pending []pendingPing // oldest first
+	lastRTT time.Duration // of the last matched pong, see LastRTT
+	nonce   uint64        // numbers the pings of PingWithRTT
+}
+
+// sent records a ping we just wrote to the peer
+func (p *pingTracker) sent(payload []byte, at time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.add(pendingPing{payload: string(payload), sentAt: at})
+}
+
+// measure records a ping of PingWithRTT about to be written and returns its
+// payload, the round-trip time arrives on answered once it's matched
+func (p *pingTracker) measure(at time.Time) (payload []byte, answered <-chan time.Duration) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nonce++
+	// the prefix keeps it apart from the timestamps of keepalive pings
+	payload = strconv.AppendUint([]byte("rtt-"), p.nonce, 10)
+	ch := make(chan time.Duration, 1)
+	p.add(pendingPing{payload: string(payload), sentAt: at, answered: ch})
+	return payload, ch
+}
+
+// add appends ping, forgetting the oldest one when too many are in flight.
+// p.mu must be held.
+func (p *pingTracker) add(ping pendingPing) {
+	if len(p.pending) == maxPendingPings {
+		p.pending = p.pending[1:]
+	}
+	p.pending = append(p.pending, ping)
+}
+
+// forget drops the ping with payload, its pong is no longer waited for
+func (p *pingTracker) forget(payload []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, ping := range p.pending {
+		if ping.payload == string(payload) {
+			p.pending = append(p.pending[:i:i], p.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+// last returns the round-trip time of the last matched pong
+func (p *pingTracker) last() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastRTT
+}
+
+// pong matches a PONG payload against the outstanding pings and returns the
+// round-trip time. ok is false for unsolicited pongs and for pongs that don't
+// echo the payload of any ping we sent.
+// A pong answers the ping it matches and every older one, per RFC 6455 5.5.3
+// a peer may skip pongs and only answer the most recent ping.
+func (p *pingTracker) pong(payload []byte, at time.Time) (rtt time.Duration, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, ping := range p.pending {
+		if ping.payload != string(payload) {
+			continue
+		}
+		// a waiter of an older ping gets the time until this answer
+		for _, older := range p.pending[:i+1] {
+			if older.answered != nil {
+				older.answered <- at.Sub(older.sentAt)
+			}
+		}
+		p.pending = p.pending[i+1:]
+		p.lastRTT = at.Sub(ping.sentAt)
+		return p.lastRTT, true
+	}
+	return 0, false
+}
+
+// PingWithRTT pings the peer and returns the time until its PONG arrived.
+// The pong is only seen while another goroutine reads the connection, and
+// gives up when ctx is done. Calls made at the same time take turns.
+func (c *Conn) PingWithRTT(ctx context.Context) (time.Duration, error) {
+	select {
+	case c.rttLock <- struct{}{}:
+		defer func() { <-c.rttLock }()
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, ErrConnClosed
+	}
+
+	payload, answered := c.pings.measure(time.Now())
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = c.controlDeadline()
+	}
+	if err := c.WriteControl(PingMessage, payload, deadline); err != nil {
+		c.pings.forget(payload)
+		return 0, err
+	}
+	select {
+	case rtt := <-answered:
+		return rtt, nil
+	case <-ctx.Done():
+		c.pings.forget(payload)
+		return 0, ctx.Err()
+	case <-c.done:
+		return 0, ErrConnClosed
+	}
+}
+
+// LastRTT returns the round-trip time measured with the last PONG that
+// answered one of our pings, keepalive ones included, zero before the first
+func (c *Conn) LastRTT() time.Duration {
+	return c.pings.last()
+}
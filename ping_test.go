@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestPingTrackerMatchedPong(t *testing.T) {
+	var p pingTracker
+	start := time.Now()
+	p.sent([]byte("1"), start)
+	p.sent([]byte("2"), start.Add(time.Second))
+
+	rtt, ok := p.pong([]byte("2"), start.Add(1500*time.Millisecond))
+	if !ok || rtt != 500*time.Millisecond {
+		t.Fatalf("expected a 500ms round trip, got %v (ok=%t)", rtt, ok)
+	}
+	// the pong for the newest ping also answers the older one
+	if _, ok := p.pong([]byte("1"), start.Add(2*time.Second)); ok {
+		t.Fatalf("expected the older ping to be settled")
+	}
+}
+
+func TestPingTrackerUnsolicitedPong(t *testing.T) {
+	var p pingTracker
+	if _, ok := p.pong([]byte("hello"), time.Now()); ok {
+		t.Fatalf("expected an unsolicited pong not to match")
+	}
+}
+
+func TestPingTrackerMismatchedPong(t *testing.T) {
+	var p pingTracker
+	now := time.Now()
+	p.sent([]byte("1"), now)
+	if _, ok := p.pong([]byte("2"), now); ok {
+		t.Fatalf("expected a pong with a different payload not to match")
+	}
+	// the outstanding ping is still waiting for its pong
+	if _, ok := p.pong([]byte("1"), now); !ok {
+		t.Fatalf("expected the ping to still be pending")
+	}
+}
+
+func TestPingTrackerWaiter(t *testing.T) {
+	var p pingTracker
+	start := time.Now()
+	payload, answered := p.measure(start)
+	p.sent([]byte("keepalive"), start.Add(time.Second))
+
+	// a stale or foreign pong leaves the measurement alone
+	if _, ok := p.pong([]byte("rtt-0"), start.Add(time.Second)); ok {
+		t.Fatal("a pong with a foreign payload matched")
+	}
+	select {
+	case rtt := <-answered:
+		t.Fatalf("the waiter got %v before its pong", rtt)
+	default:
+	}
+
+	// the keepalive pong also answers the older measured ping
+	p.pong([]byte("keepalive"), start.Add(1500*time.Millisecond))
+	if rtt := <-answered; rtt != 1500*time.Millisecond {
+		t.Fatalf("expected a 1.5s round trip, got %v", rtt)
+	}
+	if rtt := p.last(); rtt != 500*time.Millisecond {
+		t.Fatalf("the last round trip is %v, want 500ms", rtt)
+	}
+	// its own pong arriving late matches nothing
+	if _, ok := p.pong(payload, start.Add(2*time.Second)); ok {
+		t.Fatal("the late pong matched again")
+	}
+}
+
+// delayedConn holds every write back for delay, like a slow network
+type delayedConn struct {
+	net.Conn
+	delay time.Duration
+}
+
+func (d delayedConn) Write(p []byte) (int, error) {
+	time.Sleep(d.delay)
+	return d.Conn.Write(p)
+}
+
+// delayedPair connects a server Conn to a client Conn whose frames take
+// delay to arrive, both read in the background
+func delayedPair(t *testing.T, delay time.Duration) (server, client *Conn) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	a, b := net.Pipe()
+	slow := delayedConn{Conn: b, delay: delay}
+	server = newConn(context.Background(), a, bufio.NewReader(a), cfg, connInfo{path: "/server"})
+	client = newConn(context.Background(), slow, bufio.NewReader(b), cfg, connInfo{path: "/client", client: true})
+	t.Cleanup(func() {
+		server.close()
+		client.close()
+	})
+	return server, client
+}
+
+func TestPingWithRTT(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	server, client := delayedPair(t, delay)
+	readInBackground(server)
+	readInBackground(client)
+
+	if rtt := server.LastRTT(); rtt != 0 {
+		t.Fatalf("LastRTT is %v before any pong", rtt)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	rtt, err := server.PingWithRTT(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rtt < delay || rtt > delay+time.Second {
+		t.Fatalf("measured %v over a link delaying %v", rtt, delay)
+	}
+	if last := server.LastRTT(); last != rtt {
+		t.Fatalf("LastRTT is %v, PingWithRTT measured %v", last, rtt)
+	}
+
+	// concurrent calls take turns, each gets its own pong
+	var wg sync.WaitGroup
+	for range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if rtt, err := server.PingWithRTT(ctx); err != nil || rtt < delay {
+				t.Errorf("concurrent PingWithRTT measured %v, %v", rtt, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestPingWithRTTWithoutPong(t *testing.T) {
+	server, client := delayedPair(t, 0)
+	client.SetPingHandler(func(string) error { return nil })
+	readInBackground(server)
+	readInBackground(client)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := server.PingWithRTT(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	server.pings.mu.Lock()
+	defer server.pings.mu.Unlock()
+	if n := len(server.pings.pending); n != 0 {
+		t.Fatalf("%d pings still wait for a pong", n)
+	}
+}
+
+func TestServerPingsPeer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 50 * time.Millisecond
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, addr, "/")
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f := readFrameFrom(t, reader)
+	if f.Opcode != opPing || len(f.Payload) == 0 {
+		t.Fatalf("expected a ping with a payload, got opcode=%d payload=%q", f.Opcode, f.Payload)
+	}
+
+	// answer the ping plus an unsolicited pong, then check the echo still works
+	if _, err := conn.Write(clientFrame(opPong, f.Payload, true)); err != nil {
+		t.Fatalf("failed to send pong: %v", err)
+	}
+	if _, err := conn.Write(clientFrame(opPong, []byte("unsolicited"), true)); err != nil {
+		t.Fatalf("failed to send pong: %v", err)
+	}
+	if _, err := conn.Write(clientFrame(opText, []byte("hello"), true)); err != nil {
+		t.Fatalf("failed to send text: %v", err)
+	}
+	for {
+		f := readFrameFrom(t, reader)
+		if f.Opcode == opPing {
+			continue
+		}
+		if f.Opcode != opText || string(f.Payload) != "hello" {
+			t.Fatalf("unexpected frame: opcode=%d payload=%q", f.Opcode, f.Payload)
+		}
+		break
+	}
+}
+
+// pingConn is a Conn reading a PING followed by a small text message forever
+func pingConn() *Conn {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	data := append(clientFrame(opPing, []byte("ping"), true), clientFrame(opText, []byte("hello"), true)...)
+	transport := &repeatTransport{data: data}
+	return newConn(context.Background(), transport, bufio.NewReader(transport), cfg, connInfo{path: "/"})
+}
+
+func TestPongAllocs(t *testing.T) {
+	c := pingConn()
+	buf := make([]byte, 64)
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, n, err := c.ReadMessageInto(buf); err != nil || string(buf[:n]) != "hello" {
+			t.Fatalf("read %q, %v", buf[:n], err)
+		}
+	})
+	if allocs != 0 {
+		t.Fatalf("answering a ping allocated %v times", allocs)
+	}
+}
+
+func BenchmarkPingPong(b *testing.B) {
+	c := pingConn()
+	buf := make([]byte, 64)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := c.ReadMessageInto(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestOversizedPing(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.CloseTimeout = 0
+	c, client, reader := pipeConn(t, cfg)
+	var handled atomic.Bool
+	c.SetPingHandler(func(appData string) error {
+		handled.Store(true)
+		return nil
+	})
+
+	errs := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		errs <- err
+	}()
+	// one byte over what a control frame may carry is a protocol error, not
+	// a failure to answer it
+	go client.Write(clientFrame(opPing, make([]byte, 126), true))
+
+	reply := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(reply.Payload); reply.Opcode != opClose || code != CloseProtocolError {
+		t.Fatalf("expected CLOSE 1002, got opcode %d code %d", reply.Opcode, code)
+	}
+	var ce *CloseError
+	if err := <-errs; !errors.As(err, &ce) || ce.Code != CloseProtocolError {
+		t.Fatalf("expected a 1002 close error, got %v", err)
+	}
+	if handled.Load() {
+		t.Fatal("the ping handler saw the oversized ping")
+	}
+}
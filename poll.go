@@ -0,0 +1,101 @@
+package main
+
+import "syscall"
+
+// netpoller watches the sockets of parked connections, see
+// Config.ParkIdleConnections. It's epoll on Linux and kqueue on the BSDs and
+// macOS.
+type netpoller interface {
+	// pollable reports whether conn can be watched
+	pollable(conn transport) bool
+	// watch calls ready once conn has data to read or was hung up on, then
+	// forgets it. ready must not block.
+	watch(conn transport, ready func()) error
+	// forget stops watching conn, ready isn't called anymore
+	forget(conn transport)
+}
+
+// watchedConn is a socket waited on and who to tell. The conn tells a
+// descriptor reused by a newer connection from the one registered.
+type watchedConn struct {
+	conn  transport
+	ready func()
+}
+
+// socketFD returns the file descriptor of conn when it is a socket the
+// poller can watch. A *tls.Conn is never one: it may hold decrypted bytes
+// nobody could tell from the socket.
+func socketFD(conn transport) (int, bool) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, false
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, false
+	}
+	fd := -1
+	if err := rc.Control(func(s uintptr) { fd = int(s) }); err != nil || fd < 0 {
+		return 0, false
+	}
+	return fd, true
+}
+
+// serveParked serves c with h like Handler.serve, but between messages the
+// reader goroutine gives c to the poller and ends. A new one carries on once
+// data arrived, it reads before it parks c again.
+func serveParked(c *Conn, h Handler) (parked bool, err error) {
+	c.resume = func() {
+		c.run(func() (bool, error) { return h.serveMessages(c, true) })
+	}
+	if c.park() {
+		return true, nil
+	}
+	return h.serveMessages(c, true)
+}
+
+// park hands c to the poller when nothing was read that wasn't dispatched
+// yet: no bytes in the bufio.Reader, no frame in the decoder, no message
+// half read. It reports whether the caller has to let go of c.
+func (c *Conn) park() bool {
+	c.readMu.Lock()
+	idle := c.err == nil && c.readErr == nil && c.state == stateOpen &&
+		c.reader.Buffered() == 0 && c.decoder.Buffered() == 0 && c.decoder.Pending() == 0 &&
+		len(c.parsed) == 0 && !c.inMessage && c.message == nil && c.localClose.Load() == nil
+	if idle {
+		if c.lent {
+			// the Handler returned, the message it got can go
+			c.lent = false
+			c.releaseBuffer()
+		}
+		// under readMu, so Close leaves reading to the goroutine that resumes c
+		c.parked.Store(true)
+	}
+	c.readMu.Unlock()
+	if !idle {
+		return false
+	}
+	if err := c.poller.watch(c.conn, c.wake); err != nil {
+		c.logger.Warn("park", "err", err)
+		// unless teardown already woke c, keep reading on this goroutine
+		return !c.parked.CompareAndSwap(true, false)
+	}
+	return true
+}
+
+// wake serves a parked c again on a new goroutine, only the first call
+// after park does anything
+func (c *Conn) wake() {
+	if c.parked.CompareAndSwap(true, false) {
+		go c.resume()
+	}
+}
+
+// unpark lets a parked c see that it ended, teardown calls it before the
+// socket is closed and its descriptor reused
+func (c *Conn) unpark() {
+	if c.parked.Load() {
+		c.poller.forget(c.conn)
+		c.wake()
+	}
+}
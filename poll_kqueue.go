@@ -0,0 +1,129 @@
+//go:build darwin || dragonfly || freebsd || netbsd || openbsd
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// pollSupported tells validate that Config.ParkIdleConnections works here
+const pollSupported = true
+
+// kqueuePoller watches sockets with one-shot kqueue filters, one goroutine
+// waits for all of them
+type kqueuePoller struct {
+	kq    int
+	wakeR int // the read end of a pipe that stops the wait loop
+	wakeW int
+
+	mu      sync.Mutex
+	watched map[int]watchedConn // by file descriptor
+}
+
+// newPoller starts a poller that stops when ctx is done
+func newPoller(ctx context.Context) (netpoller, error) {
+	kq, err := syscall.Kqueue()
+	if err != nil {
+		return nil, fmt.Errorf("websocket: kqueue: %w", err)
+	}
+	syscall.CloseOnExec(kq)
+	var pipe [2]int
+	if err := syscall.Pipe(pipe[:]); err != nil {
+		syscall.Close(kq)
+		return nil, fmt.Errorf("websocket: kqueue: %w", err)
+	}
+	p := &kqueuePoller{kq: kq, wakeR: pipe[0], wakeW: pipe[1], watched: make(map[int]watchedConn)}
+	for _, fd := range pipe {
+		syscall.CloseOnExec(fd)
+		_ = syscall.SetNonblock(fd, true)
+	}
+	if err := p.control(p.wakeR, syscall.EV_ADD); err != nil {
+		p.close()
+		return nil, fmt.Errorf("websocket: kqueue: %w", err)
+	}
+	context.AfterFunc(ctx, func() { _, _ = syscall.Write(p.wakeW, []byte{0}) })
+	go p.wait()
+	return p, nil
+}
+
+// control changes the read filter of fd
+func (p *kqueuePoller) control(fd int, flags int) error {
+	var change [1]syscall.Kevent_t
+	syscall.SetKevent(&change[0], fd, syscall.EVFILT_READ, flags)
+	_, err := syscall.Kevent(p.kq, change[:], nil, nil)
+	return err
+}
+
+func (p *kqueuePoller) pollable(conn transport) bool {
+	_, ok := socketFD(conn)
+	return ok
+}
+
+func (p *kqueuePoller) watch(conn transport, ready func()) error {
+	fd, ok := socketFD(conn)
+	if !ok {
+		return errors.New("websocket: not a socket")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// the filter of a closed socket went with it, the descriptor may be a
+	// new one by now
+	delete(p.watched, fd)
+	if err := p.control(fd, syscall.EV_ADD|syscall.EV_ONESHOT); err != nil {
+		return fmt.Errorf("websocket: kqueue: %w", err)
+	}
+	p.watched[fd] = watchedConn{conn: conn, ready: ready}
+	return nil
+}
+
+func (p *kqueuePoller) forget(conn transport) {
+	fd, ok := socketFD(conn)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w, ok := p.watched[fd]; ok && w.conn == conn {
+		delete(p.watched, fd)
+		_ = p.control(fd, syscall.EV_DELETE)
+	}
+}
+
+// wait passes on the events until the poller is stopped
+func (p *kqueuePoller) wait() {
+	defer p.close()
+	events := make([]syscall.Kevent_t, 128)
+	for {
+		n, err := syscall.Kevent(p.kq, nil, events, nil)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, event := range events[:n] {
+			fd := int(event.Ident)
+			if fd == p.wakeR {
+				return
+			}
+			// one-shot removed the filter
+			p.mu.Lock()
+			w, ok := p.watched[fd]
+			delete(p.watched, fd)
+			p.mu.Unlock()
+			if ok {
+				w.ready()
+			}
+		}
+	}
+}
+
+func (p *kqueuePoller) close() {
+	syscall.Close(p.kq)
+	syscall.Close(p.wakeR)
+	syscall.Close(p.wakeW)
+}
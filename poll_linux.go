@@ -0,0 +1,121 @@
+//go:build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+)
+
+// pollSupported tells validate that Config.ParkIdleConnections works here
+const pollSupported = true
+
+// epollPoller watches sockets with one-shot epoll registrations, one
+// goroutine waits for all of them
+type epollPoller struct {
+	epfd  int
+	wakeR int // the read end of a pipe that stops the wait loop
+	wakeW int
+
+	mu      sync.Mutex
+	watched map[int]watchedConn // by file descriptor
+}
+
+// newPoller starts a poller that stops when ctx is done
+func newPoller(ctx context.Context) (netpoller, error) {
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("websocket: epoll: %w", err)
+	}
+	var pipe [2]int
+	if err := syscall.Pipe2(pipe[:], syscall.O_CLOEXEC|syscall.O_NONBLOCK); err != nil {
+		syscall.Close(epfd)
+		return nil, fmt.Errorf("websocket: epoll: %w", err)
+	}
+	p := &epollPoller{epfd: epfd, wakeR: pipe[0], wakeW: pipe[1], watched: make(map[int]watchedConn)}
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(p.wakeR)}
+	if err := syscall.EpollCtl(epfd, syscall.EPOLL_CTL_ADD, p.wakeR, &event); err != nil {
+		p.close()
+		return nil, fmt.Errorf("websocket: epoll: %w", err)
+	}
+	context.AfterFunc(ctx, func() { _, _ = syscall.Write(p.wakeW, []byte{0}) })
+	go p.wait()
+	return p, nil
+}
+
+func (p *epollPoller) pollable(conn transport) bool {
+	_, ok := socketFD(conn)
+	return ok
+}
+
+func (p *epollPoller) watch(conn transport, ready func()) error {
+	fd, ok := socketFD(conn)
+	if !ok {
+		return errors.New("websocket: not a socket")
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	// the registration of a closed socket went with it, the descriptor may
+	// be a new one by now
+	delete(p.watched, fd)
+	event := syscall.EpollEvent{Events: syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT, Fd: int32(fd)}
+	if err := syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_ADD, fd, &event); err != nil {
+		return fmt.Errorf("websocket: epoll: %w", err)
+	}
+	p.watched[fd] = watchedConn{conn: conn, ready: ready}
+	return nil
+}
+
+func (p *epollPoller) forget(conn transport) {
+	fd, ok := socketFD(conn)
+	if !ok {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if w, ok := p.watched[fd]; ok && w.conn == conn {
+		delete(p.watched, fd)
+		_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+	}
+}
+
+// wait passes on the events until the poller is stopped
+func (p *epollPoller) wait() {
+	defer p.close()
+	events := make([]syscall.EpollEvent, 128)
+	for {
+		n, err := syscall.EpollWait(p.epfd, events, -1)
+		if errors.Is(err, syscall.EINTR) {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, event := range events[:n] {
+			fd := int(event.Fd)
+			if fd == p.wakeR {
+				return
+			}
+			p.mu.Lock()
+			w, ok := p.watched[fd]
+			if ok {
+				delete(p.watched, fd)
+				// one-shot left it registered but disabled
+				_ = syscall.EpollCtl(p.epfd, syscall.EPOLL_CTL_DEL, fd, nil)
+			}
+			p.mu.Unlock()
+			if ok {
+				w.ready()
+			}
+		}
+	}
+}
+
+func (p *epollPoller) close() {
+	syscall.Close(p.epfd)
+	syscall.Close(p.wakeR)
+	syscall.Close(p.wakeW)
+}
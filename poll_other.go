@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+
+package main
+
+import (
+	"context"
+	"errors"
+	"runtime"
+)
+
+// pollSupported tells validate that Config.ParkIdleConnections works here
+const pollSupported = false
+
+func newPoller(ctx context.Context) (netpoller, error) {
+	return nil, errors.New("websocket: no poller for idle connections on " + runtime.GOOS)
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// memConn is one end of an in-memory connection that memPoller can watch
+type memConn struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	data     []byte
+	closed   bool
+	deadline time.Time
+	onData   func() // set by memPoller.watch, called once data arrives
+	peer     *memConn
+}
+
+func memConnPair() (*memConn, *memConn) {
+	a, b := &memConn{}, &memConn{}
+	a.cond, b.cond = sync.NewCond(&a.mu), sync.NewCond(&b.mu)
+	a.peer, b.peer = b, a
+	return a, b
+}
+
+func (m *memConn) Read(p []byte) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for len(m.data) == 0 {
+		switch {
+		case m.closed:
+			return 0, io.EOF
+		case !m.deadline.IsZero() && !time.Now().Before(m.deadline):
+			return 0, os.ErrDeadlineExceeded
+		}
+		m.cond.Wait()
+	}
+	n := copy(p, m.data)
+	m.data = m.data[n:]
+	return n, nil
+}
+
+func (m *memConn) Write(p []byte) (int, error) {
+	peer := m.peer
+	peer.mu.Lock()
+	if peer.closed {
+		peer.mu.Unlock()
+		return 0, io.ErrClosedPipe
+	}
+	peer.data = append(peer.data, p...)
+	ready := peer.onData
+	peer.onData = nil
+	peer.cond.Broadcast()
+	peer.mu.Unlock()
+	if ready != nil {
+		ready()
+	}
+	return len(p), nil
+}
+
+// Close hangs up on both ends, like a socket the peer sees EOF on
+func (m *memConn) Close() error {
+	for _, end := range []*memConn{m, m.peer} {
+		end.mu.Lock()
+		end.closed = true
+		ready := end.onData
+		end.onData = nil
+		end.cond.Broadcast()
+		end.mu.Unlock()
+		if ready != nil {
+			ready()
+		}
+	}
+	return nil
+}
+
+func (m *memConn) SetReadDeadline(t time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deadline = t
+	if !t.IsZero() {
+		time.AfterFunc(time.Until(t), func() {
+			m.mu.Lock()
+			m.cond.Broadcast()
+			m.mu.Unlock()
+		})
+	}
+	return nil
+}
+
+func (m *memConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// memPoller watches memConns
+type memPoller struct{}
+
+func (memPoller) pollable(conn transport) bool {
+	_, ok := conn.(*memConn)
+	return ok
+}
+
+func (memPoller) watch(conn transport, ready func()) error {
+	m := conn.(*memConn)
+	m.mu.Lock()
+	if len(m.data) > 0 || m.closed {
+		m.mu.Unlock()
+		ready()
+		return nil
+	}
+	m.onData = ready
+	m.mu.Unlock()
+	return nil
+}
+
+func (memPoller) forget(conn transport) {
+	m := conn.(*memConn)
+	m.mu.Lock()
+	m.onData = nil
+	m.mu.Unlock()
+}
+
+func TestParkIdleConnections(t *testing.T) {
+	const conns = 10_000
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.ParkIdleConnections = true
+	disconnected := make(chan struct{}, 1)
+	cfg.OnDisconnect = func(c *Conn, err error) { disconnected <- struct{}{} }
+
+	before := runtime.NumGoroutine()
+	clients := make([]*memConn, conns)
+	for i := range clients {
+		client, srv := memConnPair()
+		clients[i] = client
+		c := newConn(context.Background(), srv, bufio.NewReaderSize(srv, 16), cfg, connInfo{path: "/"})
+		c.poller = memPoller{}
+		// nothing to read yet, the connection is parked right away
+		serveConn(c, EchoHandler)
+	}
+	if n := runtime.NumGoroutine(); n > before {
+		t.Fatalf("expected no goroutine for idle connections, there are %d more", n-before)
+	}
+
+	// every connection answers, its goroutine ends again afterwards. Half a
+	// frame keeps a connection reading until the rest arrived.
+	frame := clientFrame(opText, []byte("hello"), true)
+	for i, client := range clients {
+		if i%2 == 0 {
+			client.Write(frame[:3])
+			client.Write(frame[3:])
+		} else {
+			client.Write(frame)
+		}
+		if f := readFrameFrom(t, bufio.NewReader(client)); string(f.Payload) != "hello" {
+			t.Fatalf("connection %d: expected the echo, got %q", i, f.Payload)
+		}
+	}
+	waitGoroutines(t, before+10)
+
+	// hanging up wakes a parked connection, it ends as usual
+	for i, client := range clients {
+		client.Close()
+		select {
+		case <-disconnected:
+		case <-time.After(time.Second):
+			t.Fatalf("connection %d didn't end", i)
+		}
+	}
+}
+
+// waitGoroutines waits for the goroutines to drop to at most n
+func waitGoroutines(t *testing.T, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected at most %d goroutines, there are %d", n, runtime.NumGoroutine())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestParkIdleConnectionsPoller(t *testing.T) {
+	if !pollSupported {
+		t.Skip("no poller on " + runtime.GOOS)
+	}
+	const conns = 50
+	cfg := DefaultConfig()
+	cfg.PingInterval = 20 * time.Millisecond
+	cfg.HandshakeRate = 0
+	cfg.EnableCompression = false
+	cfg.ParkIdleConnections = true
+	var disconnected atomic.Int32
+	cfg.OnDisconnect = func(c *Conn, err error) { disconnected.Add(1) }
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+
+	before := runtime.NumGoroutine()
+	clients := make([]*Conn, conns)
+	for i := range clients {
+		clients[i] = dial(t, "ws://"+addr+"/", nil)
+	}
+	// the clients don't read, nor ping: only the server's poller and timers run
+	waitGoroutines(t, before+10)
+	for i, c := range clients {
+		if err := c.WriteMessage(TextMessage, []byte("hello")); err != nil {
+			t.Fatalf("connection %d: failed to send: %v", i, err)
+		}
+	}
+
+	// parked connections are pinged and read the pongs, then the echo follows
+	pings := make(chan struct{}, 1)
+	clients[0].SetPingHandler(func(appData string) error {
+		select {
+		case pings <- struct{}{}:
+		default:
+		}
+		return clients[0].WriteControl(PongMessage, []byte(appData), time.Time{})
+	})
+	for i, c := range clients {
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != "hello" {
+			t.Fatalf("connection %d: expected the echo, got %q %v", i, data, err)
+		}
+	}
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := clients[0].ReadMessage()
+		read <- err
+	}()
+	for range 3 {
+		select {
+		case <-pings:
+		case <-time.After(time.Second):
+			t.Fatalf("a parked connection wasn't pinged")
+		}
+	}
+	if rtt := serverRTT(server); rtt <= 0 {
+		t.Fatalf("no pong reached the parked connection")
+	}
+
+	// shutting down closes the parked connections with 1001
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the clients answer the CLOSE
+	for _, c := range clients[1:] {
+		go c.ReadMessage()
+	}
+	if err := server.Shutdown(ctx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		t.Fatalf("shutdown: %v", err)
+	}
+	var ce *CloseError
+	if err := <-read; !errors.As(err, &ce) || ce.Code != CloseGoingAway {
+		t.Fatalf("expected 1001, got %v", err)
+	}
+	if n := disconnected.Load(); n != conns {
+		t.Fatalf("expected %d connections to end, %d did", conns, n)
+	}
+}
+
+// serverRTT waits for a connection of server to measure a round trip
+func serverRTT(server *Server) time.Duration {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		for _, c := range server.upgrader.liveConns() {
+			if c.LastRTT() > 0 {
+				return c.LastRTT()
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return 0
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"sync"
+)
+
+// workerQueueSize is how many messages may wait for a worker unless
+// Config.WorkerQueueSize says otherwise
+const workerQueueSize = 64
+
+// workerPool runs the Handlers of an Upgrader's connections on
+// Config.WorkerPoolSize goroutines. The messages of one connection are
+// handled one after the other in the order they were read, those of
+// different connections in parallel.
+type workerPool struct {
+	slots    chan struct{} // taken by every message waiting for a worker
+	ready    chan *inbox   // the inboxes with messages, each at most once
+	overflow OverflowPolicy
+}
+
+// newWorkerPool starts the workers of cfg, they stop when ctx is done and
+// leave the messages still waiting to inbox.close
+func newWorkerPool(ctx context.Context, cfg Config) *workerPool {
+	size := cfg.WorkerQueueSize
+	if size == 0 {
+		size = workerQueueSize
+	}
+	// An inbox is only ready while it holds a message that took a slot, so
+	// ready never fills up
+	p := &workerPool{
+		slots:    make(chan struct{}, size),
+		ready:    make(chan *inbox, size),
+		overflow: cfg.WorkerOverflow,
+	}
+	for range cfg.WorkerPoolSize {
+		go p.work(ctx)
+	}
+	return p
+}
+
+// inbox holds the messages of a connection until a worker handles them
+type inbox struct {
+	c  *Conn
+	wg sync.WaitGroup // messages submitted and not handled yet
+
+	mu     sync.Mutex
+	jobs   []func() error
+	queued bool // in ready or being drained by a worker
+	closed bool // the connection ended or a message failed, the rest is skipped
+	holds  bool // holds the connection's slot until close, see Conn.holdSlot
+}
+
+// newInbox returns the inbox of c. Shutdown keeps waiting for c while one
+// of its messages is being handled, even after the connection ended.
+func newInbox(c *Conn) *inbox {
+	return &inbox{c: c, holds: c.holdSlot()}
+}
+
+// submit queues job behind the earlier messages of in. With the queue full
+// the reader waits for room or, with OverflowClose, gets a 1013 to close
+// its connection with.
+func (p *workerPool) submit(in *inbox, job func() error) error {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		if p.overflow == OverflowClose {
+			return &CloseError{Code: CloseTryAgainLater, Text: "server busy"}
+		}
+		select {
+		case p.slots <- struct{}{}:
+		case <-in.c.done:
+			return ErrConnClosed
+		}
+	}
+	in.wg.Add(1)
+	in.mu.Lock()
+	in.jobs = append(in.jobs, job)
+	ready := !in.queued
+	in.queued = true
+	in.mu.Unlock()
+	if ready {
+		p.ready <- in
+	}
+	return nil
+}
+
+func (p *workerPool) work(ctx context.Context) {
+	for {
+		select {
+		case in := <-p.ready:
+			p.drain(in)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// drain handles the messages of in until none is left
+func (p *workerPool) drain(in *inbox) {
+	for {
+		in.mu.Lock()
+		if len(in.jobs) == 0 {
+			in.queued = false
+			in.mu.Unlock()
+			return
+		}
+		job := in.jobs[0]
+		in.jobs[0] = nil
+		in.jobs = in.jobs[1:]
+		skip := in.closed
+		in.mu.Unlock()
+		<-p.slots
+
+		if !skip {
+			if err := in.run(job); err != nil {
+				in.fail(err)
+			}
+		}
+		in.wg.Done()
+	}
+}
+
+// run calls job, turning a panic into an error like serveConn does
+func (in *inbox) run(job func() error) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			in.c.logger.Error("handler panic", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	return job()
+}
+
+// fail skips the messages still waiting and closes the connection the way
+// a failed Handler does. The reader sees the closing handshake through.
+func (in *inbox) fail(err error) {
+	in.mu.Lock()
+	in.closed = true
+	in.mu.Unlock()
+	ce := applicationCloseError(err)
+	go func() {
+		if in.c.Close(uint16(ce.Code), ce.Text) != nil {
+			in.c.CloseNow()
+		}
+	}()
+}
+
+// close skips the messages still waiting once the connection ended, and
+// waits for the one being handled. The skipped ones are settled here, the
+// workers are gone once the Upgrader's context ended.
+func (in *inbox) close() {
+	in.mu.Lock()
+	in.closed = true
+	holds := in.holds
+	in.holds = false
+	in.mu.Unlock()
+	in.c.pool.drain(in)
+	in.wg.Wait()
+	if holds {
+		in.c.releaseSlot()
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolOrdering(t *testing.T) {
+	const workers, clients, messages = 3, 16, 100
+	var (
+		mu       sync.Mutex
+		last     = map[uint64]int{} // the last message handled of every connection
+		handled  sync.WaitGroup
+		inflight atomic.Int32
+		peak     atomic.Int32
+	)
+	handled.Add(clients * messages)
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WorkerPoolSize = workers
+	cfg.WorkerQueueSize = 4 // readers keep waiting for room
+	cfg.Handlers = map[string]Handler{"/": func(c *Conn, messageType int, data []byte) error {
+		defer handled.Done()
+		n := inflight.Add(1)
+		defer inflight.Add(-1)
+		for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+		}
+		time.Sleep(100 * time.Microsecond)
+
+		seq, err := strconv.Atoi(string(data))
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if prev, ok := last[c.ID()]; ok && seq != prev+1 {
+			t.Errorf("connection %d: message %d was handled after %d", c.ID(), seq, prev)
+		}
+		last[c.ID()] = seq
+		return nil
+	}}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	for range clients {
+		c := dial(t, "ws://"+addr+"/", nil)
+		go func() {
+			for i := range messages {
+				if err := c.WriteMessage(TextMessage, []byte(strconv.Itoa(i))); err != nil {
+					t.Errorf("failed to send: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		handled.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("not every message was handled")
+	}
+	if p := peak.Load(); p > workers || p < 2 {
+		t.Fatalf("expected up to %d messages handled at once, and more than one, saw %d", workers, p)
+	}
+	for id, seq := range last {
+		if seq != messages-1 {
+			t.Fatalf("connection %d: the last message handled was %d", id, seq)
+		}
+	}
+}
+
+func TestWorkerPoolOverflowClose(t *testing.T) {
+	release := make(chan struct{})
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.WorkerPoolSize = 1
+	cfg.WorkerQueueSize = 1
+	cfg.WorkerOverflow = OverflowClose
+	cfg.Handlers = map[string]Handler{"/": func(c *Conn, messageType int, data []byte) error {
+		<-release
+		return nil
+	}}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	// the first message keeps the worker busy, the second waits, the third
+	// doesn't fit
+	c := dial(t, "ws://"+addr+"/", nil)
+	for i := range 3 {
+		if err := c.WriteMessage(TextMessage, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	_, _, err = c.ReadMessage()
+	close(release)
+	var ce *CloseError
+	if !errors.As(err, &ce) || ce.Code != CloseTryAgainLater || !strings.Contains(ce.Text, "busy") {
+		t.Fatalf("expected the connection to be closed with 1013, got %v", err)
+	}
+}
+
+func TestWorkerPoolShutdownWithQueuedMessages(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{}, 2)
+	var disconnects atomic.Int32
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.HandshakeRate = 0
+	cfg.WorkerPoolSize = 1
+	cfg.OnDisconnect = func(c *Conn, err error) { disconnects.Add(1) }
+	cfg.Handlers = map[string]Handler{"/": func(c *Conn, messageType int, data []byte) error {
+		started <- struct{}{}
+		<-release
+		return nil
+	}}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	// the first message keeps the only worker busy, the second waits for it
+	closed := make(chan error, 2)
+	for i := range 2 {
+		c := dial(t, "ws://"+addr+"/", nil)
+		if err := c.WriteMessage(TextMessage, []byte(fmt.Sprint(i))); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		go func() {
+			_, _, err := c.ReadMessage()
+			closed <- err
+		}()
+	}
+	<-started
+	deadline := time.Now().Add(2 * time.Second)
+	for len(server.upgrader.pool.slots) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("the second message never queued")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(ctx) }()
+	for range 2 {
+		var ce *CloseError
+		if err := <-closed; !errors.As(err, &ce) || ce.Code != CloseGoingAway {
+			t.Fatalf("expected close 1001, got %v", err)
+		}
+	}
+
+	// the connections ended but a handler still runs, Shutdown waits for it
+	select {
+	case err := <-shutdown:
+		t.Fatalf("Shutdown returned while a handler was running: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+	if n := disconnects.Load(); n != 2 {
+		t.Fatalf("expected OnDisconnect for both connections, got %d", n)
+	}
+	if n := server.upgrader.Connections(); n != 0 {
+		t.Fatalf("expected every slot given back, %d are taken", n)
+	}
+}
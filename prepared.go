@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+)
+
+// PreparedMessage is a data message whose frame is encoded once and then
+// written to any number of connections, e.g. for a broadcast.
+// It is safe for concurrent use.
+type PreparedMessage struct {
+	messageType int
+	data        []byte
+	frame       []byte // the uncompressed frame
+
+	// compressedFrame is deflated on first use, only connections that reset
+	// their compressor after every message can share it
+	compressOnce    sync.Once
+	compressedFrame []byte
+	compressErr     error
+}
+
+// NewPreparedMessage encodes a TextMessage or BinaryMessage for WritePreparedMessage.
+// data must not be modified afterwards.
+func NewPreparedMessage(messageType int, data []byte) (*PreparedMessage, error) {
+	if !IsData(messageType) {
+		return nil, fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	frame, err := buildFrame(opcodeOf(messageType), data, true)
+	if err != nil {
+		return nil, err
+	}
+	return &PreparedMessage{messageType: messageType, data: data, frame: frame}, nil
+}
+
+// compressed returns the frame deflated without context takeover
+func (pm *PreparedMessage) compressed() ([]byte, error) {
+	pm.compressOnce.Do(func() {
+		d := newDeflateState(deflateParams{serverNoContextTakeover: true})
+		payload, err := d.compress(pm.data)
+		if err != nil {
+			pm.compressErr = err
+			return
+		}
+		frame, err := buildFrame(opcodeOf(pm.messageType), payload, true)
+		if err != nil {
+			pm.compressErr = err
+			return
+		}
+		frame[0] |= rsv1Bit
+		pm.compressedFrame = frame
+	})
+	return pm.compressedFrame, pm.compressErr
+}
+
+// WritePreparedMessage sends pm like WriteMessage would, without encoding it again.
+// Under compression with server context takeover every message depends on
+// the ones before it, and a client masks every frame with a key of its own,
+// so then pm is encoded for this connection alone.
+func (c *Conn) WritePreparedMessage(pm *PreparedMessage) error {
+	if c.dropSlow() {
+		return ErrSlowConsumer
+	}
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	return c.sentMessage(opcodeOf(pm.messageType), c.writePreparedLocked(pm))
+}
+
+// writePreparedLocked writes pm while the caller holds messageMu
+func (c *Conn) writePreparedLocked(pm *PreparedMessage) error {
+	switch {
+	case c.info.client:
+		return c.writeMessageLocked(opcodeOf(pm.messageType), pm.data)
+	case c.deflate == nil || c.compressOff.Load():
+		return c.write(pm.frame)
+	case c.deflate.params.serverNoContextTakeover && c.level.Load() == compressionLevel:
+		frame, err := pm.compressed()
+		if err != nil {
+			return err
+		}
+		return c.write(frame)
+	default:
+		return c.writeMessageLocked(opcodeOf(pm.messageType), pm.data)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestPreparedMessageSameFrame(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+
+	data := []byte("hello everyone")
+	pm, err := NewPreparedMessage(opText, data)
+	if err != nil {
+		t.Fatalf("NewPreparedMessage: %v", err)
+	}
+	go func() {
+		c.WriteMessage(opText, data)
+		c.WritePreparedMessage(pm)
+	}()
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	direct := readFrameFrom(t, reader)
+	prepared := readFrameFrom(t, reader)
+	if direct.Opcode != prepared.Opcode || direct.Fin != prepared.Fin || !bytes.Equal(direct.Payload, prepared.Payload) {
+		t.Fatalf("prepared frame %+v differs from %+v", prepared, direct)
+	}
+}
+
+func TestPreparedMessageCompressed(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	text := []byte(wordySample(64 << 10))
+	pm, err := NewPreparedMessage(opText, text)
+	if err != nil {
+		t.Fatalf("NewPreparedMessage: %v", err)
+	}
+	for _, params := range []deflateParams{{}, {serverNoContextTakeover: true}} {
+		server, client := connPair(t, cfg, &params)
+		// Mixed with regular messages, so under context takeover the
+		// messages after the prepared one refer back to it
+		go func() {
+			for i := 0; i < 3; i++ {
+				server.WriteMessage(opText, text)
+				server.WritePreparedMessage(pm)
+			}
+		}()
+		for i := 0; i < 6; i++ {
+			messageType, data, err := client.ReadMessage()
+			if err != nil {
+				t.Fatalf("%+v: ReadMessage: %v", params, err)
+			}
+			if messageType != opText || !bytes.Equal(data, text) {
+				t.Fatalf("%+v: message %d differs from the one sent", params, i)
+			}
+		}
+	}
+}
+
+func TestPreparedMessageInvalidType(t *testing.T) {
+	if _, err := NewPreparedMessage(opPing, nil); err == nil {
+		t.Fatal("expected an error for a control frame")
+	}
+}
+
+// discardTransport accepts every write, so a benchmark measures only the
+// work done per connection
+type discardTransport struct{}
+
+func (discardTransport) Read(p []byte) (int, error)         { select {} }
+func (discardTransport) Write(p []byte) (int, error)        { return len(p), nil }
+func (discardTransport) Close() error                       { return nil }
+func (discardTransport) SetReadDeadline(t time.Time) error  { return nil }
+func (discardTransport) SetWriteDeadline(t time.Time) error { return nil }
+
+// BenchmarkBroadcast sends one message to 10k connections, encoding it for
+// every connection against encoding it once
+func BenchmarkBroadcast(b *testing.B) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	data := []byte(wordySample(1 << 10))
+	for _, deflate := range []*deflateParams{nil, {serverNoContextTakeover: true}} {
+		conns := make([]*Conn, 10000)
+		for i := range conns {
+			conns[i] = newConn(context.Background(), discardTransport{}, nil, cfg, connInfo{path: "/", deflate: deflate})
+		}
+		name := fmt.Sprintf("compressed=%t", deflate != nil)
+		b.Run(name+"/WriteMessage", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				for _, c := range conns {
+					if err := c.WriteMessage(opText, data); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+		b.Run(name+"/WritePreparedMessage", func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				pm, err := NewPreparedMessage(opText, data)
+				if err != nil {
+					b.Fatal(err)
+				}
+				for _, c := range conns {
+					if err := c.WritePreparedMessage(pm); err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+		for _, c := range conns {
+			c.close()
+		}
+	}
+}
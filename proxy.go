@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// ErrProxy is wrapped by the errors of a proxy that refused or failed to
+// open the tunnel, e.g. 407 Proxy Authentication Required
+var ErrProxy = errors.New("websocket: proxy")
+
+// dialProxy opens a tunnel to target, a host:port, through the proxy at
+// proxyURL. ctx bounds connecting to the proxy and the tunnel setup.
+func dialProxy(ctx context.Context, proxyURL *url.URL, target string) (net.Conn, error) {
+	var dialer net.Dialer
+	switch proxyURL.Scheme {
+	case "http", "https":
+		port := proxyURL.Port()
+		if port == "" {
+			port = "80"
+			if proxyURL.Scheme == "https" {
+				port = "443"
+			}
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(proxyURL.Hostname(), port))
+		if err != nil {
+			return nil, err
+		}
+		if proxyURL.Scheme == "https" {
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: proxyURL.Hostname()})
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				_ = conn.Close()
+				return nil, err
+			}
+			conn = tlsConn
+		}
+		return tunnel(ctx, conn, proxyURL, target, httpConnect)
+	case "socks5", "socks5h":
+		port := proxyURL.Port()
+		if port == "" {
+			port = "1080"
+		}
+		conn, err := dialer.DialContext(ctx, "tcp", net.JoinHostPort(proxyURL.Hostname(), port))
+		if err != nil {
+			return nil, err
+		}
+		return tunnel(ctx, conn, proxyURL, target, socks5Connect)
+	}
+	return nil, fmt.Errorf("%w: unsupported scheme %q", ErrProxy, proxyURL.Scheme)
+}
+
+// tunnel runs the setup of a tunnel on conn, the connection to the proxy,
+// closing it when that fails
+func tunnel(ctx context.Context, conn net.Conn, proxyURL *url.URL, target string, setup func(net.Conn, *url.URL, string) error) (net.Conn, error) {
+	stop := bindDeadline(ctx, conn)
+	err := setup(conn, proxyURL, target)
+	if !stop() && err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		_ = conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+	_ = conn.SetDeadline(time.Time{})
+	return conn, nil
+}
+
+// httpConnect asks an HTTP proxy for a tunnel to target with CONNECT
+func httpConnect(conn net.Conn, proxyURL *url.URL, target string) error {
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: target},
+		Host:   target,
+		Header: make(http.Header),
+	}
+	if proxyURL.User != nil {
+		password, _ := proxyURL.User.Password()
+		credentials := proxyURL.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	// The server only speaks once it got the upgrade request, anything
+	// buffered past the response is an error
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		return fmt.Errorf("%w: reading the CONNECT response: %v", ErrProxy, err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%w: CONNECT %s: %s", ErrProxy, target, resp.Status)
+	}
+	if reader.Buffered() > 0 {
+		return fmt.Errorf("%w: data sent before the tunnel was up", ErrProxy)
+	}
+	return nil
+}
+
+// socks5Replies explains the reply codes of RFC 1928 section 6
+var socks5Replies = [...]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// socks5Connect asks a SOCKS5 proxy for a tunnel to target (RFC 1928), with
+// the username and password of proxyURL when it has some (RFC 1929)
+func socks5Connect(conn net.Conn, proxyURL *url.URL, target string) error {
+	host, portStr, err := net.SplitHostPort(target)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("%w: bad port %q", ErrProxy, portStr)
+	}
+
+	// Offer no authentication, and username/password when there are credentials
+	methods := []byte{0x00}
+	if proxyURL.User != nil {
+		methods = []byte{0x02}
+	}
+	if _, err := conn.Write(append([]byte{5, byte(len(methods))}, methods...)); err != nil {
+		return err
+	}
+	var choice [2]byte
+	if _, err := io.ReadFull(conn, choice[:]); err != nil {
+		return fmt.Errorf("%w: reading the SOCKS5 greeting: %v", ErrProxy, err)
+	}
+	if choice[0] != 5 {
+		return fmt.Errorf("%w: not a SOCKS5 server", ErrProxy)
+	}
+	switch choice[1] {
+	case 0x00:
+	case 0x02:
+		username := proxyURL.User.Username()
+		password, _ := proxyURL.User.Password()
+		if len(username) > 255 || len(password) > 255 {
+			return fmt.Errorf("%w: SOCKS5 credentials longer than 255 bytes", ErrProxy)
+		}
+		auth := append([]byte{1, byte(len(username))}, username...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := conn.Write(auth); err != nil {
+			return err
+		}
+		var status [2]byte
+		if _, err := io.ReadFull(conn, status[:]); err != nil {
+			return fmt.Errorf("%w: reading the SOCKS5 authentication status: %v", ErrProxy, err)
+		}
+		if status[1] != 0 {
+			return fmt.Errorf("%w: SOCKS5 authentication failed", ErrProxy)
+		}
+	default:
+		return fmt.Errorf("%w: no acceptable SOCKS5 authentication method", ErrProxy)
+	}
+
+	request := []byte{5, 1, 0} // CONNECT
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("%w: host name too long", ErrProxy)
+		}
+		request = append(append(request, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(append(request, 1), ip4...)
+	} else {
+		request = append(append(request, 4), ip...)
+	}
+	request = binary.BigEndian.AppendUint16(request, uint16(port))
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	var reply [4]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return fmt.Errorf("%w: reading the SOCKS5 reply: %v", ErrProxy, err)
+	}
+	if reply[1] != 0 {
+		reason := "unknown error"
+		if int(reply[1]) < len(socks5Replies) {
+			reason = socks5Replies[reply[1]]
+		}
+		return fmt.Errorf("%w: SOCKS5 CONNECT %s: %s", ErrProxy, target, reason)
+	}
+	// Skip the bound address, the tunnel starts after it
+	var skip int
+	switch reply[3] {
+	case 1:
+		skip = net.IPv4len
+	case 4:
+		skip = net.IPv6len
+	case 3:
+		var n [1]byte
+		if _, err := io.ReadFull(conn, n[:]); err != nil {
+			return err
+		}
+		skip = int(n[0])
+	default:
+		return fmt.Errorf("%w: bad SOCKS5 address type %d", ErrProxy, reply[3])
+	}
+	if _, err := io.ReadFull(conn, make([]byte, skip+2)); err != nil {
+		return fmt.Errorf("%w: reading the SOCKS5 reply: %v", ErrProxy, err)
+	}
+	return nil
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// pipeBoth copies between a and b until either side is done, then closes both
+func pipeBoth(a, b net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() { io.Copy(a, b); done <- struct{}{} }()
+	go func() { io.Copy(b, a); done <- struct{}{} }()
+	<-done
+	a.Close()
+	b.Close()
+}
+
+// newConnectProxy starts an HTTP proxy that only does CONNECT, requiring
+// auth as its Proxy-Authorization when it isn't empty. The targets it
+// tunneled to are sent on the returned channel.
+func newConnectProxy(t *testing.T, auth string) (*httptest.Server, <-chan string) {
+	targets := make(chan string, 10)
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			http.Error(w, "CONNECT only", http.StatusMethodNotAllowed)
+			return
+		}
+		if auth != "" && r.Header.Get("Proxy-Authorization") != auth {
+			w.Header().Set("Proxy-Authenticate", `Basic realm="test"`)
+			w.WriteHeader(http.StatusProxyAuthRequired)
+			return
+		}
+		upstream, err := net.Dial("tcp", r.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		targets <- r.Host
+		conn, _, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			upstream.Close()
+			return
+		}
+		conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+		pipeBoth(conn, upstream)
+	}))
+	t.Cleanup(proxy.Close)
+	return proxy, targets
+}
+
+func TestDialThroughConnectProxy(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+	// "Basic " + base64("user:secret")
+	proxy, targets := newConnectProxy(t, "Basic dXNlcjpzZWNyZXQ=")
+
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "secret")
+	d := Dialer{Config: DefaultConfig(), Proxy: http.ProxyURL(proxyURL)}
+	c, _, err := d.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.CloseNow()
+	if target := <-targets; target != addr {
+		t.Fatalf("the proxy tunneled to %s, want %s", target, addr)
+	}
+	echoThrough(t, c, []byte("through the tunnel"))
+}
+
+func TestDialConnectProxyAuthFailure(t *testing.T) {
+	proxy, _ := newConnectProxy(t, "Basic dXNlcjpzZWNyZXQ=")
+	proxyURL, _ := url.Parse(proxy.URL)
+	proxyURL.User = url.UserPassword("user", "wrong")
+
+	d := Dialer{Proxy: http.ProxyURL(proxyURL)}
+	_, _, err := d.Dial("ws://127.0.0.1:1/", nil)
+	if !errors.Is(err, ErrProxy) || !strings.Contains(err.Error(), "407") {
+		t.Fatalf("expected a proxy error with the 407, got %v", err)
+	}
+}
+
+// serveSOCKS5 answers one SOCKS5 client on conn, requiring username and
+// password when username isn't empty, and tunnels it to the requested target
+func serveSOCKS5(conn net.Conn, username, password string) {
+	defer conn.Close()
+	var greeting [2]byte
+	if _, err := io.ReadFull(conn, greeting[:]); err != nil {
+		return
+	}
+	methods := make([]byte, greeting[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+	if username == "" {
+		conn.Write([]byte{5, 0})
+	} else {
+		conn.Write([]byte{5, 2})
+		var header [2]byte
+		io.ReadFull(conn, header[:])
+		user := make([]byte, header[1])
+		io.ReadFull(conn, user)
+		var n [1]byte
+		io.ReadFull(conn, n[:])
+		pass := make([]byte, n[0])
+		io.ReadFull(conn, pass)
+		if string(user) != username || string(pass) != password {
+			conn.Write([]byte{1, 1})
+			return
+		}
+		conn.Write([]byte{1, 0})
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1:
+		ip := make([]byte, 4)
+		io.ReadFull(conn, ip)
+		host = net.IP(ip).String()
+	case 3:
+		var n [1]byte
+		io.ReadFull(conn, n[:])
+		name := make([]byte, n[0])
+		io.ReadFull(conn, name)
+		host = string(name)
+	}
+	var port [2]byte
+	io.ReadFull(conn, port[:])
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	upstream, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	pipeBoth(conn, upstream)
+}
+
+func TestDialThroughSOCKS5Proxy(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go serveSOCKS5(conn, "user", "secret")
+		}
+	}()
+
+	d := Dialer{Config: DefaultConfig(), Proxy: http.ProxyURL(&url.URL{Scheme: "socks5", Host: ln.Addr().String(), User: url.UserPassword("user", "secret")})}
+	c, _, err := d.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("Dial: %v", err)
+	}
+	defer c.CloseNow()
+	echoThrough(t, c, []byte("through SOCKS5"))
+
+	// Wrong credentials and unreachable targets are reported
+	d.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: ln.Addr().String(), User: url.UserPassword("user", "wrong")})
+	if _, _, err := d.Dial("ws://"+addr+"/", nil); !errors.Is(err, ErrProxy) || !strings.Contains(err.Error(), "authentication failed") {
+		t.Fatalf("expected the authentication to fail, got %v", err)
+	}
+	d.Proxy = http.ProxyURL(&url.URL{Scheme: "socks5", Host: ln.Addr().String(), User: url.UserPassword("user", "secret")})
+	if _, _, err := d.Dial("ws://127.0.0.1:1/", nil); !errors.Is(err, ErrProxy) || !strings.Contains(err.Error(), "connection refused") {
+		t.Fatalf("expected the refused connection to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Idle buckets are dropped at most this often, so the map only holds the
+// clients seen recently
+const rateLimitSweepInterval = time.Minute
+
+// rateLimiter is a token bucket per client IP.
+// A bucket that has been idle long enough to refill completely is the same as
+// a new one, those are swept from the map.
+type rateLimiter struct {
+	rate  float64 // tokens added per second
+	burst float64 // bucket size
+	now   func() time.Time
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time // when tokens was last brought up to date
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: make(map[string]*tokenBucket),
+	}
+}
+
+// allow takes a token from the bucket of ip. Without one it reports how long
+// until the next token is available.
+func (l *rateLimiter) allow(ip string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	l.sweep(now)
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[ip] = b
+	}
+	return b.take(now, l.rate, l.burst)
+}
+
+// take brings b up to date and takes a token. Without one it reports how
+// long until the next token is available.
+func (b *tokenBucket) take(now time.Time, rate, burst float64) (bool, time.Duration) {
+	b.tokens = math.Min(burst, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / rate * float64(time.Second))
+}
+
+// sweep drops the buckets that are full again
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < rateLimitSweepInterval {
+		return
+	}
+	l.lastSweep = now
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	for ip, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// RatePolicy decides what happens to a message read over Config.MessageRate
+type RatePolicy int
+
+const (
+	// RateDelay stops reading until the message may be taken, TCP holds the
+	// peer back meanwhile
+	RateDelay RatePolicy = iota
+	// RateClose closes the connection with 1008 "rate limit exceeded"
+	RateClose
+)
+
+// messageLimiter is the token bucket of the data messages a connection
+// reads, see Config.MessageRate
+type messageLimiter struct {
+	rate   float64
+	burst  float64
+	policy RatePolicy
+	bucket tokenBucket
+	now    func() time.Time
+	sleep  func(d time.Duration, done <-chan struct{}) bool // false when done closed first
+}
+
+// newMessageLimiter returns the limiter of cfg, nil without a limit
+func newMessageLimiter(cfg Config) *messageLimiter {
+	if cfg.MessageRate <= 0 {
+		return nil
+	}
+	burst := float64(max(cfg.MessageBurst, 1))
+	return &messageLimiter{
+		rate:   cfg.MessageRate,
+		burst:  burst,
+		policy: cfg.MessageRatePolicy,
+		bucket: tokenBucket{tokens: burst, last: time.Now()},
+		now:    time.Now,
+		sleep:  sleep,
+	}
+}
+
+// sleep waits d unless done closes first
+func sleep(d time.Duration, done <-chan struct{}) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-done:
+		return false
+	}
+}
+
+// limitMessage takes a token for a data message that was read completely.
+// Without one RateDelay waits for it and RateClose refuses the message.
+func (c *Conn) limitMessage() error {
+	l := c.messageLimiter
+	for {
+		ok, wait := l.bucket.take(l.now(), l.rate, l.burst)
+		if ok {
+			return nil
+		}
+		if l.policy == RateClose {
+			return &CloseError{Code: ClosePolicyViolation, Text: "rate limit exceeded"}
+		}
+		if !l.sleep(wait, c.done) {
+			return nil // the connection is gone, reading fails next
+		}
+	}
+}
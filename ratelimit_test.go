@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(2, 3)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := l.allow("a"); !ok {
+			t.Fatalf("attempt %d within the burst was refused", i)
+		}
+	}
+	ok, wait := l.allow("a")
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected a refusal with a 500ms wait, got ok=%t wait=%v", ok, wait)
+	}
+	if ok, _ := l.allow("b"); !ok {
+		t.Fatalf("another client shares the bucket")
+	}
+
+	now = now.Add(500 * time.Millisecond)
+	if ok, _ := l.allow("a"); !ok {
+		t.Fatalf("expected a token after waiting")
+	}
+	if ok, _ := l.allow("a"); ok {
+		t.Fatalf("expected the refilled token to be used up")
+	}
+}
+
+func TestRateLimiterEvictsIdleBuckets(t *testing.T) {
+	now := time.Unix(0, 0)
+	l := newRateLimiter(1, 45) // refills in 45s
+	l.now = func() time.Time { return now }
+	l.allow("stale")
+	now = now.Add(rateLimitSweepInterval / 2)
+	l.allow("recent")
+
+	// "stale" had time to refill completely, "recent" didn't
+	now = now.Add(rateLimitSweepInterval/2 + time.Second)
+	l.allow("new")
+	if _, ok := l.buckets["stale"]; ok {
+		t.Fatalf("expected the idle bucket to be evicted")
+	}
+	if len(l.buckets) != 2 {
+		t.Fatalf("expected 2 buckets to remain, got %d", len(l.buckets))
+	}
+}
+
+// fakeClock makes l run on a clock that only moves when l sleeps, it
+// returns how long l slept so far
+func fakeClock(l *messageLimiter) *time.Duration {
+	start := time.Unix(0, 0)
+	slept := new(time.Duration)
+	l.bucket.last = start
+	l.now = func() time.Time { return start.Add(*slept) }
+	l.sleep = func(d time.Duration, done <-chan struct{}) bool {
+		*slept += d
+		return true
+	}
+	return slept
+}
+
+func TestMessageRateDelay(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MessageRate = 10
+	cfg.MessageBurst = 3
+	// every message comes with a ping, which doesn't count
+	c := pingConn()
+	c.messageLimiter = newMessageLimiter(cfg)
+	slept := fakeClock(c.messageLimiter)
+
+	for i := range 5 {
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != "hello" {
+			t.Fatalf("message %d: read %q, %v", i, data, err)
+		}
+		want := time.Duration(max(i-2, 0)) * 100 * time.Millisecond
+		if *slept != want {
+			t.Fatalf("message %d: expected reading to wait %v in all, it waited %v", i, want, *slept)
+		}
+	}
+}
+
+func TestMessageRateClose(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.MessageRate = 10
+	cfg.MessageBurst = 2
+	cfg.MessageRatePolicy = RateClose
+	c, client, reader := pipeConn(t, cfg)
+	slept := fakeClock(c.messageLimiter)
+
+	errs := make(chan error, 1)
+	go func() {
+		for {
+			if _, _, err := c.ReadMessage(); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	go func() {
+		for range 3 {
+			client.Write(clientFrame(opPing, []byte("keepalive"), true))
+			client.Write(clientFrame(opText, []byte("hello"), true))
+		}
+	}()
+
+	// the pings are answered, the third message over the burst closes
+	for range 3 {
+		if f := readFrameFrom(t, reader); f.Opcode != opPong {
+			t.Fatalf("expected a PONG, got opcode %d", f.Opcode)
+		}
+	}
+	reply := readFrameFrom(t, reader)
+	code, reason, _ := parseClosePayload(reply.Payload)
+	if reply.Opcode != opClose || code != ClosePolicyViolation || reason != "rate limit exceeded" {
+		t.Fatalf("expected CLOSE 1008, got opcode %d code %d %q", reply.Opcode, code, reason)
+	}
+	payload, _ := formatClosePayload(ClosePolicyViolation, "")
+	client.Write(clientFrame(opClose, payload, true))
+	var ce *CloseError
+	if err := <-errs; !errors.As(err, &ce) || ce.Code != ClosePolicyViolation {
+		t.Fatalf("expected reading to end with 1008, got %v", err)
+	}
+	if *slept != 0 {
+		t.Fatalf("RateClose waited %v", *slept)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultSendQueueSize is the queue of Send when Config.SendQueueSize is zero
+const defaultSendQueueSize = 64
+
+// OverflowPolicy decides what Send does when the send queue is full
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits for room in the queue, at most Config.SendTimeout
+	OverflowBlock OverflowPolicy = iota
+	// OverflowDropNewest discards the message being sent
+	OverflowDropNewest
+	// OverflowDropOldest discards the message that waited longest
+	OverflowDropOldest
+	// OverflowClose abandons the queue and closes the connection with 1013
+	OverflowClose
+)
+
+// ErrSendTimeout is returned by Send when the queue stayed full for
+// Config.SendTimeout
+var ErrSendTimeout = errors.New("websocket: send queue full")
+
+// sendQueue holds the messages Send accepted until its writer sends them
+type sendQueue struct {
+	messages chan Message
+
+	// mu is held for writing to stop accepting messages, so none slips in
+	// after the writer was told to stop. dropMu pairs dropping the oldest
+	// message with queueing the new one.
+	mu     sync.RWMutex
+	dropMu sync.Mutex
+
+	stopOnce  sync.Once
+	stop      chan struct{} // closed once no more messages are accepted
+	stopped   chan struct{} // closed by the writer when it returns
+	abandoned atomic.Bool   // the queued messages are dropped instead of sent
+	dropped   atomic.Uint64
+}
+
+// Send queues a TextMessage or BinaryMessage for a writer goroutine of the
+// connection and returns, so a slow peer doesn't hold up the caller. The
+// queue holds Config.SendQueueSize messages, when it is full
+// Config.SendOverflow decides: OverflowBlock waits, OverflowDropNewest and
+// OverflowDropOldest drop a message and return nil, OverflowClose closes
+// the connection and returns ErrConnClosed. Messages are sent in the order
+// they were queued, interleaved with the WriteMessage calls of other
+// goroutines. data must not be modified after Send returned. Close sends
+// what is queued before its CLOSE frame, CloseNow abandons it.
+func (c *Conn) Send(messageType int, data []byte) error {
+	if !IsData(messageType) {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	q := c.sendQueue()
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	select {
+	case <-q.stop:
+		return ErrCloseSent
+	case <-c.done:
+		return ErrConnClosed
+	default:
+	}
+	if q.abandoned.Load() {
+		return ErrConnClosed
+	}
+	if c.dropSlow() {
+		q.dropped.Add(1)
+		return nil
+	}
+	switch err := c.reserve(int64(len(data)), false); {
+	case errors.Is(err, errBudgetFull):
+		q.dropped.Add(1)
+		return nil
+	case errors.Is(err, errBudgetExceeded):
+		q.abandoned.Store(true)
+		q.abandon(c)
+		go c.Close(CloseTryAgainLater, errBudgetExceeded.Text)
+		return ErrConnClosed
+	case err != nil:
+		return err
+	}
+
+	m := Message{Type: messageType, Data: data}
+	select {
+	case q.messages <- m:
+		return nil
+	default:
+	}
+	switch c.cfg.SendOverflow {
+	case OverflowDropNewest:
+		q.drop(c, m)
+		return nil
+	case OverflowDropOldest:
+		q.dropMu.Lock()
+		defer q.dropMu.Unlock()
+		for {
+			select {
+			case q.messages <- m:
+				return nil
+			default:
+			}
+			select {
+			case old := <-q.messages:
+				q.drop(c, old)
+			default:
+			}
+		}
+	case OverflowClose:
+		c.logger.Warn("send queue full, closing")
+		q.abandoned.Store(true)
+		c.uncharge(int64(len(data)))
+		q.abandon(c)
+		go c.Close(CloseTryAgainLater, "send queue full")
+		return ErrConnClosed
+	}
+
+	var timeout <-chan time.Time
+	if c.cfg.SendTimeout > 0 {
+		t := time.NewTimer(c.cfg.SendTimeout)
+		defer t.Stop()
+		timeout = t.C
+	}
+	select {
+	case q.messages <- m:
+		return nil
+	case <-c.done:
+		c.uncharge(int64(len(data)))
+		return ErrConnClosed
+	case <-timeout:
+		c.uncharge(int64(len(data)))
+		return ErrSendTimeout
+	}
+}
+
+// SendQueueLen returns how many messages wait in the queue of Send
+func (c *Conn) SendQueueLen() int {
+	if q := c.sendQ.Load(); q != nil {
+		return len(q.messages)
+	}
+	return 0
+}
+
+// SendDropped returns how many messages Send dropped because the queue was
+// full or abandoned, or SlowDrop dropped them
+func (c *Conn) SendDropped() uint64 {
+	if q := c.sendQ.Load(); q != nil {
+		return q.dropped.Load()
+	}
+	return 0
+}
+
+// sendQueue returns the queue of Send, starting its writer on first use
+func (c *Conn) sendQueue() *sendQueue {
+	c.sendOnce.Do(func() {
+		size := c.cfg.SendQueueSize
+		if size == 0 {
+			size = defaultSendQueueSize
+		}
+		q := &sendQueue{messages: make(chan Message, size), stop: make(chan struct{}), stopped: make(chan struct{})}
+		c.sendQ.Store(q)
+		go c.sendLoop(q)
+	})
+	return c.sendQ.Load()
+}
+
+// sendLoop writes the queued messages until the queue is stopped or the
+// connection closed
+func (c *Conn) sendLoop(q *sendQueue) {
+	defer close(q.stopped)
+	for {
+		select {
+		case m := <-q.messages:
+			if !q.send(c, m) {
+				return
+			}
+		case <-q.stop:
+			// what was queued before goes out first
+			for {
+				select {
+				case m := <-q.messages:
+					if !q.send(c, m) {
+						return
+					}
+				default:
+					return
+				}
+			}
+		case <-c.done:
+			q.abandon(c)
+			return
+		}
+	}
+}
+
+// send writes m unless the queue was abandoned, it reports whether the
+// writer goes on
+func (q *sendQueue) send(c *Conn, m Message) bool {
+	if q.abandoned.Load() {
+		q.drop(c, m)
+		return true
+	}
+	err := c.WriteMessage(m.Type, m.Data)
+	c.uncharge(int64(len(m.Data)))
+	if errors.Is(err, ErrSlowConsumer) {
+		q.dropped.Add(1)
+		return true
+	}
+	if err != nil {
+		q.abandoned.Store(true)
+		q.abandon(c)
+		return false
+	}
+	return true
+}
+
+// abandon drops what is left in the queue
+func (q *sendQueue) abandon(c *Conn) {
+	for {
+		select {
+		case m := <-q.messages:
+			q.drop(c, m)
+		default:
+			return
+		}
+	}
+}
+
+// drop counts m as dropped and gives back its memory
+func (q *sendQueue) drop(c *Conn, m Message) {
+	q.dropped.Add(1)
+	c.uncharge(int64(len(m.Data)))
+}
+
+// stopSending stops Send from accepting messages and waits for the writer
+// to send the queued ones, or to drop them when the queue was abandoned
+func (c *Conn) stopSending() {
+	q := c.sendQ.Load()
+	if q == nil {
+		return
+	}
+	q.stopOnce.Do(func() {
+		q.mu.Lock()
+		close(q.stop)
+		q.mu.Unlock()
+	})
+	<-q.stopped
+}
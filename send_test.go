@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"testing"
+	"time"
+)
+
+// fillSendQueue sends "m0" to the peer, which doesn't read it, then fills
+// the queue of size 2 with "m1" and "m2"
+func fillSendQueue(t *testing.T, c *Conn) {
+	t.Helper()
+	if err := c.Send(TextMessage, []byte("m0")); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	// the writer took m0 and is stuck writing it
+	deadline := time.Now().Add(2 * time.Second)
+	for c.SendQueueLen() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("the writer never took the first message")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	for _, msg := range []string{"m1", "m2"} {
+		if err := c.Send(TextMessage, []byte(msg)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+	if n := c.SendQueueLen(); n != 2 {
+		t.Fatalf("expected 2 queued messages, got %d", n)
+	}
+}
+
+// expectTexts reads text frames with the payloads of want
+func expectTexts(t *testing.T, reader *bufio.Reader, want ...string) {
+	t.Helper()
+	for _, msg := range want {
+		if f := readFrameFrom(t, reader); f.Opcode != opText || string(f.Payload) != msg {
+			t.Fatalf("expected %q, got opcode %d %q", msg, f.Opcode, f.Payload)
+		}
+	}
+}
+
+func TestSendOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		policy  OverflowPolicy
+		err     error    // what Send returns once the queue is full
+		dropped uint64   // SendDropped afterwards
+		read    []string // what the peer gets once it reads
+	}{
+		{"block", OverflowBlock, ErrSendTimeout, 0, []string{"m0", "m1", "m2"}},
+		{"drop newest", OverflowDropNewest, nil, 1, []string{"m0", "m1", "m2"}},
+		{"drop oldest", OverflowDropOldest, nil, 1, []string{"m0", "m2", "m3"}},
+		{"close", OverflowClose, ErrConnClosed, 2, []string{"m0"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.SendQueueSize = 2
+			cfg.SendOverflow = tc.policy
+			cfg.SendTimeout = 50 * time.Millisecond
+			c, _, reader := pipeConn(t, cfg)
+			fillSendQueue(t, c)
+
+			if err := c.Send(TextMessage, []byte("m3")); !errors.Is(err, tc.err) {
+				t.Fatalf("expected %v, got %v", tc.err, err)
+			}
+			expectTexts(t, reader, tc.read...)
+			if tc.policy == OverflowClose {
+				f := readFrameFrom(t, reader)
+				if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseTryAgainLater {
+					t.Fatalf("expected CLOSE 1013, got opcode %d code %d", f.Opcode, code)
+				}
+			}
+			if n := c.SendDropped(); n != tc.dropped {
+				t.Fatalf("expected %d dropped messages, got %d", tc.dropped, n)
+			}
+		})
+	}
+}
+
+func TestCloseFlushesSendQueue(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.SendQueueSize = 2
+	c, client, reader := pipeConn(t, cfg)
+	fillSendQueue(t, c)
+
+	closed := make(chan error, 1)
+	go func() { closed <- c.Close(CloseNormalClosure, "") }()
+	expectTexts(t, reader, "m0", "m1", "m2")
+	if f := readFrameFrom(t, reader); f.Opcode != opClose {
+		t.Fatalf("expected the CLOSE after the queued messages, got opcode %d", f.Opcode)
+	}
+	client.Write(clientFrame(opClose, nil, true))
+	if err := <-closed; err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if err := c.Send(TextMessage, []byte("late")); !errors.Is(err, ErrConnClosed) {
+		t.Fatalf("expected Send after Close to fail, got %v", err)
+	}
+}
@@ -1,186 +1,413 @@
 package main
 
 import (
-	"bufio"
+	"context"
+	"crypto/rand"
 	"crypto/sha1"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"maps"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"runtime/debug"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"gows/wire"
 )
 
-/* ------The WebSockets Frame -----
-    0                   1                   2                   3
-    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
-   +-+-+-+-+-------+-+-------------+-------------------------------+
-   |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
-   |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
-   |N|V|V|V|       |S|             |   (if payload len==126/127)   |
-   | |1|2|3|       |K|             |                               |
-   +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
-   |     Extended payload length continued, if payload len == 127  |
-   + - - - - - - - - - - - - - - - +-------------------------------+
-   |                               |Masking-key, if MASK set to 1  |
-   +-------------------------------+-------------------------------+
-   | Masking-key (continued)       |          Payload Data         |
-   +-------------------------------- - - - - - - - - - - - - - - - +
-   :                     Payload Data continued ...                :
-   + - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - +
-   |                     Payload Data continued ...                |
-   +---------------------------------------------------------------+
-
-*/
-
-// the websockets opcodes
+// the websockets opcodes, see package wire
 const (
-	opCont  = 0x0 // 0000
-	opText  = 0x1 // 0001
-	opBin   = 0x2 // 0010
-	opClose = 0x8 // 1000
-	opPing  = 0x9 // 1001
-	opPong  = 0xA // 1010
+	opCont  = wire.OpContinuation
+	opText  = wire.OpText
+	opBin   = wire.OpBinary
+	opClose = wire.OpClose
+	opPing  = wire.OpPing
+	opPong  = wire.OpPong
 )
 
+// readBufferSize is how many bytes a Conn reads from the socket at once,
+// unless Config.ReadBufferSize says otherwise
+const readBufferSize = 4096
+
+// reassemblyBufferSize is the capacity ReadMessage's reassembly buffer may
+// keep between messages unless Config.ReassemblyBufferSize says otherwise
+const reassemblyBufferSize = 64 << 10
+
+// vectoredWriteSize is the payload size from which the server writes a
+// frame's header and payload as they are instead of copying them together
+const vectoredWriteSize = 16 << 10
+
+// maxFrameHeaderSize is the longest frame header: 2 bytes, 8 bytes of extended
+// payload length and a 4-byte masking key
+const maxFrameHeaderSize = wire.MaxHeaderSize
+
 // WebSocket GUID used when computing Sec-WebSocket-Accept during the handshake
 const wsGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
 
-// frame represents a single WebSocket frame.
-// Fin: true if this frame completes the message (FIN bit)
-// Opcode: identifies text/binary/control/ping pong frame types
-// Payload: decoded message bytes
-type frame struct {
-	Fin     bool
-	Opcode  byte
-	Payload []byte
-}
-
-// large buffer may have one or more websocket frames
-// parseFrames walks the incoming buffer, extracting as many complete frames as
-// possible. Any leftover bytes (partial frame) are returned so the caller can
-// prepend them to the next read.
-func parseFrames(buffer []byte) ([]frame, []byte, error) {
-	var frames []frame
-	offset := 0
-
-	// we loop through the buffer data arrived and capture frames
-	// one "Read" can give us multiple frames
-
-	// if we have at least 2 bytes, there might be a complete frame to parse
-	// Remember: the minimum frame size is 2 bytes (no payload, no mask)
-	for len(buffer)-offset >= 2 {
-		firstByte := buffer[offset]    // first byte (FIN(1bit) + RSV(3bit) + Opcode(4bit))
-		fin := (firstByte & 0x80) != 0 // the fin bit is the first bit      (1000,0000)
-		opcode := firstByte & 0x0F     // the opcodes are the last 4 bits   (0000,1111)
-
-		secondByte := buffer[offset+1]     // second byte (MASK(1bit) + Payload len(7bit))
-		masked := (secondByte & 0x80) != 0 // the mask bit is the first bit     (1000,0000)
-		length := int(secondByte & 0x7F)   // the length is the last 7 bits     (0111,1111)
-		pos := offset + 2
-
-		if length == 126 {
-			// Length 126 means the next 2 bytes (extended payload len) contain the actual payload length
-			if len(buffer)-pos < 2 {
-				break
-			}
-			length = int(binary.BigEndian.Uint16(buffer[pos : pos+2]))
-			pos += 2
-		} else if length == 127 {
-			// Length 127 means the next 8 bytes (extended payload len + continue) hold the payload length
-			if len(buffer)-pos < 8 {
-				break
-			}
-			hi := binary.BigEndian.Uint32(buffer[pos : pos+4])
-			lo := binary.BigEndian.Uint32(buffer[pos+4 : pos+8])
-			pos += 8
-			if hi != 0 {
-				return nil, nil, errors.New("frame larger than 4GB not supported")
-			}
-			length = int(lo)
+// frame is a single WebSocket frame, decoded by package wire
+type frame = wire.Frame
+
+// parseOptions are the limits and checks applied to every frame a Conn reads
+type parseOptions struct {
+	maxFrameSize int64 // largest payload a frame may declare, 0 = unlimited
+	strict       bool  // reject lengths that could have used a shorter encoding
+	compression  bool  // permessage-deflate was negotiated, RSV1 may be set
+	client       bool  // we are the client: frames must not be masked, otherwise they must be
+	inPlace      bool  // payloads alias the read buffer, see Config.InPlaceReads
+}
+
+// wire returns the options for package wire
+func (opts parseOptions) wire() wire.ParseOptions {
+	wopts := wire.ParseOptions{MaxFrameSize: opts.maxFrameSize, Strict: opts.strict, Compression: opts.compression, Mask: wire.MaskRequired, InPlace: opts.inPlace}
+	if opts.client {
+		wopts.Mask = wire.MaskForbidden
+	}
+	return wopts
+}
+
+// frameError turns an error of package wire into one matching
+// errMessageTooBig for frames over the limit, any other matches errProtocol
+func frameError(err error) error {
+	if errors.Is(err, wire.ErrFrameTooLarge) {
+		return fmt.Errorf("%w: %w", errMessageTooBig, err)
+	}
+	return err
+}
+
+// buildFrame assembles a server-to-client frame (no masking)
+func buildFrame(opcode byte, payload []byte, fin bool) ([]byte, error) {
+	var header [wire.MaxHeaderSize]byte
+	n, err := writeFrameHeader(&header, opcode, fin, false, uint64(len(payload)))
+	if err != nil {
+		return nil, err
+	}
+	frameData := make([]byte, n+len(payload))
+	copy(frameData, header[:n])
+	copy(frameData[n:], payload)
+	return frameData, nil
+}
+
+// writeFrameHeader encodes the header of a frame carrying length payload
+// bytes into buf and returns its size. A masked header ends with a fresh
+// masking key, the payload has to be masked with it. Like wire.AppendHeader
+// it refuses a length with the most significant bit set.
+func writeFrameHeader(buf *[wire.MaxHeaderSize]byte, opcode byte, fin bool, masked bool, length uint64) (int, error) {
+	h := wire.Header{Fin: fin, Opcode: opcode, Length: length, Masked: masked}
+	if masked {
+		// drawn into buf, which is overwritten next, so h stays on the stack
+		_, _ = rand.Read(buf[:4]) // never fails
+		h.MaskKey = [4]byte(buf[:4])
+	}
+	header, err := wire.AppendHeader(buf[:0], h)
+	if err != nil {
+		return 0, err
+	}
+	return len(header), nil
+}
+
+// checkSameOrigin is the default origin policy: browsers always send Origin,
+// so a missing header means a non-browser client, which is allowed.
+// Otherwise the host in Origin must match the Host the request was sent to.
+func checkSameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, r.Host)
+}
+
+// reservedResponseHeaders are written by the handshake itself and can't be
+// replaced by Config.ResponseHeader without breaking the upgrade
+var reservedResponseHeaders = map[string]bool{
+	"Upgrade":                  true,
+	"Connection":               true,
+	"Sec-Websocket-Accept":     true,
+	"Sec-Websocket-Extensions": true,
+	"Sec-Websocket-Protocol":   true,
+	"Content-Length":           true,
+	"Transfer-Encoding":        true,
+}
+
+// writeResponseHeader adds application headers to the hand written 101 response.
+// Header.Write turns CR and LF in values into spaces, names that could split
+// the response are skipped.
+func writeResponseHeader(w io.Writer, header http.Header) {
+	safe := make(http.Header, len(header))
+	for name, values := range header {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			continue
 		}
+		key := http.CanonicalHeaderKey(name)
+		safe[key] = append(safe[key], values...)
+	}
+	_ = safe.WriteSubset(w, reservedResponseHeaders)
+}
 
-		var maskKey []byte
-		if masked {
-			// Client-to-server frames must include a 4-byte masking key
-			if len(buffer)-pos < 4 {
-				break
+// headerTokens splits the comma separated values of the header name
+func headerTokens(h http.Header, name string) []string {
+	var tokens []string
+	for _, line := range h.Values(name) {
+		for _, part := range strings.Split(line, ",") {
+			if part = strings.TrimSpace(part); part != "" {
+				tokens = append(tokens, part)
 			}
-			maskKey = buffer[pos : pos+4]
-			pos += 4
 		}
+	}
+	return tokens
+}
 
-		if len(buffer)-pos < length {
-			break // incomplete payload
+// selectSubprotocol picks the first of supported the client offers, "" when
+// none of them is
+func selectSubprotocol(h http.Header, supported []string) string {
+	offered := headerTokens(h, "Sec-WebSocket-Protocol")
+	for _, p := range supported {
+		if slices.Contains(offered, p) {
+			return p
 		}
+	}
+	return ""
+}
 
-		payload := make([]byte, length)
-		copy(payload, buffer[pos:pos+length])
+// splitHost splits a Host header or an AllowedHosts entry into name and
+// port, the port is empty when there is none. Brackets around IPv6 literals
+// are dropped.
+func splitHost(hostport string) (host, port string) {
+	if h, p, err := net.SplitHostPort(hostport); err == nil {
+		return h, p
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(hostport, "["), "]"), ""
+}
 
-		if masked {
-			for i := 0; i < length; i++ {
-				payload[i] ^= maskKey[i%4]
-			}
+// hostAllowed reports whether the Host of a request matches one of allowed
+func hostAllowed(hostport string, allowed []string) bool {
+	host, port := splitHost(hostport)
+	for _, entry := range allowed {
+		h, p := splitHost(entry)
+		if strings.EqualFold(h, host) && (p == "" || p == port) {
+			return true
+		}
+	}
+	return false
+}
+
+// validKey reports whether a Sec-WebSocket-Key is a base64 encoded 16 byte nonce.
+// The key is always decoded in full, its content doesn't change the work done.
+func validKey(key string) bool {
+	nonce, err := base64.StdEncoding.DecodeString(key)
+	return err == nil && len(nonce) == 16
+}
+
+// Upgrader performs the WebSocket opening handshake. It works inside any
+// http.Handler; startServer mounts one on its own mux for all WebSocket paths.
+type Upgrader struct {
+	// SuppressErrors stops Upgrade from answering a refused handshake, the
+	// caller writes the response from the returned *HandshakeError instead.
+	// Headers such as Retry-After or Allow are still set on the ResponseWriter.
+	SuppressErrors bool
+
+	cfg     Config
+	ctx     context.Context // parent of every connection's context, cancelled by Shutdown
+	limiter *rateLimiter    // nil when handshakes aren't rate limited
+	pool    *workerPool     // nil when Handlers run on the readers
+	poller  netpoller       // parks idle connections, nil without Config.ParkIdleConnections
+	budget  *memoryBudget   // nil without Config.MemoryBudget
+	started time.Time       // when the Upgrader was made, for the uptime of the health endpoints
+	conns   atomic.Int64    // live connections
+	wg      sync.WaitGroup  // connections that haven't ended yet
+
+	mu   sync.Mutex
+	live map[*Conn]struct{} // the upgraded connections that haven't ended yet
+}
+
+// HandshakeError is returned by Upgrade when it refuses a request
+type HandshakeError struct {
+	Status int    // HTTP status of the refusal
+	Reason string // response body
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("websocket: handshake refused: %d %s", e.Status, e.Reason)
+}
+
+// capacityRetryAfter is the Retry-After sent with 503 at MaxConnections
+const capacityRetryAfter = "5"
+
+// NewUpgrader returns an Upgrader for cfg, or the reason cfg can't work.
+// The Handlers, Middleware, Mux and listener settings of cfg only matter to startServer
+// and are ignored here.
+func NewUpgrader(cfg Config) (*Upgrader, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return newUpgrader(context.Background(), cfg), nil
+}
+
+func newUpgrader(ctx context.Context, cfg Config) *Upgrader {
+	u := &Upgrader{cfg: cfg, ctx: ctx, started: time.Now()}
+	if cfg.HandshakeRate > 0 {
+		u.limiter = newRateLimiter(cfg.HandshakeRate, cfg.HandshakeBurst)
+	}
+	if cfg.WorkerPoolSize > 0 {
+		u.pool = newWorkerPool(ctx, cfg)
+	}
+	if cfg.ParkIdleConnections {
+		poller, err := newPoller(ctx)
+		if err != nil {
+			// every connection keeps its reader goroutine instead
+			cfg.logger().Warn("park idle connections", "err", err)
+		}
+		u.poller = poller
+	}
+	if cfg.MemoryBudget > 0 {
+		u.budget = newMemoryBudget(cfg, u.liveConns)
+	}
+	return u
+}
+
+// acquire takes a connection slot, false when MaxConnections are in use.
+// It's taken before the connection is hijacked, so http.Server.Shutdown
+// can't return before Shutdown knows about the connection.
+func (u *Upgrader) acquire() bool {
+	n := u.conns.Add(1)
+	if u.cfg.MaxConnections > 0 && n > int64(u.cfg.MaxConnections) {
+		u.conns.Add(-1)
+		return false
+	}
+	u.wg.Add(1)
+	return true
+}
+
+// release gives back the slot of a connection that ended, after the
+// handlers of its pooled messages returned
+func (u *Upgrader) release() {
+	u.conns.Add(-1)
+	u.wg.Done()
+}
+
+// Connections returns the number of live connections, the ones counted
+// against Config.MaxConnections
+func (u *Upgrader) Connections() int64 {
+	return u.conns.Load()
+}
+
+// track adds c to the live connections
+func (u *Upgrader) track(c *Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.live == nil {
+		u.live = make(map[*Conn]struct{})
+	}
+	u.live[c] = struct{}{}
+}
+
+// untrack removes a connection that ended
+func (u *Upgrader) untrack(c *Conn) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	delete(u.live, c)
+}
+
+// liveConns returns the connections that haven't ended yet
+func (u *Upgrader) liveConns() []*Conn {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return slices.Collect(maps.Keys(u.live))
+}
+
+// clientIP is the address handshakes are rate limited by
+func (u *Upgrader) clientIP(r *http.Request) string {
+	if u.cfg.ClientIP != nil {
+		return u.cfg.ClientIP(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// refuse answers a handshake that can't go ahead, unless SuppressErrors is set
+func (u *Upgrader) refuse(w http.ResponseWriter, status int, reason string) error {
+	if !u.SuppressErrors {
+		http.Error(w, reason, status)
+	}
+	return &HandshakeError{Status: status, Reason: reason}
+}
+
+// Upgrade performs the opening handshake, over HTTP/1.1 or as an HTTP/2
+// extended CONNECT, and returns the connection. A refused request gets its
+// error response and Upgrade returns a *HandshakeError.
+// The caller must keep calling ReadMessage, the connection is closed once it
+// returns an error. Over HTTP/2 the connection is the request's stream and
+// ends when the calling handler returns.
+func (u *Upgrader) Upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	var start time.Time
+	if u.cfg.OnHandshake != nil {
+		start = time.Now()
+	}
+	c, err := u.upgrade(w, r)
+	u.cfg.Metrics.handshake(err)
+	if u.cfg.OnHandshake != nil {
+		u.cfg.OnHandshake(u.handshakeInfo(r, c, err, time.Since(start)))
+	}
+	return c, err
+}
+
+func (u *Upgrader) upgrade(w http.ResponseWriter, r *http.Request) (*Conn, error) {
+	cfg := u.cfg
+	if u.ctx.Err() != nil {
+		return nil, u.refuse(w, http.StatusServiceUnavailable, "server shutting down")
+	}
+
+	// A client hammering the endpoint is turned away before any work is done
+	if u.limiter != nil {
+		if ok, wait := u.limiter.allow(u.clientIP(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			return nil, u.refuse(w, http.StatusTooManyRequests, "Too Many Requests")
 		}
+	}
 
-		frames = append(frames, frame{Fin: fin, Opcode: opcode, Payload: payload})
-		offset = pos + length
-	}
-
-	// return complete frames and any leftover bytes belong to a partial frame
-	return frames, buffer[offset:], nil
-}
-
-// building a frame so we can send it to the client
-// buildFrame assembles the header for a server-to-client frame (no masking)
-// The header length expands to 2, 4, or 10 bytes depending on payload size
-func buildFrame(opcode byte, payload []byte, fin bool) []byte {
-	firstByte := byte(0)
-	if fin {
-		firstByte = 0x80 // 1000 0000
-	}
-	firstByte |= opcode & 0x0F // 0000 1111
-
-	length := len(payload)
-
-	switch {
-	// payload len is less than 126
-	// header size is 2 bytes
-	case length < 126:
-		header := []byte{firstByte, byte(length)}
-		return append(header, payload...)
-	// payload len is less than or equal to 65535
-	// header size is 4 bytes
-	case length <= 0xFFFF:
-		header := make([]byte, 4)
-		header[0] = firstByte
-		header[1] = 126
-		binary.BigEndian.PutUint16(header[2:], uint16(length))
-		return append(header, payload...)
-	// payload len is greater than 65535
-	// header size is 10 bytes
-	default:
-		header := make([]byte, 10)
-		header[0] = firstByte
-		header[1] = 127
-		binary.BigEndian.PutUint32(header[2:], 0)
-		binary.BigEndian.PutUint32(header[6:], uint32(length))
-		return append(header, payload...)
-	}
-}
-
-func startServer(addr string) (*http.Server, string, error) {
-	// Start an HTTP/1.1 server and upgrade only WebSocket requests
-	mux := http.NewServeMux()
-	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+	// Over HTTP/2 the handshake is an extended CONNECT (RFC 8441) instead of an Upgrade
+	extendedConnect := isExtendedConnect(r)
+
+	// The opening handshake is a GET, nothing else may be upgraded (not even HEAD)
+	if r.Method != http.MethodGet && !extendedConnect {
+		w.Header().Set("Allow", http.MethodGet)
+		return nil, u.refuse(w, http.StatusMethodNotAllowed, "Method Not Allowed")
+	}
+
+	var key string
+	if extendedConnect {
+		if !strings.EqualFold(r.Header.Get(":protocol"), "websocket") {
+			return nil, u.refuse(w, http.StatusBadRequest, "Unsupported protocol")
+		}
+		// :authority and :path become r.Host and r.URL
+		if r.Host == "" || r.URL.Path == "" {
+			return nil, u.refuse(w, http.StatusBadRequest, "Bad Request")
+		}
+	} else {
 		// Reject normal HTTP traffic, only the WebSocket upgrade path is supported
 		if strings.ToLower(r.Header.Get("Upgrade")) != "websocket" {
-			w.WriteHeader(http.StatusNotFound)
-			_, _ = w.Write([]byte("Use WebSocket upgrade"))
-			return
+			return nil, u.refuse(w, http.StatusNotFound, "Use WebSocket upgrade")
 		}
 		// Check that the Connection header includes "Upgrade" (may contain multiple values)
 		connection := strings.ToLower(r.Header.Get("Connection"))
@@ -193,190 +420,623 @@ func startServer(addr string) (*http.Server, string, error) {
 		}
 
 		// Validate standard handshake requirements (Sec-WebSocket-Key, version 13)
-		key := r.Header.Get("Sec-WebSocket-Key")
-		version := r.Header.Get("Sec-WebSocket-Version")
-		if !hasUpgrade || key == "" || version != "13" {
-			http.Error(w, "Bad Request", http.StatusBadRequest)
-			return
+		key = r.Header.Get("Sec-WebSocket-Key")
+		if !hasUpgrade {
+			return nil, u.refuse(w, http.StatusBadRequest, "Bad Request")
 		}
+		if !validKey(key) {
+			return nil, u.refuse(w, http.StatusBadRequest, "Sec-WebSocket-Key must be the base64 encoding of a 16 byte nonce")
+		}
+	}
+	// A client speaking another version can retry with one listed in the reply
+	if version := r.Header.Get("Sec-WebSocket-Version"); version != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, u.refuse(w, http.StatusUpgradeRequired, fmt.Sprintf("Unsupported WebSocket version %q, this server speaks version 13", version))
+	}
 
-		// Hijack the underlying TCP connection so we can speak raw WebSocket frames
-		hj, ok := w.(http.Hijacker)
-		if !ok {
-			http.Error(w, "Websocket upgrade not supported", http.StatusInternalServerError)
-			return
+	// Misrouted requests and DNS rebinding show up as an unexpected Host
+	if len(cfg.AllowedHosts) > 0 && !hostAllowed(r.Host, cfg.AllowedHosts) {
+		return nil, u.refuse(w, http.StatusForbidden, "Forbidden host")
+	}
+
+	// Refuse cross-site WebSocket hijacking before taking over the connection
+	checkOrigin := cfg.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = checkSameOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, u.refuse(w, http.StatusForbidden, "Forbidden origin")
+	}
+
+	// Authorize may already store values with the connection
+	info := connInfo{path: r.URL.Path, clientAddr: u.clientIP(r), values: new(connValues), requestID: requestID(r)}
+	r = withValues(r, info.values)
+	// Mutual TLS: the certificate the client authenticated with
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		info.clientCert = r.TLS.VerifiedChains[0][0]
+		if cfg.VerifyClientCert != nil {
+			if err := cfg.VerifyClientCert(info.clientCert); err != nil {
+				return nil, u.refuse(w, http.StatusForbidden, "Forbidden client certificate")
+			}
+		}
+	}
+	if cfg.Authorize != nil {
+		identity, status, err := cfg.Authorize(r)
+		if status == 0 && err != nil {
+			status = http.StatusForbidden
+		}
+		if status != 0 && (status < 200 || status > 299) {
+			body := http.StatusText(status)
+			if err != nil {
+				body = err.Error()
+			}
+			return nil, u.refuse(w, status, body)
 		}
+		info.identity = identity
+	}
+
+	var header http.Header
+	if cfg.ResponseHeader != nil {
+		header = cfg.ResponseHeader(r)
+	}
+	if cfg.EnableCompression {
+		if params, ok := negotiateDeflate(r.Header); ok {
+			info.deflate = &params
+		}
+	}
+	info.subprotocol = selectSubprotocol(r.Header, cfg.Subprotocols)
+
+	// At capacity a clean 503 beats accepting the connection only to drop it
+	if !u.acquire() {
+		w.Header().Set("Retry-After", capacityRetryAfter)
+		return nil, u.refuse(w, http.StatusServiceUnavailable, "Service Unavailable")
+	}
+	// The connection's context keeps the request's values but ends with the
+	// connection or when the server shuts down, not with the HTTP request
+	ctx, cancel := context.WithCancel(context.WithoutCancel(r.Context()))
+	stop := context.AfterFunc(u.ctx, cancel)
+	end := func() {
+		stop()
+		cancel()
+		u.release()
+	}
+
+	// The request outlives the handshake, its body is gone by then
+	info.request = r.WithContext(ctx)
+	info.request.Body = http.NoBody
+
+	var c *Conn
+	var err error
+	if extendedConnect {
+		c, err = acceptExtendedConnect(ctx, w, r, cfg, info, header)
+	} else {
+		c, err = u.hijack(ctx, w, key, info, header)
+	}
+	if err != nil {
+		// The slot is given back right away when the upgrade doesn't happen
+		end()
+		return nil, err
+	}
+	// otherwise when the connection ends
+	c.pool = u.pool
+	c.poller = u.poller
+	c.budget = u.budget
+	u.track(c)
+	c.onClose = func() {
+		u.untrack(c)
+		end()
+	}
+	if cfg.onUpgrade != nil {
+		cfg.onUpgrade(info)
+	}
+	return c, nil
+}
+
+// maxRequestIDSize caps the X-Request-Id a connection logs
+const maxRequestIDSize = 128
 
-		// Switch to raw TCP socket so we can speak WebSocket
-		conn, rw, err := hj.Hijack()
+// requestID returns the X-Request-Id header of r, cut at maxRequestIDSize
+func requestID(r *http.Request) string {
+	id := strings.TrimSpace(r.Header.Get("X-Request-Id"))
+	if len(id) > maxRequestIDSize {
+		id = id[:maxRequestIDSize]
+	}
+	return id
+}
+
+// hijack takes over the HTTP/1.1 connection of a validated handshake and
+// answers it with 101 Switching Protocols
+func (u *Upgrader) hijack(ctx context.Context, w http.ResponseWriter, key string, info connInfo, header http.Header) (*Conn, error) {
+	cfg := u.cfg
+	// Hijack the underlying TCP connection so we can speak raw WebSocket frames
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, u.refuse(w, http.StatusInternalServerError, "Websocket upgrade not supported")
+	}
+
+	// Switch to raw TCP socket so we can speak WebSocket
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		return nil, u.refuse(w, http.StatusInternalServerError, "Hijack failed")
+	}
+
+	// Over wss:// the socket is the one under the TLS connection
+	if err := cfg.Socket.apply(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	// Compute Sec-WebSocket-Accept (Sec-WebSocket-Key + GUID -> SHA-1 -> Base64)
+	accept := sha1.Sum([]byte(key + wsGUID))
+	acceptKey := base64.StdEncoding.EncodeToString(accept[:])
+
+	if cfg.HandshakeTimeout > 0 {
+		_ = conn.SetWriteDeadline(time.Now().Add(cfg.HandshakeTimeout))
+	}
+
+	// Send the mandatory upgrade response headers followed by a blank line
+	_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
+	_, _ = rw.WriteString("Upgrade: websocket\r\n")
+	_, _ = rw.WriteString("Connection: Upgrade\r\n")
+	_, _ = rw.WriteString(fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n", acceptKey))
+	if info.deflate != nil {
+		_, _ = rw.WriteString("Sec-WebSocket-Extensions: " + info.deflate.String() + "\r\n")
+	}
+	if info.subprotocol != "" {
+		_, _ = rw.WriteString("Sec-WebSocket-Protocol: " + info.subprotocol + "\r\n")
+	}
+	writeResponseHeader(rw, header)
+	_, _ = rw.WriteString("\r\n")
+	if err := rw.Flush(); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	_ = conn.SetWriteDeadline(time.Time{})
+
+	// From here on we operate on the raw TCP connection with WebSocket frames
+	return newConn(ctx, conn, rw.Reader, cfg, info), nil
+}
+
+// handler upgrades requests and serves the connections with handler
+func (u *Upgrader) handler(handler ConnHandler) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := u.Upgrade(w, r)
 		if err != nil {
-			http.Error(w, "Hijack failed", http.StatusInternalServerError)
 			return
 		}
-
-		if tcp, ok := conn.(*net.TCPConn); ok {
-			_ = tcp.SetNoDelay(true)
+		// An HTTP/2 stream is only usable while this handler runs
+		if isExtendedConnect(r) {
+			serveConn(c, handler)
+			return
 		}
+		go serveConn(c, handler)
+	}
+}
 
-		// Compute Sec-WebSocket-Accept (Sec-WebSocket-Key + GUID -> SHA-1 -> Base64)
-		accept := sha1.Sum([]byte(key + wsGUID))
-		acceptKey := base64.StdEncoding.EncodeToString(accept[:])
+// ConnHandler is the application behind a WebSocket path: ServeWS gets a
+// connection once its handshake completed and owns it until it returns. The
+// library takes care of fragmentation, pings and the closing handshake on
+// the way, and closes the connection with 1000 if ServeWS left it open. A
+// panic closes it with 1011.
+type ConnHandler interface {
+	ServeWS(c *Conn)
+}
 
-		// Send the mandatory upgrade response headers followed by a blank line
-		_, _ = rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n")
-		_, _ = rw.WriteString("Upgrade: websocket\r\n")
-		_, _ = rw.WriteString("Connection: Upgrade\r\n")
-		_, _ = rw.WriteString(fmt.Sprintf("Sec-WebSocket-Accept: %s\r\n\r\n", acceptKey))
-		if err := rw.Flush(); err != nil {
-			_ = conn.Close()
-			return
+// Handler is the application behind a WebSocket path. It's called with every
+// complete data message (TextMessage or BinaryMessage) and may answer on c, the library
+// keeps taking care of fragmentation, pings and the closing handshake.
+// Messages that went to a sink are passed to its SinkHandler instead, see
+// Conn.SetMessageSink. Returning a *CloseError closes the connection with its code and reason,
+// any other error with 1011. With Config.InPlaceReads data is only valid until it returns.
+type Handler func(c *Conn, messageType int, data []byte) error
+
+// ServeWS makes a Handler a ConnHandler: it passes every message read from c
+// to h until either side ends the connection
+func (h Handler) ServeWS(c *Conn) {
+	_ = h.serve(c)
+}
+
+// serve is ServeWS returning why the connection ended
+func (h Handler) serve(c *Conn) error {
+	if c.pool != nil {
+		c.inbox = newInbox(c)
+		defer c.inbox.close()
+	}
+	_, err := h.serveMessages(c, false)
+	return err
+}
+
+// serveMessages reads messages from c and passes them to h until the
+// connection ends, or with park set until c was parked after a message.
+// The messages go through c.inbox when there is one.
+func (h Handler) serveMessages(c *Conn, park bool) (parked bool, err error) {
+	for {
+		messageType, data, sink, err := c.ReadMessageSink()
+		if err != nil {
+			return false, err
 		}
+		if c.inbox != nil {
+			err = c.pool.submit(c.inbox, func() error { return h.handle(c, messageType, data, sink) })
+		} else {
+			err = h.handle(c, messageType, data, sink)
+		}
+		if err != nil {
+			return false, c.fail(err)
+		}
+		if park && c.park() {
+			return true, nil
+		}
+	}
+}
 
-		// From here on we operate on the raw TCP connection with WebSocket frames
-		go handleConnection(conn, rw.Reader)
-	})
+// handle passes a message to h, or to the SinkHandler when it went to sink
+func (h Handler) handle(c *Conn, messageType int, data []byte, sink io.WriteCloser) error {
+	if sink != nil {
+		c.logger.Debug("[client message] written to a sink")
+		return c.sinkHandler(c, messageType, sink)
+	}
+	// payloads only show up at debug level, and cut short
+	if c.logger.Enabled(c.ctx, slog.LevelDebug) {
+		if messageType == TextMessage {
+			c.logger.Debug("[client TEXT]", "payload", c.logPayload(data))
+		} else {
+			c.logger.Debug("[client BIN]", "size", len(data))
+		}
+	}
+	return h(c, messageType, data)
+}
 
-	listener, err := net.Listen("tcp", addr)
+// Middleware adds behavior to a Handler, e.g. logging or a policy on
+// payloads. The Handler it returns gets every message before next: it can
+// pass it on, changed or not, drop it by returning nil without calling next,
+// or close the connection by returning an error.
+type Middleware func(next Handler) Handler
+
+// chain wraps h in middleware, the first one outermost. A ConnHandler that
+// isn't a Handler reads the messages itself, middleware can't see them.
+func chain(h ConnHandler, middleware []Middleware) ConnHandler {
+	mh, ok := h.(Handler)
+	if !ok {
+		return h
+	}
+	for _, m := range slices.Backward(middleware) {
+		mh = m(mh)
+	}
+	return mh
+}
+
+// EchoHandler sends every message back to the client (same payload, same
+// opcode), it serves every path when Config has no other handler
+var EchoHandler = Handler(func(c *Conn, messageType int, data []byte) error {
+	return c.WriteMessage(messageType, data)
+})
+
+// startServer serves the WebSocket handlers on addr, as wss:// when
+// cfg.TLSConfig or cfg.CertFile and cfg.KeyFile are set
+func startServer(addr string, cfg Config) (*Server, string, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, "", err
+	}
+	tlsCfg, err := serverTLSConfig(cfg)
 	if err != nil {
 		return nil, "", err
 	}
+	server := newServer(cfg)
+	actualAddr, err := serve(server.Server, addr, tlsCfg, cfg.logger())
+	if err != nil {
+		return nil, "", err
+	}
+	return server, actualAddr, nil
+}
 
-	server := &http.Server{Handler: mux}
-	actualAddr := listener.Addr().String()
+// startDualServer serves plain ws:// on addr and wss:// on tlsAddr from one
+// server, for the time clients move from one to the other
+func startDualServer(addr, tlsAddr string, cfg Config) (*Server, string, string, error) {
+	if err := cfg.validate(); err != nil {
+		return nil, "", "", err
+	}
+	tlsCfg, err := serverTLSConfig(cfg)
+	if err != nil {
+		return nil, "", "", err
+	}
+	if tlsCfg == nil {
+		return nil, "", "", errors.New("wss:// needs TLSConfig or CertFile and KeyFile")
+	}
+	server := newServer(cfg)
+	plainAddr, err := serve(server.Server, addr, nil, cfg.logger())
+	if err != nil {
+		return nil, "", "", err
+	}
+	secureAddr, err := serve(server.Server, tlsAddr, tlsCfg, cfg.logger())
+	if err != nil {
+		_ = server.Close()
+		return nil, "", "", err
+	}
+	return server, plainAddr, secureAddr, nil
+}
 
-	go func() {
-		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
-			log.Printf("server error: %v", err)
+// Server is the HTTP server with the WebSocket connections it upgraded.
+// Close and the embedded http.Server's Shutdown don't know about upgraded
+// connections, Shutdown does.
+type Server struct {
+	*http.Server
+
+	upgrader *Upgrader
+	cancel   context.CancelFunc // cancels the context of every connection
+}
+
+// newServer builds the HTTP server, the WebSocket paths sit next to the application's routes
+func newServer(cfg Config) *Server {
+	mux := cfg.Mux
+	if mux == nil {
+		mux = http.NewServeMux()
+	}
+	if cfg.Expvar {
+		if cfg.Metrics == nil {
+			cfg.Metrics = NewMetrics()
 		}
-	}()
+		publishExpvar(cfg.Metrics)
+		mountExpvar(mux)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	var handler ConnHandler = EchoHandler
+	if cfg.ConnHandler != nil {
+		handler = cfg.ConnHandler
+	}
+	if (cfg.Broadcast || cfg.Room != nil) && len(cfg.Handlers) == 0 {
+		hub := NewHub()
+		hub.Logger = cfg.logger()
+		cfg = hub.track(cfg)
+		handler = Handler(hub.relay)
+		if cfg.Room != nil {
+			handler = Handler(hub.relayRooms)
+		}
+	}
+	u := newUpgrader(ctx, cfg)
+	if cfg.AdminPath != "" {
+		u.mountAdmin(mux, cfg.AdminPath)
+	}
+	u.mountHealth(mux, cfg.HealthPath, cfg.ReadyPath)
+	if len(cfg.Handlers) == 0 {
+		mux.Handle("/", u.handler(chain(handler, cfg.Middleware)))
+	}
+	for path, handler := range cfg.Handlers {
+		mux.Handle(path, u.handler(chain(handler, cfg.Middleware)))
+	}
 
-	return server, actualAddr, nil
+	// A client dribbling its request headers is dropped once HandshakeTimeout passes
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: cfg.HandshakeTimeout}
+	if cfg.EnableHTTP2 {
+		server.Protocols = new(http.Protocols)
+		server.Protocols.SetHTTP1(true)
+		server.Protocols.SetUnencryptedHTTP2(true)
+	}
+	return &Server{Server: server, upgrader: u, cancel: cancel}
 }
 
-// handleConnection processes the raw TCP socket after the upgrade
-// It parses incoming WebSocket frames and responds based on the opcode
-func handleConnection(conn net.Conn, reader *bufio.Reader) {
-	// Ensure the TCP connection gets closed when the handler returns
-	defer conn.Close()
+// Shutdown stops accepting connections and upgrades, cancels the context of
+// every WebSocket connection and closes them with 1001 "going away". It
+// returns once the peers answered, the connections all ended and the
+// handlers of a WorkerPoolSize pool returned. When ctx expires first the
+// remaining connections are dropped and ctx's error is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.cancel()
+	err := s.Server.Shutdown(ctx)
 
-	leftover := make([]byte, 0)
-	buffer := make([]byte, 4096)
-	var textBuf []byte // Accumulates pieces of fragmented text messages
+	// A connection being read from sends its CLOSE as it sees the
+	// cancellation, this reaches the others too
+	for _, c := range s.upgrader.liveConns() {
+		go c.Close(CloseGoingAway, "server shutting down")
+	}
 
-	// send builds a single-frame message (FIN=true) and writes it to the connection
-	send := func(opcode byte, payload []byte) error {
-		frameData := buildFrame(opcode, payload, true)
-		_, err := conn.Write(frameData)
+	done := make(chan struct{})
+	go func() {
+		s.upgrader.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
 		return err
+	case <-ctx.Done():
+		for _, c := range s.upgrader.liveConns() {
+			c.CloseNow()
+		}
+		return ctx.Err()
 	}
+}
+
+// errForcedShutdown is returned by awaitShutdown when a second signal cut
+// the drain short
+var errForcedShutdown = errors.New("shutdown forced by a second signal")
+
+// awaitShutdown blocks until the first signal, then shuts server down within
+// drain, zero without a limit. A second signal drops the remaining
+// connections and the server right away. It returns nil once every
+// connection ended on its own.
+func awaitShutdown(server *Server, signals <-chan os.Signal, drain time.Duration) error {
+	logger := server.upgrader.cfg.logger()
+	sig := <-signals
+	logger.Info("shutting down", "signal", sig.String(), "drain_timeout", drain)
 
-	// sendClose sends a CLOSE control frame with an optional reason, then returns
-	sendClose := func(code uint16, reason string) {
-		// build payload: 2-byte close code followed by optional text reason
-		payload := make([]byte, 2+len(reason))
-		binary.BigEndian.PutUint16(payload, code)
-		// append reason bytes after the 2-byte code
-		copy(payload[2:], reason)
-		_ = send(opClose, payload)
+	ctx := context.Background()
+	if drain > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, drain)
+		defer cancel()
 	}
+	done := make(chan error, 1)
+	go func() { done <- server.Shutdown(ctx) }()
 
-	for {
-		/*
-				messages coming from clients
-				|          msg1         |         msg2         |         msg3         |
-				      prev leftover|-----------------------------n| next leftover
-			                                       buffer
-		*/
-		// bufio.Reader.Read delivers arbitrary chunks, not aligned to frame boundaries
-		n, err := reader.Read(buffer)
-		if n > 0 {
-			chunk := buffer[:n]
-			// prev leftover + new chunk
-			leftover = append(leftover, chunk...)
-
-			// parseFrames may return zero, one, or many frames along with leftovers
-			frames, rest, perr := parseFrames(leftover)
-			if perr != nil {
-				// error → reply with CLOSE (1002) and terminate
-				sendClose(1002, "protocol error")
-				return
-			}
-			leftover = rest // Keep any partial frame bytes for the next read
-
-			// Dispatch each frame based on opcode
-			for _, f := range frames {
-				switch f.Opcode {
-				case opText:
-					// This server just send back what it received (echo)
-					// Same payload, same opcode
-					if textBuf == nil {
-						textBuf = make([]byte, 0, len(f.Payload))
-					}
-					textBuf = append(textBuf, f.Payload...)
-					if f.Fin {
-						msg := string(textBuf)
-						log.Printf("[client TEXT] %s", msg)
-						if err := send(opText, []byte(msg)); err != nil {
-							return
-						}
-						textBuf = nil
-					}
-				case opBin:
-					log.Printf("[client BIN] %d bytes", len(f.Payload))
-					if err := send(opBin, f.Payload); err != nil {
-						return
-					}
-				case opCont:
-					// The WebSocket is fragmented, accumulate pieces until FIN=true
-					if textBuf == nil {
-						textBuf = make([]byte, 0)
-					}
-					textBuf = append(textBuf, f.Payload...)
-					if f.Fin {
-						msg := string(textBuf)
-						log.Printf("[client TEXT] %s", msg)
-						if err := send(opText, []byte(msg)); err != nil {
-							return
-						}
-						textBuf = nil
-					}
-				case opPing:
-					// Echo back a PONG with the same payload
-					if err := send(opPong, f.Payload); err != nil {
-						return
-					}
-				case opClose:
-					// Reply with CLOSE and then terminate the connection
-					_ = send(opClose, f.Payload)
-					return
-				default:
-					// Unknown opcodes are ignored
-				}
-			}
+	select {
+	case err := <-done:
+		return err
+	case sig := <-signals:
+		logger.Warn("forcing shutdown", "signal", sig.String())
+		for _, c := range server.upgrader.liveConns() {
+			c.CloseNow()
 		}
+		_ = server.Close()
+		return errForcedShutdown
+	}
+}
 
+// serve starts serving on a new listener for addr, wrapped in TLS when
+// tlsCfg isn't nil, and returns the address it listens on. A failure to
+// serve is logged to logger.
+func serve(server *http.Server, addr string, tlsCfg *tls.Config, logger *slog.Logger) (string, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return "", err
+	}
+	if tlsCfg != nil {
+		listener = tls.NewListener(listener, tlsCfg)
+	}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("server error", "err", err)
+		}
+	}()
+	return listener.Addr().String(), nil
+}
+
+// serverTLSConfig combines cfg.TLSConfig with the CertFile/KeyFile pair,
+// nil means plain ws://
+func serverTLSConfig(cfg Config) (*tls.Config, error) {
+	if cfg.TLSConfig == nil && cfg.CertFile == "" && cfg.KeyFile == "" {
+		return nil, nil
+	}
+	tlsCfg := &tls.Config{}
+	if cfg.TLSConfig != nil {
+		tlsCfg = cfg.TLSConfig.Clone()
+	}
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(cfg.CertFile, cfg.KeyFile)
 		if err != nil {
-			if err != io.EOF {
-				log.Printf("read error: %v", err)
+			return nil, err
+		}
+		tlsCfg.Certificates = append(tlsCfg.Certificates, cert)
+	}
+	// The upgrade takes over an HTTP/1.1 connection
+	if len(tlsCfg.NextProtos) == 0 {
+		tlsCfg.NextProtos = []string{"http/1.1"}
+	}
+	return tlsCfg, nil
+}
+
+// states of the closing handshake, see RFC 6455 section 7
+const (
+	stateOpen    = iota // frames are dispatched normally
+	stateClosing        // we sent CLOSE and only wait for the peer's CLOSE
+	stateClosed         // CLOSE frames were exchanged, nothing else is processed
+)
+
+// connInfo carries what the handshake negotiated for a connection
+type connInfo struct {
+	path        string         // URL path of the upgrade request
+	clientAddr  string         // address of the client as Config.ClientIP derives it, see Conn.ClientAddr
+	subprotocol string         // negotiated in Sec-WebSocket-Protocol, see Conn.Subprotocol
+	request     *http.Request  // the upgrade request, see Handler
+	deflate     *deflateParams // permessage-deflate parameters, nil when not negotiated
+	client      bool           // we dialed the connection, see Dialer
+	identity    interface{}    // returned by Config.Authorize
+	values      *connValues    // see Conn.Set, nil outside Upgrade
+	requestID   string         // X-Request-Id of the upgrade request, see Conn.RequestID
+
+	clientCert *x509.Certificate // verified client certificate (mutual TLS), nil otherwise
+}
+
+// transport is what the frame loop needs from the connection: the hijacked
+// net.Conn after an HTTP/1.1 upgrade, or an HTTP/2 stream (h2Stream)
+type transport interface {
+	io.ReadWriteCloser
+	SetReadDeadline(t time.Time) error
+	SetWriteDeadline(t time.Time) error
+}
+
+// serveConn serves c with handler until the connection ends. A panicking
+// handler closes the connection with 1011.
+func serveConn(c *Conn, handler ConnHandler) {
+	// Shutdown waits for OnDisconnect, even when the connection ended first
+	c.serving = c.holdSlot()
+	c.run(func() (bool, error) {
+		if c.cfg.OnConnect != nil {
+			if err := c.cfg.OnConnect(c); err != nil {
+				return false, c.fail(err)
+			}
+		}
+		h, ok := handler.(Handler)
+		if ok && c.poller != nil && c.poller.pollable(c.conn) {
+			if c.pool != nil {
+				c.inbox = newInbox(c)
 			}
+			return serveParked(c, h)
+		}
+		if ok {
+			return false, h.serve(c)
+		}
+		handler.ServeWS(c)
+		// whatever the handler left open is closed normally
+		return false, c.fail(&CloseError{Code: CloseNormalClosure})
+	})
+}
+
+// run calls serve on the current goroutine and, unless it parked c, ends
+// the connection: the callbacks learn why, the values are cleared and the
+// socket is closed
+func (c *Conn) run(serve func() (parked bool, err error)) {
+	var parked bool
+	var err error // why the connection ended, for OnDisconnect
+	defer func() {
+		if parked {
+			// c belongs to the goroutine that resumes it
 			return
 		}
-	}
+		if c.inbox != nil {
+			c.inbox.close()
+		}
+		if ferr := failure(err); ferr != nil && c.cfg.OnError != nil {
+			c.cfg.OnError(c, ferr)
+		}
+		if c.cfg.OnDisconnect != nil {
+			c.cfg.OnDisconnect(c, err)
+		}
+		c.values.clear()
+		c.close()
+		if c.serving {
+			c.releaseSlot()
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Error("handler panic", "panic", r, "stack", string(debug.Stack()))
+			err = fmt.Errorf("handler panic: %v", r)
+			c.fail(&CloseError{Code: CloseInternalServerErr, Text: "internal error"})
+		}
+	}()
+	parked, err = serve()
 }
 
 func main() {
 	const port = 8080
 	addr := fmt.Sprintf(":%d", port)
-	server, actualAddr, err := startServer(addr)
+	cfg := DefaultConfig()
+	// Notify before serving, a signal can't kill the process without a drain
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	server, actualAddr, err := startServer(addr, cfg)
 	if err != nil {
-		log.Fatalf("failed to start server: %v", err)
+		slog.Error("failed to start server", "err", err)
+		os.Exit(1)
 	}
 	host := actualAddr
 	if strings.HasPrefix(actualAddr, ":") {
 		host = "localhost" + actualAddr
 	}
-	log.Printf("HTTP/1.1 WS server on ws://%s", host)
-	// select {} blocks forever so the server keeps running
-	select {}
-	_ = server
+	slog.Info("HTTP/1.1 WS server on ws://" + host)
+	if err := awaitShutdown(server, signals, cfg.DrainTimeout); err != nil {
+		slog.Error("shutdown", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("server stopped")
 }
@@ -2,140 +2,2195 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"log/slog"
+	"math"
 	"net"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"os/signal"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
+
+	"gows/wire"
 )
 
 func dialWebSocket(t *testing.T, addr string, path string) (net.Conn, *bufio.Reader) {
 	t.Helper()
-	u := url.URL{Scheme: "ws", Host: addr, Path: path}
+	conn, reader, resp := handshake(t, addr, path, nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+
+	accept := strings.TrimSpace(resp.Header.Get("Sec-WebSocket-Accept"))
+	sum := sha1.Sum([]byte(testKey + wsGUID))
+	expectedAccept := base64.StdEncoding.EncodeToString(sum[:])
+	if accept != expectedAccept {
+		t.Fatalf("unexpected accept header: %s", accept)
+	}
+
+	return conn, reader
+}
+
+// dial connects a client Conn to urlStr, it's closed when the test ends
+func dial(t *testing.T, urlStr string, header http.Header) *Conn {
+	t.Helper()
+	d := Dialer{Config: DefaultConfig(), HandshakeTimeout: 5 * time.Second}
+	d.Config.PingInterval = 0
+	c, _, err := d.Dial(urlStr, header)
+	if err != nil {
+		t.Fatalf("failed to dial %s: %v", urlStr, err)
+	}
+	t.Cleanup(func() { c.CloseNow() })
+	return c
+}
 
-	conn, err := net.Dial("tcp", u.Host)
+const testKey = "w3CJHMbDL2EzLkh9GBhXDw=="
+
+// handshake sends an upgrade request with the standard WebSocket headers and
+// returns the server's response. Headers in extra replace the standard ones,
+// an empty value removes the header altogether.
+func handshake(t *testing.T, addr string, path string, extra http.Header) (net.Conn, *bufio.Reader, *http.Response) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
 		t.Fatalf("failed to dial: %v", err)
 	}
+	t.Cleanup(func() { conn.Close() })
+	reader, resp := handshakeOn(t, conn, addr, path, extra)
+	return conn, reader, resp
+}
 
-	key := "w3CJHMbDL2EzLkh9GBhXDw=="
-	req := fmt.Sprintf("GET %s HTTP/1.1\r\n", u.RequestURI()) +
-		fmt.Sprintf("Host: %s\r\n", u.Host) +
-		"Upgrade: websocket\r\n" +
-		"Connection: Upgrade\r\n" +
-		fmt.Sprintf("Sec-WebSocket-Key: %s\r\n", key) +
-		"Sec-WebSocket-Version: 13\r\n\r\n"
+// handshakeOn is handshake over a connection the caller opened, e.g. a TLS one
+func handshakeOn(t *testing.T, conn net.Conn, addr string, path string, extra http.Header) (*bufio.Reader, *http.Response) {
+	t.Helper()
+	u, err := url.Parse(path)
+	if err != nil {
+		t.Fatalf("bad path %q: %v", path, err)
+	}
+	u.Scheme, u.Host = "ws", addr
+
+	header := http.Header{}
+	header.Set("Upgrade", "websocket")
+	header.Set("Connection", "Upgrade")
+	header.Set("Sec-WebSocket-Key", testKey)
+	header.Set("Sec-WebSocket-Version", "13")
+	for k, v := range extra {
+		header.Del(k)
+		if len(v) > 0 && v[0] != "" {
+			header[http.CanonicalHeaderKey(k)] = v
+		}
+	}
 
+	req := fmt.Sprintf("GET %s HTTP/1.1\r\n", u.RequestURI()) +
+		fmt.Sprintf("Host: %s\r\n", u.Host)
 	if _, err := conn.Write([]byte(req)); err != nil {
 		t.Fatalf("failed to send handshake: %v", err)
 	}
+	if err := header.Write(conn); err != nil {
+		t.Fatalf("failed to send handshake: %v", err)
+	}
+	if _, err := conn.Write([]byte("\r\n")); err != nil {
+		t.Fatalf("failed to send handshake: %v", err)
+	}
 
 	reader := bufio.NewReader(conn)
 	resp, err := http.ReadResponse(reader, nil)
 	if err != nil {
 		t.Fatalf("failed to read response: %v", err)
 	}
-	if resp.StatusCode != http.StatusSwitchingProtocols {
-		t.Fatalf("unexpected status: %s", resp.Status)
+	return reader, resp
+}
+
+// clientFrame builds a frame the way a browser would send it, masked with a fixed key
+func clientFrame(opcode byte, payload []byte, fin bool) []byte {
+	header, err := wire.AppendHeader(nil, wire.Header{Fin: fin, Opcode: opcode, Length: uint64(len(payload))})
+	if err != nil {
+		panic(err)
 	}
 
-	accept := strings.TrimSpace(resp.Header.Get("Sec-WebSocket-Accept"))
-	sum := sha1.Sum([]byte(key + wsGUID))
-	expectedAccept := base64.StdEncoding.EncodeToString(sum[:])
-	if accept != expectedAccept {
-		t.Fatalf("unexpected accept header: %s", accept)
+	maskKey := []byte{0x12, 0x34, 0x56, 0x78}
+	out := make([]byte, 0, len(header)+4+len(payload))
+	out = append(out, header...)
+	out[1] |= 0x80 // set the MASK bit
+	out = append(out, maskKey...)
+	for i, b := range payload {
+		out = append(out, b^maskKey[i%4])
 	}
+	return out
+}
 
-	return conn, reader
+// parseFrames decodes the complete frames in buffer the way a Conn does
+func parseFrames(buffer []byte, opts parseOptions) ([]frame, []byte, error) {
+	frames, rest, err := wire.ParseFrames(buffer, opts.wire())
+	return frames, rest, frameError(err)
+}
+
+// readFrameFrom reads exactly one server frame from the reader
+func readFrameFrom(t *testing.T, reader *bufio.Reader) frame {
+	t.Helper()
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		t.Fatalf("failed to read frame header: %v", err)
+	}
+	length := uint64(header[1] & 0x7F)
+	switch length {
+	case 126:
+		ext := make([]byte, 2)
+		if _, err := io.ReadFull(reader, ext); err != nil {
+			t.Fatalf("failed to read extended length: %v", err)
+		}
+		length = uint64(binary.BigEndian.Uint16(ext))
+	case 127:
+		ext := make([]byte, 8)
+		if _, err := io.ReadFull(reader, ext); err != nil {
+			t.Fatalf("failed to read extended length: %v", err)
+		}
+		length = binary.BigEndian.Uint64(ext)
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		t.Fatalf("failed to read frame payload: %v", err)
+	}
+	return frame{Fin: header[0]&0x80 != 0, Rsv1: header[0]&0x40 != 0, Opcode: header[0] & 0x0F, Payload: payload}
+}
+
+// pipeConnection serves a connection on one end of an in-memory pipe and
+// returns the client end. Writes on a pipe block until the other side reads,
+// which lets tests observe exactly how far the server got.
+func pipeConnection(t *testing.T, cfg Config) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	client, srv := net.Pipe()
+	go serveConn(newConn(context.Background(), srv, bufio.NewReader(srv), cfg, connInfo{path: "/"}), EchoHandler)
+	t.Cleanup(func() { client.Close() })
+	return client, bufio.NewReader(client)
 }
 
 func TestWebSocketEcho(t *testing.T) {
-	server, addr, err := startServer("127.0.0.1:0")
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, rec := servePipe(t, cfg, EchoHandler)
+	msgs := []string{"hello", strings.Repeat("a", 200)}
+	for _, msg := range msgs {
+		if err := c.WriteMessage(opText, []byte(msg)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		messageType, data, err := c.ReadMessage()
+		if err != nil {
+			t.Fatalf("failed to read the echo: %v", err)
+		}
+		if messageType != opText || string(data) != msg {
+			t.Fatalf("unexpected echo: type=%d payload=%.20s (%d bytes)", messageType, data, len(data))
+		}
+	}
+	rec.expectFrames(t, frame{Opcode: opText, Payload: []byte(msgs[0])}, frame{Opcode: opText, Payload: []byte(msgs[1])})
+}
+
+func TestPingPong(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, rec := servePipe(t, cfg, EchoHandler)
+	pongs := make(chan string, 1)
+	c.SetPongHandler(func(appData string) error {
+		pongs <- appData
+		return nil
+	})
+	readInBackground(c)
+	if err := c.Ping([]byte("ping")); err != nil {
+		t.Fatalf("failed to send ping: %v", err)
+	}
+	select {
+	case payload := <-pongs:
+		if payload != "ping" {
+			t.Fatalf("unexpected pong payload %q", payload)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no pong")
+	}
+	rec.expectFrames(t, frame{Opcode: opPong, Payload: []byte("ping")})
+}
+
+func TestInvalidClosePayloadGetsProtocolError(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, addr, "/")
+	defer conn.Close()
+
+	// a single byte close payload is illegal
+	if _, err := conn.Write(clientFrame(opClose, []byte{0x03}, true)); err != nil {
+		t.Fatalf("failed to send close: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f := readFrameFrom(t, reader)
+	if f.Opcode != opClose {
+		t.Fatalf("expected close frame, got opcode=%d", f.Opcode)
+	}
+	code, _, err := parseClosePayload(f.Payload)
+	if err != nil || code != 1002 {
+		t.Fatalf("expected close code 1002, got %d (err=%v)", code, err)
+	}
+}
+
+func TestCloseReplyBytes(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload []byte
+		want    []byte
+	}{
+		// FIN + CLOSE, 2 byte payload holding 1000
+		{name: "empty close", payload: nil, want: []byte{0x88, 0x02, 0x03, 0xE8}},
+		// the code is echoed but the reason is dropped
+		{name: "code with reason", payload: append([]byte{0x0F, 0xA0}, "bye"...), want: []byte{0x88, 0x02, 0x0F, 0xA0}},
+	}
+
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, reader := dialWebSocket(t, addr, "/")
+			defer conn.Close()
+
+			if _, err := conn.Write(clientFrame(opClose, tt.payload, true)); err != nil {
+				t.Fatalf("failed to send close: %v", err)
+			}
+
+			// the peer started the closing handshake, so the server replies and
+			// drops the connection right away instead of waiting for CloseTimeout
+			conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+			got, err := io.ReadAll(reader)
+			if err != nil {
+				t.Fatalf("failed to read close reply: %v", err)
+			}
+			if string(got) != string(tt.want) {
+				t.Fatalf("unexpected close frame bytes: % x, want % x", got, tt.want)
+			}
+		})
+	}
+}
+
+// oversizedFrameHeader declares a payload length with the most significant bit
+// set, which the server rejects with 1002 as soon as it sees the header
+var oversizedFrameHeader = []byte{0x82, 0xFF, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}
+
+func TestServerInitiatedCloseWaitsForPeer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CloseTimeout = 2 * time.Second
+	server, addr, err := startServer("127.0.0.1:0", cfg)
 	if err != nil {
 		t.Fatalf("failed to start server: %v", err)
 	}
 	defer server.Close()
 
-	time.Sleep(100 * time.Millisecond)
+	conn, reader := dialWebSocket(t, addr, "/")
+	defer conn.Close()
+
+	if _, err := conn.Write(oversizedFrameHeader); err != nil {
+		t.Fatalf("failed to send header: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseProtocolError {
+		t.Fatalf("expected close 1002, got opcode=%d code=%d", f.Opcode, code)
+	}
+
+	// data sent while the server waits for our CLOSE is discarded, not echoed
+	if _, err := conn.Write(clientFrame(opText, []byte("late"), true)); err != nil {
+		t.Fatalf("failed to send text: %v", err)
+	}
+	if _, err := conn.Write(clientFrame(opClose, []byte{0x03, 0xE8}, true)); err != nil {
+		t.Fatalf("failed to send close: %v", err)
+	}
+
+	// the server drops the TCP connection as soon as our CLOSE arrives
+	start := time.Now()
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if len(rest) != 0 {
+		t.Fatalf("expected nothing after the close frame, got % x", rest)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("server lingered for %v after the closing handshake", elapsed)
+	}
+}
+
+func TestServerInitiatedCloseTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CloseTimeout = 200 * time.Millisecond
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
 
 	conn, reader := dialWebSocket(t, addr, "/")
 	defer conn.Close()
 
-	sendText := func(msg string) {
-		payload := []byte(msg)
-		frame := buildFrame(opText, payload, true)
-		if _, err := conn.Write(frame); err != nil {
-			t.Fatalf("failed to send frame: %v", err)
+	start := time.Now()
+	if _, err := conn.Write(oversizedFrameHeader); err != nil {
+		t.Fatalf("failed to send header: %v", err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if f := readFrameFrom(t, reader); f.Opcode != opClose {
+		t.Fatalf("expected close frame, got opcode=%d", f.Opcode)
+	}
+
+	// we never answer, so the server gives up after CloseTimeout
+	if _, err := io.ReadAll(reader); err != nil {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < cfg.CloseTimeout {
+		t.Fatalf("server closed after %v, before the %v timeout", elapsed, cfg.CloseTimeout)
+	}
+}
+
+func TestFramesAfterCloseAreIgnored(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, addr, "/")
+	defer conn.Close()
+
+	// close and text pipelined in a single write
+	batch := append(clientFrame(opClose, []byte{0x03, 0xE8}, true), clientFrame(opText, []byte("after close"), true)...)
+	if _, err := conn.Write(batch); err != nil {
+		t.Fatalf("failed to send frames: %v", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	got, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("failed to read reply: %v", err)
+	}
+	want := []byte{0x88, 0x02, 0x03, 0xE8}
+	if string(got) != string(want) {
+		t.Fatalf("expected only a close frame, got % x", got)
+	}
+}
+
+func TestParseFramesRejectsOversizedHeader(t *testing.T) {
+	// only the header of a 3GB frame has arrived
+	header := []byte{0x82, 0xFF, 0x00, 0x00, 0x00, 0x00, 0xC0, 0x00, 0x00, 0x00}
+	_, _, err := parseFrames(header, parseOptions{maxFrameSize: 1 << 20})
+	if !errors.Is(err, errMessageTooBig) {
+		t.Fatalf("expected message too big, got %v", err)
+	}
+	// without a limit the parser just waits for the payload
+	frames, rest, err := parseFrames(header, parseOptions{})
+	if err != nil || len(frames) != 0 || len(rest) != len(header) {
+		t.Fatalf("expected an incomplete frame, got frames=%d rest=%d err=%v", len(frames), len(rest), err)
+	}
+}
+
+func TestMaxFrameSize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxFrameSize = 1024
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, addr, "/")
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+
+	// a frame right at the limit is echoed
+	if _, err := conn.Write(clientFrame(opBin, make([]byte, 1024), true)); err != nil {
+		t.Fatalf("failed to send frame: %v", err)
+	}
+	if f := readFrameFrom(t, reader); f.Opcode != opBin || len(f.Payload) != 1024 {
+		t.Fatalf("unexpected echo: opcode=%d length=%d", f.Opcode, len(f.Payload))
+	}
+
+	// one byte over is refused as soon as the header arrives, the payload is never sent
+	over := clientFrame(opBin, make([]byte, 1025), true)
+	if _, err := conn.Write(over[:8]); err != nil {
+		t.Fatalf("failed to send header: %v", err)
+	}
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseMessageTooBig {
+		t.Fatalf("expected close 1009, got opcode=%d code=%d", f.Opcode, code)
+	}
+}
+
+func TestFragmentedMessages(t *testing.T) {
+	conn, reader := pipeConnection(t, DefaultConfig())
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	tests := []struct {
+		opcode byte
+		parts  []string
+	}{
+		{opText, []string{"Hel", "lo, ", "Server!"}},
+		{opBin, []string{"\x00\x01", "\x02"}},
+	}
+	for _, tt := range tests {
+		for i, part := range tt.parts {
+			opcode := byte(opCont)
+			if i == 0 {
+				opcode = tt.opcode
+			}
+			if _, err := conn.Write(clientFrame(opcode, []byte(part), i == len(tt.parts)-1)); err != nil {
+				t.Fatalf("failed to send fragment: %v", err)
+			}
+		}
+		f := readFrameFrom(t, reader)
+		if f.Opcode != tt.opcode || string(f.Payload) != strings.Join(tt.parts, "") {
+			t.Fatalf("unexpected echo: opcode=%d payload=%q", f.Opcode, f.Payload)
+		}
+	}
+}
+
+func TestMaxMessageSizeAcrossFragments(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.MaxMessageSize = 64 << 10
+	conn, reader := pipeConnection(t, cfg)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	const fragments = 10000
+	var written atomic.Int64
+	go func() {
+		part := make([]byte, 100)
+		for i := 0; i < fragments; i++ {
+			opcode := byte(opCont)
+			if i == 0 {
+				opcode = opText
+			}
+			if _, err := conn.Write(clientFrame(opcode, part, i == fragments-1)); err != nil {
+				return
+			}
+			written.Add(1)
+		}
+	}()
+
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseMessageTooBig {
+		t.Fatalf("expected close 1009, got opcode=%d code=%d", f.Opcode, code)
+	}
+	// 64KB is reached after ~656 fragments of 100 bytes
+	if n := written.Load(); n > 1000 {
+		t.Fatalf("server consumed %d fragments before closing", n)
+	}
+}
+
+// manualTimer replaces time.AfterFunc for the frame timeout so tests decide when it fires
+type manualTimer struct {
+	fire    func()
+	stopped atomic.Bool
+}
+
+func (m *manualTimer) Stop() bool { return !m.stopped.Swap(true) }
+
+func manualTimers(cfg *Config) <-chan *manualTimer {
+	armed := make(chan *manualTimer, 8)
+	cfg.afterFunc = func(d time.Duration, f func()) timer {
+		m := &manualTimer{fire: f}
+		armed <- m
+		return m
+	}
+	return armed
+}
+
+func TestFrameTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	armed := manualTimers(&cfg)
+	conn, reader := pipeConnection(t, cfg)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	// the header of a 100KB frame, then silence
+	partial := clientFrame(opBin, make([]byte, 100<<10), true)[:8]
+	if _, err := conn.Write(partial); err != nil {
+		t.Fatalf("failed to send header: %v", err)
+	}
+
+	var m *manualTimer
+	select {
+	case m = <-armed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the frame timer to be armed")
+	}
+	m.fire()
+
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != ClosePolicyViolation {
+		t.Fatalf("expected close 1008, got opcode=%d code=%d", f.Opcode, code)
+	}
+}
+
+func TestFrameTimeoutClearedWhenFrameCompletes(t *testing.T) {
+	cfg := DefaultConfig()
+	armed := manualTimers(&cfg)
+	conn, reader := pipeConnection(t, cfg)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	full := clientFrame(opText, []byte("slowly"), true)
+	if _, err := conn.Write(full[:4]); err != nil {
+		t.Fatalf("failed to send first half: %v", err)
+	}
+	m := <-armed
+	if _, err := conn.Write(full[4:]); err != nil {
+		t.Fatalf("failed to send second half: %v", err)
+	}
+	if f := readFrameFrom(t, reader); string(f.Payload) != "slowly" {
+		t.Fatalf("unexpected echo: %q", f.Payload)
+	}
+	if !m.stopped.Load() {
+		t.Fatalf("expected the frame timer to be stopped once the frame completed")
+	}
+
+	// an idle connection without a pending frame never arms the timer
+	select {
+	case <-armed:
+		t.Fatalf("frame timer armed on an idle connection")
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestParseFramesLargeLengths(t *testing.T) {
+	header := func(length uint64) []byte {
+		h := []byte{0x82, 0x7F, 0, 0, 0, 0, 0, 0, 0, 0}
+		binary.BigEndian.PutUint64(h[2:], length)
+		return h
+	}
+	// whether an unlimited parser can hold the frame depends on the size of int
+	fits := func(length uint64) bool { return length <= uint64(math.MaxInt) }
+
+	for _, length := range []uint64{1 << 31, 1 << 32} {
+		h := header(length)
+		if _, _, err := parseFrames(h, parseOptions{maxFrameSize: 1 << 20, client: true}); !errors.Is(err, errMessageTooBig) {
+			t.Fatalf("length %d: expected message too big with a limit, got %v", length, err)
+		}
+		frames, rest, err := parseFrames(h, parseOptions{client: true})
+		if fits(length) {
+			if err != nil || len(frames) != 0 || len(rest) != len(h) {
+				t.Fatalf("length %d: expected an incomplete frame, got frames=%d err=%v", length, len(frames), err)
+			}
+		} else if !errors.Is(err, errMessageTooBig) {
+			t.Fatalf("length %d: expected message too big on a 32-bit build, got %v", length, err)
 		}
 	}
 
-	readFrame := func() frame {
-		buf := make([]byte, 4096)
-		//conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-		n, err := reader.Read(buf)
+	// 2^63 has the most significant bit set, which the RFC forbids
+	if _, _, err := parseFrames(header(1<<63), parseOptions{client: true}); !errors.Is(err, errProtocol) {
+		t.Fatalf("expected a protocol error for 2^63, got %v", err)
+	}
+}
+
+func TestFrameHeaderLengthEncodings(t *testing.T) {
+	tests := []struct {
+		length    uint64
+		headerLen int
+	}{
+		{125, 2},
+		{126, 4},
+		{65535, 4},
+		{65536, 10},
+		{1 << 32, 10},
+	}
+	for _, tt := range tests {
+		var buf [maxFrameHeaderSize]byte
+		n, err := writeFrameHeader(&buf, opBin, true, false, tt.length)
 		if err != nil {
-			t.Fatalf("failed to read frame: %v", err)
+			t.Fatalf("length %d: %v", tt.length, err)
+		}
+		header := buf[:n]
+		if len(header) != tt.headerLen {
+			t.Fatalf("length %d: expected a %d byte header, got %d", tt.length, tt.headerLen, len(header))
+		}
+		if header[0] != 0x82 {
+			t.Fatalf("length %d: unexpected first byte %#x", tt.length, header[0])
 		}
-		frames, _, err := parseFrames(buf[:n])
+		// decode the header with the client side of our own parser
+		frames, rest, err := parseFrames(header, parseOptions{client: true})
+		if err != nil || len(frames) != 0 || len(rest) != len(header) {
+			t.Fatalf("length %d: expected the parser to wait for the payload, got frames=%d err=%v", tt.length, len(frames), err)
+		}
+		var decoded uint64
+		switch header[1] {
+		case 126:
+			decoded = uint64(binary.BigEndian.Uint16(header[2:]))
+		case 127:
+			decoded = binary.BigEndian.Uint64(header[2:])
+		default:
+			decoded = uint64(header[1])
+		}
+		if decoded != tt.length {
+			t.Fatalf("length %d: header decodes to %d", tt.length, decoded)
+		}
+	}
+
+	for _, masked := range []bool{false, true} {
+		var buf [maxFrameHeaderSize]byte
+		if _, err := writeFrameHeader(&buf, opBin, true, masked, 1<<63); err == nil {
+			t.Fatalf("masked=%v: expected a length with the top bit set to be refused", masked)
+		}
+	}
+}
+
+func TestWriteFrameHeader(t *testing.T) {
+	tests := []struct {
+		opcode byte
+		fin    bool
+		length uint64
+		want   []byte
+	}{
+		{opPong, true, 0, []byte{0x8A, 0}},
+		{opText, false, 125, []byte{0x01, 125}},
+		{opBin, true, 126, []byte{0x82, 126, 0, 126}},
+		{opCont, true, 65535, []byte{0x80, 126, 0xFF, 0xFF}},
+		{opBin, true, 65536, []byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0, 0}},
+		{opBin, false, 1 << 32, []byte{0x02, 127, 0, 0, 0, 1, 0, 0, 0, 0}},
+	}
+	for _, tt := range tests {
+		for _, masked := range []bool{false, true} {
+			var buf [maxFrameHeaderSize]byte
+			n, err := writeFrameHeader(&buf, tt.opcode, tt.fin, masked, tt.length)
+			if err != nil {
+				t.Fatalf("length %d: %v", tt.length, err)
+			}
+			want := slices.Clone(tt.want)
+			if masked {
+				want[1] |= 0x80
+				if n != len(want)+4 {
+					t.Fatalf("length %d: masked header is %d bytes", tt.length, n)
+				}
+				want = append(want, buf[len(want):n]...)
+			}
+			if !bytes.Equal(buf[:n], want) {
+				t.Fatalf("length %d masked=%v: got header % x, want % x", tt.length, masked, buf[:n], want)
+			}
+		}
+	}
+}
+
+func TestBuildFrameRoundTrip(t *testing.T) {
+	for _, size := range []int{0, 125, 126, 65535, 65536} {
+		payload := make([]byte, size)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		data, err := buildFrame(opBin, payload, true)
 		if err != nil {
-			t.Fatalf("failed to parse frame: %v", err)
+			t.Fatalf("size %d: %v", size, err)
+		}
+		frames, rest, err := parseFrames(data, parseOptions{client: true})
+		if err != nil || len(frames) != 1 || len(rest) != 0 {
+			t.Fatalf("size %d: expected one frame, got frames=%d rest=%d err=%v", size, len(frames), len(rest), err)
 		}
-		if len(frames) == 0 {
-			t.Fatalf("no frame parsed")
+		if string(frames[0].Payload) != string(payload) {
+			t.Fatalf("size %d: payload changed in the round trip", size)
 		}
-		return frames[0]
 	}
+}
+
+func TestWriteTimeoutDropsNonReadingPeer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.WriteTimeout = 100 * time.Millisecond
+	disconnected := make(chan struct{})
+	cfg.OnDisconnect = func(c *Conn, err error) { close(disconnected) }
+	conn, reader := pipeConnection(t, cfg)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
 
-	sendText("hello")
-	f := readFrame()
-	if f.Opcode != opText || string(f.Payload) != "hello" {
-		t.Fatalf("unexpected response: opcode=%d payload=%s", f.Opcode, f.Payload)
+	// the echo of this message can't be written because we never read it
+	if _, err := conn.Write(clientFrame(opBin, make([]byte, 64<<10), true)); err != nil {
+		t.Fatalf("failed to send message: %v", err)
 	}
+	<-disconnected
 
-	sendText(strings.Repeat("a", 200))
-	f = readFrame()
-	if f.Opcode != opText || len(f.Payload) != 200 {
-		t.Fatalf("unexpected response length: %d", len(f.Payload))
+	// by now the server gave up on the write and closed its end of the pipe
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected the server to drop the connection, got %v", err)
 	}
 }
 
-func TestPingPong(t *testing.T) {
-	server, addr, err := startServer("127.0.0.1:0")
+func TestStrictFrameLengths(t *testing.T) {
+	masked := func(header ...byte) []byte {
+		// append a zero masking key and a 5 byte payload
+		return append(append(header, 0, 0, 0, 0), "hello"...)
+	}
+	encodings := map[string][]byte{
+		"7-bit":  masked(0x81, 0x80|5),
+		"16-bit": masked(0x81, 0x80|126, 0, 5),
+		"64-bit": masked(0x81, 0x80|127, 0, 0, 0, 0, 0, 0, 0, 5),
+	}
+	for name, data := range encodings {
+		for _, strict := range []bool{false, true} {
+			frames, _, err := parseFrames(data, parseOptions{strict: strict})
+			if name != "7-bit" && strict {
+				if !errors.Is(err, errProtocol) {
+					t.Fatalf("%s strict: expected a protocol error, got %v", name, err)
+				}
+				continue
+			}
+			if err != nil || len(frames) != 1 || string(frames[0].Payload) != "hello" {
+				t.Fatalf("%s strict=%t: expected the frame to parse, got frames=%d err=%v", name, strict, len(frames), err)
+			}
+		}
+	}
+
+	// the server configuration turns strict mode on
+	cfg := DefaultConfig()
+	cfg.StrictFrameLengths = true
+	conn, reader := pipeConnection(t, cfg)
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(encodings["16-bit"]); err != nil {
+		t.Fatalf("failed to send frame: %v", err)
+	}
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseProtocolError {
+		t.Fatalf("expected close 1002, got opcode=%d code=%d", f.Opcode, code)
+	}
+}
+
+func TestCheckOrigin(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
 	if err != nil {
 		t.Fatalf("failed to start server: %v", err)
 	}
 	defer server.Close()
 
-	time.Sleep(100 * time.Millisecond)
-
-	conn, reader := dialWebSocket(t, addr, "/")
-	defer conn.Close()
-
-	payload := []byte("ping")
-	frame := buildFrame(opPing, payload, true)
-	if _, err := conn.Write(frame); err != nil {
-		t.Fatalf("failed to send ping: %v", err)
+	tests := []struct {
+		name   string
+		origin string
+		status int
+	}{
+		{name: "no origin", origin: "", status: http.StatusSwitchingProtocols},
+		{name: "same origin", origin: "http://" + addr, status: http.StatusSwitchingProtocols},
+		{name: "cross origin", origin: "https://evil.example", status: http.StatusForbidden},
+		{name: "same host other port", origin: "http://127.0.0.1:1", status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, resp := handshake(t, addr, "/", http.Header{"Origin": {tt.origin}})
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %s", tt.status, resp.Status)
+			}
+		})
 	}
+}
 
-	buf := make([]byte, 4096)
-	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
-	n, err := reader.Read(buf)
-	if err != nil {
-		t.Fatalf("failed to read frame: %v", err)
+func TestCustomCheckOrigin(t *testing.T) {
+	cfg := DefaultConfig()
+	cookies := make(chan string, 1)
+	cfg.CheckOrigin = func(r *http.Request) bool {
+		if c, err := r.Cookie("session"); err == nil {
+			cookies <- c.Value
+		}
+		return true
 	}
-	frames, _, err := parseFrames(buf[:n])
+	server, addr, err := startServer("127.0.0.1:0", cfg)
 	if err != nil {
-		t.Fatalf("failed to parse frame: %v", err)
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	_, _, resp := handshake(t, addr, "/", http.Header{
+		"Origin": {"https://elsewhere.example"},
+		"Cookie": {"session=abc"},
+	})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the permissive hook to allow the upgrade, got %s", resp.Status)
 	}
-	if len(frames) == 0 {
-		t.Fatalf("no frame parsed")
+	select {
+	case v := <-cookies:
+		if v != "abc" {
+			t.Fatalf("unexpected cookie value %q", v)
+		}
+	default:
+		t.Fatalf("expected the hook to see the request cookies")
 	}
-	f := frames[0]
-	if f.Opcode != opPong || string(f.Payload) != "ping" {
-		t.Fatalf("unexpected pong: opcode=%d payload=%s", f.Opcode, f.Payload)
+}
+
+func TestUnsupportedVersion(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	for _, version := range []string{"8", "", "garbage"} {
+		t.Run(fmt.Sprintf("%q", version), func(t *testing.T) {
+			_, _, resp := handshake(t, addr, "/", http.Header{"Sec-WebSocket-Version": {version}})
+			if resp.StatusCode != http.StatusUpgradeRequired {
+				t.Fatalf("expected 426, got %s", resp.Status)
+			}
+			if v := resp.Header.Get("Sec-WebSocket-Version"); v != "13" {
+				t.Fatalf("expected the supported version to be listed, got %q", v)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), "version 13") {
+				t.Fatalf("expected the body to explain the problem, got %q", body)
+			}
+		})
+	}
+
+	// a missing key is still a plain bad request
+	_, _, resp := handshake(t, addr, "/", http.Header{"Sec-WebSocket-Key": {""}, "Sec-WebSocket-Version": {"8"}})
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a key, got %s", resp.Status)
+	}
+}
+
+func TestNonGetHandshakeRejected(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	for _, method := range []string{http.MethodPost, http.MethodPut, http.MethodHead} {
+		t.Run(method, func(t *testing.T) {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatalf("failed to dial: %v", err)
+			}
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			reader := bufio.NewReader(conn)
+
+			req := fmt.Sprintf("%s / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Key: %s\r\nSec-WebSocket-Version: 13\r\nContent-Length: 0\r\n\r\n", method, addr, testKey)
+			if _, err := conn.Write([]byte(req)); err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			resp, err := http.ReadResponse(reader, &http.Request{Method: method})
+			if err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			if resp.StatusCode != http.StatusMethodNotAllowed {
+				t.Fatalf("expected 405, got %s", resp.Status)
+			}
+			if allow := resp.Header.Get("Allow"); allow != http.MethodGet {
+				t.Fatalf("expected Allow: GET, got %q", allow)
+			}
+
+			// the connection is still plain HTTP and serves the next request
+			if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\n\r\n", addr); err != nil {
+				t.Fatalf("failed to send request: %v", err)
+			}
+			resp, err = http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatalf("expected the connection not to be hijacked: %v", err)
+			}
+			if resp.StatusCode != http.StatusNotFound {
+				t.Fatalf("expected 404 for a plain GET, got %s", resp.Status)
+			}
+		})
+	}
+}
+
+func TestSecWebSocketKeyValidation(t *testing.T) {
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		key    string
+		status int
+	}{
+		{name: "rfc sample", key: "dGhlIHNhbXBsZSBub25jZQ==", status: http.StatusSwitchingProtocols},
+		{name: "short", key: "x", status: http.StatusBadRequest},
+		{name: "not base64", key: "!!!!!!!!!!!!!!!!!!!!!!==", status: http.StatusBadRequest},
+		{name: "17 bytes", key: "AAAAAAAAAAAAAAAAAAAAAAA=", status: http.StatusBadRequest},
+		{name: "long", key: strings.Repeat("A", 500), status: http.StatusBadRequest},
+		{name: "missing", key: "", status: http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, resp := handshake(t, addr, "/", http.Header{"Sec-WebSocket-Key": {tt.key}})
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %s", tt.status, resp.Status)
+			}
+			if tt.status != http.StatusBadRequest {
+				return
+			}
+			body, _ := io.ReadAll(resp.Body)
+			if !strings.Contains(string(body), "16 byte nonce") {
+				t.Fatalf("expected the body to describe the problem, got %q", body)
+			}
+		})
+	}
+}
+
+func TestCustomResponseHeaders(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.ResponseHeader = func(r *http.Request) http.Header {
+		h := http.Header{}
+		h.Add("Set-Cookie", "affinity=node-3; Path=/")
+		h.Set("X-Request-Id", r.Header.Get("X-Request-Id"))
+		h.Set("X-Injected", "a\r\nSet-Cookie: evil=1")
+		h.Set("Connection", "close")
+		h.Set("Content-Length", "10")
+		h["Bad\r\nName"] = []string{"x"}
+		return h
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, reader, resp := handshake(t, addr, "/", http.Header{"X-Request-Id": {"req-42"}})
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	if got := resp.Header.Values("Set-Cookie"); len(got) != 1 || got[0] != "affinity=node-3; Path=/" {
+		t.Fatalf("unexpected Set-Cookie %q", got)
+	}
+	if got := resp.Header.Get("X-Request-Id"); got != "req-42" {
+		t.Fatalf("unexpected X-Request-Id %q", got)
+	}
+	if got := resp.Header.Get("X-Injected"); got != "a  Set-Cookie: evil=1" {
+		t.Fatalf("expected CR/LF to be neutralized, got %q", got)
+	}
+	if got := resp.Header.Get("Connection"); got != "Upgrade" {
+		t.Fatalf("expected the handshake's Connection header, got %q", got)
+	}
+	if resp.Header.Get("Content-Length") != "" {
+		t.Fatalf("expected Content-Length to be filtered out")
+	}
+
+	// the upgrade still works
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(clientFrame(opText, []byte("hi"), true)); err != nil {
+		t.Fatalf("failed to send frame: %v", err)
+	}
+	if f := readFrameFrom(t, reader); string(f.Payload) != "hi" {
+		t.Fatalf("unexpected echo %q", f.Payload)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Authorize = func(r *http.Request) (interface{}, int, error) {
+		token := r.URL.Query().Get("token")
+		if token == "" {
+			if c, err := r.Cookie("token"); err == nil {
+				token = c.Value
+			}
+		}
+		if token == "" {
+			token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		}
+		switch token {
+		case "":
+			return nil, http.StatusUnauthorized, errors.New("missing token")
+		case "secret":
+			return "alice", http.StatusOK, nil
+		default:
+			return nil, http.StatusForbidden, nil
+		}
+	}
+	identities := make(chan interface{}, 1)
+	cfg.onUpgrade = func(info connInfo) { identities <- info.identity }
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		path   string
+		header http.Header
+		status int
+		body   string
+	}{
+		{name: "missing token", path: "/", status: http.StatusUnauthorized, body: "missing token"},
+		{name: "bad token", path: "/?token=guess", status: http.StatusForbidden, body: "Forbidden"},
+		{name: "query token", path: "/?token=secret", status: http.StatusSwitchingProtocols},
+		{name: "bearer token", path: "/", header: http.Header{"Authorization": {"Bearer secret"}}, status: http.StatusSwitchingProtocols},
+		{name: "cookie token", path: "/", header: http.Header{"Cookie": {"token=secret"}}, status: http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, resp := handshake(t, addr, tt.path, tt.header)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %s", tt.status, resp.Status)
+			}
+			if tt.status != http.StatusSwitchingProtocols {
+				body, _ := io.ReadAll(resp.Body)
+				if strings.TrimSpace(string(body)) != tt.body {
+					t.Fatalf("expected body %q, got %q", tt.body, body)
+				}
+				return
+			}
+			select {
+			case id := <-identities:
+				if id != "alice" {
+					t.Fatalf("expected the identity on the connection, got %v", id)
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("connection was never upgraded")
+			}
+		})
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HandshakeTimeout = 200 * time.Millisecond
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	// half a handshake, then nothing
+	if _, err := fmt.Fprintf(conn, "GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\n", addr); err != nil {
+		t.Fatalf("failed to send request: %v", err)
+	}
+	start := time.Now()
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("connection closed after %v, expected about %v", elapsed, cfg.HandshakeTimeout)
+	}
+}
+
+func TestPathHandlers(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Handlers = map[string]Handler{
+		"/echo": EchoHandler,
+		"/shout": func(c *Conn, messageType int, data []byte) error {
+			return c.WriteMessage(messageType, bytes.ToUpper(data))
+		},
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	for path, want := range map[string]string{"/echo": "hello", "/shout": "HELLO"} {
+		c := dial(t, "ws://"+addr+path, nil)
+		if err := c.WriteMessage(opText, []byte("hello")); err != nil {
+			t.Fatalf("%s: failed to send: %v", path, err)
+		}
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != want {
+			t.Fatalf("%s: expected %q, got %q %v", path, want, data, err)
+		}
+	}
+
+	_, _, resp := handshake(t, addr, "/unknown", nil)
+	if resp.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown path, got %s", resp.Status)
+	}
+}
+
+func TestPlainHTTPNextToWebSocket(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Mux = http.NewServeMux()
+	cfg.Mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"status":"ok"}`))
+	})
+	cfg.Handlers = map[string]Handler{"/ws": EchoHandler}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	resp, err := http.Get("http://" + addr + "/status")
+	if err != nil {
+		t.Fatalf("failed to get /status: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" || string(body) != `{"status":"ok"}` {
+		t.Fatalf("unexpected /status response: %s %q", resp.Status, body)
+	}
+
+	// a plain request to the WebSocket path is told to upgrade
+	resp, err = http.Get("http://" + addr + "/ws")
+	if err != nil {
+		t.Fatalf("failed to get /ws: %v", err)
+	}
+	body, _ = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || !strings.Contains(string(body), "WebSocket") {
+		t.Fatalf("unexpected /ws response: %s %q", resp.Status, body)
+	}
+
+	conn, reader, resp := handshake(t, addr, "/ws", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(clientFrame(opText, []byte("hello"), true)); err != nil {
+		t.Fatalf("failed to send frame: %v", err)
+	}
+	if f := readFrameFrom(t, reader); string(f.Payload) != "hello" {
+		t.Fatalf("unexpected echo %q", f.Payload)
+	}
+}
+
+func TestHostAllowed(t *testing.T) {
+	tests := []struct {
+		host    string
+		allowed []string
+		want    bool
+	}{
+		{"example.com", []string{"example.com"}, true},
+		{"Example.COM", []string{"example.com"}, true},
+		{"evil.example", []string{"example.com"}, false},
+		{"example.com:8080", []string{"example.com"}, true},
+		{"example.com:8080", []string{"example.com:8080"}, true},
+		{"example.com:9090", []string{"example.com:8080"}, false},
+		{"example.com", []string{"example.com:8080"}, false},
+		{"ws.example.com", []string{"example.com", "ws.example.com"}, true},
+		{"[::1]:8080", []string{"::1"}, true},
+		{"[::1]:8080", []string{"[::1]"}, true},
+		{"[::1]:8080", []string{"[::1]:8080"}, true},
+		{"[::1]", []string{"::1"}, true},
+		{"[::2]:8080", []string{"[::1]"}, false},
+		{"", []string{"example.com"}, false},
+	}
+	for _, tt := range tests {
+		if got := hostAllowed(tt.host, tt.allowed); got != tt.want {
+			t.Errorf("hostAllowed(%q, %q) = %t, want %t", tt.host, tt.allowed, got, tt.want)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	tests := []struct {
+		name    string
+		allowed []string
+		status  int
+	}{
+		{name: "empty list", allowed: nil, status: http.StatusSwitchingProtocols},
+		{name: "matching host", allowed: []string{"127.0.0.1"}, status: http.StatusSwitchingProtocols},
+		{name: "mismatched host", allowed: []string{"example.com"}, status: http.StatusForbidden},
+		{name: "mismatched port", allowed: []string{"127.0.0.1:1"}, status: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.AllowedHosts = tt.allowed
+			server, addr, err := startServer("127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatalf("failed to start server: %v", err)
+			}
+			defer server.Close()
+
+			_, _, resp := handshake(t, addr, "/", nil)
+			if resp.StatusCode != tt.status {
+				t.Fatalf("expected status %d, got %s", tt.status, resp.Status)
+			}
+		})
+	}
+}
+
+func TestHandshakeRateLimit(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HandshakeRate, cfg.HandshakeBurst = 10, 20
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	limited := 0
+	for i := 0; i < 50; i++ {
+		_, _, resp := handshake(t, addr, "/", nil)
+		switch resp.StatusCode {
+		case http.StatusSwitchingProtocols:
+		case http.StatusTooManyRequests:
+			limited++
+			if resp.Header.Get("Retry-After") != "1" {
+				t.Fatalf("expected Retry-After: 1, got %q", resp.Header.Get("Retry-After"))
+			}
+		default:
+			t.Fatalf("unexpected status %s", resp.Status)
+		}
+	}
+	// the burst plus whatever trickled in while the test ran
+	if limited < 25 {
+		t.Fatalf("expected most of the 30 handshakes over the burst to be limited, got %d", limited)
+	}
+
+	// another address has its own bucket
+	dialer := net.Dialer{LocalAddr: &net.TCPAddr{IP: net.IPv4(127, 0, 0, 2)}}
+	conn, err := dialer.Dial("tcp", addr)
+	if err != nil {
+		t.Skipf("can't dial from 127.0.0.2: %v", err)
+	}
+	defer conn.Close()
+	if _, resp := handshakeOn(t, conn, addr, "/", nil); resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected another address to be unaffected, got %s", resp.Status)
+	}
+}
+
+func TestMaxConnections(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HandshakeRate = 0
+	cfg.MaxConnections = 5
+	cfg.Metrics = NewMetrics()
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	var idle []net.Conn
+	for i := 0; i < cfg.MaxConnections; i++ {
+		conn, _, resp := handshake(t, addr, "/", nil)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("connection %d: unexpected status %s", i, resp.Status)
+		}
+		idle = append(idle, conn)
+	}
+	if n := server.upgrader.Connections(); n != int64(cfg.MaxConnections) {
+		t.Fatalf("expected %d connections, got %d", cfg.MaxConnections, n)
+	}
+	if n := cfg.Metrics.active.Load(); n != int64(cfg.MaxConnections) {
+		t.Fatalf("expected the active gauge at %d, got %d", cfg.MaxConnections, n)
+	}
+
+	_, _, resp := handshake(t, addr, "/", nil)
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 at capacity, got %s", resp.Status)
+	}
+	if resp.Header.Get("Retry-After") == "" {
+		t.Fatalf("expected a Retry-After header")
+	}
+	if n := server.upgrader.Connections(); n != int64(cfg.MaxConnections) {
+		t.Fatalf("a refused handshake changed the count to %d", n)
+	}
+
+	// once a connection is gone its slot is free again
+	idle[0].Close()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		_, _, resp := handshake(t, addr, "/", nil)
+		if resp.StatusCode == http.StatusSwitchingProtocols {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot was never released, last status %s", resp.Status)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnectionsReleasedOnce(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.HandshakeRate = 0
+	cfg.PingInterval = 0
+	cfg.MaxConnections = 2
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	cfg.Handlers = map[string]Handler{
+		"/": func(c *Conn, messageType int, data []byte) error {
+			switch string(data) {
+			case "panic":
+				panic("boom")
+			case "fail":
+				return errors.New("handler failed")
+			}
+			return c.WriteMessage(messageType, data)
+		},
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+	waitConnections := func(want int64) {
+		t.Helper()
+		deadline := time.Now().Add(2 * time.Second)
+		for server.upgrader.Connections() != want {
+			if time.Now().After(deadline) {
+				t.Fatalf("expected %d connections, got %d", want, server.upgrader.Connections())
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+
+	// a panic, a failing handler, a clean close and a dropped socket each
+	// give back their slot exactly once
+	for _, end := range []string{"panic", "fail", "close", "drop"} {
+		c := dial(t, "ws://"+addr+"/", nil)
+		waitConnections(1)
+		switch end {
+		case "close":
+			c.Close(CloseNormalClosure, "")
+		case "drop":
+			c.CloseNow()
+		default:
+			if err := c.WriteMessage(TextMessage, []byte(end)); err != nil {
+				t.Fatalf("%s: failed to send: %v", end, err)
+			}
+			if _, _, err := c.ReadMessage(); err == nil {
+				t.Fatalf("%s: expected the connection to end", end)
+			}
+		}
+		waitConnections(0)
+	}
+
+	// the count didn't go below zero: the limit still holds
+	for i := 0; i < cfg.MaxConnections; i++ {
+		dial(t, "ws://"+addr+"/", nil)
+	}
+	if _, _, resp := handshake(t, addr, "/", nil); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 at capacity, got %s", resp.Status)
+	}
+}
+
+func TestHandlerSeesUpgradeRequest(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Handlers = map[string]Handler{
+		"/rooms": func(c *Conn, messageType int, data []byte) error {
+			r := c.Request()
+			session, _ := r.Cookie("session")
+			info := fmt.Sprintf("%s %s %s %s %t", r.URL.Query().Get("room"), r.Header.Get("X-Client"),
+				session.Value, r.URL.Path, r.Context().Err() == nil)
+			return c.WriteMessage(opText, []byte(info))
+		},
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	c := dial(t, "ws://"+addr+"/rooms?room=lobby", http.Header{
+		"X-Client": {"test-suite"},
+		"Cookie":   {"session=abc"},
+	})
+	if err := c.WriteMessage(opText, []byte("who am i")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "lobby test-suite abc /rooms true" {
+		t.Fatalf("unexpected request data %q %v", data, err)
+	}
+}
+
+func TestShutdownClosesConnections(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	server, addr, err := startServer("127.0.0.1:0", DefaultConfig())
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for i := 0; i < 2; i++ {
+		conn, reader, resp := handshake(t, addr, "/", nil)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("unexpected status: %s", resp.Status)
+		}
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		conns, readers = append(conns, conn), append(readers, reader)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(ctx) }()
+
+	for i, conn := range conns {
+		f := readFrameFrom(t, readers[i])
+		if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseGoingAway {
+			t.Fatalf("connection %d: expected close 1001, got opcode=%d code=%d", i, f.Opcode, code)
+		}
+		if _, err := conn.Write(clientFrame(opClose, f.Payload[:2], true)); err != nil {
+			t.Fatalf("failed to answer the close: %v", err)
+		}
+	}
+	if err := <-shutdown; err != nil {
+		t.Fatalf("shutdown: %v", err)
+	}
+
+	// every connection goroutine is gone
+	deadline := time.Now().Add(2 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left over:\n%s", runtime.NumGoroutine()-before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownDropsUnansweredConnections(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CloseTimeout = time.Minute // only Shutdown's context ends the wait
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	var conns []net.Conn
+	var readers []*bufio.Reader
+	for i := 0; i < 3; i++ {
+		conn, reader, resp := handshake(t, addr, "/", nil)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("unexpected status: %s", resp.Status)
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		conns, readers = append(conns, conn), append(readers, reader)
+	}
+	// A pong means the read loop runs, so the connection is registered
+	for i, conn := range conns {
+		conn.Write(clientFrame(opPing, nil, true))
+		readFrameFrom(t, readers[i])
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- server.Shutdown(ctx) }()
+
+	// Every client gets 1001, only the first one answers
+	for i := range conns {
+		f := readFrameFrom(t, readers[i])
+		if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseGoingAway {
+			t.Fatalf("connection %d: expected close 1001, got opcode=%d code=%d", i, f.Opcode, code)
+		}
+	}
+	conns[0].Write(clientFrame(opClose, []byte{0x03, 0xE9}, true))
+
+	if err := <-shutdown; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the context to expire, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("Shutdown took %v", elapsed)
+	}
+	// the others were dropped
+	for i := 1; i < len(conns); i++ {
+		if _, err := readers[i].ReadByte(); err != io.EOF {
+			t.Fatalf("connection %d: expected EOF, got %v", i, err)
+		}
+	}
+
+	// and upgrades are refused from now on
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	if _, err := server.upgrader.Upgrade(rec, req); err == nil || rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after Shutdown, got %d %v", rec.Code, err)
+	}
+}
+
+func TestAwaitShutdownOnSignal(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.HandshakeRate = 0
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	clients := []*Conn{dial(t, "ws://"+addr+"/", nil), dial(t, "ws://"+addr+"/", nil)}
+	closed := make(chan error, len(clients))
+	for _, c := range clients {
+		go func() {
+			_, _, err := c.ReadMessage()
+			closed <- err
+		}()
+	}
+
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	done := make(chan error, 1)
+	go func() { done <- awaitShutdown(server, signals, 2*time.Second) }()
+	self, _ := os.FindProcess(os.Getpid())
+	if err := self.Signal(syscall.SIGTERM); err != nil {
+		t.Fatalf("failed to signal: %v", err)
+	}
+
+	for range clients {
+		var ce *CloseError
+		if err := <-closed; !errors.As(err, &ce) || ce.Code != CloseGoingAway {
+			t.Fatalf("expected close 1001, got %v", err)
+		}
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("expected a clean shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("awaitShutdown didn't return within the drain timeout")
+	}
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Fatal("the server still accepts connections")
+	}
+}
+
+func TestAwaitShutdownDrainTimeout(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CloseTimeout = time.Minute // only the drain timeout ends the wait
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	conn, reader, _ := handshake(t, addr, "/", nil)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(clientFrame(opPing, nil, true))
+	readFrameFrom(t, reader)
+
+	signals := make(chan os.Signal, 1)
+	signals <- syscall.SIGTERM
+	start := time.Now()
+	if err := awaitShutdown(server, signals, 200*time.Millisecond); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the drain to time out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("awaitShutdown took %v", elapsed)
+	}
+	// the client got 1001 and was dropped when it didn't answer
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseGoingAway {
+		t.Fatalf("expected close 1001, got opcode=%d code=%d", f.Opcode, code)
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestAwaitShutdownSecondSignal(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.CloseTimeout = time.Minute
+	cfg.Logger = slog.New(slog.DiscardHandler)
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	conn, reader, _ := handshake(t, addr, "/", nil)
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.Write(clientFrame(opPing, nil, true))
+	readFrameFrom(t, reader)
+
+	signals := make(chan os.Signal, 2)
+	done := make(chan error, 1)
+	go func() { done <- awaitShutdown(server, signals, time.Minute) }()
+	signals <- syscall.SIGINT
+	if f := readFrameFrom(t, reader); f.Opcode != opClose {
+		t.Fatalf("expected a close frame, got opcode=%d", f.Opcode)
+	}
+	signals <- syscall.SIGINT
+	select {
+	case err := <-done:
+		if !errors.Is(err, errForcedShutdown) {
+			t.Fatalf("expected a forced shutdown, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("the second signal didn't force the shutdown")
+	}
+	if _, err := reader.ReadByte(); err != io.EOF {
+		t.Fatalf("expected EOF, got %v", err)
+	}
+}
+
+func TestUpgraderInsideHandler(t *testing.T) {
+	upgrader, err := NewUpgrader(DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewUpgrader: %v", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/ws" {
+			fmt.Fprint(w, "plain page")
+			return
+		}
+		c, err := upgrader.Upgrade(w, r)
+		if err != nil {
+			return
+		}
+		go func() {
+			for {
+				messageType, data, err := c.ReadMessage()
+				if err != nil {
+					return
+				}
+				if err := c.WriteMessage(messageType, data); err != nil {
+					return
+				}
+			}
+		}()
+	}))
+	defer ts.Close()
+	addr := strings.TrimPrefix(ts.URL, "http://")
+
+	resp, err := http.Get(ts.URL + "/")
+	if err != nil {
+		t.Fatalf("plain request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "plain page" {
+		t.Fatalf("unexpected plain response %q", body)
+	}
+
+	conn, reader, resp := handshake(t, addr, "/ws", nil)
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	for _, msg := range []string{"Hello", "World"} {
+		if _, err := conn.Write(clientFrame(opText, []byte(msg), true)); err != nil {
+			t.Fatalf("failed to send frame: %v", err)
+		}
+		if f := readFrameFrom(t, reader); f.Opcode != opText || string(f.Payload) != msg {
+			t.Fatalf("expected echo of %q, got opcode %d %q", msg, f.Opcode, f.Payload)
+		}
+	}
+
+	// A refused handshake is answered by the Upgrader
+	conn2, _, resp := handshake(t, addr, "/ws", http.Header{"Sec-WebSocket-Version": {"8"}})
+	conn2.Close()
+	if resp.StatusCode != http.StatusUpgradeRequired {
+		t.Fatalf("expected 426, got %s", resp.Status)
+	}
+}
+
+func TestUpgraderSuppressErrors(t *testing.T) {
+	upgrader, err := NewUpgrader(DefaultConfig())
+	if err != nil {
+		t.Fatalf("NewUpgrader: %v", err)
+	}
+	upgrader.SuppressErrors = true
+	errs := make(chan error, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, err := upgrader.Upgrade(w, r)
+		errs <- err
+		var he *HandshakeError
+		if errors.As(err, &he) {
+			w.WriteHeader(http.StatusTeapot)
+			fmt.Fprintf(w, "refused with %d", he.Status)
+		}
+	}))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/ws")
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusTeapot || string(body) != "refused with 404" {
+		t.Fatalf("expected the caller's own response, got %s %q", resp.Status, body)
+	}
+	var he *HandshakeError
+	if err := <-errs; !errors.As(err, &he) || he.Status != http.StatusNotFound {
+		t.Fatalf("expected a 404 HandshakeError, got %v", err)
+	}
+}
+
+func TestCustomHandler(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.Handlers = map[string]Handler{
+		"/reverse": func(c *Conn, messageType int, data []byte) error {
+			if messageType != opText {
+				return &CloseError{Code: CloseUnsupportedData, Text: "text only"}
+			}
+			runes := []rune(string(data))
+			for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+				runes[i], runes[j] = runes[j], runes[i]
+			}
+			return c.WriteMessage(opText, []byte(string(runes)))
+		},
+		"/broken": func(c *Conn, messageType int, data []byte) error {
+			return errors.New("database unavailable")
+		},
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	c := dial(t, "ws://"+addr+"/reverse", nil)
+	for msg, want := range map[string]string{"Hello, World": "dlroW ,olleH", "añb€": "€bña"} {
+		if err := c.WriteMessage(opText, []byte(msg)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if messageType, data, err := c.ReadMessage(); err != nil || messageType != opText || string(data) != want {
+			t.Fatalf("expected %q, got type %d %q %v", want, messageType, data, err)
+		}
+	}
+
+	// A returned *CloseError closes with its code and reason
+	if err := c.WriteMessage(opBin, []byte{1, 2, 3}); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	var ce *CloseError
+	if _, _, err := c.ReadMessage(); !errors.As(err, &ce) || ce.Code != CloseUnsupportedData || ce.Text != "text only" {
+		t.Fatalf("expected CLOSE 1003 text only, got %v", err)
+	}
+
+	// Any other error closes with 1011
+	c2 := dial(t, "ws://"+addr+"/broken", nil)
+	if err := c2.WriteMessage(opText, []byte("hi")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if _, _, err := c2.ReadMessage(); !IsCloseError(err, CloseInternalServerErr) {
+		t.Fatalf("expected CLOSE 1011, got %v", err)
+	}
+}
+
+func TestLifecycleCallbacks(t *testing.T) {
+	type event struct {
+		kind string // "connect" or "disconnect"
+		conn *Conn
+		err  error
+	}
+	events := make(chan event, 16)
+	cfg := DefaultConfig()
+	cfg.OnConnect = func(c *Conn) error {
+		events <- event{"connect", c, nil}
+		return nil
+	}
+	cfg.OnDisconnect = func(c *Conn, err error) {
+		events <- event{"disconnect", c, err}
+	}
+	cfg.Handlers = map[string]Handler{
+		"/": EchoHandler,
+		"/panic": func(c *Conn, messageType int, data []byte) error {
+			panic("handler bug")
+		},
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	tests := []struct {
+		name  string
+		path  string
+		run   func(t *testing.T, conn net.Conn, reader *bufio.Reader)
+		check func(err error) bool
+	}{
+		{"normal close", "/", func(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+			payload, _ := formatClosePayload(CloseNormalClosure, "done")
+			conn.Write(clientFrame(opClose, payload, true))
+			readFrameFrom(t, reader)
+		}, func(err error) bool {
+			var ce *CloseError
+			return errors.As(err, &ce) && ce.Code == CloseNormalClosure && ce.Text == "done"
+		}},
+		{"abrupt reset", "/", func(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+			conn.(*net.TCPConn).SetLinger(0)
+			conn.Close()
+		}, func(err error) bool {
+			var ce *CloseError
+			return err != nil && !errors.As(err, &ce)
+		}},
+		{"protocol error", "/", func(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+			conn.Write(clientFrame(opCont, []byte("orphan"), true))
+			readFrameFrom(t, reader)
+			conn.Write(clientFrame(opClose, nil, true))
+		}, func(err error) bool {
+			var ce *CloseError
+			return errors.As(err, &ce) && ce.Code == CloseProtocolError
+		}},
+		{"handler panic", "/panic", func(t *testing.T, conn net.Conn, reader *bufio.Reader) {
+			conn.Write(clientFrame(opText, []byte("boom"), true))
+			f := readFrameFrom(t, reader)
+			if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseInternalServerErr {
+				t.Errorf("expected CLOSE 1011, got opcode %d code %d", f.Opcode, code)
+			}
+			conn.Write(clientFrame(opClose, nil, true))
+		}, func(err error) bool {
+			return err != nil && strings.Contains(err.Error(), "handler bug")
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, reader, resp := handshake(t, addr, tt.path, nil)
+			defer conn.Close()
+			if resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("unexpected status: %s", resp.Status)
+			}
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			tt.run(t, conn, reader)
+
+			connected := <-events
+			if connected.kind != "connect" {
+				t.Fatalf("expected OnConnect first, got %s", connected.kind)
+			}
+			disconnected := <-events
+			if disconnected.kind != "disconnect" || disconnected.conn != connected.conn {
+				t.Fatalf("expected OnDisconnect for the same connection, got %s", disconnected.kind)
+			}
+			if !tt.check(disconnected.err) {
+				t.Fatalf("unexpected disconnect error: %v", disconnected.err)
+			}
+			select {
+			case e := <-events:
+				t.Fatalf("unexpected extra %s callback", e.kind)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	}
+}
+
+func TestOnConnectRefuses(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.OnConnect = func(c *Conn) error {
+		return &CloseError{Code: ClosePolicyViolation, Text: "not today"}
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, reader, _ := handshake(t, addr, "/", nil)
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	f := readFrameFrom(t, reader)
+	code, reason, _ := parseClosePayload(f.Payload)
+	if f.Opcode != opClose || code != ClosePolicyViolation || reason != "not today" {
+		t.Fatalf("expected CLOSE 1008 not today, got opcode %d %d %q", f.Opcode, code, reason)
+	}
+}
+
+func TestOnError(t *testing.T) {
+	errs := make(chan error, 4)
+	disconnected := make(chan struct{}, 4)
+	cfg := DefaultConfig()
+	cfg.OnError = func(c *Conn, err error) { errs <- err }
+	cfg.OnDisconnect = func(c *Conn, err error) { disconnected <- struct{}{} }
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	// a protocol violation
+	conn, reader := dialWebSocket(t, addr, "/")
+	conn.Write(clientFrame(opCont, []byte("orphan"), true))
+	readFrameFrom(t, reader)
+	conn.Write(clientFrame(opClose, nil, true))
+	<-disconnected
+	conn.Close()
+	err = <-errs
+	if !IsCloseError(err, CloseProtocolError) || !errors.Is(err, wire.ErrProtocol) {
+		t.Fatalf("expected a 1002 protocol error, got %v", err)
+	}
+
+	// the peer vanishes without a CLOSE
+	conn, _ = dialWebSocket(t, addr, "/")
+	conn.Close()
+	<-disconnected
+	err = <-errs
+	if !IsCloseError(err, CloseAbnormalClosure) || !errors.Is(err, io.EOF) {
+		t.Fatalf("expected 1006 wrapping io.EOF, got %v", err)
+	}
+
+	// a clean close isn't an error
+	conn, reader = dialWebSocket(t, addr, "/")
+	conn.Write(clientFrame(opClose, nil, true))
+	readFrameFrom(t, reader)
+	conn.Close()
+	<-disconnected
+	select {
+	case err := <-errs:
+		t.Fatalf("OnError called for a clean close with %v", err)
+	default:
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	calls := make(chan string, 4)
+	cfg := DefaultConfig()
+	cfg.Middleware = []Middleware{
+		func(next Handler) Handler {
+			return func(c *Conn, messageType int, data []byte) error {
+				calls <- "upper"
+				return next(c, messageType, bytes.ToUpper(data))
+			}
+		},
+		func(next Handler) Handler {
+			return func(c *Conn, messageType int, data []byte) error {
+				calls <- "text only"
+				if messageType == BinaryMessage {
+					return &CloseError{Code: CloseUnsupportedData, Text: "text only"}
+				}
+				return next(c, messageType, data)
+			}
+		},
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	// the default echo handler runs inside the middleware
+	conn, reader := dialWebSocket(t, addr, "/")
+	defer conn.Close()
+	conn.Write(clientFrame(opText, []byte("hello"), true))
+	if f := readFrameFrom(t, reader); string(f.Payload) != "HELLO" {
+		t.Fatalf("expected the changed payload echoed, got %q", f.Payload)
+	}
+	if first, second := <-calls, <-calls; first != "upper" || second != "text only" {
+		t.Fatalf("middleware ran in the order %s, %s", first, second)
+	}
+
+	conn.Write(clientFrame(opBin, []byte{1, 2, 3}, true))
+	f := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != CloseUnsupportedData {
+		t.Fatalf("expected CLOSE 1003, got opcode %d code %d", f.Opcode, code)
+	}
+}
+
+// counter answers every message with its index on the connection
+type counter struct{}
+
+func (counter) ServeWS(c *Conn) {
+	for i := 0; ; i++ {
+		if _, _, err := c.ReadMessage(); err != nil {
+			return
+		}
+		if err := c.WriteMessage(TextMessage, []byte(strconv.Itoa(i))); err != nil {
+			return
+		}
+	}
+}
+
+// quitter leaves after the first message, panicker panics on it
+type quitter struct{ panic bool }
+
+func (q quitter) ServeWS(c *Conn) {
+	c.ReadMessage()
+	if q.panic {
+		panic("boom")
+	}
+}
+
+func TestConnHandler(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler ConnHandler
+		replies []string
+		code    int // of the CLOSE after the replies
+	}{
+		{"echo", nil, []string{"a", "b", "c"}, CloseNormalClosure},
+		{"counter", counter{}, []string{"0", "1", "2"}, CloseNormalClosure},
+		{"returns", quitter{}, nil, CloseNormalClosure},
+		{"panics", quitter{panic: true}, nil, CloseInternalServerErr},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.ConnHandler = tc.handler
+			server, addr, err := startServer("127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatalf("failed to start server: %v", err)
+			}
+			defer server.Close()
+
+			conn, reader := dialWebSocket(t, addr, "/")
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(2 * time.Second))
+			for _, msg := range []string{"a", "b", "c"} {
+				conn.Write(clientFrame(opText, []byte(msg), true))
+			}
+			for _, want := range tc.replies {
+				if f := readFrameFrom(t, reader); f.Opcode != opText || string(f.Payload) != want {
+					t.Fatalf("expected %q, got opcode %d %q", want, f.Opcode, f.Payload)
+				}
+			}
+			if tc.replies != nil {
+				conn.Write(clientFrame(opClose, nil, true))
+			}
+			f := readFrameFrom(t, reader)
+			if code, _, _ := parseClosePayload(f.Payload); f.Opcode != opClose || code != tc.code {
+				t.Fatalf("expected CLOSE %d, got opcode %d code %d", tc.code, f.Opcode, code)
+			}
+		})
+	}
+}
+
+// logCapture collects what a slog.Logger writes, connections log from their
+// own goroutines
+type logCapture struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (l *logCapture) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.Write(p)
+}
+
+func (l *logCapture) String() string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.buf.String()
+}
+
+// captureLogger returns a logger writing text lines from level up to the capture
+func captureLogger(level slog.Level) (*slog.Logger, *logCapture) {
+	capture := new(logCapture)
+	return slog.New(slog.NewTextHandler(capture, &slog.HandlerOptions{Level: level})), capture
+}
+
+func TestMessagePayloadLogging(t *testing.T) {
+	secret := "secret-" + strings.Repeat("x", 93)
+	for _, tc := range []struct {
+		level     slog.Level
+		logged    string // what of secret shows up, "" for nothing
+		truncated bool
+	}{
+		{slog.LevelInfo, "", false},
+		{slog.LevelDebug, secret[:10], true},
+	} {
+		cfg := DefaultConfig()
+		cfg.PingInterval = 0
+		cfg.LogPayloadSize = 10
+		logger, capture := captureLogger(tc.level)
+		cfg.Logger = logger
+		c, _ := servePipe(t, cfg, EchoHandler)
+		if err := c.WriteMessage(TextMessage, []byte(secret)); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+		if _, data, err := c.ReadMessage(); err != nil || string(data) != secret {
+			t.Fatalf("expected the echo, got %q %v", data, err)
+		}
+
+		logs := capture.String()
+		switch {
+		case tc.logged == "" && strings.Contains(logs, "secret"):
+			t.Errorf("%v: the payload was logged: %s", tc.level, logs)
+		case tc.logged != "" && !strings.Contains(logs, tc.logged):
+			t.Errorf("%v: expected %q logged: %s", tc.level, tc.logged, logs)
+		case strings.Contains(logs, secret[:11]):
+			t.Errorf("%v: the payload wasn't cut at 10 bytes: %s", tc.level, logs)
+		case tc.truncated && !strings.Contains(logs, "(100 bytes)"):
+			t.Errorf("%v: expected the size of the cut payload: %s", tc.level, logs)
+		}
+	}
+}
+
+func TestConnectionLogLines(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.HandshakeRate = 0
+	logger, capture := captureLogger(slog.LevelDebug)
+	cfg.Logger = logger
+	// the handler tells each client the ID of its connection
+	cfg.Handlers = map[string]Handler{"/": func(c *Conn, messageType int, data []byte) error {
+		return c.WriteMessage(TextMessage, []byte(strconv.FormatUint(c.ID(), 10)))
+	}}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Shutdown(context.Background())
+
+	clients := []struct {
+		requestID string
+		message   string
+		id        string
+	}{{"req-a", "from-a", ""}, {"", "from-b", ""}}
+	var wg sync.WaitGroup
+	for i := range clients {
+		header := http.Header{}
+		if clients[i].requestID != "" {
+			header.Set("X-Request-Id", clients[i].requestID)
+		}
+		c := dial(t, "ws://"+addr+"/", header)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer c.Close(CloseNormalClosure, "")
+			if err := c.WriteMessage(TextMessage, []byte(clients[i].message)); err != nil {
+				t.Errorf("failed to send: %v", err)
+				return
+			}
+			_, data, err := c.ReadMessage()
+			if err != nil {
+				t.Errorf("failed to read: %v", err)
+			}
+			clients[i].id = string(data)
+		}()
+	}
+	wg.Wait()
+	if clients[0].id == clients[1].id {
+		t.Fatalf("both connections have ID %s", clients[0].id)
+	}
+
+	// every line of a connection carries its ID, and the request ID it came with
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(capture.String(), "connection closed") < 2 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, client := range clients {
+		var lines []string
+		for _, line := range strings.Split(capture.String(), "\n") {
+			if strings.Contains(line, " conn="+client.id+" ") {
+				lines = append(lines, line)
+			}
+		}
+		var message, closed bool
+		for _, line := range lines {
+			message = message || strings.Contains(line, client.message)
+			closed = closed || strings.Contains(line, "connection closed")
+			if client.requestID != "" && !strings.Contains(line, "request_id="+client.requestID) {
+				t.Errorf("line without request ID %s: %s", client.requestID, line)
+			}
+			if client.requestID == "" && strings.Contains(line, "request_id=") {
+				t.Errorf("line with a request ID: %s", line)
+			}
+		}
+		if !message || !closed {
+			t.Errorf("connection %s: expected its message and close logged, got %q", client.id, lines)
+		}
+		for _, other := range clients {
+			if other.message != client.message && strings.Contains(strings.Join(lines, "\n"), other.message) {
+				t.Errorf("connection %s: the message of another connection is attributed to it", client.id)
+			}
+		}
 	}
 }
@@ -0,0 +1,111 @@
+package main
+
+import "io"
+
+// SinkFactory creates the writer a big message goes to, see SetMessageSink.
+// estimatedSize is the size of a message that arrived in a single frame
+// that isn't compressed, -1 when it isn't known yet.
+type SinkFactory func(messageType int, estimatedSize int64) (io.WriteCloser, error)
+
+// SinkHandler is called with every message that went to a sink, once it
+// was written completely and the sink was closed
+type SinkHandler func(c *Conn, messageType int, sink io.WriteCloser) error
+
+// SetMessageSink makes data messages bigger than threshold bytes go to a
+// writer that factory creates instead of memory, as their fragments arrive.
+// A Handler serving c gets them through handler instead, reading a
+// message yourself takes ReadMessageSink. The read limit still applies,
+// an upload endpoint will want to raise it with SetReadLimit. A sink that
+// fails closes the connection with 1011. A nil factory turns sinking off.
+// It must not be changed while another goroutine is reading.
+func (c *Conn) SetMessageSink(threshold int64, factory SinkFactory, handler SinkHandler) {
+	c.sinkThreshold = threshold
+	c.sinkFactory = factory
+	c.sinkHandler = handler
+}
+
+// ReadMessageSink is ReadMessage on a connection with a message sink: a
+// message bigger than the threshold is returned as the closed sink it was
+// written to, with a nil data. Without a sink it's ReadMessage.
+func (c *Conn) ReadMessageSink() (messageType int, data []byte, sink io.WriteCloser, err error) {
+	if c.sinkFactory == nil {
+		messageType, data, err = c.ReadMessage()
+		return messageType, data, nil, err
+	}
+	for {
+		messageType, r, err := c.NextReader()
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		data, sink, err := c.readOrSink(messageType, r.(*messageReader))
+		if err == nil {
+			return messageType, data, sink, nil
+		}
+		if _, ok := err.(*sinkError); ok {
+			return 0, nil, nil, c.fail(&CloseError{Code: CloseInternalServerErr, Text: "message sink failed"})
+		}
+		// A message failing half way started the closing handshake,
+		// NextReader waits for it to finish
+	}
+}
+
+// readOrSink reassembles the message mr delivers in memory, or writes it to
+// a sink once it grew past the threshold. The reassembly buffer carries the
+// payload on to the sink.
+func (c *Conn) readOrSink(messageType int, mr *messageReader) ([]byte, io.WriteCloser, error) {
+	buf, eof, err := c.fill(mr, int(c.sinkThreshold)+1)
+	defer c.keepReassembly(buf)
+	if err != nil {
+		return nil, nil, err
+	}
+	if eof {
+		data := make([]byte, len(buf))
+		copy(data, buf)
+		return data, nil, nil
+	}
+	estimate := int64(-1)
+	if _, ok := mr.src.(frameSource); ok && mr.fin {
+		estimate = int64(len(buf) + len(mr.payload))
+	}
+	sink, err := c.sinkFactory(messageType, estimate)
+	if err != nil {
+		return nil, nil, c.sinkFailed(err)
+	}
+	for {
+		if _, err := sink.Write(buf); err != nil {
+			_ = sink.Close()
+			return nil, nil, c.sinkFailed(err)
+		}
+		if eof {
+			break
+		}
+		var n int
+		n, err = mr.Read(buf[:cap(buf)])
+		buf = buf[:n]
+		if err == io.EOF {
+			eof = true
+		} else if err != nil {
+			_ = sink.Close()
+			return nil, nil, err
+		}
+	}
+	if err := sink.Close(); err != nil {
+		return nil, nil, c.sinkFailed(err)
+	}
+	return nil, sink, nil
+}
+
+// sinkError is a failure of a message sink
+type sinkError struct {
+	err error
+}
+
+func (e *sinkError) Error() string { return "websocket: message sink: " + e.err.Error() }
+
+func (e *sinkError) Unwrap() error { return e.err }
+
+// sinkFailed logs why a message sink failed
+func (c *Conn) sinkFailed(err error) error {
+	c.logger.Error("message sink failed", "err", err)
+	return &sinkError{err}
+}
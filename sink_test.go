@@ -0,0 +1,148 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"os"
+	"runtime"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type sinkResult struct {
+	messageType int
+	data        []byte
+	sink        io.WriteCloser
+}
+
+func TestMessageSink(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, _ := pipeConn(t, cfg)
+	c.SetReadLimit(0)
+
+	const fragments, fragmentSize = 64, 1 << 20
+	estimates := make(chan int64, 1)
+	results := make(chan sinkResult, 3)
+	c.SetMessageSink(fragmentSize, func(messageType int, estimatedSize int64) (io.WriteCloser, error) {
+		estimates <- estimatedSize
+		return os.CreateTemp(t.TempDir(), "upload")
+	}, func(c *Conn, messageType int, sink io.WriteCloser) error {
+		results <- sinkResult{messageType: messageType, sink: sink}
+		return nil
+	})
+	go Handler(func(c *Conn, messageType int, data []byte) error {
+		results <- sinkResult{messageType: messageType, data: data}
+		return nil
+	}).serve(c)
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	var peak atomic.Uint64
+	stop := make(chan struct{})
+	sampled := make(chan struct{})
+	go func() {
+		defer close(sampled)
+		for {
+			var m runtime.MemStats
+			runtime.ReadMemStats(&m)
+			if m.HeapAlloc > peak.Load() {
+				peak.Store(m.HeapAlloc)
+			}
+			select {
+			case <-stop:
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	}()
+
+	// a small message stays in memory, 64MB in fragments of 1MB go to a file
+	hash := sha256.New()
+	go func() {
+		client.Write(clientFrame(opText, []byte("small"), true))
+		payload := make([]byte, fragmentSize)
+		opcode := byte(opBin)
+		for i := range fragments {
+			for j := range payload {
+				payload[j] = byte(i + j)
+			}
+			hash.Write(payload)
+			client.Write(clientFrame(opcode, payload, i == fragments-1))
+			opcode = opCont
+		}
+	}()
+
+	if r := <-results; r.sink != nil || string(r.data) != "small" {
+		t.Fatalf("expected the small message in memory, got %q and sink %v", r.data, r.sink)
+	}
+	r := <-results
+	close(stop)
+	<-sampled
+	file, ok := r.sink.(*os.File)
+	if !ok || r.data != nil || r.messageType != BinaryMessage {
+		t.Fatalf("expected the big message in a file, got %d bytes of type %d and sink %T", len(r.data), r.messageType, r.sink)
+	}
+	if estimate := <-estimates; estimate != -1 {
+		t.Fatalf("a fragmented message was estimated at %d bytes", estimate)
+	}
+	content, err := os.ReadFile(file.Name())
+	if err != nil || len(content) != fragments*fragmentSize {
+		t.Fatalf("the sink holds %d bytes, %v", len(content), err)
+	}
+	if sum := sha256.Sum256(content); !bytes.Equal(sum[:], hash.Sum(nil)) {
+		t.Fatalf("the sink doesn't hold the message that was sent")
+	}
+	if grown := peak.Load() - min(peak.Load(), before.HeapAlloc); grown > fragments*fragmentSize/4 {
+		t.Fatalf("the heap grew by %d bytes while a message of %d bytes went to a sink", grown, fragments*fragmentSize)
+	}
+}
+
+// failingSink fails once more than left bytes were written to it
+type failingSink struct {
+	left int
+}
+
+func (s *failingSink) Write(p []byte) (int, error) {
+	if s.left -= len(p); s.left < 0 {
+		return 0, errors.New("disk full")
+	}
+	return len(p), nil
+}
+
+func (s *failingSink) Close() error { return nil }
+
+func TestMessageSinkFails(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, client, reader := pipeConn(t, cfg)
+	c.SetMessageSink(1000, func(messageType int, estimatedSize int64) (io.WriteCloser, error) {
+		if estimatedSize != 100_000 {
+			t.Errorf("a single frame of 100000 bytes was estimated at %d", estimatedSize)
+		}
+		return &failingSink{left: 50_000}, nil
+	}, func(c *Conn, messageType int, sink io.WriteCloser) error {
+		t.Errorf("a failed sink was handed to the handler")
+		return nil
+	})
+	served := make(chan error, 1)
+	go func() {
+		served <- Handler(func(c *Conn, messageType int, data []byte) error { return nil }).serve(c)
+	}()
+	go client.Write(clientFrame(opBin, make([]byte, 100_000), true))
+
+	reply := readFrameFrom(t, reader)
+	if code, _, _ := parseClosePayload(reply.Payload); reply.Opcode != opClose || code != CloseInternalServerErr {
+		t.Fatalf("expected CLOSE 1011, got opcode %d code %d", reply.Opcode, code)
+	}
+	payload, _ := formatClosePayload(CloseInternalServerErr, "")
+	client.Write(clientFrame(opClose, payload, true))
+	var ce *CloseError
+	if err := <-served; !errors.As(err, &ce) || ce.Code != CloseInternalServerErr {
+		t.Fatalf("expected the connection to end with 1011, got %v", err)
+	}
+}
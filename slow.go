@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// SlowPolicy decides what happens to a connection whose peer stopped
+// reading, see Config.SlowClientTimeout
+type SlowPolicy int
+
+const (
+	// SlowBlock only logs, writes keep waiting for the peer
+	SlowBlock SlowPolicy = iota
+	// SlowDrop drops data messages while the peer is slow: WriteMessage and
+	// WritePreparedMessage return ErrSlowConsumer, Send drops the message and
+	// counts it in SendDropped. Control frames still go out.
+	SlowDrop
+	// SlowClose closes the connection with 1008
+	SlowClose
+)
+
+// ErrSlowConsumer is returned by the writes SlowDrop dropped, the
+// connection stays usable
+var ErrSlowConsumer = errors.New("websocket: peer is not reading, message dropped")
+
+// slowCloseWait is how long SlowClose tries to get its CLOSE frame out
+// before dropping the connection
+const slowCloseWait = 100 * time.Millisecond
+
+// markWrite and unmarkWrite bracket a write to the socket, so the watchdog
+// sees how long it has been stuck
+func (c *Conn) markWrite() {
+	if c.cfg.SlowClientTimeout > 0 {
+		c.writingSince.Store(time.Now().UnixNano())
+	}
+}
+
+func (c *Conn) unmarkWrite() {
+	if c.cfg.SlowClientTimeout > 0 {
+		c.writingSince.Store(0)
+	}
+}
+
+// dropSlow reports whether a data message is dropped instead of written
+func (c *Conn) dropSlow() bool {
+	return c.cfg.SlowClientPolicy == SlowDrop && c.slow.Load()
+}
+
+// watchSlow checks every quarter of Config.SlowClientTimeout whether a
+// write has been stuck, or the send queue above its high-water mark, for
+// that long
+func (c *Conn) watchSlow() {
+	timeout := c.cfg.SlowClientTimeout
+	highWater := c.cfg.SlowClientHighWater
+	if highWater == 0 {
+		size := c.cfg.SendQueueSize
+		if size == 0 {
+			size = defaultSendQueueSize
+		}
+		highWater = size / 2
+	}
+	ticker := time.NewTicker(timeout / 4)
+	defer ticker.Stop()
+	var queued time.Time // when the send queue went above highWater
+	for {
+		select {
+		case now := <-ticker.C:
+			slow := false
+			if since := c.writingSince.Load(); since != 0 && now.Sub(time.Unix(0, since)) >= timeout {
+				slow = true
+			}
+			switch {
+			case c.SendQueueLen() <= highWater:
+				queued = time.Time{}
+			case queued.IsZero():
+				queued = now
+			case now.Sub(queued) >= timeout:
+				slow = true
+			}
+			c.setSlow(slow)
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// setSlow applies Config.SlowClientPolicy when the peer became slow
+func (c *Conn) setSlow(slow bool) {
+	if c.slow.Swap(slow) == slow {
+		return
+	}
+	if !slow {
+		c.logger.Info("slow consumer: peer is reading again")
+		return
+	}
+	c.logger.Warn("slow consumer: peer stopped reading", "timeout", c.cfg.SlowClientTimeout)
+	if c.cfg.SlowClientPolicy == SlowClose {
+		c.closeSlow()
+	}
+}
+
+// closeSlow sends a CLOSE 1008 when the writer is free soon enough, gives up
+// on the write that is stuck and drops the connection. The reader ends with
+// the 1008.
+func (c *Conn) closeSlow() {
+	ce := &CloseError{Code: ClosePolicyViolation, Text: "slow consumer"}
+	c.slowClose.Store(ce)
+	payload, _ := formatClosePayload(ce.Code, ce.Text)
+	_ = c.WriteControl(CloseMessage, payload, time.Now().Add(slowCloseWait))
+	_ = c.conn.SetWriteDeadline(time.Now())
+	c.CloseNow()
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+// stallWrite starts a write the peer of a pipe never reads, it reports its
+// result on the channel
+func stallWrite(c *Conn) <-chan error {
+	written := make(chan error, 1)
+	go func() { written <- c.WriteMessage(BinaryMessage, make([]byte, 1000)) }()
+	return written
+}
+
+// waitSlow waits for the watchdog to see the peer as slow
+func waitSlow(t *testing.T, c *Conn) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for !c.slow.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the peer wasn't seen as slow")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestSlowClientBlock(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.SlowClientTimeout = 50 * time.Millisecond
+	c, _, reader := pipeConn(t, cfg)
+
+	written := stallWrite(c)
+	waitSlow(t, c)
+	select {
+	case err := <-written:
+		t.Fatalf("the write didn't keep waiting for the peer: %v", err)
+	case <-time.After(2 * cfg.SlowClientTimeout):
+	}
+
+	// reading again lets the write finish and the peer is no longer slow
+	if f := readFrameFrom(t, reader); f.Opcode != opBin || len(f.Payload) != 1000 {
+		t.Fatalf("expected the message, got opcode %d with %d bytes", f.Opcode, len(f.Payload))
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for c.slow.Load() {
+		if time.Now().After(deadline) {
+			t.Fatalf("the peer is still seen as slow")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	go c.WriteMessage(TextMessage, []byte("hello"))
+	if f := readFrameFrom(t, reader); string(f.Payload) != "hello" {
+		t.Fatalf("expected hello, got %q", f.Payload)
+	}
+}
+
+func TestSlowClientDrop(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.SlowClientTimeout = 50 * time.Millisecond
+	cfg.SlowClientPolicy = SlowDrop
+	c, _, reader := pipeConn(t, cfg)
+
+	written := stallWrite(c)
+	waitSlow(t, c)
+	start := time.Now()
+	if err := c.WriteMessage(TextMessage, []byte("dropped")); !errors.Is(err, ErrSlowConsumer) {
+		t.Fatalf("expected ErrSlowConsumer, got %v", err)
+	}
+	for range 3 {
+		if err := c.Send(TextMessage, []byte("dropped")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	if time.Since(start) > cfg.SlowClientTimeout {
+		t.Fatalf("dropping took %v", time.Since(start))
+	}
+	if n := c.SendDropped(); n != 3 {
+		t.Fatalf("expected 3 messages dropped, got %d", n)
+	}
+
+	// the stuck message still goes out, then nothing that was dropped
+	if f := readFrameFrom(t, reader); len(f.Payload) != 1000 {
+		t.Fatalf("expected the stuck message, got %d bytes", len(f.Payload))
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("failed to write: %v", err)
+	}
+	go c.WriteControl(PingMessage, []byte("ping"), time.Time{})
+	if f := readFrameFrom(t, reader); f.Opcode != opPing {
+		t.Fatalf("expected the ping after the dropped messages, got opcode %d %q", f.Opcode, f.Payload)
+	}
+}
+
+func TestSlowClientClose(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.SlowClientTimeout = 50 * time.Millisecond
+	cfg.SlowClientPolicy = SlowClose
+	c, client, _ := pipeConn(t, cfg)
+
+	written := stallWrite(c)
+	select {
+	case err := <-written:
+		if err == nil {
+			t.Fatalf("the write to a peer that doesn't read succeeded")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the stuck write wasn't given up")
+	}
+	var ce *CloseError
+	if _, _, err := c.ReadMessage(); !errors.As(err, &ce) || ce.Code != ClosePolicyViolation || ce.Text != "slow consumer" {
+		t.Fatalf("expected 1008 slow consumer, got %v", err)
+	}
+	if _, err := io.ReadAll(client); err != nil {
+		t.Fatalf("expected the pipe to be closed, got %v", err)
+	}
+}
+
+func TestSlowClientSendQueue(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.SlowClientTimeout = 50 * time.Millisecond
+	cfg.SlowClientPolicy = SlowClose
+	cfg.SendQueueSize = 8
+	cfg.SendOverflow = OverflowDropNewest
+	c, _, _ := pipeConn(t, cfg)
+
+	read := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadMessage()
+		read <- err
+	}()
+	for range 16 {
+		if err := c.Send(TextMessage, []byte("queued")); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	select {
+	case err := <-read:
+		var ce *CloseError
+		if !errors.As(err, &ce) || ce.Code != ClosePolicyViolation {
+			t.Fatalf("expected 1008, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("the connection with a full send queue wasn't closed")
+	}
+}
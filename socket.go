@@ -0,0 +1,70 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+// SocketOptions tune the TCP connection under a WebSocket. A server applies
+// them right after taking over the connection, a Dialer right after
+// connecting, before TLS. Wrappers such as *tls.Conn are looked through,
+// connections that aren't TCP, e.g. unix sockets, are left alone.
+type SocketOptions struct {
+	// DisableNoDelay lets the kernel collect small writes (Nagle's
+	// algorithm), by default TCP_NODELAY is set
+	DisableNoDelay bool
+
+	// ReadBuffer and WriteBuffer set SO_RCVBUF and SO_SNDBUF, zero keeps the
+	// system's sizes
+	ReadBuffer  int
+	WriteBuffer int
+
+	// Control is called with the socket's file descriptor for anything
+	// platform specific, an error fails the connection
+	Control func(fd uintptr) error
+}
+
+// apply sets the options on conn when it's TCP underneath
+func (opts SocketOptions) apply(conn net.Conn) error {
+	// e.g. *tls.Conn
+	for {
+		wrapper, ok := conn.(interface{ NetConn() net.Conn })
+		if !ok {
+			break
+		}
+		conn = wrapper.NetConn()
+	}
+	tcp, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	var errs []error
+	if err := tcp.SetNoDelay(!opts.DisableNoDelay); err != nil {
+		errs = append(errs, err)
+	}
+	if opts.ReadBuffer > 0 {
+		if err := tcp.SetReadBuffer(opts.ReadBuffer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.WriteBuffer > 0 {
+		if err := tcp.SetWriteBuffer(opts.WriteBuffer); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if opts.Control != nil {
+		rc, err := tcp.SyscallConn()
+		if err == nil {
+			cerr := rc.Control(func(fd uintptr) { err = opts.Control(fd) })
+			err = errors.Join(cerr, err)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("websocket: socket options: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSocketOptions(t *testing.T) {
+	var serverFD, clientFD atomic.Uintptr
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	cfg.Socket = SocketOptions{ReadBuffer: 64 << 10, WriteBuffer: 64 << 10, Control: func(fd uintptr) error {
+		serverFD.Store(fd + 1) // fd 0 is valid
+		return nil
+	}}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	d := Dialer{Config: DefaultConfig()}
+	d.Config.PingInterval = 0
+	d.Config.Socket = SocketOptions{DisableNoDelay: true, Control: func(fd uintptr) error {
+		clientFD.Store(fd + 1)
+		return nil
+	}}
+	c, _, err := d.Dial("ws://"+addr+"/", nil)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer c.CloseNow()
+	if err := c.WriteMessage(TextMessage, []byte("hello")); err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+	if _, data, err := c.ReadMessage(); err != nil || string(data) != "hello" {
+		t.Fatalf("expected the echo, got %q %v", data, err)
+	}
+	if serverFD.Load() == 0 || clientFD.Load() == 0 {
+		t.Fatalf("expected Control to see the sockets, server: %t client: %t", serverFD.Load() != 0, clientFD.Load() != 0)
+	}
+
+	// a failing option fails the connection
+	d.Config.Socket.Control = func(fd uintptr) error { return errors.New("not today") }
+	if _, _, err := d.Dial("ws://"+addr+"/", nil); err == nil || !strings.Contains(err.Error(), "not today") {
+		t.Fatalf("expected the Control error, got %v", err)
+	}
+}
+
+func TestSocketOptionsLookThroughTLS(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	called := false
+	opts := SocketOptions{Control: func(fd uintptr) error {
+		called = true
+		return nil
+	}}
+	if err := opts.apply(tls.Client(conn, &tls.Config{})); err != nil || !called {
+		t.Fatalf("expected the TCP connection under TLS to be tuned, called: %t err: %v", called, err)
+	}
+}
+
+func TestSocketOptionsSkipOtherTransports(t *testing.T) {
+	opts := SocketOptions{ReadBuffer: 4096, Control: func(fd uintptr) error {
+		t.Errorf("Control was called for a connection that isn't TCP")
+		return nil
+	}}
+	client, srv := net.Pipe()
+	defer client.Close()
+	defer srv.Close()
+	if err := opts.apply(client); err != nil {
+		t.Fatalf("pipe: %v", err)
+	}
+	if err := opts.apply(tls.Client(client, &tls.Config{})); err != nil {
+		t.Fatalf("TLS over a pipe: %v", err)
+	}
+
+	ln, err := net.Listen("unix", filepath.Join(t.TempDir(), "ws.sock"))
+	if err != nil {
+		t.Skipf("no unix sockets: %v", err)
+	}
+	defer ln.Close()
+	conn, err := net.Dial("unix", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if err := opts.apply(conn); err != nil {
+		t.Fatalf("unix socket: %v", err)
+	}
+}
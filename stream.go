@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"gows/wire"
+)
+
+// streamChunkSize is how much of a reader WriteReader copies at a time, and
+// its fragment size when Config.FragmentSize is zero
+const streamChunkSize = 32 << 10
+
+// errShortReader is returned by WriteReader when the reader ends before size bytes
+var errShortReader = errors.New("websocket: reader ended before the message size")
+
+// WriteReader sends what r delivers as a TextMessage or BinaryMessage without
+// holding it in memory. With a size of -1 the message goes out in fragments
+// of Config.FragmentSize as r delivers it, the last one with FIN once r
+// returns io.EOF. With a known size the size bytes of r go out as a single
+// frame, header first, unless they exceed Config.WriteFragmentSize or the
+// message is compressed, then it is fragmented as well.
+//
+// An error of r before any of the message was written is returned and the
+// connection goes on. Once part of it is on the wire it can't be taken back:
+// a later error of r, or r ending before size bytes, fails the connection,
+// which is dropped without a closing handshake. While a single frame is
+// copied no control frame can go out, a slow r holds up pings and Close.
+func (c *Conn) WriteReader(messageType int, r io.Reader, size int64) error {
+	if !IsData(messageType) {
+		return fmt.Errorf("websocket: invalid message type %d", messageType)
+	}
+	if size < -1 {
+		return fmt.Errorf("websocket: invalid message size %d", size)
+	}
+	c.messageMu.Lock()
+	defer c.messageMu.Unlock()
+	opcode := opcodeOf(messageType)
+	if size >= 0 {
+		r = &sizedReader{r: r, left: size}
+		if limit := c.cfg.WriteFragmentSize; !c.compressing() && (limit == 0 || size <= int64(limit)) {
+			return c.sentMessage(opcode, c.writeFrameFrom(opcode, r, size))
+		}
+	}
+	return c.sentMessage(opcode, c.writeFragmentsFrom(opcode, r))
+}
+
+// writeFrameFrom copies the size bytes of r into a single frame while the
+// caller holds messageMu
+func (c *Conn) writeFrameFrom(opcode byte, r io.Reader, size int64) error {
+	buf := make([]byte, min(size, streamChunkSize))
+	// the first chunk is read before the header goes out, an error of r
+	// then leaves the connection as it was
+	n, err := io.ReadFull(r, buf)
+	if err != nil {
+		return err
+	}
+	h := wire.Header{Fin: true, Opcode: opcode, Length: uint64(size), Masked: c.info.client}
+	if h.Masked {
+		if _, err := rand.Read(h.MaskKey[:]); err != nil {
+			return err
+		}
+	}
+	frameData, err := wire.AppendHeader(make([]byte, 0, wire.MaxHeaderSize+n), h)
+	if err != nil {
+		return err
+	}
+	frameData = append(frameData, buf[:n]...)
+	if h.Masked {
+		wire.MaskBytes(h.MaskKey, 0, frameData[len(frameData)-n:])
+	}
+
+	_ = c.lockWrite(time.Time{})
+	defer c.unlockWrite()
+	c.extendWriteDeadline()
+	if err := c.writeLocked(frameData); err != nil {
+		return err
+	}
+	for sent := int64(n); sent < size; sent += int64(n) {
+		if n, err = io.ReadFull(r, buf[:min(size-sent, int64(len(buf)))]); err != nil {
+			return c.streamFailed(err)
+		}
+		if h.Masked {
+			wire.MaskBytes(h.MaskKey, int(sent%4), buf[:n])
+		}
+		c.extendWriteDeadline()
+		if err := c.writeBytesLocked(buf[:n]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeFragmentsFrom sends what r delivers as fragments while the caller
+// holds messageMu
+func (c *Conn) writeFragmentsFrom(opcode byte, r io.Reader) error {
+	size := c.cfg.FragmentSize
+	if size <= 0 {
+		size = streamChunkSize
+	}
+	w := c.newMessageWriter(opcode, size)
+	buf := make([]byte, size)
+	started := false
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			// what r delivered last goes out with FIN
+			if !w.compressed {
+				w.buf = buf[:n]
+			} else if _, err := w.Write(buf[:n]); err != nil {
+				return err
+			}
+			return w.finish()
+		}
+		if err != nil {
+			// the compressor may hold part of the message even when no
+			// fragment went out yet
+			if started {
+				return c.streamFailed(err)
+			}
+			return err
+		}
+		started = true
+		if _, err := w.Write(buf); err != nil {
+			return err
+		}
+	}
+}
+
+// streamFailed drops the connection after the reader of WriteReader failed
+// in the middle of a message, which can neither be finished nor taken back
+func (c *Conn) streamFailed(err error) error {
+	c.writeFailed.Store(true)
+	c.logger.Error("message reader failed half way", "err", err)
+	c.CloseNow()
+	return err
+}
+
+// sizedReader delivers the first left bytes of r and reports r ending early
+type sizedReader struct {
+	r    io.Reader
+	left int64
+}
+
+func (s *sizedReader) Read(p []byte) (int, error) {
+	if s.left == 0 {
+		return 0, io.EOF
+	}
+	n, err := s.r.Read(p[:min(int64(len(p)), s.left)])
+	s.left -= int64(n)
+	if err == io.EOF && s.left > 0 {
+		err = errShortReader
+	}
+	return n, err
+}
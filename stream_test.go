@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"runtime"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// randomStream is size bytes of the same pseudo-random data for every call
+func randomStream(size int64) io.Reader {
+	return io.LimitReader(rand.NewChaCha8([32]byte{42}), size)
+}
+
+func TestWriteReaderSingleFrame(t *testing.T) {
+	const size = 100 << 20
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, reader := pipeConn(t, cfg)
+
+	// the client hashes the payload as it arrives, never holding the frame
+	sum := make(chan []byte, 1)
+	go func() {
+		defer close(sum)
+		var header [10]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			return
+		}
+		if header[0] != 0x80|opBin || header[1] != 127 || binary.BigEndian.Uint64(header[2:]) != size {
+			t.Errorf("unexpected frame header % x", header)
+			return
+		}
+		h := sha256.New()
+		if _, err := io.CopyN(h, reader, size); err != nil {
+			t.Errorf("reading the payload: %v", err)
+			return
+		}
+		sum <- h.Sum(nil)
+	}()
+
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	if err := c.WriteReader(BinaryMessage, randomStream(size), size); err != nil {
+		t.Fatalf("WriteReader: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 4<<20 {
+		t.Fatalf("streaming a 100MB message allocated %d bytes", allocated)
+	}
+
+	want := sha256.New()
+	io.Copy(want, randomStream(size))
+	if got := <-sum; !bytes.Equal(got, want.Sum(nil)) {
+		t.Fatal("the client received a different payload")
+	}
+}
+
+func TestWriteReaderFragments(t *testing.T) {
+	const size = 1 << 20
+	want, _ := io.ReadAll(randomStream(size))
+	tests := []struct {
+		name    string
+		size    int64
+		deflate *deflateParams
+	}{
+		{"unknown size", -1, nil},
+		{"unknown size compressed", -1, &deflateParams{}},
+		{"over WriteFragmentSize", size, nil},
+		{"known size compressed", size, &deflateParams{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			cfg.FragmentSize = 64 << 10
+			cfg.WriteFragmentSize = 64 << 10
+			server, client := connPair(t, cfg, tt.deflate)
+			errs := make(chan error, 1)
+			go func() { errs <- server.WriteReader(BinaryMessage, randomStream(size), tt.size) }()
+
+			messageType, data, err := client.ReadMessage()
+			if err != nil || messageType != BinaryMessage || !bytes.Equal(data, want) {
+				t.Fatalf("client read type %d, %d bytes, %v", messageType, len(data), err)
+			}
+			if err := <-errs; err != nil {
+				t.Fatalf("WriteReader: %v", err)
+			}
+		})
+	}
+}
+
+func TestWriteReaderEmpty(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, rec := servePipe(t, cfg, Handler(func(c *Conn, messageType int, data []byte) error {
+		if err := c.WriteReader(messageType, strings.NewReader(""), 0); err != nil {
+			return err
+		}
+		return c.WriteReader(messageType, strings.NewReader(""), -1)
+	}))
+	if err := c.WriteMessage(TextMessage, []byte("go")); err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if messageType, data, err := c.ReadMessage(); err != nil || messageType != TextMessage || len(data) != 0 {
+			t.Fatalf("read type %d %q, %v", messageType, data, err)
+		}
+	}
+	rec.expectFrames(t, frame{Opcode: opText}, frame{Opcode: opText})
+}
+
+func TestWriteReaderFailsEarly(t *testing.T) {
+	errBroken := errors.New("export failed")
+	tests := []struct {
+		name string
+		r    io.Reader
+		size int64
+		err  error
+	}{
+		{"unknown size", iotest.ErrReader(errBroken), -1, errBroken},
+		{"known size", iotest.ErrReader(errBroken), 100, errBroken},
+		{"short reader", strings.NewReader(""), 100, errShortReader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := DefaultConfig()
+			cfg.PingInterval = 0
+			server, client := connPair(t, cfg, nil)
+			if err := server.WriteReader(TextMessage, tt.r, tt.size); !errors.Is(err, tt.err) {
+				t.Fatalf("expected %v, got %v", tt.err, err)
+			}
+			// nothing went out, the connection goes on
+			go server.WriteMessage(TextMessage, []byte("still here"))
+			if _, data, err := client.ReadMessage(); err != nil || string(data) != "still here" {
+				t.Fatalf("client read %q, %v", data, err)
+			}
+		})
+	}
+}
+
+func TestWriteReaderFailsHalfWay(t *testing.T) {
+	errBroken := errors.New("export failed")
+	for _, size := range []int64{-1, 1 << 20} {
+		cfg := DefaultConfig()
+		cfg.PingInterval = 0
+		server, client := connPair(t, cfg, nil)
+		clientErr := readInBackground(client)
+
+		r := io.MultiReader(randomStream(200<<10), iotest.ErrReader(errBroken))
+		if err := server.WriteReader(BinaryMessage, r, size); !errors.Is(err, errBroken) {
+			t.Fatalf("size %d: expected the reader's error, got %v", size, err)
+		}
+		// the peer sees the connection drop without a CLOSE
+		select {
+		case err := <-clientErr:
+			var ce *CloseError
+			if !errors.As(err, &ce) || ce.Code != CloseAbnormalClosure {
+				t.Fatalf("size %d: expected the connection to drop, got %v", size, err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("size %d: the connection is still up", size)
+		}
+		if err := server.WriteMessage(TextMessage, []byte("too late")); err == nil {
+			t.Fatalf("size %d: wrote to a failed connection", size)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testCA issues the certificates the TLS tests run with
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	pool   *x509.CertPool
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("failed to parse CA certificate: %v", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool, serial: 1}
+}
+
+// issue creates a leaf certificate for name, valid for 127.0.0.1 as well
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	ca.serial++
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(ca.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name + ".internal"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	revoked := ca.issue(t, "revoked", x509.ExtKeyUsageClientAuth)
+	revokedCert, _ := x509.ParseCertificate(revoked.Certificate[0])
+
+	cfg := DefaultConfig()
+	cfg.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{ca.issue(t, "server", x509.ExtKeyUsageServerAuth)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    ca.pool,
+	}
+	cfg.VerifyClientCert = func(cert *x509.Certificate) error {
+		if cert.SerialNumber.Cmp(revokedCert.SerialNumber) == 0 {
+			return errors.New("revoked")
+		}
+		return nil
+	}
+	certs := make(chan *x509.Certificate, 1)
+	cfg.onUpgrade = func(info connInfo) { certs <- info.clientCert }
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	dial := func(t *testing.T, clientCert *tls.Certificate) *tls.Conn {
+		t.Helper()
+		tlsCfg := &tls.Config{RootCAs: ca.pool}
+		if clientCert != nil {
+			tlsCfg.Certificates = []tls.Certificate{*clientCert}
+		}
+		conn, err := tls.Dial("tcp", addr, tlsCfg)
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conn.SetDeadline(time.Now().Add(2 * time.Second))
+		return conn
+	}
+
+	t.Run("valid client certificate", func(t *testing.T) {
+		client := ca.issue(t, "robot-7", x509.ExtKeyUsageClientAuth)
+		conn := dial(t, &client)
+		reader, resp := handshakeOn(t, conn, addr, "/", nil)
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			t.Fatalf("unexpected status: %s", resp.Status)
+		}
+		select {
+		case cert := <-certs:
+			if cert == nil || cert.Subject.CommonName != "robot-7" || len(cert.DNSNames) != 1 || cert.DNSNames[0] != "robot-7.internal" {
+				t.Fatalf("expected the client identity on the connection, got %v", cert)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("connection was never upgraded")
+		}
+
+		if _, err := conn.Write(clientFrame(opText, []byte("hello"), true)); err != nil {
+			t.Fatalf("failed to send frame: %v", err)
+		}
+		if f := readFrameFrom(t, reader); string(f.Payload) != "hello" {
+			t.Fatalf("unexpected echo %q", f.Payload)
+		}
+	})
+
+	t.Run("revoked client certificate", func(t *testing.T) {
+		_, resp := handshakeOn(t, dial(t, &revoked), addr, "/", nil)
+		if resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("expected 403, got %s", resp.Status)
+		}
+	})
+
+	// Under TLS 1.3 the client finishes its handshake first and learns
+	// about the rejection when it reads
+	refused := func(t *testing.T, clientCert *tls.Certificate) {
+		t.Helper()
+		conn := dial(t, clientCert)
+		if _, err := io.WriteString(conn, "GET / HTTP/1.1\r\nHost: "+addr+"\r\n\r\n"); err != nil {
+			return
+		}
+		if _, err := conn.Read(make([]byte, 1)); err == nil {
+			t.Fatalf("expected the TLS layer to refuse the connection")
+		}
+	}
+	t.Run("no client certificate", func(t *testing.T) {
+		refused(t, nil)
+	})
+	t.Run("certificate from another CA", func(t *testing.T) {
+		other := newTestCA(t).issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+		refused(t, &other)
+	})
+}
+
+// echoOver runs the echo assertions over an already dialed connection
+func echoOver(t *testing.T, conn net.Conn, addr string) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	reader, resp := handshakeOn(t, conn, addr, "/", nil)
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("unexpected status: %s", resp.Status)
+	}
+	for _, msg := range []string{"Hello, Server!", strings.Repeat("x", 70000)} {
+		if _, err := conn.Write(clientFrame(opText, []byte(msg), true)); err != nil {
+			t.Fatalf("failed to send frame: %v", err)
+		}
+		if f := readFrameFrom(t, reader); f.Opcode != opText || string(f.Payload) != msg {
+			t.Fatalf("unexpected echo: opcode=%d, %d bytes", f.Opcode, len(f.Payload))
+		}
+	}
+}
+
+func dialInsecureTLS(t *testing.T, addr string) net.Conn {
+	t.Helper()
+	conn, err := tls.Dial("tcp", addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestWSSEcho(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{newTestCA(t).issue(t, "server", x509.ExtKeyUsageServerAuth)}}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	echoOver(t, dialInsecureTLS(t, addr), addr)
+}
+
+func TestConnAddresses(t *testing.T) {
+	type addrs struct {
+		remote, local net.Addr
+		client        string
+		underlying    net.Conn
+	}
+	for _, secure := range []bool{false, true} {
+		name := "ws"
+		if secure {
+			name = "wss"
+		}
+		t.Run(name, func(t *testing.T) {
+			seen := make(chan addrs, 1)
+			cfg := DefaultConfig()
+			if secure {
+				cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{newTestCA(t).issue(t, "server", x509.ExtKeyUsageServerAuth)}}
+			}
+			// The proxy in front of the server tells who the client is
+			cfg.ClientIP = func(r *http.Request) string { return r.Header.Get("X-Forwarded-For") }
+			cfg.OnConnect = func(c *Conn) error {
+				seen <- addrs{c.RemoteAddr(), c.LocalAddr(), c.ClientAddr(), c.UnderlyingConn()}
+				return nil
+			}
+			server, addr, err := startServer("127.0.0.1:0", cfg)
+			if err != nil {
+				t.Fatalf("failed to start server: %v", err)
+			}
+			defer server.Close()
+
+			var conn net.Conn
+			if secure {
+				conn = dialInsecureTLS(t, addr)
+			} else {
+				if conn, err = net.Dial("tcp", addr); err != nil {
+					t.Fatalf("failed to dial: %v", err)
+				}
+				defer conn.Close()
+			}
+			if _, resp := handshakeOn(t, conn, addr, "/", http.Header{"X-Forwarded-For": {"203.0.113.7"}}); resp.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("unexpected status: %s", resp.Status)
+			}
+
+			got := <-seen
+			if got.remote.String() != conn.LocalAddr().String() || got.local.String() != conn.RemoteAddr().String() {
+				t.Fatalf("server saw %v -> %v, client is %v -> %v", got.remote, got.local, conn.LocalAddr(), conn.RemoteAddr())
+			}
+			// RemoteAddr stays the TCP peer, the forwarded address is separate
+			if got.client != "203.0.113.7" {
+				t.Fatalf("expected client address 203.0.113.7, got %q", got.client)
+			}
+			if _, isTLS := got.underlying.(*tls.Conn); isTLS != secure {
+				t.Fatalf("unexpected underlying connection %T", got.underlying)
+			}
+		})
+	}
+}
+
+func TestWSSCertFiles(t *testing.T) {
+	cert := newTestCA(t).issue(t, "server", x509.ExtKeyUsageServerAuth)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.CertFile, cfg.KeyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := os.WriteFile(cfg.CertFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600); err != nil {
+		t.Fatalf("failed to write certificate: %v", err)
+	}
+	if err := os.WriteFile(cfg.KeyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatalf("failed to write key: %v", err)
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	echoOver(t, dialInsecureTLS(t, addr), addr)
+
+	cfg.KeyFile = filepath.Join(dir, "missing.pem")
+	if _, _, err := startServer("127.0.0.1:0", cfg); err == nil {
+		t.Fatalf("expected a missing key file to fail")
+	}
+}
+
+func TestDualServer(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.TLSConfig = &tls.Config{Certificates: []tls.Certificate{newTestCA(t).issue(t, "server", x509.ExtKeyUsageServerAuth)}}
+	server, plainAddr, secureAddr, err := startDualServer("127.0.0.1:0", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	plain, err := net.Dial("tcp", plainAddr)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer plain.Close()
+	echoOver(t, plain, plainAddr)
+	echoOver(t, dialInsecureTLS(t, secureAddr), secureAddr)
+
+	if _, _, _, err := startDualServer("127.0.0.1:0", "127.0.0.1:0", DefaultConfig()); err == nil {
+		t.Fatalf("expected a dual server without certificates to fail")
+	}
+}
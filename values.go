@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+)
+
+// connValues is the application's per-connection state, see Conn.Set.
+// It is created before Authorize runs so the handshake can fill it too.
+type connValues struct {
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+func (v *connValues) set(key string, value interface{}) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.values == nil {
+		v.values = make(map[string]interface{})
+	}
+	v.values[key] = value
+}
+
+func (v *connValues) get(key string) (interface{}, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	value, ok := v.values[key]
+	return value, ok
+}
+
+// clear drops every value so they don't outlive the connection
+func (v *connValues) clear() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.values = nil
+}
+
+// valuesKey finds the connValues of a handshake in its request's context
+type valuesKey struct{}
+
+// withValues returns r with a context carrying v, for SetHandshakeValue
+func withValues(r *http.Request, v *connValues) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), valuesKey{}, v))
+}
+
+// Set stores value under key with the connection, e.g. the user ID found by
+// Authorize or the time it joined. It's safe for concurrent use. On
+// connections served by the server's handlers the values are dropped once
+// OnDisconnect returned.
+func (c *Conn) Set(key string, value interface{}) {
+	c.values.set(key, value)
+}
+
+// Get returns the value stored under key, ok is false when there is none
+func (c *Conn) Get(key string) (value interface{}, ok bool) {
+	return c.values.get(key)
+}
+
+// SetHandshakeValue stores value under key with the connection r is the
+// upgrade request of, Conn.Get finds it once the connection is up. It is
+// meant for Authorize, which runs before the Conn exists, and does nothing
+// for requests that aren't being upgraded.
+func SetHandshakeValue(r *http.Request, key string, value interface{}) {
+	if v, ok := r.Context().Value(valuesKey{}).(*connValues); ok {
+		v.set(key, value)
+	}
+}
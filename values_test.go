@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"testing"
+)
+
+func TestConnValuesConcurrent(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	c, _, _ := pipeConn(t, cfg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := fmt.Sprintf("key-%d", i)
+			for j := 0; j < 1000; j++ {
+				c.Set(key, j)
+				if v, ok := c.Get(key); !ok || v.(int) != j {
+					t.Errorf("%s: got %v %t, want %d", key, v, ok, j)
+					return
+				}
+				c.Get("key-0")
+			}
+		}()
+	}
+	wg.Wait()
+	if _, ok := c.Get("missing"); ok {
+		t.Fatal("found a value that was never set")
+	}
+}
+
+func TestConnValuesFromHandshake(t *testing.T) {
+	disconnected := make(chan interface{}, 1)
+	cfg := DefaultConfig()
+	cfg.Authorize = func(r *http.Request) (interface{}, int, error) {
+		SetHandshakeValue(r, "user", r.URL.Query().Get("user"))
+		return nil, 0, nil
+	}
+	cfg.OnConnect = func(c *Conn) error {
+		c.Set("greeting", "hello")
+		return nil
+	}
+	cfg.OnDisconnect = func(c *Conn, err error) {
+		user, _ := c.Get("user")
+		disconnected <- user
+	}
+	cfg.Handlers = map[string]Handler{
+		"/": func(c *Conn, messageType int, data []byte) error {
+			user, _ := c.Get("user")
+			greeting, _ := c.Get("greeting")
+			return c.WriteMessage(opText, []byte(fmt.Sprintf("%s %s", greeting, user)))
+		},
+	}
+	server, addr, err := startServer("127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatalf("failed to start server: %v", err)
+	}
+	defer server.Close()
+
+	conn, reader := dialWebSocket(t, addr, "/?user=ada")
+	defer conn.Close()
+	conn.Write(clientFrame(opText, []byte("who am I"), true))
+	if f := readFrameFrom(t, reader); string(f.Payload) != "hello ada" {
+		t.Fatalf("expected %q, got %q", "hello ada", f.Payload)
+	}
+
+	conn.Write(clientFrame(opClose, nil, true))
+	readFrameFrom(t, reader)
+	if user := <-disconnected; user != "ada" {
+		t.Fatalf("OnDisconnect saw user %v", user)
+	}
+}
+
+func TestSetHandshakeValueOutsideUpgrade(t *testing.T) {
+	r, _ := http.NewRequest(http.MethodGet, "/", nil)
+	SetHandshakeValue(r, "ignored", true) // must not panic
+}
@@ -0,0 +1,213 @@
+package wire
+
+import "errors"
+
+// ErrNeedMore is returned by Decoder.Next when no complete frame is buffered
+var ErrNeedMore = errors.New("wire: need more data")
+
+// maxInitialPayload caps what a Decoder allocates for a payload up front, a
+// bigger one grows as its bytes arrive so a peer can't make us reserve a
+// huge declared length it never sends
+const maxInitialPayload = 64 << 10
+
+// maxSpares is how many payloads given back with Reuse a Decoder keeps
+const maxSpares = 8
+
+// Decoder decodes a stream of frames pushed to it in pieces of any size.
+// Unlike ParseFrames it remembers how far it got in the current frame, every
+// byte is looked at once no matter how the stream is split. It applies the
+// same checks as ParseFrames. The zero value isn't usable, see NewDecoder.
+type Decoder struct {
+	opts ParseOptions
+
+	header    [MaxHeaderSize]byte
+	headerLen int    // bytes of header collected
+	h         Header // the current frame's header, once complete
+	inPayload bool   // the header is complete, its payload is being collected
+	payload   []byte
+
+	frames []Frame  // complete frames not returned by Next yet
+	head   int      // index of the next one in frames
+	spares [][]byte // payloads given back with Reuse, empty
+
+	offset  int // position in the stream of the current frame
+	pending int // bytes of the current frame consumed
+	err     *ParseError
+
+	scanned int // bytes examined, the tests check every byte is looked at once
+}
+
+// NewDecoder returns a Decoder applying opts to every frame
+func NewDecoder(opts ParseOptions) *Decoder {
+	return &Decoder{opts: opts}
+}
+
+// SetMaxFrameSize changes opts.MaxFrameSize, it applies from the next
+// header on
+func (d *Decoder) SetMaxFrameSize(n int64) {
+	d.opts.MaxFrameSize = n
+}
+
+// Write decodes p, the next bytes of the stream. Complete frames are queued
+// for Next. A frame that breaks the rules stops decoding: Write returns its
+// *ParseError, with an offset counted from the start of the stream, and
+// keeps returning it until Reset. The frames before it stay queued.
+func (d *Decoder) Write(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	n := 0
+	for n < len(p) {
+		if !d.inPayload {
+			// Take what the header needs: 2 bytes, then the rest it announces
+			want := 2
+			if d.headerLen >= 2 {
+				want = headerSize(d.header[1])
+			}
+			k := copy(d.header[d.headerLen:want], p[n:])
+			d.headerLen += k
+			d.scanned += k
+			n += k
+			d.pending += k
+			h, size, err := parseHeader(d.header[:d.headerLen], d.opts)
+			if err != nil {
+				err.Offset += d.offset
+				d.err = err
+				return n, err
+			}
+			if size == 0 {
+				continue
+			}
+			d.h = h
+			d.inPayload = true
+			d.payload = d.newPayload(h.Length)
+		}
+
+		k := min(uint64(len(p)-n), d.h.Length-uint64(len(d.payload)))
+		d.growPayload(int(k))
+		start := len(d.payload)
+		d.payload = append(d.payload, p[n:n+int(k)]...)
+		if d.h.Masked {
+			MaskBytes(d.h.MaskKey, start, d.payload[start:])
+		}
+		d.scanned += int(k)
+		n += int(k)
+		d.pending += int(k)
+		if uint64(len(d.payload)) == d.h.Length {
+			d.frames = append(d.frames, Frame{Fin: d.h.Fin, Rsv1: d.h.Rsv1, Opcode: d.h.Opcode, Payload: d.payload})
+			d.offset += d.pending
+			d.startFrame()
+		}
+	}
+	return n, nil
+}
+
+// newPayload returns an empty payload for a frame of length bytes, a spare
+// when one is big enough
+func (d *Decoder) newPayload(length uint64) []byte {
+	for i, p := range d.spares {
+		if uint64(cap(p)) >= length {
+			last := len(d.spares) - 1
+			d.spares[i], d.spares[last] = d.spares[last], nil
+			d.spares = d.spares[:last]
+			return p
+		}
+	}
+	return make([]byte, 0, min(length, maxInitialPayload))
+}
+
+// growPayload makes room for n more bytes of the payload. It at least
+// doubles the capacity up to the declared length, append grows big slices in
+// smaller steps and would copy a large payload many times over.
+func (d *Decoder) growPayload(n int) {
+	need := uint64(len(d.payload) + n)
+	if need <= uint64(cap(d.payload)) {
+		return
+	}
+	grown := make([]byte, len(d.payload), min(d.h.Length, max(need, 2*uint64(cap(d.payload)))))
+	copy(grown, d.payload)
+	d.payload = grown
+}
+
+// headerSize is the length of a header from its second byte on
+func headerSize(secondByte byte) int {
+	size := 2
+	switch secondByte & 0x7F {
+	case 126:
+		size += 2
+	case 127:
+		size += 8
+	}
+	if secondByte&0x80 != 0 {
+		size += 4
+	}
+	return size
+}
+
+// startFrame gets ready for the header of the next frame
+func (d *Decoder) startFrame() {
+	d.headerLen = 0
+	d.inPayload = false
+	d.payload = nil
+	d.pending = 0
+}
+
+// Next returns the next complete frame, or ErrNeedMore when there is none.
+// The payload belongs to the caller.
+func (d *Decoder) Next() (Frame, error) {
+	if d.head == len(d.frames) {
+		return Frame{}, ErrNeedMore
+	}
+	f := d.frames[d.head]
+	d.frames[d.head] = Frame{}
+	d.head++
+	if d.head == len(d.frames) {
+		d.frames = d.frames[:0]
+		d.head = 0
+	}
+	return f, nil
+}
+
+// Reuse gives back the payload of a frame returned by Next once the caller
+// is done with it, a later frame that fits is decoded into it instead of a
+// new slice. Only payloads up to 64KB are kept.
+func (d *Decoder) Reuse(payload []byte) {
+	if cap(payload) > 0 && cap(payload) <= maxInitialPayload && len(d.spares) < maxSpares {
+		d.spares = append(d.spares, payload[:0])
+	}
+}
+
+// Buffered returns how many complete frames wait for Next
+func (d *Decoder) Buffered() int {
+	return len(d.frames) - d.head
+}
+
+// Held returns the bytes of memory the decoder holds on to: the payloads of
+// the queued frames and of the partial one, and the spares kept by Reuse
+func (d *Decoder) Held() int {
+	n := cap(d.payload)
+	for _, f := range d.frames[d.head:] {
+		n += cap(f.Payload)
+	}
+	for _, p := range d.spares {
+		n += cap(p)
+	}
+	return n
+}
+
+// Pending returns how many bytes of a frame that isn't complete yet were
+// written, 0 between frames
+func (d *Decoder) Pending() int {
+	return d.pending
+}
+
+// Reset drops the queued frames, the partial frame and a failure. Decoding
+// starts over with the next Write, which is expected to start a frame.
+func (d *Decoder) Reset() {
+	clear(d.frames)
+	d.frames = d.frames[:0]
+	d.head = 0
+	d.err = nil
+	d.offset = 0
+	d.startFrame()
+}
@@ -0,0 +1,199 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"slices"
+	"testing"
+)
+
+func TestDecoderOneByteAtATime(t *testing.T) {
+	payload := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(payload)
+	data, err := BuildFrame(Frame{Fin: true, Opcode: OpBinary, Payload: payload}, &[4]byte{1, 2, 3, 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	d := NewDecoder(ParseOptions{Mask: MaskRequired, MaxFrameSize: 2 << 20})
+	for i := range data {
+		if _, err := d.Write(data[i : i+1]); err != nil {
+			t.Fatalf("byte %d: %v", i, err)
+		}
+		if i < len(data)-1 {
+			if _, err := d.Next(); err != ErrNeedMore {
+				t.Fatalf("byte %d: expected no frame yet, got %v", i, err)
+			}
+			if d.Pending() != i+1 {
+				t.Fatalf("byte %d: %d bytes pending", i, d.Pending())
+			}
+		}
+	}
+	f, err := d.Next()
+	if err != nil || !bytes.Equal(f.Payload, payload) || f.Opcode != OpBinary || !f.Fin {
+		t.Fatalf("the frame didn't survive being fed byte by byte: %v", err)
+	}
+	// Every byte was looked at once, ParseFrames would have rescanned the
+	// partial frame on every call
+	if d.scanned != len(data) {
+		t.Fatalf("%d bytes examined for a %d byte stream", d.scanned, len(data))
+	}
+	if d.Pending() != 0 {
+		t.Fatalf("%d bytes pending after the frame", d.Pending())
+	}
+}
+
+func TestDecoderPayloadGrowth(t *testing.T) {
+	data, err := BuildFrame(Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, 1<<20)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := NewDecoder(ParseOptions{})
+	// the payload doubles from 64KB to 1MB, it isn't copied at every step of append
+	allocs := testing.AllocsPerRun(10, func() {
+		for chunk := range slices.Chunk(data, 1<<10) {
+			d.Write(chunk)
+		}
+		if f, err := d.Next(); err != nil || len(f.Payload) != 1<<20 {
+			t.Fatalf("decoded %d bytes, %v", len(f.Payload), err)
+		}
+	})
+	if allocs > 5 {
+		t.Fatalf("decoding a 1MB payload took %v allocations", allocs)
+	}
+}
+
+func TestDecoderReuse(t *testing.T) {
+	d := NewDecoder(ParseOptions{})
+	write := func(payload string) Frame {
+		t.Helper()
+		data, err := BuildFrame(Frame{Fin: true, Opcode: OpText, Payload: []byte(payload)}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := d.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		f, err := d.Next()
+		if err != nil || string(f.Payload) != payload {
+			t.Fatalf("decoded %q, %v", f.Payload, err)
+		}
+		return f
+	}
+
+	first := write("hello world")
+	d.Reuse(first.Payload)
+	// a frame that fits is decoded into the payload given back
+	if second := write("hi"); &second.Payload[0] != &first.Payload[0] {
+		t.Fatal("the payload given back wasn't reused")
+	}
+	// one that doesn't gets its own
+	if third := write("a longer message than the first"); &third.Payload[0] == &first.Payload[0] {
+		t.Fatal("a payload too small was reused")
+	}
+
+	d.Reuse(make([]byte, maxInitialPayload+1))
+	if len(d.spares) != 0 {
+		t.Fatal("a payload over 64KB was kept")
+	}
+}
+
+func TestDecoderHeld(t *testing.T) {
+	d := NewDecoder(ParseOptions{})
+	data, err := BuildFrame(Frame{Fin: true, Opcode: OpBinary, Payload: make([]byte, 100)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Write(data)
+	d.Write(data[:10])
+	// the queued frame and the partial one
+	if held := d.Held(); held != 200 {
+		t.Fatalf("expected 200 bytes held, got %d", held)
+	}
+	f, _ := d.Next()
+	if held := d.Held(); held != 100 {
+		t.Fatalf("expected 100 bytes held once the frame was taken, got %d", held)
+	}
+	d.Reuse(f.Payload)
+	if held := d.Held(); held != 200 {
+		t.Fatalf("expected the spare to be held, got %d", held)
+	}
+}
+
+func TestDecoderMatchesParseFrames(t *testing.T) {
+	rng := rand.New(rand.NewSource(2))
+	var stream []byte
+	for _, length := range append(boundaryLengths, 0, 3, 70000) {
+		payload := make([]byte, length)
+		rng.Read(payload)
+		var err error
+		stream, err = AppendFrame(stream, Frame{Fin: rng.Intn(2) == 0, Opcode: OpText, Payload: payload}, &[4]byte{9, 8, 7, byte(length)})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	want, rest, err := ParseFrames(stream, ParseOptions{Mask: MaskRequired})
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("ParseFrames: rest=%d err=%v", len(rest), err)
+	}
+
+	// The same stream, cut at random points
+	d := NewDecoder(ParseOptions{Mask: MaskRequired})
+	var got []Frame
+	for rest := stream; len(rest) > 0; {
+		n := min(len(rest), 1+rng.Intn(5000))
+		if _, err := d.Write(rest[:n]); err != nil {
+			t.Fatal(err)
+		}
+		rest = rest[n:]
+		for {
+			f, err := d.Next()
+			if err == ErrNeedMore {
+				break
+			}
+			got = append(got, f)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("decoded %d frames, ParseFrames %d", len(got), len(want))
+	}
+	for i := range want {
+		if got[i].Fin != want[i].Fin || got[i].Opcode != want[i].Opcode || !bytes.Equal(got[i].Payload, want[i].Payload) {
+			t.Fatalf("frame %d differs", i)
+		}
+	}
+}
+
+func TestDecoderErrors(t *testing.T) {
+	first, _ := BuildFrame(Frame{Fin: true, Opcode: OpText, Payload: []byte("fine")}, &[4]byte{1, 2, 3, 4})
+	tooBig, _ := AppendHeader(nil, Header{Fin: true, Opcode: OpBinary, Length: 1000, Masked: true})
+
+	d := NewDecoder(ParseOptions{Mask: MaskRequired, MaxFrameSize: 100})
+	// the header arrives in two pieces, the limit applies as soon as the length is known
+	d.Write(first)
+	d.Write(tooBig[:1])
+	_, err := d.Write(tooBig[1:])
+	var pe *ParseError
+	if !errors.As(err, &pe) || !errors.Is(err, ErrFrameTooLarge) || pe.Offset != len(first)+1 {
+		t.Fatalf("expected a too large frame at byte %d, got %v", len(first)+1, err)
+	}
+	// the frame before it is still there, the failure sticks
+	if f, err := d.Next(); err != nil || string(f.Payload) != "fine" {
+		t.Fatalf("expected the first frame, got %q %v", f.Payload, err)
+	}
+	if _, err := d.Write(first); err != pe {
+		t.Fatalf("expected the failure to stick, got %v", err)
+	}
+
+	// masking is enforced the same way as by ParseFrames
+	d.Reset()
+	unmasked, _ := BuildFrame(Frame{Fin: true, Opcode: OpText, Payload: []byte("x")}, nil)
+	if _, err := d.Write(unmasked); !errors.Is(err, ErrProtocol) {
+		t.Fatalf("expected an unmasked frame to be refused, got %v", err)
+	}
+	d.Reset()
+	if _, err := d.Write(first); err != nil {
+		t.Fatalf("after Reset: %v", err)
+	}
+}
@@ -0,0 +1,370 @@
+// Package wire encodes and decodes WebSocket frames (RFC 6455 section 5).
+// It knows nothing about connections: ParseFrames turns bytes into frames,
+// e.g. captured traffic, and AppendFrame turns frames into bytes, e.g. test
+// fixtures.
+package wire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+/* ------The WebSockets Frame -----
+    0                   1                   2                   3
+    0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1 2 3 4 5 6 7 8 9 0 1
+   +-+-+-+-+-------+-+-------------+-------------------------------+
+   |F|R|R|R| opcode|M| Payload len |    Extended payload length    |
+   |I|S|S|S|  (4)  |A|     (7)     |             (16/64)           |
+   |N|V|V|V|       |S|             |   (if payload len==126/127)   |
+   | |1|2|3|       |K|             |                               |
+   +-+-+-+-+-------+-+-------------+ - - - - - - - - - - - - - - - +
+   |     Extended payload length continued, if payload len == 127  |
+   + - - - - - - - - - - - - - - - +-------------------------------+
+   |                               |Masking-key, if MASK set to 1  |
+   +-------------------------------+-------------------------------+
+   | Masking-key (continued)       |          Payload Data         |
+   +-------------------------------- - - - - - - - - - - - - - - - +
+   :                     Payload Data continued ...                :
+   + - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - - +
+   |                     Payload Data continued ...                |
+   +---------------------------------------------------------------+
+
+*/
+
+// the websockets opcodes
+const (
+	OpContinuation = 0x0 // 0000
+	OpText         = 0x1 // 0001
+	OpBinary       = 0x2 // 0010
+	OpClose        = 0x8 // 1000
+	OpPing         = 0x9 // 1001
+	OpPong         = 0xA // 1010
+)
+
+// MaxControlPayload is the most a control frame (CLOSE, PING, PONG) may
+// carry, RFC 6455 5.5
+const MaxControlPayload = 125
+
+// MaxHeaderSize is the longest frame header: 2 bytes, 8 bytes of extended
+// payload length and a 4-byte masking key
+const MaxHeaderSize = 14
+
+// Frame represents a single WebSocket frame.
+// Fin: true if this frame completes the message (FIN bit)
+// Rsv1: true if the message is compressed (permessage-deflate)
+// Opcode: identifies text/binary/control/ping pong frame types
+// Payload: decoded message bytes
+type Frame struct {
+	Fin     bool
+	Rsv1    bool
+	Opcode  byte
+	Payload []byte
+}
+
+var (
+	// ErrProtocol is wrapped by the errors of frames violating RFC 6455
+	ErrProtocol = errors.New("protocol error")
+
+	// ErrFrameTooLarge is wrapped by the errors of frames declaring more
+	// than ParseOptions.MaxFrameSize bytes, or more than a slice can hold
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// ParseError is the error of a frame ParseFrames refused
+type ParseError struct {
+	Offset int    // position of the offending byte in the parsed buffer
+	Reason string // what was wrong
+	Err    error  // ErrProtocol or ErrFrameTooLarge
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("%v: %s (at byte %d)", e.Err, e.Reason, e.Offset)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// MaskRule is what ParseFrames expects of the MASK bit
+type MaskRule int
+
+const (
+	// MaskAny accepts masked and unmasked frames, e.g. for captured traffic
+	MaskAny MaskRule = iota
+	// MaskRequired refuses unmasked frames, the reader is a server
+	MaskRequired
+	// MaskForbidden refuses masked frames, the reader is a client
+	MaskForbidden
+)
+
+// ParseOptions are the limits and checks ParseFrames applies to every frame
+type ParseOptions struct {
+	MaxFrameSize int64    // largest payload a frame may declare, 0 = unlimited
+	Strict       bool     // reject lengths that could have used a shorter encoding
+	Compression  bool     // permessage-deflate was negotiated, RSV1 may be set
+	Mask         MaskRule // clients mask every frame, servers never do (RFC 6455 5.1)
+
+	// InPlace makes ParseFrames return payloads aliasing the parsed buffer,
+	// unmasked in place, instead of copies. A Decoder keeps frames across
+	// Writes and always copies.
+	InPlace bool
+}
+
+// ParseFrames walks buffer, extracting as many complete frames as possible.
+// Any leftover bytes (partial frame) are returned so the caller can prepend
+// them to the next read. Payloads are unmasked copies, they don't alias buffer.
+// With opts.InPlace they do: the payloads are unmasked inside buffer and are
+// only valid until buffer is reused, e.g. for the next read, a caller that
+// keeps one longer copies it. Appending to such a payload doesn't overwrite
+// the frame after it.
+// A frame declaring more than opts.MaxFrameSize bytes is rejected as soon as
+// its header is complete, before the payload is waited for. Errors are
+// *ParseError. A stream arriving in pieces is better decoded with a Decoder,
+// which doesn't go over the bytes of a partial frame again.
+func ParseFrames(buffer []byte, opts ParseOptions) ([]Frame, []byte, error) {
+	var frames []Frame
+	offset := 0
+
+	// we loop through the buffer data arrived and capture frames
+	// one "Read" can give us multiple frames
+	for offset < len(buffer) {
+		h, size, err := parseHeader(buffer[offset:], opts)
+		if err != nil {
+			err.Offset += offset
+			return nil, nil, err
+		}
+		if size == 0 || uint64(len(buffer)-offset-size) < h.Length {
+			break // incomplete header or payload
+		}
+		pos := offset + size
+		n := int(h.Length)
+
+		var payload []byte
+		if opts.InPlace {
+			payload = buffer[pos : pos+n : pos+n]
+		} else {
+			payload = make([]byte, n)
+			copy(payload, buffer[pos:pos+n])
+		}
+		if h.Masked {
+			MaskBytes(h.MaskKey, 0, payload)
+		}
+
+		frames = append(frames, Frame{Fin: h.Fin, Rsv1: h.Rsv1, Opcode: h.Opcode, Payload: payload})
+		offset = pos + n
+	}
+
+	// return complete frames and any leftover bytes belong to a partial frame
+	return frames, buffer[offset:], nil
+}
+
+// parseHeader decodes the frame header at the start of b and checks it
+// against opts. size is 0 while the header is incomplete, what is there is
+// checked already. Offsets in the error count from the start of b.
+func parseHeader(b []byte, opts ParseOptions) (h Header, size int, err *ParseError) {
+	// Remember: the minimum frame size is 2 bytes (no payload, no mask)
+	if len(b) < 2 {
+		return h, 0, nil
+	}
+	firstByte := b[0]                // first byte (FIN(1bit) + RSV(3bit) + Opcode(4bit))
+	h.Fin = (firstByte & 0x80) != 0  // the fin bit is the first bit      (1000,0000)
+	h.Rsv1 = (firstByte & 0x40) != 0 // RSV1 marks a compressed message (0100,0000)
+	h.Opcode = firstByte & 0x0F      // the opcodes are the last 4 bits   (0000,1111)
+
+	// RSV2 and RSV3 belong to extensions we never negotiate, and RSV1 is only
+	// allowed on the first frame of a compressed data message
+	if firstByte&0x30 != 0 {
+		return h, 0, protocolError(0, "reserved bits set")
+	}
+	if h.Rsv1 && (!opts.Compression || h.Opcode == OpContinuation || h.Opcode >= OpClose) {
+		return h, 0, protocolError(0, fmt.Sprintf("RSV1 set on opcode %d", h.Opcode))
+	}
+	// Control frames can't be fragmented (RFC 6455 5.5)
+	if h.Opcode >= OpClose && !h.Fin {
+		return h, 0, protocolError(0, fmt.Sprintf("fragmented control frame, opcode %d", h.Opcode))
+	}
+
+	secondByte := b[1]                   // second byte (MASK(1bit) + Payload len(7bit))
+	h.Masked = (secondByte & 0x80) != 0  // the mask bit is the first bit     (1000,0000)
+	h.Length = uint64(secondByte & 0x7F) // the length is the last 7 bits     (0111,1111)
+	pos := 2
+
+	// and carry at most 125 bytes, which the 7-bit length holds
+	if h.Opcode >= OpClose && h.Length > MaxControlPayload {
+		return h, 0, protocolError(1, fmt.Sprintf("control frame longer than %d bytes", MaxControlPayload))
+	}
+	if h.Masked && opts.Mask == MaskForbidden {
+		return h, 0, protocolError(1, "masked frame from the server")
+	}
+	if !h.Masked && opts.Mask == MaskRequired {
+		return h, 0, protocolError(1, "unmasked frame from the client")
+	}
+
+	if h.Length == 126 {
+		// Length 126 means the next 2 bytes (extended payload len) contain the actual payload length
+		if len(b) < pos+2 {
+			return h, 0, nil
+		}
+		h.Length = uint64(binary.BigEndian.Uint16(b[pos : pos+2]))
+		if opts.Strict && h.Length < 126 {
+			return h, 0, protocolError(pos, fmt.Sprintf("%d byte payload uses the 16-bit length encoding", h.Length))
+		}
+		pos += 2
+	} else if h.Length == 127 {
+		// Length 127 means the next 8 bytes (extended payload len + continue) hold the payload length
+		if len(b) < pos+8 {
+			return h, 0, nil
+		}
+		h.Length = binary.BigEndian.Uint64(b[pos : pos+8])
+		// The most significant bit must be 0 (RFC 6455 5.2)
+		if h.Length&(1<<63) != 0 {
+			return h, 0, protocolError(pos, "payload length has the most significant bit set")
+		}
+		if opts.Strict && h.Length <= 0xFFFF {
+			return h, 0, protocolError(pos, fmt.Sprintf("%d byte payload uses the 64-bit length encoding", h.Length))
+		}
+		pos += 8
+	}
+
+	if opts.MaxFrameSize > 0 && h.Length > uint64(opts.MaxFrameSize) {
+		return h, 0, &ParseError{Offset: 1, Reason: fmt.Sprintf("%d bytes exceed the %d byte limit", h.Length, opts.MaxFrameSize), Err: ErrFrameTooLarge}
+	}
+	// Without a limit a frame still has to fit in a slice on this platform
+	if h.Length > uint64(math.MaxInt) {
+		return h, 0, &ParseError{Offset: 1, Reason: fmt.Sprintf("%d bytes can't be addressed", h.Length), Err: ErrFrameTooLarge}
+	}
+
+	if h.Masked {
+		// Client-to-server frames must include a 4-byte masking key
+		if len(b) < pos+4 {
+			return h, 0, nil
+		}
+		copy(h.MaskKey[:], b[pos:pos+4])
+		pos += 4
+	}
+	return h, pos, nil
+}
+
+func protocolError(offset int, reason string) *ParseError {
+	return &ParseError{Offset: offset, Reason: reason, Err: ErrProtocol}
+}
+
+// BuildFrame encodes f in a new slice, see AppendFrame
+func BuildFrame(f Frame, mask *[4]byte) ([]byte, error) {
+	return AppendFrame(make([]byte, 0, MaxHeaderSize+len(f.Payload)), f, mask)
+}
+
+// AppendFrame appends f encoded to dst. With a mask the payload is masked
+// with that key, which frames sent by a client must be (RFC 6455 5.3); the
+// key should come from a strong source of randomness. Without one the frame
+// is encoded the way a server sends it.
+func AppendFrame(dst []byte, f Frame, mask *[4]byte) ([]byte, error) {
+	h := Header{Fin: f.Fin, Rsv1: f.Rsv1, Opcode: f.Opcode, Length: uint64(len(f.Payload))}
+	if mask != nil {
+		h.Masked, h.MaskKey = true, *mask
+	}
+	dst, err := AppendHeader(dst, h)
+	if err != nil {
+		return nil, err
+	}
+	start := len(dst)
+	dst = append(dst, f.Payload...)
+	if mask != nil {
+		MaskBytes(*mask, 0, dst[start:])
+	}
+	return dst, nil
+}
+
+// Header is what comes before the payload of a frame, for writing the
+// payload separately
+type Header struct {
+	Fin     bool
+	Rsv1    bool
+	Opcode  byte
+	Length  uint64 // of the payload
+	Masked  bool
+	MaskKey [4]byte
+}
+
+// AppendHeader appends the encoded h to dst, the payload has to follow
+// masked with h.MaskKey when h.Masked is set. The header length expands to
+// 2, 4, or 10 bytes depending on payload size, plus 4 for the key. Lengths
+// with the most significant bit set can't be encoded (RFC 6455 5.2) and
+// return an error.
+func AppendHeader(dst []byte, h Header) ([]byte, error) {
+	if h.Length&(1<<63) != 0 {
+		return nil, fmt.Errorf("wire: payload length %d has the most significant bit set", h.Length)
+	}
+
+	firstByte := byte(0)
+	if h.Fin {
+		firstByte = 0x80 // 1000 0000
+	}
+	if h.Rsv1 {
+		firstByte |= 0x40 // 0100 0000
+	}
+	firstByte |= h.Opcode & 0x0F // 0000 1111
+	maskBit := byte(0)
+	if h.Masked {
+		maskBit = 0x80 // 1000 0000
+	}
+
+	switch {
+	// payload len is less than 126
+	// header size is 2 bytes
+	case h.Length < 126:
+		dst = append(dst, firstByte, maskBit|byte(h.Length))
+	// payload len is less than or equal to 65535
+	// header size is 4 bytes
+	case h.Length <= 0xFFFF:
+		dst = append(dst, firstByte, maskBit|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(h.Length))
+	// payload len is greater than 65535
+	// header size is 10 bytes
+	default:
+		dst = append(dst, firstByte, maskBit|127)
+		dst = binary.BigEndian.AppendUint64(dst, h.Length)
+	}
+	if h.Masked {
+		dst = append(dst, h.MaskKey[:]...)
+	}
+	return dst, nil
+}
+
+// wordMaskSize is the payload size from which MaskBytes works a word at a time
+const wordMaskSize = 16
+
+// MaskBytes applies the masking key to b in place, b starting pos bytes
+// into the payload, and returns the position after b modulo 4 to continue
+// with the next piece. Masking and unmasking are the same operation.
+func MaskBytes(key [4]byte, pos int, b []byte) int {
+	pos &= 3
+	if len(b) < wordMaskSize {
+		return maskByteWise(key, pos, b)
+	}
+	// The key repeated over 8 bytes, starting where b starts in it. A word
+	// is a multiple of the key, every word of b starts at the same place.
+	// The loads work at any alignment, on every architecture.
+	var k [8]byte
+	for i := range k {
+		k[i] = key[(pos+i)&3]
+	}
+	kw := binary.LittleEndian.Uint64(k[:])
+	words := len(b) &^ 7
+	for i := 0; i < words; i += 8 {
+		binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^kw)
+	}
+	maskByteWise(key, pos, b[words:])
+	return (pos + len(b)) & 3
+}
+
+// maskByteWise is MaskBytes a byte at a time, for short payloads and what
+// is left after the last whole word
+func maskByteWise(key [4]byte, pos int, b []byte) int {
+	for i := range b {
+		b[i] ^= key[(pos+i)&3]
+	}
+	return (pos + len(b)) & 3
+}
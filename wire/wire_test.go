@@ -0,0 +1,299 @@
+package wire
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"math/rand"
+	"testing"
+)
+
+// boundaryLengths are the payload lengths around the switches between the
+// 7-bit, 16-bit and 64-bit length encodings
+var boundaryLengths = []int{0, 1, 124, 125, 126, 127, 65534, 65535, 65536, 65537}
+
+func TestRoundTrip(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	opcodes := []byte{OpContinuation, OpText, OpBinary, OpClose, OpPing, OpPong}
+	lengths := append([]int{}, boundaryLengths...)
+	for i := 0; i < 20; i++ {
+		lengths = append(lengths, rng.Intn(200000))
+	}
+
+	for _, length := range lengths {
+		for _, masked := range []bool{false, true} {
+			opcode := opcodes[rng.Intn(len(opcodes))]
+			if opcode >= OpClose && length > MaxControlPayload {
+				opcode = OpBinary
+			}
+			want := Frame{Fin: rng.Intn(2) == 0, Opcode: opcode, Payload: make([]byte, length)}
+			// control frames are never fragmented
+			want.Fin = want.Fin || opcode >= OpClose
+			// RSV1 may only be set on the first frame of a data message
+			want.Rsv1 = (opcode == OpText || opcode == OpBinary) && rng.Intn(2) == 0
+			rng.Read(want.Payload)
+			var mask *[4]byte
+			opts := ParseOptions{Compression: true, Strict: true, Mask: MaskForbidden}
+			if masked {
+				mask = new([4]byte)
+				rng.Read(mask[:])
+				opts.Mask = MaskRequired
+			}
+
+			data, err := BuildFrame(want, mask)
+			if err != nil {
+				t.Fatalf("length %d: %v", length, err)
+			}
+			frames, rest, err := ParseFrames(data, opts)
+			if err != nil || len(frames) != 1 || len(rest) != 0 {
+				t.Fatalf("length %d masked=%t: expected one frame, got frames=%d rest=%d err=%v", length, masked, len(frames), len(rest), err)
+			}
+			got := frames[0]
+			if got.Fin != want.Fin || got.Rsv1 != want.Rsv1 || got.Opcode != want.Opcode || !bytes.Equal(got.Payload, want.Payload) {
+				t.Fatalf("length %d masked=%t: the frame changed in the round trip", length, masked)
+			}
+
+			// Every shorter prefix is a partial frame, left over whole
+			for _, cut := range []int{0, 1, 2, len(data) / 2, len(data) - 1} {
+				if cut < 0 || cut >= len(data) {
+					continue
+				}
+				frames, rest, err := ParseFrames(data[:cut], opts)
+				if err != nil || len(frames) != 0 || len(rest) != cut {
+					t.Fatalf("length %d: a %d byte prefix gave frames=%d rest=%d err=%v", length, cut, len(frames), len(rest), err)
+				}
+			}
+		}
+	}
+}
+
+func TestHeaderSizes(t *testing.T) {
+	tests := []struct {
+		length    uint64
+		headerLen int
+	}{
+		{125, 2},
+		{126, 4},
+		{65535, 4},
+		{65536, 10},
+		{1 << 40, 10},
+	}
+	for _, tt := range tests {
+		for _, masked := range []bool{false, true} {
+			header, err := AppendHeader(nil, Header{Fin: true, Opcode: OpBinary, Length: tt.length, Masked: masked})
+			want := tt.headerLen
+			if masked {
+				want += 4
+			}
+			if err != nil || len(header) != want {
+				t.Fatalf("length %d masked=%t: expected a %d byte header, got %d %v", tt.length, masked, want, len(header), err)
+			}
+		}
+	}
+	if _, err := AppendHeader(nil, Header{Length: 1 << 63}); err == nil {
+		t.Fatal("expected a length with the top bit set to be refused")
+	}
+}
+
+func TestParseFramesBatch(t *testing.T) {
+	var batch []byte
+	for i, payload := range []string{"one", "two", "three"} {
+		var err error
+		batch, err = AppendFrame(batch, Frame{Fin: true, Opcode: OpText, Payload: []byte(payload)}, &[4]byte{byte(i), 1, 2, 3})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// MaskAny reads what either side sent
+	unmasked, _ := BuildFrame(Frame{Fin: true, Opcode: OpPing, Payload: []byte("four")}, nil)
+	batch = append(batch, unmasked...)
+
+	frames, rest, err := ParseFrames(batch, ParseOptions{})
+	if err != nil || len(frames) != 4 || len(rest) != 0 {
+		t.Fatalf("expected four frames, got %d rest=%d err=%v", len(frames), len(rest), err)
+	}
+	for i, want := range []string{"one", "two", "three", "four"} {
+		if string(frames[i].Payload) != want {
+			t.Fatalf("frame %d: expected %q, got %q", i, want, frames[i].Payload)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid, _ := BuildFrame(Frame{Fin: true, Opcode: OpText, Payload: []byte("ok")}, nil)
+	tests := []struct {
+		name   string
+		data   []byte
+		opts   ParseOptions
+		offset int
+		err    error
+	}{
+		{"reserved bits", []byte{0x80 | 0x20 | OpText, 0}, ParseOptions{}, 0, ErrProtocol},
+		{"RSV1 without compression", []byte{0x80 | 0x40 | OpText, 0}, ParseOptions{}, 0, ErrProtocol},
+		{"RSV1 on a control frame", []byte{0x80 | 0x40 | OpPing, 0}, ParseOptions{Compression: true}, 0, ErrProtocol},
+		{"unmasked from a client", []byte{0x80 | OpText, 0}, ParseOptions{Mask: MaskRequired}, 1, ErrProtocol},
+		{"masked from a server", []byte{0x80 | OpText, 0x80, 1, 2, 3, 4}, ParseOptions{Mask: MaskForbidden}, 1, ErrProtocol},
+		{"non-minimal 16-bit length", []byte{0x80 | OpText, 126, 0, 5}, ParseOptions{Strict: true}, 2, ErrProtocol},
+		{"non-minimal 64-bit length", []byte{0x80 | OpText, 127, 0, 0, 0, 0, 0, 0, 1, 0}, ParseOptions{Strict: true}, 2, ErrProtocol},
+		{"top bit of the length", []byte{0x80 | OpText, 127, 0x80, 0, 0, 0, 0, 0, 0, 0}, ParseOptions{}, 2, ErrProtocol},
+		{"fragmented ping", []byte{OpPing, 0}, ParseOptions{}, 0, ErrProtocol},
+		{"126 byte close", []byte{0x80 | OpClose, 126, 0, 126}, ParseOptions{}, 1, ErrProtocol},
+		{"over the limit", []byte{0x80 | OpText, 126, 1, 0}, ParseOptions{MaxFrameSize: 100}, 1, ErrFrameTooLarge},
+		// the offset counts from the start of the buffer, not of the frame
+		{"second frame", append(valid, 0x80|0x10|OpText, 0), ParseOptions{}, len(valid), ErrProtocol},
+	}
+	for _, tt := range tests {
+		_, _, err := ParseFrames(tt.data, tt.opts)
+		var pe *ParseError
+		if !errors.As(err, &pe) || !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected a *ParseError wrapping %v, got %v", tt.name, tt.err, err)
+			continue
+		}
+		if pe.Offset != tt.offset || pe.Reason == "" {
+			t.Errorf("%s: expected offset %d and a reason, got %d %q", tt.name, tt.offset, pe.Offset, pe.Reason)
+		}
+	}
+}
+
+func TestParseFramesInPlace(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	var stream []byte
+	for i, length := range append(boundaryLengths, 1<<20) {
+		payload := make([]byte, length)
+		rng.Read(payload)
+		var err error
+		stream, err = AppendFrame(stream, Frame{Fin: true, Opcode: OpBinary, Payload: payload}, &[4]byte{byte(i), 7, 42, 255})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a partial frame at the end stays masked
+	stream = append(stream, 0x80|OpText, 0x80|5, 1, 2, 3, 4, 'x')
+	opts := ParseOptions{Mask: MaskRequired}
+	want, wantRest, err := ParseFrames(stream, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	opts.InPlace = true
+	buffer := bytes.Clone(stream)
+	got, rest, err := ParseFrames(buffer, opts)
+	if err != nil || len(got) != len(want) || !bytes.Equal(rest, wantRest) {
+		t.Fatalf("expected %d frames and %d bytes left, got %d and %d: %v", len(want), len(wantRest), len(got), len(rest), err)
+	}
+	offset := 0
+	for i := range want {
+		if !bytes.Equal(got[i].Payload, want[i].Payload) {
+			t.Fatalf("frame %d: unmasking in place gave a different payload", i)
+		}
+		header, _ := AppendHeader(nil, Header{Length: uint64(len(want[i].Payload)), Masked: true})
+		offset += len(header)
+		// the payload is the unmasked part of buffer, appending to it copies
+		if len(got[i].Payload) > 0 && &got[i].Payload[0] != &buffer[offset] || cap(got[i].Payload) != len(got[i].Payload) {
+			t.Fatalf("frame %d: the payload isn't the frame's part of the buffer", i)
+		}
+		offset += len(want[i].Payload)
+	}
+}
+
+// BenchmarkEcho parses a client's frame and encodes it back as the server's
+// frame, with a copy of the payload and with the payload unmasked in place
+func BenchmarkEcho(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		size int
+	}{{"1KB", 1 << 10}, {"1MB", 1 << 20}} {
+		size := bench.size
+		payload := make([]byte, size)
+		rand.New(rand.NewSource(1)).Read(payload)
+		data, err := BuildFrame(Frame{Fin: true, Opcode: OpBinary, Payload: payload}, &[4]byte{1, 2, 3, 4})
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, inPlace := range []bool{false, true} {
+			name := bench.name + "/copy"
+			if inPlace {
+				name = bench.name + "/inplace"
+			}
+			b.Run(name, func(b *testing.B) {
+				opts := ParseOptions{Mask: MaskRequired, InPlace: inPlace}
+				buffer := make([]byte, len(data))
+				out := make([]byte, 0, MaxHeaderSize+size)
+				b.SetBytes(int64(size))
+				b.ReportAllocs()
+				for i := 0; i < b.N; i++ {
+					copy(buffer, data) // what a read from the socket does
+					frames, _, err := ParseFrames(buffer, opts)
+					if err != nil {
+						b.Fatal(err)
+					}
+					f := frames[0]
+					if inPlace {
+						// the header goes out, then the payload straight from the buffer
+						out, _ = AppendHeader(out[:0], Header{Fin: f.Fin, Opcode: f.Opcode, Length: uint64(len(f.Payload))})
+						io.Discard.Write(out)
+						io.Discard.Write(f.Payload)
+					} else {
+						out, _ = AppendFrame(out[:0], f, nil)
+						io.Discard.Write(out)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestMaskBytes(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		b := make([]byte, rng.Intn(300))
+		if i%100 == 0 {
+			b = make([]byte, rng.Intn(1<<20))
+		}
+		rng.Read(b)
+		var key [4]byte
+		rng.Read(key[:])
+		pos := rng.Intn(1 << 20)
+
+		want := bytes.Clone(b)
+		for j := range want {
+			want[j] ^= key[(pos+j)%4]
+		}
+		got := bytes.Clone(b)
+		if next := MaskBytes(key, pos, got); !bytes.Equal(got, want) || next != (pos+len(b))%4 {
+			t.Fatalf("%d bytes at %d: masked differently than a byte at a time, next position %d", len(b), pos, next)
+		}
+
+		// in two pieces, the second one continuing where the first ended
+		cut := rng.Intn(len(b) + 1)
+		got = bytes.Clone(b)
+		MaskBytes(key, MaskBytes(key, pos, got[:cut]), got[cut:])
+		if !bytes.Equal(got, want) {
+			t.Fatalf("%d bytes at %d cut at %d: the pieces were masked differently", len(b), pos, cut)
+		}
+	}
+}
+
+// BenchmarkMaskBytes masks payloads a word at a time and a byte at a time,
+// at an odd position into the payload
+func BenchmarkMaskBytes(b *testing.B) {
+	key := [4]byte{1, 2, 3, 4}
+	for _, bench := range []struct {
+		name string
+		size int
+	}{{"64B", 64}, {"4KB", 4 << 10}, {"1MB", 1 << 20}} {
+		payload := make([]byte, bench.size)
+		b.Run(bench.name+"/word", func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				MaskBytes(key, 3, payload)
+			}
+		})
+		b.Run(bench.name+"/byte", func(b *testing.B) {
+			b.SetBytes(int64(len(payload)))
+			for i := 0; i < b.N; i++ {
+				maskByteWise(key, 3, payload)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"testing"
+
+	"gows/wire"
+)
+
+// The helpers below connect a client Conn and a server Conn over net.Pipe,
+// past the opening handshake: no port is bound and nothing has to be waited
+// for before the first frame. Writes on a pipe block until the other side
+// reads, so a test can't race ahead of the code it observes.
+
+// connPair returns two Conns talking to each other over a pipe
+func connPair(t *testing.T, cfg Config, deflate *deflateParams) (server, client *Conn) {
+	t.Helper()
+	a, b := net.Pipe()
+	server = newConn(context.Background(), a, bufio.NewReader(a), cfg, connInfo{path: "/server", deflate: deflate})
+	client = newConn(context.Background(), b, bufio.NewReader(b), cfg, connInfo{path: "/client", deflate: deflate, client: true})
+	t.Cleanup(func() {
+		server.close()
+		client.close()
+	})
+	return server, client
+}
+
+// servePipe serves handler on the server end of an in-memory connection the
+// way the server's paths do and returns the client end, together with a
+// recording of every frame the server sent
+func servePipe(t *testing.T, cfg Config, handler ConnHandler) (*Conn, *recordingConn) {
+	t.Helper()
+	c, s := net.Pipe()
+	rec := &recordingConn{Conn: s}
+	client := newConn(context.Background(), c, bufio.NewReader(c), cfg, connInfo{path: "/", client: true})
+	go serveConn(newConn(context.Background(), rec, bufio.NewReader(s), cfg, connInfo{path: "/"}), handler)
+	t.Cleanup(func() { client.CloseNow() })
+	return client, rec
+}
+
+// recordingConn keeps a copy of everything written to the connection it wraps
+type recordingConn struct {
+	net.Conn
+
+	mu      sync.Mutex
+	written bytes.Buffer
+}
+
+func (r *recordingConn) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	r.written.Write(p)
+	r.mu.Unlock()
+	return r.Conn.Write(p)
+}
+
+// frames decodes the frames written so far, control frames included
+func (r *recordingConn) frames(t *testing.T) []frame {
+	t.Helper()
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	frames, _, err := wire.ParseFrames(r.written.Bytes(), wire.ParseOptions{Compression: true})
+	if err != nil {
+		t.Fatalf("the connection wrote a broken frame: %v", err)
+	}
+	return frames
+}
+
+// expectFrames checks the frames r recorded have the opcodes and payloads of want
+func (r *recordingConn) expectFrames(t *testing.T, want ...frame) {
+	t.Helper()
+	got := r.frames(t)
+	if len(got) != len(want) {
+		t.Fatalf("expected %d frames, the connection wrote %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].Opcode != want[i].Opcode || !bytes.Equal(got[i].Payload, want[i].Payload) {
+			t.Fatalf("frame %d: expected opcode %d %.20q, got opcode %d %.20q", i, want[i].Opcode, want[i].Payload, got[i].Opcode, got[i].Payload)
+		}
+	}
+}
+
+func TestConnPair(t *testing.T) {
+	cfg := DefaultConfig()
+	cfg.PingInterval = 0
+	server, client := connPair(t, cfg, nil)
+	go client.WriteMessage(BinaryMessage, []byte("to the server"))
+	if messageType, data, err := server.ReadMessage(); err != nil || messageType != BinaryMessage || string(data) != "to the server" {
+		t.Fatalf("server read type %d %q, %v", messageType, data, err)
+	}
+	go server.WriteMessage(TextMessage, []byte("to the client"))
+	if messageType, data, err := client.ReadMessage(); err != nil || messageType != TextMessage || string(data) != "to the client" {
+		t.Fatalf("client read type %d %q, %v", messageType, data, err)
+	}
+}